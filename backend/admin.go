@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// handleAdmin serves operator endpoints under /api/admin.
+func (a *app) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/api/admin/reload":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := a.reload(); err != nil {
+			writeError(w, http.StatusInternalServerError, "reload failed: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status": "reloaded",
+		})
+	case "/api/admin/maintenance":
+		a.handleMaintenance(w, r)
+	case "/api/admin/backup":
+		a.handleBackup(w, r)
+	case "/api/admin/audit":
+		a.handleAudit(w, r)
+	case "/api/admin/stats":
+		a.handleAdminStats(w, r)
+	case "/api/admin/loglevel":
+		a.handleLogLevel(w, r)
+	case "/api/admin/read-only":
+		a.handleReadOnly(w, r)
+	case "/api/admin/config":
+		a.handleAdminConfig(w, r)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/api/admin/backups") {
+			a.handleBackups(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/admin/service-accounts") {
+			a.handleServiceAccounts(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/admin/config/") {
+			a.handleAdminConfig(w, r)
+			return
+		}
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+	}
+}
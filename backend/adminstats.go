@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+)
+
+const largestDiagramsLimit = 10
+
+type largestDiagram struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	PayloadBytes int64  `json:"payloadBytes"`
+	StoredBytes  int64  `json:"storedBytes"`
+}
+
+// adminStats is an overview of what the server stores. Table sizes come
+// from the dbstat virtual table and include the table's indexes; diagrams
+// sharing a payload share its blob, so the blob bytes can be smaller than
+// the sum over diagrams.
+type adminStats struct {
+	Diagrams struct {
+		Total    int64 `json:"total"`
+		Archived int64 `json:"archived"`
+		Trashed  int64 `json:"trashed"`
+	} `json:"diagrams"`
+	Versions int64 `json:"versions"`
+	Blobs    int64 `json:"blobs"`
+	Storage  struct {
+		DatabaseBytes int64            `json:"databaseBytes"`
+		WALBytes      int64            `json:"walBytes"`
+		BlobBytes     int64            `json:"blobBytes"`
+		Tables        map[string]int64 `json:"tables"`
+	} `json:"storage"`
+	LargestDiagrams []largestDiagram `json:"largestDiagrams"`
+	Activity        struct {
+		LastDiagramUpdate *string `json:"lastDiagramUpdate"`
+		LastVersion       *string `json:"lastVersion"`
+		LastEvent         *string `json:"lastEvent"`
+		LastAudit         *string `json:"lastAudit"`
+	} `json:"activity"`
+}
+
+// handleAdminStats serves GET /api/admin/stats.
+func (a *app) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	stats, err := a.adminStats(r.Context())
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *app) adminStats(ctx context.Context) (adminStats, error) {
+	var stats adminStats
+	const counts = `
+SELECT
+	(SELECT COUNT(*) FROM diagrams WHERE deleted_at IS NULL),
+	(SELECT COUNT(*) FROM diagrams WHERE deleted_at IS NULL AND archived = 1),
+	(SELECT COUNT(*) FROM diagrams WHERE deleted_at IS NOT NULL),
+	(SELECT COUNT(*) FROM diagram_versions),
+	(SELECT COUNT(*) FROM blobs),
+	(SELECT COALESCE(SUM(LENGTH(payload)), 0) FROM blobs),
+	(SELECT MAX(updated_at) FROM diagrams),
+	(SELECT MAX(created_at) FROM diagram_versions),
+	(SELECT MAX(at) FROM events),
+	(SELECT MAX(at) FROM audit_log)`
+	if err := a.db.QueryRowContext(ctx, counts).Scan(
+		&stats.Diagrams.Total, &stats.Diagrams.Archived, &stats.Diagrams.Trashed,
+		&stats.Versions, &stats.Blobs, &stats.Storage.BlobBytes,
+		&stats.Activity.LastDiagramUpdate, &stats.Activity.LastVersion,
+		&stats.Activity.LastEvent, &stats.Activity.LastAudit,
+	); err != nil {
+		return adminStats{}, err
+	}
+
+	tables, err := a.tableSizes(ctx)
+	if err != nil {
+		return adminStats{}, err
+	}
+	stats.Storage.Tables = tables
+	if info, err := os.Stat(a.dbPath); err == nil {
+		stats.Storage.DatabaseBytes = info.Size()
+	}
+	if info, err := os.Stat(a.dbPath + "-wal"); err == nil {
+		stats.Storage.WALBytes = info.Size()
+	}
+
+	rows, err := a.db.QueryContext(ctx, `
+SELECT d.id, d.name, b.size, LENGTH(b.payload)
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.deleted_at IS NULL
+ORDER BY b.size DESC, d.id
+LIMIT ?`, largestDiagramsLimit)
+	if err != nil {
+		return adminStats{}, err
+	}
+	defer rows.Close()
+	stats.LargestDiagrams = make([]largestDiagram, 0, largestDiagramsLimit)
+	for rows.Next() {
+		var diagram largestDiagram
+		if err := rows.Scan(&diagram.ID, &diagram.Name, &diagram.PayloadBytes, &diagram.StoredBytes); err != nil {
+			return adminStats{}, err
+		}
+		stats.LargestDiagrams = append(stats.LargestDiagrams, diagram)
+	}
+	return stats, rows.Err()
+}
+
+// tableSizes returns the bytes of database pages used by each table,
+// counting its indexes towards it.
+func (a *app) tableSizes(ctx context.Context) (map[string]int64, error) {
+	rows, err := a.db.QueryContext(ctx, `
+SELECT s.tbl_name, SUM(d.pgsize)
+FROM dbstat d
+JOIN sqlite_schema s ON s.name = d.name
+GROUP BY s.tbl_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var size sql.NullInt64
+		if err := rows.Scan(&name, &size); err != nil {
+			return nil, err
+		}
+		sizes[name] = size.Int64
+	}
+	return sizes, rows.Err()
+}
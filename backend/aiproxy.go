@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	aiProviderOpenAI = "openai"
+	aiProviderAzure  = "azure"
+	aiProviderOllama = "ollama"
+
+	defaultAITimeout       = 60 * time.Second
+	defaultOpenAIBaseURL   = "https://api.openai.com/v1"
+	defaultOpenAIModel     = "gpt-4o-mini"
+	defaultOllamaBaseURL   = "http://localhost:11434/v1"
+	defaultAzureAPIVersion = "2024-06-01"
+	// maxAIResponseBytes bounds what is read back from the provider.
+	maxAIResponseBytes = 4 << 20
+)
+
+// aiDatabaseTypes are the frontend's database types an export can target.
+var aiDatabaseTypes = []string{"generic", "postgresql", "mysql", "sql_server", "mariadb", "sqlite", "clickhouse", "cockroachdb", "oracle"}
+
+// aiClient talks to an OpenAI-compatible chat completions API. The key
+// stays on the server; the frontend only sees /api/ai.
+type aiClient struct {
+	provider   string
+	baseURL    string
+	apiKey     string
+	model      string
+	apiVersion string
+	client     *http.Client
+}
+
+// newAIClient returns nil when AI_PROVIDER is not set.
+func newAIClient(cfg config) (*aiClient, error) {
+	provider := strings.ToLower(cfg.AI.Provider)
+	if provider == "" {
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(cfg.AI.Timeout)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid AI_TIMEOUT %q: use a duration such as 60s", cfg.AI.Timeout)
+	}
+	c := &aiClient{
+		provider:   provider,
+		baseURL:    strings.TrimRight(cfg.AI.BaseURL, "/"),
+		apiKey:     cfg.AI.APIKey,
+		model:      cfg.AI.Model,
+		apiVersion: cfg.AI.APIVersion,
+		client:     &http.Client{Timeout: timeout},
+	}
+
+	switch provider {
+	case aiProviderOpenAI:
+		if c.baseURL == "" {
+			c.baseURL = defaultOpenAIBaseURL
+		}
+		if c.model == "" {
+			c.model = defaultOpenAIModel
+		}
+		if c.apiKey == "" {
+			return nil, errors.New("AI_PROVIDER=openai requires AI_API_KEY")
+		}
+	case aiProviderAzure:
+		if c.baseURL == "" || c.apiKey == "" || c.model == "" {
+			return nil, errors.New("AI_PROVIDER=azure requires AI_BASE_URL (https://<resource>.openai.azure.com), AI_API_KEY and AI_MODEL (the deployment name)")
+		}
+		if c.apiVersion == "" {
+			c.apiVersion = defaultAzureAPIVersion
+		}
+	case aiProviderOllama:
+		if c.baseURL == "" {
+			c.baseURL = defaultOllamaBaseURL
+		}
+		if c.model == "" {
+			return nil, errors.New("AI_PROVIDER=ollama requires AI_MODEL")
+		}
+	default:
+		return nil, fmt.Errorf("invalid AI_PROVIDER %q: use %q, %q or %q", cfg.AI.Provider, aiProviderOpenAI, aiProviderAzure, aiProviderOllama)
+	}
+	parsed, err := url.Parse(c.baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid AI_BASE_URL %q", cfg.AI.BaseURL)
+	}
+	return c, nil
+}
+
+// complete sends one user message and returns the reply.
+func (c *aiClient) complete(ctx context.Context, prompt string) (string, error) {
+	request := map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": prompt}},
+	}
+	endpoint := c.baseURL + "/chat/completions"
+	if c.provider == aiProviderAzure {
+		endpoint = c.baseURL + "/openai/deployments/" + url.PathEscape(c.model) + "/chat/completions?api-version=" + url.QueryEscape(c.apiVersion)
+	} else {
+		request["model"] = c.model
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case c.provider == aiProviderAzure:
+		req.Header.Set("api-key", c.apiKey)
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxAIResponseBytes))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s: %s", c.provider, resp.Status, strings.TrimSpace(string(raw)))
+	}
+
+	var reply struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		return "", fmt.Errorf("decode %s reply: %w", c.provider, err)
+	}
+	if len(reply.Choices) == 0 {
+		return "", fmt.Errorf("%s returned no choices", c.provider)
+	}
+	return reply.Choices[0].Message.Content, nil
+}
+
+// handleAI serves /api/ai/*.
+func (a *app) handleAI(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/api/ai/export-sql":
+		a.handleAIExportSQL(w, r)
+	default:
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+	}
+}
+
+// handleAIExportSQL serves POST /api/ai/export-sql with
+// {"diagramId": "...", "databaseType": "mysql"}, or with the unsaved payload
+// as "diagram". The diagram's DDL in its own dialect is given to the
+// configured model to rewrite for databaseType; when databaseType is the
+// diagram's own, the DDL is returned without asking the model.
+func (a *app) handleAIExportSQL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if a.ai == nil {
+		writeErrorCode(w, http.StatusNotFound, codeAINotConfigured, "AI proxy is not configured (set AI_PROVIDER)")
+		return
+	}
+
+	var req struct {
+		DiagramID    string          `json:"diagramId"`
+		Diagram      json.RawMessage `json:"diagram"`
+		DatabaseType string          `json:"databaseType"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	if !slices.Contains(aiDatabaseTypes, req.DatabaseType) {
+		writePayloadError(w, invalidField("databaseType", "must be one of "+strings.Join(aiDatabaseTypes, ", ")))
+		return
+	}
+
+	payload := []byte(req.Diagram)
+	switch {
+	case req.DiagramID != "" && len(req.Diagram) > 0:
+		writePayloadError(w, invalidField("diagram", "cannot be sent with diagramId"))
+		return
+	case req.DiagramID != "":
+		inTrash, err := a.isInTrash(r.Context(), req.DiagramID)
+		if err == nil && inTrash {
+			err = sql.ErrNoRows
+		}
+		if err == nil {
+			payload, err = a.getDiagramPayload(r.Context(), req.DiagramID)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+	case len(req.Diagram) == 0:
+		writePayloadError(w, invalidField("diagramId", "or diagram is required"))
+		return
+	}
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		writePayloadError(w, invalidField("diagram", err.Error()))
+		return
+	}
+
+	ddl := generateDDL(doc, dialectForDatabaseType(doc.DatabaseType))
+	if req.DatabaseType == doc.DatabaseType {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sql": ddl, "databaseType": req.DatabaseType, "generated": false})
+		return
+	}
+	reply, err := a.ai.complete(r.Context(), aiExportSQLPrompt(req.DatabaseType, ddl))
+	if err != nil {
+		// The provider's answer can echo request details, so it is only
+		// logged.
+		slog.WarnContext(r.Context(), "ai export-sql failed", "provider", a.ai.provider, "error", err)
+		writeErrorCode(w, http.StatusBadGateway, codeUpstreamFailed, "the AI provider request failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sql":          stripCodeFence(reply),
+		"databaseType": req.DatabaseType,
+		"generated":    true,
+		"model":        a.ai.model,
+	})
+}
+
+// aiDialectInstructions follow the frontend's prompt for the dialects that
+// need more than the general rules.
+var aiDialectInstructions = map[string]string{
+	"postgresql":  "- Use CREATE SEQUENCE IF NOT EXISTS, CREATE TABLE IF NOT EXISTS and CREATE INDEX IF NOT EXISTS.\n- For auto-increment columns use SERIAL or GENERATED BY DEFAULT AS IDENTITY.\n",
+	"cockroachdb": "- Use CREATE SEQUENCE IF NOT EXISTS, CREATE TABLE IF NOT EXISTS and CREATE INDEX IF NOT EXISTS.\n- For auto-increment columns use SERIAL or GENERATED BY DEFAULT AS IDENTITY.\n",
+	"mysql":       "- Use CREATE TABLE IF NOT EXISTS and AUTO_INCREMENT; there are no sequences.\n- Put CREATE INDEX statements after the CREATE TABLE, without IF NOT EXISTS, and do not index TEXT or BLOB columns.\n- Use TINYINT(1) for booleans and escape reserved column names with backticks.\n",
+	"mariadb":     "- Use CREATE TABLE IF NOT EXISTS and AUTO_INCREMENT; there are no sequences.\n- Put CREATE INDEX statements after the CREATE TABLE, without IF NOT EXISTS, and do not index TEXT or BLOB columns.\n- Use TINYINT(1) for booleans, no NOT NULL on TEXT or BLOB columns, and escape reserved column names with backticks.\n",
+	"sql_server":  "- Do not use CREATE TABLE IF NOT EXISTS; guard creation with IF NOT EXISTS (SELECT * FROM sys.objects WHERE ...).\n- Prefer IDENTITY(1,1) for auto-increment primary keys.\n",
+	"sqlite":      "- Use CREATE TABLE IF NOT EXISTS and INTEGER PRIMARY KEY AUTOINCREMENT; there are no sequences.\n- Define foreign keys inside CREATE TABLE, never with ALTER TABLE, and do not name them.\n",
+}
+
+func aiExportSQLPrompt(databaseType, ddl string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "You are generating SQL scripts for creating database tables and sequences, handling primary keys, indices, and other table attributes.\n")
+	fmt.Fprintf(&b, "Rewrite the script below for the %s dialect:\n", databaseType)
+	b.WriteString("- Do not change any table or column names.\n")
+	b.WriteString("- Escape column names that clash with data types or reserved keywords.\n")
+	b.WriteString(aiDialectInstructions[databaseType])
+	b.WriteString("\nAnswer with just the SQL commands, without markdown and without any explanation.\n\n")
+	b.WriteString(ddl)
+	return b.String()
+}
+
+// stripCodeFence removes the ```sql fence models add despite being asked
+// not to.
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	text = strings.TrimPrefix(text, "```")
+	if newline := strings.IndexByte(text, '\n'); newline >= 0 {
+		text = text[newline+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "```"))
+}
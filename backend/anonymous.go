@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	anonymousWrite = "write"
+	anonymousRead  = "read"
+	anonymousNone  = "none"
+)
+
+// anonymousAccess is what requests without an identity may do. "write"
+// keeps the open access of a server without authentication; "read" serves
+// public docs while edits need a client certificate, and with diagrams set
+// only those diagrams are public; "none" turns anonymous callers away.
+type anonymousAccess struct {
+	mode string
+	// diagrams, when not empty, are the only diagrams anonymous callers may
+	// read.
+	diagrams map[string]bool
+}
+
+func newAnonymousAccess(mode string, diagrams []string) (anonymousAccess, error) {
+	access := anonymousAccess{mode: strings.ToLower(strings.TrimSpace(mode))}
+	switch access.mode {
+	case "":
+		access.mode = anonymousWrite
+	case anonymousWrite, anonymousRead, anonymousNone:
+	default:
+		return access, fmt.Errorf("invalid ANONYMOUS_ACCESS %q: use %q, %q or %q", mode, anonymousWrite, anonymousRead, anonymousNone)
+	}
+	if len(diagrams) > 0 {
+		if access.mode != anonymousRead {
+			return access, fmt.Errorf("ANONYMOUS_DIAGRAMS requires ANONYMOUS_ACCESS=%s", anonymousRead)
+		}
+		access.diagrams = make(map[string]bool, len(diagrams))
+		for _, id := range diagrams {
+			access.diagrams[id] = true
+		}
+	}
+	return access, nil
+}
+
+// anonymousPublicPaths answer anonymous callers whatever ANONYMOUS_ACCESS
+// says, so clients can find out how to sign in, and do.
+var anonymousPublicPaths = map[string]bool{
+	"/api/health":       true,
+	"/api/version":      true,
+	"/api/features":     true,
+	"/api/openapi.json": true,
+	"/api/docs":         true,
+	"/api/auth/login":   true,
+	"/api/auth/logout":  true,
+	samlMetadataPath:    true,
+	samlLoginPath:       true,
+	samlACSPath:         true,
+}
+
+// anonymousRestrictedPaths are the reads left to anonymous callers when
+// ANONYMOUS_DIAGRAMS is set; the others would show every diagram.
+var anonymousRestrictedPaths = map[string]bool{
+	"/api/diagrams":  true,
+	"/api/templates": true,
+	"/api/config":    true,
+}
+
+// allowsAnonymous reports whether the request may run without an identity,
+// and if not, the status to refuse it with.
+func (access anonymousAccess) allowsAnonymous(r *http.Request) (bool, int) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if access.mode == anonymousWrite || anonymousPublicPaths[path] {
+		return true, 0
+	}
+	if path != "/api" && !strings.HasPrefix(path, "/api/") {
+		return true, 0
+	}
+	if access.mode == anonymousNone || strings.HasPrefix(path, "/api/admin") {
+		return false, http.StatusUnauthorized
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	case http.MethodPost:
+		// Validating and GraphQL queries only read.
+		if path != "/api/diagrams/validate" && path != "/api/graphql" {
+			return false, http.StatusUnauthorized
+		}
+	default:
+		return false, http.StatusUnauthorized
+	}
+	if access.diagrams == nil {
+		return true, 0
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) >= 3 && parts[1] == "diagrams" && path != "/api/diagrams/validate" {
+		id, err := url.PathUnescape(parts[2])
+		if err != nil || !access.diagrams[id] {
+			return false, http.StatusNotFound
+		}
+		return true, 0
+	}
+	for prefix := range anonymousRestrictedPaths {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true, 0
+		}
+	}
+	return false, http.StatusUnauthorized
+}
+
+// allowsRPC reports whether an anonymous gRPC call may run. The gRPC API
+// has no way to narrow its reads to ANONYMOUS_DIAGRAMS, so with diagrams
+// set it needs an identity for every call.
+func (access anonymousAccess) allowsRPC(mutating bool) bool {
+	switch access.mode {
+	case anonymousWrite:
+		return true
+	case anonymousRead:
+		return !mutating && access.diagrams == nil
+	}
+	return false
+}
+
+// listableIDs narrows a diagram list to ANONYMOUS_DIAGRAMS for anonymous
+// requests. ids are the diagrams the caller asked for, nil for all of them.
+func (access anonymousAccess) listableIDs(r *http.Request, ids []string) []string {
+	if access.diagrams == nil || requestUserID(r) != "" {
+		return ids
+	}
+	visible := make([]string, 0, len(access.diagrams))
+	if ids == nil {
+		for id := range access.diagrams {
+			visible = append(visible, id)
+		}
+		sort.Strings(visible)
+		return visible
+	}
+	for _, id := range ids {
+		if access.diagrams[id] {
+			visible = append(visible, id)
+		}
+	}
+	return visible
+}
+
+// withAnonymousAccess applies ANONYMOUS_ACCESS to requests without an
+// identity. Diagrams anonymous callers may not read are answered as
+// missing, so a public server does not reveal its private diagrams.
+func (a *app) withAnonymousAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestUserID(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed, status := a.anonymous.allowsAnonymous(r)
+		switch {
+		case allowed:
+			next.ServeHTTP(w, r)
+		case status == http.StatusNotFound:
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		case a.anonymous.mode == anonymousRead && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			writeErrorCode(w, http.StatusUnauthorized, codeUnauthorized, "authentication required: anonymous access is read-only")
+		default:
+			writeErrorCode(w, http.StatusUnauthorized, codeUnauthorized, "authentication required")
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Error codes of the /api/v1 error body. Clients branch on the code; the
+// message is for people and may change.
+const (
+	codeInvalidRequest        = "INVALID_REQUEST"
+	codePayloadInvalid        = "PAYLOAD_INVALID"
+	codePayloadTooLarge       = "PAYLOAD_TOO_LARGE"
+	codeUnauthorized          = "UNAUTHORIZED"
+	codeForbidden             = "FORBIDDEN"
+	codeNotFound              = "NOT_FOUND"
+	codeRouteNotFound         = "ROUTE_NOT_FOUND"
+	codeDiagramNotFound       = "DIAGRAM_NOT_FOUND"
+	codeVersionNotFound       = "VERSION_NOT_FOUND"
+	codeFilterNotFound        = "FILTER_NOT_FOUND"
+	codeFolderNotFound        = "FOLDER_NOT_FOUND"
+	codeTemplateNotFound      = "TEMPLATE_NOT_FOUND"
+	codeBackupNotFound        = "BACKUP_NOT_FOUND"
+	codeSyncNotConfigured     = "SYNC_NOT_CONFIGURED"
+	codeAINotConfigured       = "AI_NOT_CONFIGURED"
+	codeMethodNotAllowed      = "METHOD_NOT_ALLOWED"
+	codeConflict              = "CONFLICT"
+	codeDiagramExists         = "DIAGRAM_EXISTS"
+	codeDiagramStale          = "DIAGRAM_STALE"
+	codeCRDTDisabled          = "CRDT_DISABLED"
+	codeDiagramLocked         = "DIAGRAM_LOCKED"
+	codeDiagramApproved       = "DIAGRAM_APPROVED"
+	codeDiagramInReview       = "DIAGRAM_IN_REVIEW"
+	codeDiagramFrozen         = "DIAGRAM_FROZEN"
+	codeQuotaExceeded         = "QUOTA_EXCEEDED"
+	codeReadOnly              = "READ_ONLY"
+	codeCSRFInvalid           = "CSRF_INVALID"
+	codeConfigInvalid         = "CONFIG_INVALID"
+	codeFolderNotEmpty        = "FOLDER_NOT_EMPTY"
+	codeFolderCycle           = "FOLDER_CYCLE"
+	codeEventsPruned          = "EVENTS_PRUNED"
+	codeIdempotencyKeyInvalid = "IDEMPOTENCY_KEY_INVALID"
+	codeIdempotencyKeyInUse   = "IDEMPOTENCY_KEY_IN_USE"
+	codeIdempotencyKeyReused  = "IDEMPOTENCY_KEY_REUSED"
+	codeIntrospectionDisabled = "INTROSPECTION_DISABLED"
+	codeUnprocessable         = "UNPROCESSABLE"
+	codeInternal              = "INTERNAL"
+	codeUpstreamFailed        = "UPSTREAM_FAILED"
+	codeDatabaseBusy          = "DATABASE_BUSY"
+	codeTimeout               = "TIMEOUT"
+)
+
+// errorCodeForStatus is the code of errors written without a more
+// specific one.
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusRequestEntityTooLarge:
+		return codePayloadTooLarge
+	case http.StatusUnprocessableEntity:
+		return codeUnprocessable
+	case http.StatusInternalServerError:
+		return codeInternal
+	case http.StatusBadGateway:
+		return codeUpstreamFailed
+	case http.StatusServiceUnavailable:
+		return codeDatabaseBusy
+	case http.StatusGatewayTimeout:
+		return codeTimeout
+	}
+	return strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// fieldError is a validation failure of one request field, reported under
+// details in the /api/v1 error body. Its message reads "<field> <problem>",
+// e.g. "diagram.name is required".
+type fieldError struct {
+	field   string
+	problem string
+}
+
+func (e *fieldError) Error() string { return e.field + " " + e.problem }
+
+func invalidField(field, problem string) error {
+	return &fieldError{field: field, problem: problem}
+}
+
+type errorDetail struct {
+	Field string `json:"field"`
+	Issue string `json:"issue"`
+}
+
+// apiError is the error body under /api/v1. The deprecated unversioned
+// paths keep answering {"error": message, "requestId": ...}.
+type apiError struct {
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Details   []errorDetail `json:"details,omitempty"`
+	RequestID string        `json:"requestId,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeAPIError(w, status, "", message, nil)
+}
+
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, status, code, message, nil)
+}
+
+// writePayloadError reports an invalid request body as PAYLOAD_INVALID,
+// listing the offending field when err names one.
+func writePayloadError(w http.ResponseWriter, err error) {
+	var tooLarge *diagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		writeErrorCode(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, tooLarge.Error())
+		return
+	}
+	var details []errorDetail
+	var invalid *fieldError
+	if errors.As(err, &invalid) {
+		details = []errorDetail{{Field: invalid.field, Issue: invalid.problem}}
+	}
+	writeAPIError(w, http.StatusBadRequest, codePayloadInvalid, err.Error(), details)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string, details []errorDetail) {
+	writeAPIErrorWith(w, status, code, message, details, nil)
+}
+
+// writeAPIErrorWith writes an error whose body carries more top-level keys
+// beside "error", in both the versioned and the unversioned shape.
+func writeAPIErrorWith(w http.ResponseWriter, status int, code, message string, details []errorDetail, extra map[string]interface{}) {
+	body := make(map[string]interface{}, len(extra)+2)
+	for key, value := range extra {
+		body[key] = value
+	}
+	recorder, _ := w.(*responseRecorder)
+	if recorder == nil {
+		body["error"] = message
+		writeJSON(w, status, body)
+		return
+	}
+	if recorder.bodyLimit > 0 && status < http.StatusInternalServerError {
+		// The handler saw a truncated body; report why.
+		status, code, details = http.StatusRequestEntityTooLarge, codePayloadTooLarge, nil
+		message = payloadTooLargeMessage(recorder.bodyLimit)
+	}
+	recorder.errorMsg = message
+
+	if !recorder.errorEnvelope {
+		body["error"] = message
+		if recorder.requestID != "" {
+			body["requestId"] = recorder.requestID
+		}
+		writeJSON(w, status, body)
+		return
+	}
+	if code == "" {
+		code = errorCodeForStatus(status)
+	}
+	body["error"] = apiError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: recorder.requestID,
+	}
+	writeJSON(w, status, body)
+}
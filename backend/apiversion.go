@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// legacyAPIDeprecated is when the unversioned /api paths were deprecated
+// in favour of /api/v1.
+var legacyAPIDeprecated = time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+
+const defaultLegacyAPISunset = "2027-04-14"
+
+// parseLegacyAPISunset reads LEGACY_API_SUNSET, a date or an RFC 3339
+// timestamp. Empty leaves the Sunset header out.
+func parseLegacyAPISunset(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if day, err := time.Parse(time.DateOnly, value); err == nil {
+		return day, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid LEGACY_API_SUNSET %q: want a date such as 2027-04-14", value)
+	}
+	return at.UTC(), nil
+}
+
+// withAPIVersion serves /api/v1/... by the same routes as /api/.... The
+// unversioned paths keep working but are marked deprecated: responses carry
+// Deprecation (RFC 9745), Sunset (RFC 8594) and a Link to the /api/v1
+// successor, so clients can move before breaking changes land there.
+func withAPIVersion(basePath string, sunset time.Time, next http.Handler) http.Handler {
+	deprecation := "@" + strconv.FormatInt(legacyAPIDeprecated.Unix(), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/api/v1"); ok && (rest == "" || rest[0] == '/') {
+			versioned := r.Clone(r.Context())
+			versioned.URL.Path = "/api" + rest
+			versioned.URL.RawPath = ""
+			recorder := recordResponse(w)
+			recorder.errorEnvelope = true
+			next.ServeHTTP(recorder, versioned)
+			return
+		}
+		if r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/") {
+			header := w.Header()
+			header.Set("Deprecation", deprecation)
+			if !sunset.IsZero() {
+				header.Set("Sunset", sunset.Format(http.TimeFormat))
+			}
+			successor := basePath + "/api/v1" + strings.TrimPrefix(r.URL.EscapedPath(), "/api")
+			header.Add("Link", "<"+successor+`>; rel="successor-version"`)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxAttachmentBytes = 10 << 20
+	maxAttachmentsPerDiagram  = 100
+	maxAttachmentNameLen      = 255
+)
+
+// attachmentTypes are the Content-Types an attachment may be uploaded as,
+// each with a check that the body is what the type says.
+var attachmentTypes = map[string]func([]byte) bool{
+	"application/pdf":  hasPrefix("%PDF-"),
+	"image/png":        hasPrefix(string(pngSignature)),
+	"image/jpeg":       hasPrefix("\xff\xd8\xff"),
+	"text/csv":         isText,
+	"text/plain":       isText,
+	"text/markdown":    isText,
+	"application/sql":  isText,
+	"application/json": json.Valid,
+	// Office documents are zip archives.
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       hasPrefix("PK\x03\x04"),
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": hasPrefix("PK\x03\x04"),
+}
+
+// isText accepts UTF-8 without NUL bytes. Besides refusing binary files
+// sent as text, that keeps uploads from starting like a compressed or
+// encrypted blob, which decodePayload tells apart by their first bytes.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+func hasPrefix(prefix string) func([]byte) bool {
+	return func(data []byte) bool { return bytes.HasPrefix(data, []byte(prefix)) }
+}
+
+// diagramAttachment describes a file kept with a diagram, such as an ERD
+// PDF, a data dictionary or sample CSV data. The content is a blob.
+type diagramAttachment struct {
+	ID          int64  `json:"id"`
+	DiagramID   string `json:"diagramId"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash"`
+	CreatedAt   string `json:"createdAt"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+}
+
+// handleDiagramAttachments serves /api/diagrams/{id}/attachments: GET lists
+// the attachments and POST uploads one as the raw body, named by ?name= or
+// the Content-Disposition filename.
+func (a *app) handleDiagramAttachments(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		exists, err := diagramExists(r.Context(), a.db, diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if !exists {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		attachments, err := a.listAttachments(r.Context(), diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, attachments)
+	case http.MethodPost:
+		a.uploadAttachment(w, r, diagramID)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *app) uploadAttachment(w http.ResponseWriter, r *http.Request, diagramID string) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+			name = params["filename"]
+		}
+	}
+	name, problem := cleanAttachmentName(name)
+	if problem != "" {
+		writePayloadError(w, invalidField("name", problem))
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	check, allowed := attachmentTypes[contentType]
+	if !allowed {
+		writeErrorCode(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "attachments must be PDF, PNG, JPEG, CSV, plain text, Markdown, SQL, JSON, XLSX or DOCX")
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, a.maxAttachmentBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeErrorCode(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("attachment must be at most %d bytes (ATTACHMENTS_MAX_BYTES)", a.maxAttachmentBytes))
+		return
+	}
+	if err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "could not read attachment")
+		return
+	}
+	if len(data) == 0 {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "attachment is empty")
+		return
+	}
+	if !check(data) {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "attachment content is not "+contentType)
+		return
+	}
+
+	attachment := diagramAttachment{
+		DiagramID:   diagramID,
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now().UTC().Format(sortableTimeFormat),
+		CreatedBy:   requestUserID(r),
+	}
+	var full bool
+	err = a.inTx(r.Context(), func(tx *sql.Tx) error {
+		exists, err := diagramExists(r.Context(), tx, diagramID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+		var count int
+		if err := tx.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM diagram_attachments WHERE diagram_id = ?`, diagramID).Scan(&count); err != nil {
+			return err
+		}
+		if count >= maxAttachmentsPerDiagram {
+			full = true
+			return nil
+		}
+		if err := a.reserveQuota(r.Context(), tx, 0, 0, len(data)); err != nil {
+			return err
+		}
+		attachment.Hash, err = a.putBlob(r.Context(), tx, data)
+		if err != nil {
+			return err
+		}
+		const query = `
+INSERT INTO diagram_attachments (diagram_id, name, content_type, size, blob_hash, created_at, created_by)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+		res, err := tx.ExecContext(r.Context(), query, diagramID, name, contentType, attachment.Size, attachment.Hash, attachment.CreatedAt, attachment.CreatedBy)
+		if err != nil {
+			return err
+		}
+		attachment.ID, err = res.LastInsertId()
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if full {
+		writeErrorCode(w, http.StatusConflict, codeConflict, fmt.Sprintf("a diagram can have at most %d attachments", maxAttachmentsPerDiagram))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(r.URL.Path, "/"), attachment.ID))
+	writeJSON(w, http.StatusCreated, attachment)
+}
+
+// handleDiagramAttachment serves /api/diagrams/{id}/attachments/{attachmentId}:
+// GET downloads the file, PATCH {"name": "..."} renames it and DELETE
+// removes it.
+func (a *app) handleDiagramAttachment(w http.ResponseWriter, r *http.Request, diagramID, rawID string) {
+	attachmentID, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid attachment id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		attachment, err := a.getAttachment(r.Context(), diagramID, attachmentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "attachment not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if setValidators(w, r, `"`+attachment.Hash+`"`, parseStoredTime(attachment.CreatedAt), true) {
+			return
+		}
+		var raw []byte
+		if err := a.db.QueryRowContext(r.Context(), `SELECT payload FROM blobs WHERE hash = ?`, attachment.Hash).Scan(&raw); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		data, err := a.decodePayload(raw)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		header := w.Header()
+		header.Set("Content-Type", attachment.ContentType)
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPatch:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		name, problem := cleanAttachmentName(req.Name)
+		if problem != "" {
+			writePayloadError(w, invalidField("name", problem))
+			return
+		}
+		const query = `UPDATE diagram_attachments SET name = ? WHERE id = ? AND diagram_id = ?`
+		res, err := a.db.ExecContext(r.Context(), query, name, attachmentID, diagramID)
+		if err == nil {
+			err = requireRowAffected(res)
+		}
+		if err == nil {
+			var attachment diagramAttachment
+			attachment, err = a.getAttachment(r.Context(), diagramID, attachmentID)
+			if err == nil {
+				writeJSON(w, http.StatusOK, attachment)
+				return
+			}
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "attachment not found")
+			return
+		}
+		writeServerError(w, err)
+	case http.MethodDelete:
+		// The blob is left to the garbage collector, which keeps it while
+		// a version or another attachment still has the same content.
+		res, err := a.db.ExecContext(r.Context(), `DELETE FROM diagram_attachments WHERE id = ? AND diagram_id = ?`, attachmentID, diagramID)
+		if err == nil {
+			err = requireRowAffected(res)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "attachment not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func diagramExists(ctx context.Context, q rowQueryer, diagramID string) (bool, error) {
+	var exists bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, diagramID).Scan(&exists)
+	return exists, err
+}
+
+// requireRowAffected turns an update or delete that matched nothing into
+// sql.ErrNoRows.
+func requireRowAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const attachmentColumns = `id, diagram_id, name, content_type, size, blob_hash, created_at, COALESCE(created_by, '')`
+
+func scanAttachment(row interface{ Scan(...interface{}) error }) (diagramAttachment, error) {
+	var attachment diagramAttachment
+	err := row.Scan(&attachment.ID, &attachment.DiagramID, &attachment.Name, &attachment.ContentType, &attachment.Size, &attachment.Hash, &attachment.CreatedAt, &attachment.CreatedBy)
+	return attachment, err
+}
+
+func (a *app) listAttachments(ctx context.Context, diagramID string) ([]diagramAttachment, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT `+attachmentColumns+` FROM diagram_attachments WHERE diagram_id = ? ORDER BY id`, diagramID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make([]diagramAttachment, 0)
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, rows.Err()
+}
+
+func (a *app) getAttachment(ctx context.Context, diagramID string, attachmentID int64) (diagramAttachment, error) {
+	const query = `SELECT ` + attachmentColumns + ` FROM diagram_attachments WHERE id = ? AND diagram_id = ?`
+	return scanAttachment(a.db.QueryRowContext(ctx, query, attachmentID, diagramID))
+}
+
+// cleanAttachmentName keeps the last path element of a file name, as
+// browsers may send the client's full path, and rejects names that could
+// not be offered back as a download name.
+func cleanAttachmentName(name string) (string, string) {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "", "is required"
+	case len(name) > maxAttachmentNameLen:
+		return "", fmt.Sprintf("must be at most %d bytes", maxAttachmentNameLen)
+	case !utf8.ValidString(name) || strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return "", "must be valid UTF-8 without control characters"
+	}
+	return name, ""
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+	auditWriteTimeout    = 5 * time.Second
+	// Fixed width, so timestamps compare correctly as text.
+	sortableTimeFormat = "2006-01-02T15:04:05.000000Z"
+)
+
+type auditEntry struct {
+	ID          int64  `json:"id"`
+	At          string `json:"at"`
+	Actor       string `json:"actor,omitempty"`
+	ActorSource string `json:"actorSource,omitempty"`
+	Action      string `json:"action"`
+	Path        string `json:"path"`
+	DiagramID   string `json:"diagramId,omitempty"`
+	Status      int    `json:"status"`
+	ClientIP    string `json:"clientIp"`
+	RequestID   string `json:"requestId,omitempty"`
+	PayloadHash string `json:"payloadHash,omitempty"`
+}
+
+// hashingBody hashes the request body as the handler reads it.
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	n    int64
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.n += int64(n)
+	return n, err
+}
+
+// withAudit appends an audit_log row for every mutating API request once
+// the handler has finished, successful or not. The payload hash covers the
+// request body as far as the handler read it.
+func (a *app) withAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		// GraphQL serves only queries, even over POST.
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/graphql" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body *hashingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &hashingBody{ReadCloser: r.Body, hash: sha256.New()}
+			r.Body = body
+		}
+		recorder := recordResponse(w)
+		next.ServeHTTP(recorder, r)
+
+		id, _ := requestIdentity(r.Context())
+		entry := auditEntry{
+			At:          time.Now().UTC().Format(sortableTimeFormat),
+			Actor:       id.ID,
+			ActorSource: id.Source,
+			Action:      r.Method + " " + routeLabel(r.URL.Path),
+			Path:        r.URL.Path,
+			DiagramID:   requestDiagramID(r.URL.Path),
+			Status:      recorder.statusCode(),
+			ClientIP:    clientIP(r),
+			RequestID:   recorder.requestID,
+		}
+		if recorder.diagramID != "" {
+			entry.DiagramID = recorder.diagramID
+		}
+		if body != nil && body.n > 0 {
+			entry.PayloadHash = hex.EncodeToString(body.hash.Sum(nil))
+		}
+
+		// The request context may already be cancelled; the entry must still
+		// be written.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), auditWriteTimeout)
+		defer cancel()
+		if err := a.appendAudit(ctx, entry); err != nil {
+			slog.Error("audit log write failed", "action", entry.Action, "path", entry.Path, "error", err)
+		}
+	})
+}
+
+func (a *app) appendAudit(ctx context.Context, entry auditEntry) error {
+	const query = `
+INSERT INTO audit_log (at, actor, actor_source, action, path, diagram_id, status, client_ip, request_id, payload_hash)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query, entry.At, entry.Actor, entry.ActorSource, entry.Action, entry.Path,
+			nullableString(entry.DiagramID), entry.Status, entry.ClientIP, entry.RequestID, nullableString(entry.PayloadHash))
+		return err
+	})
+}
+
+// writeCreatedDiagram answers 201 with a new diagram and records its id for
+// the audit log, since the path does not contain it.
+func writeCreatedDiagram(w http.ResponseWriter, payload []byte) {
+	var created struct {
+		ID string `json:"id"`
+	}
+	if recorder, ok := w.(*responseRecorder); ok && json.Unmarshal(payload, &created) == nil {
+		recorder.diagramID = created.ID
+	}
+	writeRawJSON(w, http.StatusCreated, payload)
+}
+
+type auditFilter struct {
+	diagramID string
+	actor     string
+	action    string
+	since     string
+	until     string
+	before    int64
+	limit     int
+}
+
+// handleAudit serves GET /api/admin/audit, newest entries first. Pages are
+// addressed by id: pass the returned nextBefore as ?before= for the next
+// page.
+func (a *app) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditFilter{
+		diagramID: query.Get("diagramId"),
+		actor:     query.Get("actor"),
+		action:    query.Get("action"),
+		limit:     defaultAuditPageSize,
+	}
+	for _, bound := range []struct {
+		name   string
+		target *string
+	}{{"since", &filter.since}, {"until", &filter.until}} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, bound.name+" must be an RFC 3339 timestamp")
+			return
+		}
+		*bound.target = at.UTC().Format(sortableTimeFormat)
+	}
+	if value := query.Get("before"); value != "" {
+		before, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || before < 1 {
+			writeError(w, http.StatusBadRequest, "before must be a positive entry id")
+			return
+		}
+		filter.before = before
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditPageSize))
+			return
+		}
+		filter.limit = limit
+	}
+
+	entries, err := a.listAudit(r.Context(), filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	response := struct {
+		Entries    []auditEntry `json:"entries"`
+		NextBefore int64        `json:"nextBefore,omitempty"`
+	}{Entries: entries}
+	if len(entries) > filter.limit {
+		response.Entries = entries[:filter.limit]
+		response.NextBefore = response.Entries[filter.limit-1].ID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// listAudit returns up to filter.limit+1 entries, so the caller can tell
+// whether there is another page.
+func (a *app) listAudit(ctx context.Context, filter auditFilter) ([]auditEntry, error) {
+	conditions := []string{"1 = 1"}
+	args := []interface{}{}
+	add := func(condition string, value interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, value)
+	}
+	if filter.diagramID != "" {
+		add("diagram_id = ?", filter.diagramID)
+	}
+	if filter.actor != "" {
+		add("actor = ?", filter.actor)
+	}
+	if filter.action != "" {
+		// "DELETE" matches every DELETE, "DELETE /api/diagrams/:id" one route.
+		conditions = append(conditions, "(action = ? OR action LIKE ? || ' %')")
+		args = append(args, filter.action, filter.action)
+	}
+	if filter.since != "" {
+		add("at >= ?", filter.since)
+	}
+	if filter.until != "" {
+		add("at <= ?", filter.until)
+	}
+	if filter.before > 0 {
+		add("id < ?", filter.before)
+	}
+	args = append(args, filter.limit+1)
+
+	rows, err := a.db.QueryContext(ctx, `
+SELECT id, at, actor, actor_source, action, path, COALESCE(diagram_id, ''), status, client_ip, request_id, COALESCE(payload_hash, '')
+FROM audit_log
+WHERE `+strings.Join(conditions, " AND ")+`
+ORDER BY id DESC
+LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]auditEntry, 0)
+	for rows.Next() {
+		var entry auditEntry
+		if err := rows.Scan(&entry.ID, &entry.At, &entry.Actor, &entry.ActorSource, &entry.Action, &entry.Path,
+			&entry.DiagramID, &entry.Status, &entry.ClientIP, &entry.RequestID, &entry.PayloadHash); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+const (
+	backupTimeFormat = "20060102T150405Z"
+	backupFilePrefix = "chartdb-backup-"
+	backupFileSuffix = ".sqlite"
+
+	defaultBackupDir  = "backups"
+	defaultBackupKeep = 7
+)
+
+type backupFile struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"createdAt"`
+	// Uploaded and UploadError report the copy to BACKUP_S3_BUCKET for a
+	// backup that was just written.
+	Uploaded    bool   `json:"uploaded,omitempty"`
+	UploadError string `json:"uploadError,omitempty"`
+
+	modTime time.Time
+}
+
+// snapshotDatabase writes a consistent copy of the live database to path
+// with VACUUM INTO. Unlike copying the file, this includes committed pages
+// still sitting in the WAL and never captures a half-written transaction.
+// path must not exist yet.
+func (a *app) snapshotDatabase(ctx context.Context, path string) error {
+	if _, err := a.db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("snapshot database: %w", err)
+	}
+	return nil
+}
+
+func (a *app) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// The snapshot goes next to the database so it stays on the same volume
+	// and is removed as soon as it has been sent.
+	tmpDir, err := os.MkdirTemp(filepath.Dir(a.dbPath), ".backup-")
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshotPath := filepath.Join(tmpDir, defaultDBFileName)
+	if err := a.snapshotDatabase(r.Context(), snapshotPath); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	serveBackupFile(w, snapshotPath, backupFileName(time.Now()))
+}
+
+func serveBackupFile(w http.ResponseWriter, path, fileName string) {
+	file, err := os.Open(path)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, file); err != nil {
+		slog.Warn("backup download interrupted", "error", err)
+	}
+}
+
+func backupFileName(t time.Time) string {
+	return backupFilePrefix + t.UTC().Format(backupTimeFormat) + backupFileSuffix
+}
+
+// isBackupFileName also keeps request paths from escaping the backup
+// directory.
+func isBackupFileName(name string) bool {
+	return strings.HasPrefix(name, backupFilePrefix) &&
+		strings.HasSuffix(name, backupFileSuffix) &&
+		filepath.Base(name) == name
+}
+
+// handleBackups serves /api/admin/backups: listing, creating, downloading
+// and restoring the snapshots in BACKUP_DIR.
+func (a *app) handleBackups(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/backups"), "/")
+	remote := queryFlag(r, "remote")
+	if remote && a.backupS3 == nil {
+		writeError(w, http.StatusBadRequest, "BACKUP_S3_BUCKET is not configured")
+		return
+	}
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list := a.listBackups
+			if remote {
+				list = func() ([]backupFile, error) { return a.listRemoteBackups(r.Context()) }
+			}
+			backups, err := list()
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, backups)
+		case http.MethodPost:
+			backup, err := a.createBackup(r.Context())
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, backup)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	name, err := url.PathUnescape(parts[0])
+	if err != nil || !isBackupFileName(name) {
+		writeErrorCode(w, http.StatusNotFound, codeBackupNotFound, "backup not found")
+		return
+	}
+	path := filepath.Join(a.backupDir, name)
+	if remote && len(parts) == 2 && parts[1] == "restore" && r.Method == http.MethodPost {
+		if err := a.fetchRemoteBackup(r.Context(), name, path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				writeErrorCode(w, http.StatusNotFound, codeBackupNotFound, "backup not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeErrorCode(w, http.StatusNotFound, codeBackupNotFound, "backup not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		serveBackupFile(w, path, name)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := os.Remove(path); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "restore":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		safety, err := a.restoreBackup(r.Context(), path)
+		if err != nil {
+			if errors.Is(err, errInvalidBackup) {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status":       "restored",
+			"name":         name,
+			"safetyBackup": safety.Name,
+		})
+	case len(parts) == 1:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+	}
+}
+
+// listBackups returns the snapshots in BACKUP_DIR, newest first.
+func (a *app) listBackups() ([]backupFile, error) {
+	entries, err := os.ReadDir(a.backupDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []backupFile{}, nil
+		}
+		return nil, err
+	}
+
+	backups := make([]backupFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !isBackupFileName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{
+			Name:      entry.Name(),
+			Size:      info.Size(),
+			CreatedAt: info.ModTime().UTC().Format(time.RFC3339),
+			modTime:   info.ModTime(),
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].modTime.After(backups[j].modTime) })
+	return backups, nil
+}
+
+// createBackup writes a new snapshot to BACKUP_DIR and then drops the oldest
+// ones beyond BACKUP_KEEP.
+func (a *app) createBackup(ctx context.Context) (backupFile, error) {
+	a.backupMu.Lock()
+	defer a.backupMu.Unlock()
+
+	if err := os.MkdirAll(a.backupDir, 0o700); err != nil {
+		return backupFile{}, fmt.Errorf("create backup dir: %w", err)
+	}
+	base := backupFileName(time.Now())
+	name := base
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(a.backupDir, name)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = strings.TrimSuffix(base, backupFileSuffix) + "-" + strconv.Itoa(i) + backupFileSuffix
+	}
+
+	path := filepath.Join(a.backupDir, name)
+	if err := a.snapshotDatabase(ctx, path); err != nil {
+		return backupFile{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return backupFile{}, err
+	}
+
+	if err := a.rotateBackups(); err != nil {
+		slog.Warn("backup rotation failed", "error", err)
+	}
+	backup := backupFile{
+		Name:      name,
+		Size:      info.Size(),
+		CreatedAt: info.ModTime().UTC().Format(time.RFC3339),
+	}
+	if a.backupS3 != nil {
+		// The local backup is kept either way; a failed upload is retried
+		// with the next backup.
+		if err := a.uploadBackup(ctx, path, name); err != nil {
+			slog.Error("backup upload failed", "name", name, "error", err)
+			backup.UploadError = err.Error()
+		} else {
+			backup.Uploaded = true
+		}
+	}
+	return backup, nil
+}
+
+// uploadBackup copies a backup to S3, applies BACKUP_KEEP to the uploaded
+// backups and, with BACKUP_S3_EXPORT_DIAGRAMS, uploads every diagram as
+// diagrams/<id>.json so single diagrams can be recovered without SQLite.
+func (a *app) uploadBackup(ctx context.Context, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := a.backupS3.putObject(ctx, name, file, "application/vnd.sqlite3"); err != nil {
+		return err
+	}
+	slog.Info("backup uploaded", "name", name, "bucket", a.backupS3.bucket)
+
+	if err := a.rotateRemoteBackups(ctx); err != nil {
+		slog.Warn("remote backup rotation failed", "error", err)
+	}
+	if a.backupExportDiagrams {
+		if err := a.uploadDiagramExports(ctx); err != nil {
+			return fmt.Errorf("upload diagram exports: %w", err)
+		}
+	}
+	return nil
+}
+
+func (a *app) listRemoteBackups(ctx context.Context) ([]backupFile, error) {
+	objects, err := a.backupS3.listObjects(ctx, backupFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]backupFile, 0, len(objects))
+	for _, object := range objects {
+		if !isBackupFileName(object.Key) {
+			continue
+		}
+		backups = append(backups, backupFile{
+			Name:      object.Key,
+			Size:      object.Size,
+			CreatedAt: object.LastModified.UTC().Format(time.RFC3339),
+			modTime:   object.LastModified,
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].modTime.After(backups[j].modTime) })
+	return backups, nil
+}
+
+func (a *app) rotateRemoteBackups(ctx context.Context) error {
+	if a.backupKeep <= 0 {
+		return nil
+	}
+	backups, err := a.listRemoteBackups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups[min(a.backupKeep, len(backups)):] {
+		if err := a.backupS3.deleteObject(ctx, backup.Name); err != nil {
+			return err
+		}
+		slog.Info("removed old uploaded backup", "name", backup.Name)
+	}
+	return nil
+}
+
+// fetchRemoteBackup downloads an uploaded backup into BACKUP_DIR, e.g. after
+// the volume holding the local copies was lost. An existing local copy is
+// used as is.
+func (a *app) fetchRemoteBackup(ctx context.Context, name, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	body, err := a.backupS3.getObject(ctx, name)
+	if err != nil {
+		var notFound *s3NotFoundError
+		if errors.As(err, &notFound) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(a.backupDir, 0o700); err != nil {
+		return fmt.Errorf("create backup dir: %w", err)
+	}
+	// Download under a temporary name so an interrupted transfer is never
+	// mistaken for a complete backup.
+	tmp, err := os.CreateTemp(a.backupDir, ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (a *app) uploadDiagramExports(ctx context.Context) error {
+	ids, err := a.listDiagramIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		payload, err := a.getDiagramPayload(ctx, id)
+		if err != nil {
+			return err
+		}
+		key := "diagrams/" + id + ".json"
+		if err := a.backupS3.putObject(ctx, key, bytes.NewReader(payload), "application/json"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *app) rotateBackups() error {
+	if a.backupKeep <= 0 {
+		return nil
+	}
+	backups, err := a.listBackups()
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups[min(a.backupKeep, len(backups)):] {
+		if err := os.Remove(filepath.Join(a.backupDir, backup.Name)); err != nil {
+			return err
+		}
+		slog.Info("removed old backup", "name", backup.Name)
+	}
+	return nil
+}
+
+var errInvalidBackup = errors.New("invalid backup")
+
+// restoreBackup replaces the contents of the live database with a snapshot
+// using SQLite's online backup API, so open connections keep working. The
+// current state is saved as a new backup first and returned so an operator
+// can undo the restore. Snapshots from older versions are migrated after
+// the copy.
+func (a *app) restoreBackup(ctx context.Context, path string) (backupFile, error) {
+	if err := verifyBackup(ctx, path); err != nil {
+		return backupFile{}, err
+	}
+	safety, err := a.createBackup(ctx)
+	if err != nil {
+		return backupFile{}, fmt.Errorf("save current database before restore: %w", err)
+	}
+
+	a.backupMu.Lock()
+	defer a.backupMu.Unlock()
+
+	conn, err := a.db.Conn(ctx)
+	if err != nil {
+		return safety, err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn interface{}) error {
+		if traced, ok := driverConn.(*tracedConn); ok {
+			driverConn = traced.Conn
+		}
+		restorer, ok := driverConn.(interface {
+			NewRestore(srcURI string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("sqlite driver does not support online restore")
+		}
+		restore, err := restorer.NewRestore("file:" + path + "?mode=ro")
+		if err != nil {
+			return err
+		}
+		if _, err := restore.Step(-1); err != nil {
+			_ = restore.Finish()
+			return err
+		}
+		return restore.Finish()
+	})
+	if err != nil {
+		return safety, fmt.Errorf("restore database: %w", err)
+	}
+	if err := initSchema(a.db); err != nil {
+		return safety, fmt.Errorf("migrate restored database: %w", err)
+	}
+	slog.Info("database restored from backup", "backup", filepath.Base(path), "safety_backup", safety.Name)
+	return safety, nil
+}
+
+// verifyBackup checks that path is an intact ChartDB database before it is
+// allowed to replace the live one.
+func verifyBackup(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRowContext(ctx, `PRAGMA quick_check`).Scan(&result); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidBackup, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%w: %s", errInvalidBackup, result)
+	}
+	var tables int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'diagrams'`).Scan(&tables); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidBackup, err)
+	}
+	if tables == 0 {
+		return fmt.Errorf("%w: not a ChartDB database", errInvalidBackup)
+	}
+	return nil
+}
+
+// runBackupSchedule writes a backup every time the schedule fires.
+func (a *app) runBackupSchedule(ctx context.Context, schedule *cronSchedule) {
+	for {
+		next, err := schedule.next(time.Now())
+		if err != nil {
+			slog.Error("backup schedule stopped", "error", err)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		backup, err := a.createBackup(ctx)
+		if err != nil {
+			slog.Error("scheduled backup failed", "error", err)
+			continue
+		}
+		slog.Info("scheduled backup written", "name", backup.Name, "bytes", backup.Size)
+	}
+}
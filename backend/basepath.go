@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// normalizeBasePath turns "chartdb/" or "/chartdb" into "/chartdb"; "" and
+// "/" mean the server is mounted at the root.
+func normalizeBasePath(value string) (string, error) {
+	value = strings.Trim(strings.TrimSpace(value), "/")
+	if value == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(value, "?#") || strings.Contains(value, "//") {
+		return "", fmt.Errorf("invalid BASE_PATH %q", value)
+	}
+	return "/" + value, nil
+}
+
+// withBasePath serves next under prefix, stripping it from the request path
+// so routing works unchanged. Requests outside the prefix get 404, and the
+// bare prefix redirects to prefix + "/".
+func withBasePath(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		rest, ok := strings.CutPrefix(r.URL.Path, prefix+"/")
+		if !ok {
+			writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+			return
+		}
+
+		stripped := r.Clone(r.Context())
+		stripped.URL.Path = "/" + rest
+		stripped.URL.RawPath = ""
+		next.ServeHTTP(w, stripped)
+	})
+}
+
+var rootRelativeLink = regexp.MustCompile(`\b(src|href)="/([^/"][^"]*)?"`)
+
+// prefixRootLinks rewrites root-relative src and href attributes (such as
+// /config.js) to live under the base path. Links already under it, e.g. from
+// a frontend built with --base, are left alone.
+func prefixRootLinks(html []byte, prefix string) []byte {
+	if prefix == "" {
+		return html
+	}
+	return rootRelativeLink.ReplaceAllFunc(html, func(match []byte) []byte {
+		attr, rest, _ := strings.Cut(string(match), `="`)
+		if strings.HasPrefix(rest, prefix+"/") {
+			return match
+		}
+		return []byte(attr + `="` + prefix + rest)
+	})
+}
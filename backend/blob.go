@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const blobGCInterval = time.Hour
+
+// putBlob stores content in the blobs table keyed by its SHA-256 and returns
+// the key. Identical content (a diagram and its latest full version, or a
+// restore of an unchanged payload) is stored once.
+func (a *app) putBlob(ctx context.Context, tx *sql.Tx, content []byte) (string, error) {
+	hash := blobHash(content)
+
+	stored, err := a.storedPayload(content)
+	if err != nil {
+		return "", err
+	}
+	// Always writing (rather than checking for the hash first) takes the
+	// write lock, so a concurrent garbage collection can't drop the blob
+	// before this transaction references it.
+	const query = `
+INSERT INTO blobs (hash, payload, size)
+VALUES (?, ?, ?)
+ON CONFLICT(hash) DO NOTHING`
+	_, err = tx.ExecContext(ctx, query, hash, stored, len(content))
+	return hash, err
+}
+
+// blobHash is the key content is stored under in the blobs table.
+func blobHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// migratePayloadBlobs moves payloads still stored inline on diagram and
+// version rows into the blobs table.
+func (a *app) migratePayloadBlobs(ctx context.Context) error {
+	for _, table := range []string{"diagrams", "diagram_versions"} {
+		ids, err := a.inlinePayloadIDs(ctx, table)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		err = a.inTx(ctx, func(tx *sql.Tx) error {
+			for _, id := range ids {
+				if err := a.moveInlinePayload(ctx, tx, table, id); err != nil {
+					return fmt.Errorf("%s row %v: %w", table, id, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		slog.Info("moved payloads to the blob store", "table", table, "count", len(ids))
+	}
+	return nil
+}
+
+func (a *app) inlinePayloadIDs(ctx context.Context, table string) ([]interface{}, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT id FROM `+table+` WHERE blob_hash IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]interface{}, 0)
+	for rows.Next() {
+		var id interface{}
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (a *app) moveInlinePayload(ctx context.Context, tx *sql.Tx, table string, id interface{}) error {
+	var raw []byte
+	if err := tx.QueryRowContext(ctx, `SELECT payload FROM `+table+` WHERE id = ?`, id).Scan(&raw); err != nil {
+		return err
+	}
+	content, err := a.decodePayload(raw)
+	if err != nil {
+		return err
+	}
+	hash, err := a.putBlob(ctx, tx, content)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE `+table+` SET payload = '', blob_hash = ? WHERE id = ?`, hash, id)
+	return err
+}
+
+// collectGarbageBlobs deletes blobs no longer referenced by any diagram,
+// version, idempotency key or attachment, e.g. after pruning, deletes or
+// saves that replaced a payload.
+func (a *app) collectGarbageBlobs(ctx context.Context) (int64, error) {
+	const query = `
+DELETE FROM blobs
+WHERE NOT EXISTS (SELECT 1 FROM diagrams WHERE blob_hash = blobs.hash)
+	AND NOT EXISTS (SELECT 1 FROM diagram_versions WHERE blob_hash = blobs.hash)
+	AND NOT EXISTS (SELECT 1 FROM idempotency_keys WHERE blob_hash = blobs.hash)
+	AND NOT EXISTS (SELECT 1 FROM diagram_attachments WHERE blob_hash = blobs.hash)`
+	res, err := a.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (a *app) runBlobGC(ctx context.Context) {
+	ticker := time.NewTicker(blobGCInterval)
+	defer ticker.Stop()
+
+	for {
+		if expired, err := a.pruneIdempotencyKeys(ctx); err != nil {
+			slog.Error("idempotency key prune failed", "error", err)
+		} else if expired > 0 {
+			slog.Info("pruned expired idempotency keys", "count", expired)
+		}
+		removed, err := a.collectGarbageBlobs(ctx)
+		if err != nil {
+			slog.Error("blob gc failed", "error", err)
+		} else if removed > 0 {
+			slog.Info("blob gc removed unreferenced blobs", "count", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
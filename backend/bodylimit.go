@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const defaultMaxPayloadBytes = maxImportEntryBytes
+
+// withBodyLimit caps request bodies at limit bytes. Requests that declare a
+// larger Content-Length are rejected up front; for the rest the body is
+// wrapped in http.MaxBytesReader and the recorder is flagged when the limit
+// is hit, so the handler's decode error is reported as 413 by writeError.
+// Imports keep their own upload limit.
+func withBodyLimit(limit int64, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || r.URL.Path == "/api/import" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := recordResponse(w)
+		if r.ContentLength > limit {
+			recorder.bodyLimit = limit
+			writeError(recorder, http.StatusRequestEntityTooLarge, payloadTooLargeMessage(limit))
+			return
+		}
+		r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(recorder, r.Body, limit), recorder: recorder}
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	recorder *responseRecorder
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.recorder.bodyLimit = maxBytesErr.Limit
+	}
+	return n, err
+}
+
+func payloadTooLargeMessage(limit int64) string {
+	return fmt.Sprintf("request body exceeds the %d byte limit (MAX_PAYLOAD_BYTES)", limit)
+}
+
+// diagramTooLargeError is returned for a normalized diagram payload over
+// MAX_DIAGRAM_BYTES. writeServerError and writePayloadError report it as
+// 413.
+type diagramTooLargeError struct {
+	size, limit int64
+}
+
+func (e *diagramTooLargeError) Error() string {
+	return fmt.Sprintf("diagram is %d bytes, over the %d byte limit (MAX_DIAGRAM_BYTES)", e.size, e.limit)
+}
+
+// checkDiagramSize enforces MAX_DIAGRAM_BYTES on a payload as it would be
+// stored, whichever way it arrived: a save, a patch, an import or a
+// restore of an older version.
+func (a *app) checkDiagramSize(payload []byte) error {
+	if a.maxDiagramBytes > 0 && int64(len(payload)) > a.maxDiagramBytes {
+		return &diagramTooLargeError{size: int64(len(payload)), limit: a.maxDiagramBytes}
+	}
+	return nil
+}
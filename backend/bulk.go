@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const (
+	maxBulkDiagramIDs = 1000
+
+	bulkTrashed  = "trashed"
+	bulkPurged   = "purged"
+	bulkPatched  = "patched"
+	bulkNotFound = "notFound"
+	bulkFailed   = "failed"
+)
+
+// bulkResult is the outcome of a bulk operation for one diagram. Diagrams
+// that refuse the write get the failed status with the error code the same
+// write to one diagram would get, such as DIAGRAM_LOCKED.
+type bulkResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+}
+
+// diagramCollectionActions are the POST-only routes under /api/diagrams
+// that take no diagram id.
+var diagramCollectionActions = map[string]bool{
+	"validate":    true,
+	"bulk-delete": true,
+	"bulk-patch":  true,
+}
+
+// decodeBulkIDs reads the ids of a bulk request, dropping duplicates.
+func decodeBulkIDs(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, invalidField("ids", "must list at least one diagram id")
+	}
+	unique := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		if id == "" {
+			return nil, invalidField(fmt.Sprintf("ids[%d]", i), "must not be empty")
+		}
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) > maxBulkDiagramIDs {
+		return nil, invalidField("ids", fmt.Sprintf("must list at most %d diagrams", maxBulkDiagramIDs))
+	}
+	return unique, nil
+}
+
+// handleBulkDelete serves POST /api/diagrams/bulk-delete with
+// {"ids": [...], "permanent": false}. Like DELETE /api/diagrams/{id} it
+// moves the diagrams to the trash; permanent purges them with their
+// versions, filters and stars instead. All ids are handled in one
+// transaction, and every id gets a result; diagrams that refuse the write
+// are left alone.
+func (a *app) handleBulkDelete(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs       []string `json:"ids"`
+		Permanent bool     `json:"permanent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	ids, err := decodeBulkIDs(req.IDs)
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+
+	var results []bulkResult
+	err = a.inTx(r.Context(), func(tx *sql.Tx) error {
+		results = make([]bulkResult, 0, len(ids))
+		for _, id := range ids {
+			code, _, err := a.diagramWriteRefusal(r.Context(), tx, id, lockOwner(r))
+			if err != nil {
+				return err
+			}
+			if code != "" {
+				results = append(results, bulkResult{ID: id, Status: bulkFailed, Code: code})
+				continue
+			}
+			status, err := a.bulkDeleteDiagram(r.Context(), tx, id, req.Permanent)
+			if err != nil {
+				return err
+			}
+			results = append(results, bulkResult{ID: id, Status: status})
+		}
+		return nil
+	})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]bulkResult{"results": results})
+}
+
+func (a *app) bulkDeleteDiagram(ctx context.Context, tx *sql.Tx, diagramID string, permanent bool) (string, error) {
+	if !permanent {
+		trashed, err := a.trashDiagram(ctx, tx, diagramID)
+		if err != nil || !trashed {
+			return bulkNotFound, err
+		}
+		return bulkTrashed, nil
+	}
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, diagramID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return bulkNotFound, nil
+	}
+	return bulkPurged, a.purgeDiagramTx(ctx, tx, diagramID)
+}
+
+// handleBulkPatch serves POST /api/diagrams/bulk-patch with
+// {"ids": [...], "patch": {"archived": true, "folderId": "..."}}. Only the
+// fields stored beside the payload can be bulk patched; they are set on
+// every listed diagram in one transaction. Missing and trashed diagrams are
+// reported as notFound and ones refusing the write as failed, or with
+// "atomic": true
+// either fails the whole request with 409 and nothing is changed.
+func (a *app) handleBulkPatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs    []string               `json:"ids"`
+		Patch  map[string]interface{} `json:"patch"`
+		Atomic bool                   `json:"atomic"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	ids, err := decodeBulkIDs(req.IDs)
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+	state, err := takeDiagramState(req.Patch)
+	if err != nil {
+		var invalid *fieldError
+		if errors.As(err, &invalid) {
+			err = invalidField("patch."+invalid.field, invalid.problem)
+		}
+		writePayloadError(w, err)
+		return
+	}
+	if len(req.Patch) > 0 {
+		fields := make([]string, 0, len(req.Patch))
+		for field := range req.Patch {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		writePayloadError(w, invalidField("patch."+fields[0], "cannot be bulk patched; only archived and folderId can"))
+		return
+	}
+	if state.empty() {
+		writePayloadError(w, invalidField("patch", "must set archived or folderId"))
+		return
+	}
+
+	var results []bulkResult
+	var unpatched []errorDetail
+	errUnpatched := errors.New("some diagrams could not be patched")
+	err = a.inTx(r.Context(), func(tx *sql.Tx) error {
+		results = make([]bulkResult, 0, len(ids))
+		unpatched = nil
+		for i, id := range ids {
+			var live bool
+			err := tx.QueryRowContext(r.Context(), `SELECT deleted_at IS NULL FROM diagrams WHERE id = ?`, id).Scan(&live)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if !live {
+				results = append(results, bulkResult{ID: id, Status: bulkNotFound})
+				unpatched = append(unpatched, errorDetail{Field: fmt.Sprintf("ids[%d]", i), Issue: "diagram " + id + " not found"})
+				continue
+			}
+			code, _, err := a.diagramWriteRefusal(r.Context(), tx, id, lockOwner(r))
+			if err != nil {
+				return err
+			}
+			if code != "" {
+				results = append(results, bulkResult{ID: id, Status: bulkFailed, Code: code})
+				unpatched = append(unpatched, errorDetail{Field: fmt.Sprintf("ids[%d]", i), Issue: "diagram " + id + " refuses writes: " + code})
+				continue
+			}
+			if err := a.setDiagramStateTx(r.Context(), tx, id, state); err != nil {
+				return err
+			}
+			results = append(results, bulkResult{ID: id, Status: bulkPatched})
+		}
+		if req.Atomic && len(unpatched) > 0 {
+			return errUnpatched
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errUnpatched):
+		writeAPIError(w, http.StatusConflict, codeConflict, "not every diagram could be patched; nothing was changed", unpatched)
+	case errors.Is(err, errFolderNotFound):
+		writeErrorCode(w, http.StatusBadRequest, codeFolderNotFound, err.Error())
+	case err != nil:
+		writeServerError(w, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string][]bulkResult{"results": results})
+	}
+}
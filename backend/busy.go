@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	defaultBusyTimeout = 5 * time.Second
+
+	busyRetryAttempts  = 4
+	busyRetryBaseDelay = 50 * time.Millisecond
+)
+
+// errDatabaseBusy is returned once a transaction has kept failing with
+// SQLITE_BUSY after all retries. Handlers report it as 503.
+var errDatabaseBusy = errors.New("database is busy, try again")
+
+func isBusyError(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// Extended result codes keep the primary code in the low byte.
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// inTx runs fn in a transaction and commits it. busy_timeout already makes
+// SQLite wait for the write lock; when it still reports the database busy,
+// the whole transaction is retried a few times with jittered backoff, so fn
+// must not depend on state left over from a failed attempt.
+func (a *app) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	delay := busyRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := a.runTx(ctx, fn)
+		if err == nil || !isBusyError(err) {
+			return err
+		}
+		if attempt == busyRetryAttempts {
+			return fmt.Errorf("%w: %v", errDatabaseBusy, err)
+		}
+		slog.WarnContext(ctx, "database busy, retrying transaction", "attempt", attempt, "error", err)
+
+		wait := delay + time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func (a *app) runTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Wake event consumers, in case fn recorded an event.
+	a.events.notify()
+	return nil
+}
+
+// readTx runs fn in a read-only transaction, which SQLite starts deferred:
+// it reads one snapshot of the database without taking the write lock that
+// the pool's other transactions take up front.
+func (a *app) readTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := a.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+	return fn(tx)
+}
+
+// writeServerError reports an unexpected storage error: 503 with a
+// Retry-After hint when the database stayed locked, 500 otherwise. Writes
+// refused by a quota or MAX_DIAGRAM_BYTES get their own status.
+func writeServerError(w http.ResponseWriter, err error) {
+	var quota *quotaError
+	if errors.As(err, &quota) {
+		writeErrorCode(w, quota.status, codeQuotaExceeded, quota.message)
+		return
+	}
+	var tooLarge *diagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		writeErrorCode(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, tooLarge.Error())
+		return
+	}
+	if errors.Is(err, errDatabaseBusy) || isBusyError(err) {
+		w.Header().Set("Retry-After", "1")
+		writeErrorCode(w, http.StatusServiceUnavailable, codeDatabaseBusy, errDatabaseBusy.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+// diagramChange is one entry of the changes feed: an event with the
+// diagram's current updatedAt, which is absent once the diagram is purged.
+type diagramChange struct {
+	Seq       int64   `json:"seq"`
+	DiagramID string  `json:"diagramId"`
+	Action    string  `json:"action"`
+	At        string  `json:"at"`
+	UpdatedAt *string `json:"updatedAt"`
+}
+
+// handleChanges serves GET /api/changes?since=<seq>, the event log reduced
+// to what a replica or search index needs to follow the diagrams: which
+// diagram changed, how, and how recent the stored copy is. Consumers fetch
+// the diagram when its updatedAt is newer than theirs and drop it on
+// deleted or purged. Pass the returned next as since to continue; 410 means
+// the changes after since were pruned and the consumer must start over.
+func (a *app) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	since, limit, err := parseEventPage(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if pruned, err := a.eventsPrunedAfter(r.Context(), since); err != nil {
+		writeServerError(w, err)
+		return
+	} else if pruned {
+		writeErrorCode(w, http.StatusGone, codeEventsPruned, "changes after since have been pruned; start again without since")
+		return
+	}
+
+	changes, err := a.listChanges(r.Context(), since, limit)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"changes": changes,
+		"next":    next,
+	})
+}
+
+// listChanges returns up to limit changes after since, oldest first.
+func (a *app) listChanges(ctx context.Context, since int64, limit int) ([]diagramChange, error) {
+	const query = `
+SELECT e.seq, e.diagram_id, e.type, e.at, d.updated_at
+FROM events e
+LEFT JOIN diagrams d ON d.id = e.diagram_id
+WHERE e.seq > ?
+ORDER BY e.seq
+LIMIT ?`
+	rows, err := a.db.QueryContext(ctx, query, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]diagramChange, 0)
+	for rows.Next() {
+		var change diagramChange
+		var eventType string
+		var updatedAt sql.NullString
+		if err := rows.Scan(&change.Seq, &change.DiagramID, &eventType, &change.At, &updatedAt); err != nil {
+			return nil, err
+		}
+		change.Action = strings.TrimPrefix(eventType, "diagram.")
+		if updatedAt.Valid {
+			change.UpdatedAt = &updatedAt.String
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	chatFormatSlack      = "slack"
+	chatFormatMattermost = "mattermost"
+)
+
+// chatNotifier posts a one-line message per diagram event to a Slack or
+// Mattermost incoming webhook.
+type chatNotifier struct {
+	url       string
+	format    string
+	events    []string
+	publicURL string
+	client    *http.Client
+}
+
+// newChatNotifier returns nil when no chat webhook is configured.
+func newChatNotifier(cfg config) (*chatNotifier, error) {
+	if cfg.Chat.WebhookURL == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(cfg.Chat.WebhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid CHAT_WEBHOOK_URL %q", cfg.Chat.WebhookURL)
+	}
+	format := strings.ToLower(cfg.Chat.Format)
+	if format != chatFormatSlack && format != chatFormatMattermost {
+		return nil, fmt.Errorf("invalid CHAT_FORMAT %q: use %q or %q", cfg.Chat.Format, chatFormatSlack, chatFormatMattermost)
+	}
+	for _, eventType := range cfg.Chat.Events {
+		if !slices.Contains(diagramEventTypes, eventType) {
+			return nil, fmt.Errorf("unknown CHAT_EVENTS entry %q (use %s)", eventType, strings.Join(diagramEventTypes, ", "))
+		}
+	}
+	return &chatNotifier{
+		url:       cfg.Chat.WebhookURL,
+		format:    format,
+		events:    cfg.Chat.Events,
+		publicURL: strings.TrimRight(cfg.PublicURL, "/"),
+		client:    &http.Client{Timeout: deliveryTimeout},
+	}, nil
+}
+
+func (a *app) runChatNotifier(ctx context.Context) {
+	n := a.chat
+	a.followEvents(ctx, "chat:"+n.url, func(ctx context.Context, event diagramEvent) bool {
+		if len(n.events) > 0 && !slices.Contains(n.events, event.Type) {
+			return true
+		}
+		body, err := json.Marshal(map[string]string{"text": n.message(event)})
+		if err != nil {
+			slog.Error("encode chat message failed", "error", err)
+			return true
+		}
+		return postWithRetry(ctx, n.client, n.url, nil, body, "type", event.Type, "seq", event.Seq, "diagram_id", event.DiagramID)
+	})
+}
+
+// message renders e.g. "Diagram *Shop* was saved by alice", linking the
+// name to the diagram when PUBLIC_URL is set and the diagram still exists.
+func (n *chatNotifier) message(event diagramEvent) string {
+	name := event.DiagramName
+	if name == "" {
+		name = event.DiagramID
+	}
+	link := diagramLink(n.publicURL, event)
+
+	var text string
+	switch n.format {
+	case chatFormatMattermost:
+		name = "**" + escapeMarkdown(name) + "**"
+		if link != "" {
+			name = "[" + name + "](" + link + ")"
+		}
+		text = "Diagram " + name + " was " + diagramEventVerbs[event.Type]
+		if event.Actor != "" {
+			text += " by " + escapeMarkdown(event.Actor)
+		}
+	default:
+		name = escapeSlack(name)
+		if link != "" {
+			name = "<" + link + "|" + name + ">"
+		}
+		text = "Diagram *" + name + "* was " + diagramEventVerbs[event.Type]
+		if event.Actor != "" {
+			text += " by " + escapeSlack(event.Actor)
+		}
+	}
+	return text
+}
+
+// escapeSlack escapes the characters Slack's mrkdwn treats as control
+// sequences.
+func escapeSlack(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(value)
+}
+
+func escapeMarkdown(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "`", "\\`").Replace(value)
+}
@@ -0,0 +1,251 @@
+// Package client talks to the ChartDB backend API, so Go programs and tests
+// do not have to build HTTP requests by hand.
+//
+//	c := client.New("http://localhost:8080", nil)
+//	diagrams, err := c.ListDiagrams(ctx, nil)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New returns a client for the server at baseURL, including any BASE_PATH
+// (e.g. "https://example.com/chartdb"). A nil httpClient uses
+// http.DefaultClient; pass one with a TLS config to authenticate with a
+// client certificate.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/") + "/api/v1",
+		httpClient: httpClient,
+	}
+}
+
+// Error is an error response from the server. Code is the server's error
+// code, such as "DIAGRAM_NOT_FOUND" or "PAYLOAD_INVALID"; Details names the
+// request fields that failed validation.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    []ErrorDetail
+	RequestID  string
+}
+
+// ErrorDetail is a problem with one request field.
+type ErrorDetail struct {
+	Field string `json:"field"`
+	Issue string `json:"issue"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("chartdb: %d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("chartdb: %d %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// DiagramMeta is a diagram without its tables and relationships, as listed
+// by ListDiagrams.
+type DiagramMeta struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	DatabaseType    string `json:"databaseType"`
+	DatabaseEdition string `json:"databaseEdition,omitempty"`
+	CreatedAt       string `json:"createdAt"`
+	UpdatedAt       string `json:"updatedAt"`
+	Archived        bool   `json:"archived"`
+	FolderID        string `json:"folderId,omitempty"`
+	Starred         bool   `json:"starred"`
+	// PayloadBytes is the size of the stored diagram payload.
+	PayloadBytes int64 `json:"payloadBytes"`
+}
+
+// Version describes one saved version of a diagram.
+type Version struct {
+	ID        int64  `json:"id"`
+	DiagramID string `json:"diagramId"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	Message   string `json:"message,omitempty"`
+	Pinned    bool   `json:"pinned"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// ListOptions filters ListDiagrams. The zero value lists every diagram that
+// is not archived.
+type ListOptions struct {
+	IncludeArchived bool
+	// FolderID lists one folder; "root" lists diagrams outside any folder.
+	FolderID string
+	Starred  bool
+}
+
+// ListDiagrams lists diagram metadata, most recently updated first.
+func (c *Client) ListDiagrams(ctx context.Context, opts *ListOptions) ([]DiagramMeta, error) {
+	query := url.Values{}
+	if opts != nil {
+		if opts.IncludeArchived {
+			query.Set("includeArchived", "true")
+		}
+		if opts.FolderID != "" {
+			query.Set("folderId", opts.FolderID)
+		}
+		if opts.Starred {
+			query.Set("starred", "true")
+		}
+	}
+	path := "/diagrams"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	diagrams := make([]DiagramMeta, 0)
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &diagrams); err != nil {
+		return nil, err
+	}
+	return diagrams, nil
+}
+
+// GetDiagram returns the current version of a diagram.
+func (c *Client) GetDiagram(ctx context.Context, id string) (*Diagram, error) {
+	var diagram Diagram
+	if err := c.do(ctx, http.MethodGet, diagramPath(id), nil, nil, &diagram); err != nil {
+		return nil, err
+	}
+	return &diagram, nil
+}
+
+// SaveDiagram stores diagram as a new version, creating the diagram when the
+// server does not have it yet. A diagram without an ID gets one from the
+// server. message is stored with the version and may be empty; the server
+// does not store one for the first version. It returns the diagram as
+// stored.
+func (c *Client) SaveDiagram(ctx context.Context, diagram *Diagram, message string) (*Diagram, error) {
+	body, err := json.Marshal(diagram)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if message != "" {
+		header.Set("X-Version-Message", message)
+	}
+
+	var saved Diagram
+	if diagram.ID != "" {
+		err = c.do(ctx, http.MethodPut, diagramPath(diagram.ID), header, body, &saved)
+		if !IsNotFound(err) {
+			if err != nil {
+				return nil, err
+			}
+			return &saved, nil
+		}
+	}
+	if err := c.do(ctx, http.MethodPost, "/diagrams", header, body, &saved); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// ListVersions lists a diagram's versions, newest first.
+func (c *Client) ListVersions(ctx context.Context, diagramID string) ([]Version, error) {
+	versions := make([]Version, 0)
+	if err := c.do(ctx, http.MethodGet, diagramPath(diagramID)+"/versions", nil, nil, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// RestoreVersion makes a version the current diagram, recording the restore
+// as a new version, and returns the restored diagram.
+func (c *Client) RestoreVersion(ctx context.Context, diagramID string, versionID int64) (*Diagram, error) {
+	path := diagramPath(diagramID) + "/versions/" + strconv.FormatInt(versionID, 10) + "/restore"
+	var diagram Diagram
+	if err := c.do(ctx, http.MethodPost, path, nil, nil, &diagram); err != nil {
+		return nil, err
+	}
+	return &diagram, nil
+}
+
+func diagramPath(id string) string {
+	return "/diagrams/" + url.PathEscape(id)
+}
+
+// do sends a request to the API and decodes a successful JSON response into
+// out. Error responses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+		var envelope struct {
+			Error struct {
+				Code      string        `json:"code"`
+				Message   string        `json:"message"`
+				Details   []ErrorDetail `json:"details"`
+				RequestID string        `json:"requestId"`
+			} `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error.Message != "" {
+			apiErr.Code = envelope.Error.Code
+			apiErr.Message = envelope.Error.Message
+			apiErr.Details = envelope.Error.Details
+			if envelope.Error.RequestID != "" {
+				apiErr.RequestID = envelope.Error.RequestID
+			}
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+			if apiErr.Message == "" {
+				apiErr.Message = http.StatusText(resp.StatusCode)
+			}
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,63 @@
+package client
+
+import "encoding/json"
+
+// Diagram is a ChartDB diagram document. The fields every diagram has are
+// decoded into the struct; everything else, such as tables and
+// relationships, is kept in Extra, so a diagram read with GetDiagram and
+// written back with SaveDiagram loses nothing.
+type Diagram struct {
+	ID              string
+	Name            string
+	DatabaseType    string
+	DatabaseEdition string
+	CreatedAt       string
+	UpdatedAt       string
+
+	Extra map[string]json.RawMessage
+}
+
+// diagramFields lists the document keys held in Diagram's own fields.
+var diagramFields = []string{"id", "name", "databaseType", "databaseEdition", "createdAt", "updatedAt"}
+
+func (d *Diagram) UnmarshalJSON(data []byte) error {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	targets := []*string{&d.ID, &d.Name, &d.DatabaseType, &d.DatabaseEdition, &d.CreatedAt, &d.UpdatedAt}
+	for i, key := range diagramFields {
+		*targets[i] = ""
+		raw, ok := doc[key]
+		if !ok {
+			continue
+		}
+		delete(doc, key)
+		if string(raw) == "null" {
+			continue
+		}
+		if err := json.Unmarshal(raw, targets[i]); err != nil {
+			return err
+		}
+	}
+	d.Extra = doc
+	return nil
+}
+
+// MarshalJSON writes Extra with the struct fields on top. Empty fields are
+// left out so the server fills them in.
+func (d Diagram) MarshalJSON() ([]byte, error) {
+	doc := make(map[string]interface{}, len(d.Extra)+len(diagramFields))
+	for key, value := range d.Extra {
+		doc[key] = value
+	}
+	values := []string{d.ID, d.Name, d.DatabaseType, d.DatabaseEdition, d.CreatedAt, d.UpdatedAt}
+	for i, key := range diagramFields {
+		if values[i] == "" {
+			delete(doc, key)
+			continue
+		}
+		doc[key] = values[i]
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxCommentBodyLen      = 10000
+	maxCommentAuthorLen    = 255
+	maxCommentsPerDiagram  = 1000
+	commentAuthorAnonymous = "anonymous"
+)
+
+// diagramComment is reviewer feedback on a diagram. The body is Markdown
+// and is rendered by the client. AuthorID is the identity that wrote it,
+// which is the only one allowed to edit or delete it.
+type diagramComment struct {
+	ID        int64          `json:"id"`
+	DiagramID string         `json:"diagramId"`
+	Anchor    *commentAnchor `json:"anchor,omitempty"`
+	Author    string         `json:"author"`
+	AuthorID  string         `json:"authorId,omitempty"`
+	Body      string         `json:"body"`
+	CreatedAt string         `json:"createdAt"`
+	UpdatedAt string         `json:"updatedAt"`
+}
+
+// commentAnchor ties a comment to a table, or to one of its fields, by the
+// ids in the diagram payload. Comments without one are about the diagram
+// as a whole.
+type commentAnchor struct {
+	TableID string `json:"tableId"`
+	FieldID string `json:"fieldId,omitempty"`
+}
+
+// commentThread is the comments on one anchor. The names come from the
+// current payload; Orphaned is set once the table or field is gone.
+type commentThread struct {
+	Anchor    *commentAnchor   `json:"anchor"`
+	TableName string           `json:"tableName,omitempty"`
+	FieldName string           `json:"fieldName,omitempty"`
+	Orphaned  bool             `json:"orphaned,omitempty"`
+	Comments  []diagramComment `json:"comments"`
+
+	rank []int
+}
+
+// handleDiagramComments serves /api/diagrams/{id}/comments: GET lists the
+// comments oldest first and POST {"body": "...", "author": "...",
+// "anchor": {"tableId": "...", "fieldId": "..."}} adds one. The author is
+// the client identity; anonymous callers may name themselves. An anchor
+// must name a table, and optionally a field, of the current payload.
+func (a *app) handleDiagramComments(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		exists, err := diagramExists(r.Context(), a.db, diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if !exists {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		comments, err := a.listComments(r.Context(), diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, comments)
+	case http.MethodPost:
+		var req struct {
+			Body   string         `json:"body"`
+			Author string         `json:"author"`
+			Anchor *commentAnchor `json:"anchor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		if problem := checkCommentBody(req.Body); problem != "" {
+			writePayloadError(w, invalidField("body", problem))
+			return
+		}
+		if req.Anchor != nil {
+			payload, err := a.getDiagramPayload(r.Context(), diagramID)
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+				return
+			}
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			if field, problem := checkCommentAnchor(payload, req.Anchor); problem != "" {
+				writePayloadError(w, invalidField(field, problem))
+				return
+			}
+		}
+		comment := diagramComment{
+			DiagramID: diagramID,
+			Anchor:    req.Anchor,
+			Author:    strings.TrimSpace(req.Author),
+			AuthorID:  requestUserID(r),
+			Body:      req.Body,
+			CreatedAt: time.Now().UTC().Format(sortableTimeFormat),
+		}
+		comment.UpdatedAt = comment.CreatedAt
+		switch {
+		case comment.AuthorID != "":
+			comment.Author = comment.AuthorID
+		case comment.Author == "":
+			comment.Author = commentAuthorAnonymous
+		case len(comment.Author) > maxCommentAuthorLen:
+			writePayloadError(w, invalidField("author", fmt.Sprintf("must be at most %d bytes", maxCommentAuthorLen)))
+			return
+		}
+
+		var full bool
+		err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+			exists, err := diagramExists(r.Context(), tx, diagramID)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return sql.ErrNoRows
+			}
+			var count int
+			if err := tx.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM diagram_comments WHERE diagram_id = ?`, diagramID).Scan(&count); err != nil {
+				return err
+			}
+			if count >= maxCommentsPerDiagram {
+				full = true
+				return nil
+			}
+			var tableID, fieldID sql.NullString
+			if comment.Anchor != nil {
+				tableID = sql.NullString{String: comment.Anchor.TableID, Valid: true}
+				fieldID = sql.NullString{String: comment.Anchor.FieldID, Valid: comment.Anchor.FieldID != ""}
+			}
+			const query = `
+INSERT INTO diagram_comments (diagram_id, anchor_table_id, anchor_field_id, author, author_id, body, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+			res, err := tx.ExecContext(r.Context(), query, diagramID, tableID, fieldID, comment.Author, comment.AuthorID, comment.Body, comment.CreatedAt, comment.UpdatedAt)
+			if err != nil {
+				return err
+			}
+			comment.ID, err = res.LastInsertId()
+			return err
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if full {
+			writeErrorCode(w, http.StatusConflict, codeConflict, fmt.Sprintf("a diagram can have at most %d comments", maxCommentsPerDiagram))
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(r.URL.Path, "/"), comment.ID))
+		writeJSON(w, http.StatusCreated, comment)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleDiagramComment serves /api/diagrams/{id}/comments/{commentId}:
+// GET reads the comment, PATCH {"body": "..."} edits it and DELETE removes
+// it. Comments written by an identity can only be changed by it.
+func (a *app) handleDiagramComment(w http.ResponseWriter, r *http.Request, diagramID, rawID string) {
+	commentID, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid comment id")
+		return
+	}
+
+	comment, err := a.getComment(r.Context(), diagramID, commentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeErrorCode(w, http.StatusNotFound, codeNotFound, "comment not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, comment)
+		return
+	case http.MethodPatch, http.MethodDelete:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if comment.AuthorID != "" && comment.AuthorID != requestUserID(r) {
+		writeErrorCode(w, http.StatusForbidden, codeForbidden, "only the author can change a comment")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		res, err := a.db.ExecContext(r.Context(), `DELETE FROM diagram_comments WHERE id = ? AND diagram_id = ?`, commentID, diagramID)
+		if err == nil {
+			err = requireRowAffected(res)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "comment not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	if problem := checkCommentBody(req.Body); problem != "" {
+		writePayloadError(w, invalidField("body", problem))
+		return
+	}
+	comment.Body = req.Body
+	comment.UpdatedAt = time.Now().UTC().Format(sortableTimeFormat)
+	res, err := a.db.ExecContext(r.Context(), `UPDATE diagram_comments SET body = ?, updated_at = ? WHERE id = ? AND diagram_id = ?`, comment.Body, comment.UpdatedAt, commentID, diagramID)
+	if err == nil {
+		err = requireRowAffected(res)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeErrorCode(w, http.StatusNotFound, codeNotFound, "comment not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, comment)
+}
+
+// handleCommentThreads serves GET /api/diagrams/{id}/comments/by-anchor:
+// the comments grouped by anchor, the diagram-wide ones first, then tables
+// and their fields in payload order, then anchors that no longer exist.
+func (a *app) handleCommentThreads(w http.ResponseWriter, r *http.Request, diagramID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	payload, err := a.getDiagramPayload(r.Context(), diagramID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	comments, err := a.listComments(r.Context(), diagramID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"diagramId": diagramID,
+		"threads":   groupCommentThreads(doc, comments),
+	})
+}
+
+func groupCommentThreads(doc diagramDoc, comments []diagramComment) []*commentThread {
+	threads := make([]*commentThread, 0)
+	byAnchor := make(map[commentAnchor]*commentThread)
+	for _, comment := range comments {
+		var key commentAnchor
+		if comment.Anchor != nil {
+			key = *comment.Anchor
+		}
+		thread, ok := byAnchor[key]
+		if !ok {
+			thread = newCommentThread(doc, comment.Anchor, len(threads))
+			byAnchor[key] = thread
+			threads = append(threads, thread)
+		}
+		thread.Comments = append(thread.Comments, comment)
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		return slices.Compare(threads[i].rank, threads[j].rank) < 0
+	})
+	return threads
+}
+
+// newCommentThread resolves an anchor against the payload. rank orders
+// threads: diagram-wide, then by table and field position, then orphaned
+// ones in the order they were first commented on.
+func newCommentThread(doc diagramDoc, anchor *commentAnchor, seen int) *commentThread {
+	thread := &commentThread{Anchor: anchor, Comments: make([]diagramComment, 0, 1)}
+	if anchor == nil {
+		thread.rank = []int{0}
+		return thread
+	}
+	thread.Orphaned = true
+	thread.rank = []int{2, seen}
+	for tableIndex, table := range doc.Tables {
+		if table.ID != anchor.TableID {
+			continue
+		}
+		thread.TableName = table.Name
+		if anchor.FieldID == "" {
+			thread.Orphaned = false
+			thread.rank = []int{1, tableIndex, -1}
+			break
+		}
+		for fieldIndex, field := range table.Fields {
+			if field.ID == anchor.FieldID {
+				thread.FieldName = field.Name
+				thread.Orphaned = false
+				thread.rank = []int{1, tableIndex, fieldIndex}
+			}
+		}
+		break
+	}
+	return thread
+}
+
+// checkCommentAnchor returns the request field and problem when the anchor
+// does not name a table, or a field of it, in the payload.
+func checkCommentAnchor(payload []byte, anchor *commentAnchor) (string, string) {
+	if anchor.TableID == "" {
+		return "anchor.tableId", "is required"
+	}
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		return "anchor", err.Error()
+	}
+	table, ok := doc.tableByID(anchor.TableID)
+	if !ok {
+		return "anchor.tableId", "does not name a table of the diagram"
+	}
+	if anchor.FieldID != "" {
+		if _, ok := table.fieldByID(anchor.FieldID); !ok {
+			return "anchor.fieldId", "does not name a field of the table"
+		}
+	}
+	return "", ""
+}
+
+func checkCommentBody(body string) string {
+	switch {
+	case strings.TrimSpace(body) == "":
+		return "is required"
+	case utf8.RuneCountInString(body) > maxCommentBodyLen:
+		return fmt.Sprintf("must be at most %d characters", maxCommentBodyLen)
+	}
+	return ""
+}
+
+const commentColumns = `id, diagram_id, anchor_table_id, anchor_field_id, author, COALESCE(author_id, ''), body, created_at, updated_at`
+
+func scanComment(row interface{ Scan(...interface{}) error }) (diagramComment, error) {
+	var comment diagramComment
+	var tableID, fieldID sql.NullString
+	err := row.Scan(&comment.ID, &comment.DiagramID, &tableID, &fieldID, &comment.Author, &comment.AuthorID, &comment.Body, &comment.CreatedAt, &comment.UpdatedAt)
+	if tableID.Valid {
+		comment.Anchor = &commentAnchor{TableID: tableID.String, FieldID: fieldID.String}
+	}
+	return comment, err
+}
+
+func (a *app) listComments(ctx context.Context, diagramID string) ([]diagramComment, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT `+commentColumns+` FROM diagram_comments WHERE diagram_id = ? ORDER BY id`, diagramID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]diagramComment, 0)
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+func (a *app) getComment(ctx context.Context, diagramID string, commentID int64) (diagramComment, error) {
+	const query = `SELECT ` + commentColumns + ` FROM diagram_comments WHERE id = ? AND diagram_id = ?`
+	return scanComment(a.db.QueryRowContext(ctx, query, commentID, diagramID))
+}
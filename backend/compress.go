@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+func isKnownCompression(value string) bool {
+	return value == compressionNone || value == compressionGzip
+}
+
+// storedPayload encodes blob content for writing. Plain
+// payloads stay TEXT so the database remains readable with the sqlite CLI;
+// compressed and encrypted payloads are written as BLOBs.
+func (a *app) storedPayload(payload []byte) (interface{}, error) {
+	gzipped := a.payloadCompression == compressionGzip
+	content := payload
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		content = buf.Bytes()
+	}
+	if a.payloadKeys.sealing() {
+		return a.payloadKeys.seal(content, gzipped)
+	}
+	if !gzipped {
+		return string(content), nil
+	}
+	return content, nil
+}
+
+// decodePayload reverses storedPayload. Compression is detected from the
+// gzip magic bytes, which can never start a JSON document, so rows written
+// under either setting can be read back; encrypted payloads carry their own
+// header.
+func (a *app) decodePayload(raw []byte) ([]byte, error) {
+	if isEncryptedPayload(raw) {
+		content, err := a.payloadKeys.open(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = content
+	}
+	if len(raw) < 2 || raw[0] != 0x1f || raw[1] != 0x8b {
+		return raw, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// migratePayloads rewrites stored blobs written under a different
+// compression or encryption setting than the current one.
+func (a *app) migratePayloads(ctx context.Context) (int, error) {
+	hashes, err := a.staleBlobHashes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+
+	err = a.inTx(ctx, func(tx *sql.Tx) error {
+		for _, hash := range hashes {
+			if err := a.rewriteBlob(ctx, tx, hash); err != nil {
+				return fmt.Errorf("blob %s: %w", hash, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("rewrote payloads", "count", len(hashes), "compression", a.payloadCompression, "encrypted", a.payloadKeys.sealing())
+	return len(hashes), nil
+}
+
+// staleBlobHashes finds the blobs migratePayloads has to rewrite. Only
+// compressed and encrypted payloads are BLOBs, and encrypted ones start
+// with a header naming the key and whether the content is compressed.
+func (a *app) staleBlobHashes(ctx context.Context) ([]string, error) {
+	gzipped := a.payloadCompression == compressionGzip
+	var (
+		query string
+		args  []interface{}
+	)
+	switch {
+	case a.payloadKeys.sealing():
+		header := a.payloadKeys.header(gzipped)
+		query = `SELECT hash FROM blobs WHERE typeof(payload) != 'blob' OR substr(payload, 1, ?) != ?`
+		args = []interface{}{len(header), header}
+	case gzipped:
+		query = `SELECT hash FROM blobs WHERE typeof(payload) != 'blob' OR substr(payload, 1, ?) = ?`
+		args = []interface{}{len(encryptedPayloadMagic), []byte(encryptedPayloadMagic)}
+	default:
+		query = `SELECT hash FROM blobs WHERE typeof(payload) = 'blob'`
+	}
+
+	rows, err := a.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make([]string, 0)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+func (a *app) rewriteBlob(ctx context.Context, tx *sql.Tx, hash string) error {
+	var raw []byte
+	if err := tx.QueryRowContext(ctx, `SELECT payload FROM blobs WHERE hash = ?`, hash).Scan(&raw); err != nil {
+		return err
+	}
+	payload, err := a.decodePayload(raw)
+	if err != nil {
+		return err
+	}
+	stored, err := a.storedPayload(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE blobs SET payload = ? WHERE hash = ?`, stored, hash)
+	return err
+}
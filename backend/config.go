@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config holds every server setting. Values come from the defaults, then
+// the YAML config file, then command-line flags, then environment
+// variables, each layer overriding the previous one.
+type config struct {
+	Port     string `yaml:"port"`
+	DataDir  string `yaml:"dataDir"`
+	BasePath string `yaml:"basePath"`
+	// PublicURL is where users reach the UI, for links in notifications.
+	PublicURL string `yaml:"publicUrl"`
+
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	// ReadOnly refuses writes, e.g. during migrations and restores.
+	ReadOnly bool `yaml:"readOnly"`
+
+	Log struct {
+		Level  string `yaml:"level"`
+		Access string `yaml:"access"`
+	} `yaml:"log"`
+
+	Versions struct {
+		MaxPerDiagram    int    `yaml:"maxPerDiagram"`
+		MaxAge           string `yaml:"maxAge"`
+		SnapshotInterval int    `yaml:"snapshotInterval"`
+	} `yaml:"versions"`
+
+	Payload struct {
+		Compression     string `yaml:"compression"`
+		MaxBytes        int    `yaml:"maxBytes"`
+		MaxDiagramBytes int    `yaml:"maxDiagramBytes"`
+
+		Encryption struct {
+			Key          string   `yaml:"key"`
+			KeyFile      string   `yaml:"keyFile"`
+			PreviousKeys []string `yaml:"previousKeys"`
+		} `yaml:"encryption"`
+	} `yaml:"payload"`
+
+	Trash struct {
+		Retention string `yaml:"retention"`
+	} `yaml:"trash"`
+
+	Events struct {
+		Retention string `yaml:"retention"`
+	} `yaml:"events"`
+
+	SQLite struct {
+		BusyTimeout        string `yaml:"busyTimeout"`
+		CacheSize          int    `yaml:"cacheSize"`
+		Synchronous        string `yaml:"synchronous"`
+		MaxOpenConns       int    `yaml:"maxOpenConns"`
+		CheckpointInterval string `yaml:"checkpointInterval"`
+	} `yaml:"sqlite"`
+
+	Backup struct {
+		Dir      string `yaml:"dir"`
+		Schedule string `yaml:"schedule"`
+		Keep     int    `yaml:"keep"`
+
+		S3 struct {
+			Endpoint        string `yaml:"endpoint"`
+			Region          string `yaml:"region"`
+			Bucket          string `yaml:"bucket"`
+			Prefix          string `yaml:"prefix"`
+			AccessKeyID     string `yaml:"accessKeyId"`
+			SecretAccessKey string `yaml:"secretAccessKey"`
+			PathStyle       bool   `yaml:"pathStyle"`
+			ExportDiagrams  bool   `yaml:"exportDiagrams"`
+		} `yaml:"s3"`
+	} `yaml:"backup"`
+
+	// APITokens lists the bearer tokens the server accepts; it can only be
+	// set in the config file.
+	APITokens []apiTokenConfig `yaml:"apiTokens"`
+
+	// Webhooks lists webhook targets; WEBHOOK_URL adds one more.
+	Webhooks []webhookTarget `yaml:"webhooks"`
+	Webhook  struct {
+		URL    string   `yaml:"-"`
+		Secret string   `yaml:"-"`
+		Events []string `yaml:"-"`
+	} `yaml:"-"`
+
+	Chat struct {
+		WebhookURL string   `yaml:"webhookUrl"`
+		Format     string   `yaml:"format"`
+		Events     []string `yaml:"events"`
+	} `yaml:"chat"`
+
+	SMTP struct {
+		Host           string `yaml:"host"`
+		Port           int    `yaml:"port"`
+		Username       string `yaml:"username"`
+		Password       string `yaml:"password"`
+		From           string `yaml:"from"`
+		TLS            string `yaml:"tls"`
+		DigestInterval string `yaml:"digestInterval"`
+	} `yaml:"smtp"`
+
+	Replication struct {
+		Enabled          bool   `yaml:"enabled"`
+		SyncInterval     string `yaml:"syncInterval"`
+		SnapshotInterval string `yaml:"snapshotInterval"`
+		RestoreTimestamp string `yaml:"restoreTimestamp"`
+	} `yaml:"replication"`
+
+	TLS struct {
+		Cert             string   `yaml:"cert"`
+		Key              string   `yaml:"key"`
+		ClientCA         string   `yaml:"clientCA"`
+		ClientAuth       string   `yaml:"clientAuth"`
+		ClientIdentities []string `yaml:"clientIdentities"`
+		Autocert         struct {
+			Domains  []string `yaml:"domains"`
+			CacheDir string   `yaml:"cacheDir"`
+			Email    string   `yaml:"email"`
+			HTTPAddr string   `yaml:"httpAddr"`
+		} `yaml:"autocert"`
+	} `yaml:"tls"`
+
+	CORS struct {
+		AllowedOrigins   []string `yaml:"allowedOrigins"`
+		AllowedMethods   []string `yaml:"allowedMethods"`
+		AllowedHeaders   []string `yaml:"allowedHeaders"`
+		AllowCredentials bool     `yaml:"allowCredentials"`
+		MaxAge           int      `yaml:"maxAge"`
+	} `yaml:"cors"`
+
+	UI struct {
+		Dir               string `yaml:"dir"`
+		APIBaseURL        string `yaml:"apiBaseUrl"`
+		OpenAIAPIKey      string `yaml:"openaiApiKey"`
+		OpenAIAPIEndpoint string `yaml:"openaiApiEndpoint"`
+		LLMModelName      string `yaml:"llmModelName"`
+		HideChartDBCloud  string `yaml:"hideChartdbCloud"`
+		DisableAnalytics  string `yaml:"disableAnalytics"`
+	} `yaml:"ui"`
+
+	AI struct {
+		Provider   string `yaml:"provider"`
+		BaseURL    string `yaml:"baseUrl"`
+		APIKey     string `yaml:"apiKey"`
+		Model      string `yaml:"model"`
+		APIVersion string `yaml:"apiVersion"`
+		Timeout    string `yaml:"timeout"`
+	} `yaml:"ai"`
+
+	Introspection struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"introspection"`
+
+	APIDocs struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"apiDocs"`
+
+	API struct {
+		LegacySunset string `yaml:"legacySunset"`
+	} `yaml:"api"`
+
+	Health struct {
+		MinFreeBytes int `yaml:"minFreeBytes"`
+	} `yaml:"health"`
+
+	Shutdown struct {
+		DrainDelay string `yaml:"drainDelay"`
+		Timeout    string `yaml:"timeout"`
+	} `yaml:"shutdown"`
+
+	Locks struct {
+		Enforce bool `yaml:"enforce"`
+	} `yaml:"locks"`
+
+	Session struct {
+		TTL            string `yaml:"ttl"`
+		CookieSameSite string `yaml:"cookieSameSite"`
+	} `yaml:"session"`
+
+	SAML struct {
+		EntityID          string `yaml:"entityId"`
+		IdPEntityID       string `yaml:"idpEntityId"`
+		IdPSSOURL         string `yaml:"idpSsoUrl"`
+		IdPCert           string `yaml:"idpCert"`
+		IdentityAttribute string `yaml:"identityAttribute"`
+	} `yaml:"saml"`
+
+	Anonymous struct {
+		Access   string   `yaml:"access"`
+		Diagrams []string `yaml:"diagrams"`
+	} `yaml:"anonymous"`
+
+	Freeze struct {
+		Identities []string `yaml:"identities"`
+	} `yaml:"freeze"`
+
+	Review struct {
+		Approvers         []string `yaml:"approvers"`
+		RequiredApprovals int      `yaml:"requiredApprovals"`
+	} `yaml:"review"`
+
+	Attachments struct {
+		MaxBytes int `yaml:"maxBytes"`
+	} `yaml:"attachments"`
+
+	Quotas struct {
+		MaxDiagrams        int `yaml:"maxDiagrams"`
+		MaxDiagramsPerUser int `yaml:"maxDiagramsPerUser"`
+		MaxVersions        int `yaml:"maxVersions"`
+		MaxStorageBytes    int `yaml:"maxStorageBytes"`
+	} `yaml:"quotas"`
+
+	GRPC struct {
+		Port string `yaml:"port"`
+	} `yaml:"grpc"`
+
+	Debug struct {
+		Addr  string `yaml:"addr"`
+		Token string `yaml:"token"`
+	} `yaml:"debug"`
+
+	Tracing struct {
+		Endpoint       string `yaml:"endpoint"`
+		TracesEndpoint string `yaml:"tracesEndpoint"`
+		Headers        string `yaml:"headers"`
+		ServiceName    string `yaml:"serviceName"`
+	} `yaml:"tracing"`
+}
+
+// setting ties a config field to its environment variable and flag.
+// target is a *string, *int, *bool or *[]string into the config struct.
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	target interface{}
+}
+
+func defaultConfig() config {
+	var cfg config
+	cfg.Port = defaultPort
+	cfg.DataDir = defaultDataDir
+	cfg.Log.Level = defaultLogLevel
+	cfg.Log.Access = accessLogJSON
+	cfg.Versions.MaxPerDiagram = defaultMaxVersionsPerDiagram
+	cfg.Versions.SnapshotInterval = defaultSnapshotInterval
+	cfg.Payload.Compression = compressionNone
+	cfg.Payload.MaxBytes = defaultMaxPayloadBytes
+	cfg.Trash.Retention = defaultTrashRetention
+	cfg.Events.Retention = defaultEventRetention
+	cfg.SQLite.BusyTimeout = defaultBusyTimeout.String()
+	cfg.SQLite.Synchronous = defaultSQLiteSynchronous
+	cfg.SQLite.MaxOpenConns = defaultSQLiteMaxOpenConns
+	cfg.SQLite.CheckpointInterval = defaultWALCheckpointInterval.String()
+	cfg.Backup.Keep = defaultBackupKeep
+	cfg.Chat.Format = chatFormatSlack
+	cfg.SMTP.Port = defaultSMTPPort
+	cfg.SMTP.TLS = smtpTLSStartTLS
+	cfg.SMTP.DigestInterval = defaultEmailDigestInterval.String()
+	cfg.Replication.SyncInterval = defaultReplicationSyncInterval.String()
+	cfg.Replication.SnapshotInterval = defaultReplicationSnapshotInterval.String()
+	cfg.CORS.AllowedOrigins = []string{"*"}
+	cfg.CORS.AllowedMethods = splitList(defaultCORSAllowedMethods)
+	cfg.CORS.AllowedHeaders = splitList(defaultCORSAllowedHeaders)
+	cfg.Tracing.ServiceName = defaultTraceServiceName
+	cfg.API.LegacySunset = defaultLegacyAPISunset
+	cfg.Health.MinFreeBytes = defaultHealthMinFreeBytes
+	cfg.Session.TTL = defaultSessionTTL.String()
+	cfg.Session.CookieSameSite = "lax"
+	cfg.Shutdown.DrainDelay = defaultShutdownDrainDelay.String()
+	cfg.Shutdown.Timeout = defaultShutdownTimeout.String()
+	cfg.AI.Timeout = defaultAITimeout.String()
+	cfg.Attachments.MaxBytes = defaultMaxAttachmentBytes
+	cfg.Review.RequiredApprovals = defaultRequiredApprovals
+	return cfg
+}
+
+func (cfg *config) settings() []setting {
+	return []setting{
+		{"PORT", "port", "HTTP port", &cfg.Port},
+		{"DATA_DIR", "data-dir", "directory holding the SQLite database", &cfg.DataDir},
+		{"BASE_PATH", "base-path", "serve everything under this path prefix (e.g. /chartdb)", &cfg.BasePath},
+		{"PUBLIC_URL", "public-url", "URL users open the UI at, used for links in notifications (e.g. https://chartdb.example.com)", &cfg.PublicURL},
+		{"TRUSTED_PROXIES", "trusted-proxies", "comma-separated proxy addresses or CIDRs whose X-Forwarded-* headers are honored", &cfg.TrustedProxies},
+		{"READ_ONLY", "read-only", "refuse writes with 503 while reads keep working (reloadable)", &cfg.ReadOnly},
+		{"LOG_LEVEL", "log-level", "debug, info, warn or error", &cfg.Log.Level},
+		{"ACCESS_LOG", "access-log", "json, clf or off", &cfg.Log.Access},
+		{"MAX_VERSIONS_PER_DIAGRAM", "max-versions-per-diagram", "versions kept per diagram", &cfg.Versions.MaxPerDiagram},
+		{"MAX_VERSION_AGE", "max-version-age", "drop versions older than this (e.g. 90d)", &cfg.Versions.MaxAge},
+		{"VERSION_SNAPSHOT_INTERVAL", "version-snapshot-interval", "store a full snapshot every N versions", &cfg.Versions.SnapshotInterval},
+		{"PAYLOAD_COMPRESSION", "payload-compression", "none or gzip", &cfg.Payload.Compression},
+		{"MAX_PAYLOAD_BYTES", "max-payload-bytes", "largest accepted request body in bytes (0 disables the limit)", &cfg.Payload.MaxBytes},
+		{"MAX_DIAGRAM_BYTES", "max-diagram-bytes", "largest stored diagram payload in bytes, after normalization (0 disables the limit)", &cfg.Payload.MaxDiagramBytes},
+		{"PAYLOAD_ENCRYPTION_KEY", "payload-encryption-key", "encrypt stored payloads with this AES-256 key (64 hex characters or base64)", &cfg.Payload.Encryption.Key},
+		{"PAYLOAD_ENCRYPTION_KEY_FILE", "payload-encryption-key-file", "read the payload encryption key from this file", &cfg.Payload.Encryption.KeyFile},
+		{"PAYLOAD_ENCRYPTION_PREVIOUS_KEYS", "payload-encryption-previous-keys", "comma-separated keys that existing payloads may still be encrypted with", &cfg.Payload.Encryption.PreviousKeys},
+		{"TRASH_RETENTION", "trash-retention", "purge trashed diagrams after this long (0 keeps them)", &cfg.Trash.Retention},
+		{"EVENT_RETENTION", "event-retention", "delete diagram events older than this from the event log (0 keeps them)", &cfg.Events.Retention},
+		{"SQLITE_BUSY_TIMEOUT", "sqlite-busy-timeout", "how long a write waits for the database lock (e.g. 5s)", &cfg.SQLite.BusyTimeout},
+		{"SQLITE_CACHE_SIZE", "sqlite-cache-size", "SQLite page cache per connection: pages, or KiB when negative (0 keeps the default)", &cfg.SQLite.CacheSize},
+		{"SQLITE_SYNCHRONOUS", "sqlite-synchronous", "off, normal, full or extra", &cfg.SQLite.Synchronous},
+		{"SQLITE_MAX_OPEN_CONNS", "sqlite-max-open-conns", "database connection pool size", &cfg.SQLite.MaxOpenConns},
+		{"SQLITE_WAL_CHECKPOINT_INTERVAL", "sqlite-wal-checkpoint-interval", "checkpoint and truncate the WAL this often (0 disables)", &cfg.SQLite.CheckpointInterval},
+		{"BACKUP_DIR", "backup-dir", "directory for database backups (default DATA_DIR/backups)", &cfg.Backup.Dir},
+		{"BACKUP_SCHEDULE", "backup-schedule", "cron expression or @every duration for automatic backups", &cfg.Backup.Schedule},
+		{"BACKUP_KEEP", "backup-keep", "number of backups to keep (0 keeps all)", &cfg.Backup.Keep},
+		{"BACKUP_S3_BUCKET", "backup-s3-bucket", "upload backups to this S3 bucket", &cfg.Backup.S3.Bucket},
+		{"BACKUP_S3_ENDPOINT", "backup-s3-endpoint", "S3 endpoint URL (default AWS for BACKUP_S3_REGION)", &cfg.Backup.S3.Endpoint},
+		{"BACKUP_S3_REGION", "backup-s3-region", "S3 region", &cfg.Backup.S3.Region},
+		{"BACKUP_S3_PREFIX", "backup-s3-prefix", "key prefix for uploaded backups", &cfg.Backup.S3.Prefix},
+		{"BACKUP_S3_ACCESS_KEY_ID", "backup-s3-access-key-id", "S3 access key id", &cfg.Backup.S3.AccessKeyID},
+		{"BACKUP_S3_SECRET_ACCESS_KEY", "backup-s3-secret-access-key", "S3 secret access key", &cfg.Backup.S3.SecretAccessKey},
+		{"BACKUP_S3_PATH_STYLE", "backup-s3-path-style", "use path-style bucket URLs (MinIO)", &cfg.Backup.S3.PathStyle},
+		{"BACKUP_S3_EXPORT_DIAGRAMS", "backup-s3-export-diagrams", "also upload every diagram as JSON with each backup", &cfg.Backup.S3.ExportDiagrams},
+		{"WEBHOOK_URL", "webhook-url", "POST diagram events to this URL", &cfg.Webhook.URL},
+		{"WEBHOOK_SECRET", "webhook-secret", "sign webhook bodies with HMAC-SHA256 using this secret", &cfg.Webhook.Secret},
+		{"WEBHOOK_EVENTS", "webhook-events", "comma-separated events to send to WEBHOOK_URL (default all)", &cfg.Webhook.Events},
+		{"CHAT_WEBHOOK_URL", "chat-webhook-url", "post diagram changes to this Slack or Mattermost incoming webhook", &cfg.Chat.WebhookURL},
+		{"CHAT_FORMAT", "chat-format", "slack or mattermost", &cfg.Chat.Format},
+		{"CHAT_EVENTS", "chat-events", "comma-separated events to post to the chat webhook (default all)", &cfg.Chat.Events},
+		{"SMTP_HOST", "smtp-host", "SMTP server for email notifications to diagram watchers", &cfg.SMTP.Host},
+		{"SMTP_PORT", "smtp-port", "SMTP server port", &cfg.SMTP.Port},
+		{"SMTP_USERNAME", "smtp-username", "SMTP username (PLAIN auth)", &cfg.SMTP.Username},
+		{"SMTP_PASSWORD", "smtp-password", "SMTP password", &cfg.SMTP.Password},
+		{"SMTP_FROM", "smtp-from", "sender address of notification emails", &cfg.SMTP.From},
+		{"SMTP_TLS", "smtp-tls", "starttls, tls or none", &cfg.SMTP.TLS},
+		{"SMTP_DIGEST_INTERVAL", "smtp-digest-interval", "how often digest watchers get their summary email", &cfg.SMTP.DigestInterval},
+		{"REPLICATION_ENABLED", "replication-enabled", "stream the WAL to the backup S3 bucket continuously", &cfg.Replication.Enabled},
+		{"REPLICATION_SYNC_INTERVAL", "replication-sync-interval", "upload new WAL frames this often", &cfg.Replication.SyncInterval},
+		{"REPLICATION_SNAPSHOT_INTERVAL", "replication-snapshot-interval", "start a new replica generation with a full snapshot this often", &cfg.Replication.SnapshotInterval},
+		{"REPLICATION_RESTORE_TIMESTAMP", "replication-restore-timestamp", "when the database is missing, restore the replica as of this RFC 3339 time instead of the latest state", &cfg.Replication.RestoreTimestamp},
+		{"TLS_CERT", "tls-cert", "PEM certificate file; enables HTTPS with TLS_KEY", &cfg.TLS.Cert},
+		{"TLS_KEY", "tls-key", "PEM private key file", &cfg.TLS.Key},
+		{"TLS_CLIENT_CA", "tls-client-ca", "PEM CA bundle client certificates must chain to", &cfg.TLS.ClientCA},
+		{"TLS_CLIENT_AUTH", "tls-client-auth", "require or optional client certificates", &cfg.TLS.ClientAuth},
+		{"TLS_CLIENT_IDENTITIES", "tls-client-identities", "comma-separated CN=identity pairs; other CNs are rejected", &cfg.TLS.ClientIdentities},
+		{"TLS_AUTOCERT_DOMAINS", "tls-autocert-domains", "comma-separated domains to obtain Let's Encrypt certificates for", &cfg.TLS.Autocert.Domains},
+		{"TLS_AUTOCERT_CACHE_DIR", "tls-autocert-cache-dir", "ACME account and certificate cache (default DATA_DIR/autocert)", &cfg.TLS.Autocert.CacheDir},
+		{"TLS_AUTOCERT_EMAIL", "tls-autocert-email", "contact email for the ACME account", &cfg.TLS.Autocert.Email},
+		{"TLS_AUTOCERT_HTTP_ADDR", "tls-autocert-http-addr", "listen address for HTTP-01 challenges and HTTPS redirects (e.g. :80)", &cfg.TLS.Autocert.HTTPAddr},
+		{"CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "comma-separated origins allowed by CORS, or *", &cfg.CORS.AllowedOrigins},
+		{"CORS_ALLOWED_METHODS", "cors-allowed-methods", "comma-separated methods allowed by CORS", &cfg.CORS.AllowedMethods},
+		{"CORS_ALLOWED_HEADERS", "cors-allowed-headers", "comma-separated request headers allowed by CORS", &cfg.CORS.AllowedHeaders},
+		{"CORS_ALLOW_CREDENTIALS", "cors-allow-credentials", "allow cookies and credentials on CORS requests", &cfg.CORS.AllowCredentials},
+		{"CORS_MAX_AGE", "cors-max-age", "seconds browsers may cache preflight responses", &cfg.CORS.MaxAge},
+		{"UI_DIR", "ui-dir", "serve the built frontend from this directory", &cfg.UI.Dir},
+		{"API_BASE_URL", "api-base-url", "API base URL passed to the frontend (default BASE_PATH/api/v1)", &cfg.UI.APIBaseURL},
+		{"OPENAI_API_KEY", "openai-api-key", "OpenAI API key passed to the frontend", &cfg.UI.OpenAIAPIKey},
+		{"OPENAI_API_ENDPOINT", "openai-api-endpoint", "OpenAI-compatible endpoint passed to the frontend", &cfg.UI.OpenAIAPIEndpoint},
+		{"LLM_MODEL_NAME", "llm-model-name", "LLM model name passed to the frontend", &cfg.UI.LLMModelName},
+		{"AI_PROVIDER", "ai-provider", "serve /api/ai through openai, azure or ollama (unset disables it)", &cfg.AI.Provider},
+		{"AI_BASE_URL", "ai-base-url", "base URL of the AI provider's OpenAI-compatible API", &cfg.AI.BaseURL},
+		{"AI_API_KEY", "ai-api-key", "API key for the AI provider; it never reaches the browser", &cfg.AI.APIKey},
+		{"AI_MODEL", "ai-model", "model name, or the deployment name on Azure", &cfg.AI.Model},
+		{"AI_API_VERSION", "ai-api-version", "Azure OpenAI api-version", &cfg.AI.APIVersion},
+		{"AI_TIMEOUT", "ai-timeout", "how long to wait for the AI provider", &cfg.AI.Timeout},
+		{"HIDE_CHARTDB_CLOUD", "hide-chartdb-cloud", "hide ChartDB Cloud links in the frontend (true/false)", &cfg.UI.HideChartDBCloud},
+		{"DISABLE_ANALYTICS", "disable-analytics", "disable frontend analytics (true/false)", &cfg.UI.DisableAnalytics},
+		{"INTROSPECTION_ENABLED", "introspection-enabled", "allow live database introspection and sync", &cfg.Introspection.Enabled},
+		{"API_DOCS_ENABLED", "api-docs-enabled", "serve Swagger UI for the API at /api/docs", &cfg.APIDocs.Enabled},
+		{"LEGACY_API_SUNSET", "legacy-api-sunset", "date announced in the Sunset header of the deprecated unversioned /api paths (empty omits it)", &cfg.API.LegacySunset},
+		{"HEALTH_MIN_FREE_BYTES", "health-min-free-bytes", "report the server as degraded when the data directory has less free disk space than this", &cfg.Health.MinFreeBytes},
+		{"SHUTDOWN_DRAIN_DELAY", "shutdown-drain-delay", "on SIGTERM, fail /readyz for this long before closing the listener", &cfg.Shutdown.DrainDelay},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long in-flight requests may take to finish on shutdown", &cfg.Shutdown.Timeout},
+		{"LOCKS_ENFORCE", "locks-enforce", "reject writes to a locked diagram from anyone but the lock owner", &cfg.Locks.Enforce},
+		{"SESSION_TTL", "session-ttl", "how long a browser session from POST /api/auth/login lasts", &cfg.Session.TTL},
+		{"SESSION_COOKIE_SAMESITE", "session-cookie-samesite", "SameSite attribute of the session cookie: lax, strict or none", &cfg.Session.CookieSameSite},
+		{"SAML_IDP_SSO_URL", "saml-idp-sso-url", "single sign-on URL of the SAML identity provider; enables SAML sign-in", &cfg.SAML.IdPSSOURL},
+		{"SAML_IDP_ENTITY_ID", "saml-idp-entity-id", "entity ID (issuer) of the SAML identity provider", &cfg.SAML.IdPEntityID},
+		{"SAML_IDP_CERT", "saml-idp-cert", "PEM file with the certificates the SAML identity provider signs with", &cfg.SAML.IdPCert},
+		{"SAML_ENTITY_ID", "saml-entity-id", "entity ID of this service provider (default PUBLIC_URL/api/v1/auth/saml/metadata)", &cfg.SAML.EntityID},
+		{"SAML_IDENTITY_ATTRIBUTE", "saml-identity-attribute", "SAML attribute holding the identity (default the NameID)", &cfg.SAML.IdentityAttribute},
+		{"ANONYMOUS_ACCESS", "anonymous-access", "what requests without a client certificate may do: write, read or none", &cfg.Anonymous.Access},
+		{"ANONYMOUS_DIAGRAMS", "anonymous-diagrams", "comma-separated ids of the only diagrams anonymous callers may read (needs ANONYMOUS_ACCESS=read; empty allows all)", &cfg.Anonymous.Diagrams},
+		{"FREEZE_IDENTITIES", "freeze-identities", "comma-separated identities that may freeze and unfreeze diagrams (empty allows anyone)", &cfg.Freeze.Identities},
+		{"REVIEW_APPROVERS", "review-approvers", "comma-separated identities that may approve diagrams in review (empty allows anyone)", &cfg.Review.Approvers},
+		{"REVIEW_REQUIRED_APPROVALS", "review-required-approvals", "approvals a diagram in review needs before it is approved", &cfg.Review.RequiredApprovals},
+		{"ATTACHMENTS_MAX_BYTES", "attachments-max-bytes", "largest file accepted as a diagram attachment", &cfg.Attachments.MaxBytes},
+		{"QUOTA_MAX_DIAGRAMS", "quota-max-diagrams", "most diagrams the server stores, the trash included (0 disables the quota; reloadable)", &cfg.Quotas.MaxDiagrams},
+		{"QUOTA_MAX_DIAGRAMS_PER_USER", "quota-max-diagrams-per-user", "most diagrams one identity may have created, the trash included (0 disables the quota; reloadable)", &cfg.Quotas.MaxDiagramsPerUser},
+		{"QUOTA_MAX_VERSIONS", "quota-max-versions", "most versions the server stores across all diagrams (0 disables the quota; reloadable)", &cfg.Quotas.MaxVersions},
+		{"QUOTA_MAX_STORAGE_BYTES", "quota-max-storage-bytes", "most bytes of diagrams, versions and attachments the server stores (0 disables the quota; reloadable)", &cfg.Quotas.MaxStorageBytes},
+		{"GRPC_PORT", "grpc-port", "serve the gRPC API on this port (unset disables it)", &cfg.GRPC.Port},
+		{"DEBUG_ADDR", "debug-addr", "listen address for pprof and expvar", &cfg.Debug.Addr},
+		{"DEBUG_TOKEN", "debug-token", "bearer token required by the debug listener", &cfg.Debug.Token},
+		{"OTEL_EXPORTER_OTLP_ENDPOINT", "otlp-endpoint", "OTLP/HTTP collector base URL", &cfg.Tracing.Endpoint},
+		{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "otlp-traces-endpoint", "OTLP/HTTP traces URL", &cfg.Tracing.TracesEndpoint},
+		{"OTEL_EXPORTER_OTLP_HEADERS", "otlp-headers", "collector headers as key=value,...", &cfg.Tracing.Headers},
+		{"OTEL_SERVICE_NAME", "otel-service-name", "service name reported in traces", &cfg.Tracing.ServiceName},
+	}
+}
+
+func (s setting) set(value string) error {
+	value = strings.TrimSpace(value)
+	switch target := s.target.(type) {
+	case *string:
+		*target = value
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*target = parsed
+	case *bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*target = parsed
+	case *[]string:
+		*target = splitList(value)
+	}
+	return nil
+}
+
+// splitList parses a comma-separated list, dropping empty entries.
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// loadConfig builds the configuration from args (without the program name).
+// The config file is chosen with -config or CONFIG_FILE.
+func loadConfig(args []string) (config, error) {
+	cfg := defaultConfig()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("chartdb-backend", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a YAML config file (or CONFIG_FILE)")
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		name := s.flag
+		fs.Func(name, s.usage+" ("+s.env+")", func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+	if fs.NArg() > 0 {
+		return config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	path := *configFile
+	if env := strings.TrimSpace(os.Getenv("CONFIG_FILE")); env != "" {
+		path = env
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := flagValues[s.flag]; ok {
+			if err := s.set(value); err != nil {
+				return config{}, fmt.Errorf("-%s: %w", s.flag, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value := strings.TrimSpace(os.Getenv(s.env)); value != "" {
+			if err := s.set(value); err != nil {
+				return config{}, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg *config) loadFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
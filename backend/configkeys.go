@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxConfigStringLen    = 255
+	maxConfigExportAction = 100
+)
+
+// configKeys are the keys PUT /api/config accepts: the frontend's config
+// and the display preferences it may keep on the server. Each check
+// returns what is wrong with a value, or "".
+var configKeys = map[string]func(value interface{}) string{
+	"defaultDiagramId":     configString(maxConfigStringLen),
+	"exportActions":        configTimestamps(maxConfigExportAction),
+	"theme":                configEnum("light", "dark", "system"),
+	"scrollAction":         configEnum("pan", "zoom"),
+	"showDBViews":          configBool,
+	"showCardinality":      configBool,
+	"showFieldAttributes":  configBool,
+	"showMiniMapOnCanvas":  configBool,
+	"githubRepoOpened":     configBool,
+	"starUsDialogLastOpen": configInteger(0, math.MaxInt64),
+}
+
+// validateConfigPatch checks every key of a config update and returns one
+// detail per unknown or malformed key, sorted by key.
+func validateConfigPatch(patch map[string]interface{}) []errorDetail {
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []errorDetail
+	for _, key := range keys {
+		check, known := configKeys[key]
+		if !known {
+			problems = append(problems, errorDetail{Field: key, Issue: "is not a known config key"})
+			continue
+		}
+		if problem := check(patch[key]); problem != "" {
+			problems = append(problems, errorDetail{Field: key, Issue: problem})
+		}
+	}
+	return problems
+}
+
+// dropInvalidConfig removes the keys configKeys would reject from config
+// stored before keys were checked, so clients that send back the whole
+// config they read are not refused for it, and the next write cleans the
+// row.
+func dropInvalidConfig(config map[string]interface{}) {
+	for key, value := range config {
+		if check, known := configKeys[key]; !known || check(value) != "" {
+			delete(config, key)
+		}
+	}
+}
+
+// configInvalidError rejects a config update with unknown or malformed
+// keys; nothing is stored.
+type configInvalidError struct {
+	problems []errorDetail
+}
+
+func (e *configInvalidError) Error() string {
+	parts := make([]string, len(e.problems))
+	for i, problem := range e.problems {
+		parts[i] = problem.Field + " " + problem.Issue
+	}
+	return "invalid config: " + strings.Join(parts, "; ")
+}
+
+func writeConfigError(w http.ResponseWriter, err error) {
+	var invalid *configInvalidError
+	if errors.As(err, &invalid) {
+		writeAPIError(w, http.StatusUnprocessableEntity, codeConfigInvalid, invalid.Error(), invalid.problems)
+		return
+	}
+	writeServerError(w, err)
+}
+
+func configString(maxLen int) func(interface{}) string {
+	return func(value interface{}) string {
+		s, ok := value.(string)
+		if !ok {
+			return "must be a string"
+		}
+		if len(s) > maxLen {
+			return fmt.Sprintf("must be at most %d characters", maxLen)
+		}
+		return ""
+	}
+}
+
+func configEnum(options ...string) func(interface{}) string {
+	return func(value interface{}) string {
+		s, _ := value.(string)
+		for _, option := range options {
+			if s == option {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(options, ", ")
+	}
+}
+
+func configBool(value interface{}) string {
+	if _, ok := value.(bool); !ok {
+		return "must be a boolean"
+	}
+	return ""
+}
+
+func configInteger(min, max float64) func(interface{}) string {
+	return func(value interface{}) string {
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) || n < min || n > max {
+			return fmt.Sprintf("must be an integer of at least %.0f", min)
+		}
+		return ""
+	}
+}
+
+func configTimestamps(maxItems int) func(interface{}) string {
+	return func(value interface{}) string {
+		items, ok := value.([]interface{})
+		if !ok {
+			return "must be an array of RFC 3339 timestamps"
+		}
+		if len(items) > maxItems {
+			return fmt.Sprintf("must list at most %d timestamps", maxItems)
+		}
+		for _, item := range items {
+			s, _ := item.(string)
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return "must be an array of RFC 3339 timestamps"
+			}
+		}
+		return ""
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultCORSAllowedMethods = "GET,POST,PUT,PATCH,DELETE,OPTIONS"
+	defaultCORSAllowedHeaders = "Content-Type,Authorization,X-Version-Message,X-Request-ID,Idempotency-Key,If-None-Match,If-Modified-Since,Prefer,X-Lock-Owner,X-CSRF-Token"
+	corsExposedHeaders        = "X-Request-ID, Deprecation, Sunset, Link, Idempotent-Replayed, ETag, Preference-Applied"
+)
+
+// corsPolicy decides which browser origins may call the API. A single "*"
+// origin allows any origin without credentials, which is the default.
+type corsPolicy struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	allowedMethods   string
+	allowedHeaders   string
+	allowCredentials bool
+	maxAge           int
+}
+
+func newCORSPolicy(cfg config) (*corsPolicy, error) {
+	policy := &corsPolicy{
+		origins:          map[string]bool{},
+		allowedMethods:   strings.Join(cfg.CORS.AllowedMethods, ","),
+		allowedHeaders:   strings.Join(cfg.CORS.AllowedHeaders, ","),
+		allowCredentials: cfg.CORS.AllowCredentials,
+		maxAge:           cfg.CORS.MaxAge,
+	}
+	for _, origin := range cfg.CORS.AllowedOrigins {
+		if origin == "*" {
+			policy.anyOrigin = true
+			continue
+		}
+		policy.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if policy.anyOrigin && policy.allowCredentials {
+		return nil, errors.New("CORS_ALLOW_CREDENTIALS requires explicit CORS_ALLOWED_ORIGINS instead of *")
+	}
+	if policy.maxAge < 0 {
+		return nil, errors.New("CORS_MAX_AGE must not be negative")
+	}
+	return policy, nil
+}
+
+func (p *corsPolicy) allowOrigin(origin string) string {
+	if p.anyOrigin {
+		return "*"
+	}
+	if origin != "" && p.origins[origin] {
+		return origin
+	}
+	return ""
+}
+
+func (a *app) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := a.runtime().cors
+		header := w.Header()
+		if !policy.anyOrigin {
+			header.Add("Vary", "Origin")
+		}
+
+		if allowed := policy.allowOrigin(r.Header.Get("Origin")); allowed != "" {
+			header.Set("Access-Control-Allow-Origin", allowed)
+			header.Set("Access-Control-Allow-Methods", policy.allowedMethods)
+			header.Set("Access-Control-Allow-Headers", policy.allowedHeaders)
+			header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			if policy.allowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if r.Method == http.MethodOptions && policy.maxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+			}
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A diagram in CRDT mode is also kept as a set of last-writer-wins
+// registers, one per path such as
+//
+//	name
+//	tables[t1]               the table exists (an item register)
+//	tables[t1].x             a value inside it
+//	tables[t1].fields[f2].type
+//
+// Items are the elements of arrays of objects with ids (tables, fields,
+// relationships, ...); every other value, nested objects included, is one
+// register. Clients send set and delete operations stamped with a Lamport
+// timestamp (counter, replica); the higher timestamp wins per register, so
+// operations can arrive in any order, twice, or concurrently and every
+// replica that has seen the same operations shows the same diagram. A
+// deleted item hides everything below it without deleting it.
+//
+// The stored payload stays the source for every other endpoint: each batch
+// of operations saves the materialized diagram as a version, and saves made
+// without operations (PUT, PATCH, restore) are folded back into the
+// registers as server operations.
+
+const (
+	maxCRDTOps         = 1000
+	maxCRDTReplicaLen  = 64
+	crdtServerReplica  = "server"
+	crdtOpSet          = "set"
+	crdtOpDelete       = "delete"
+	crdtVersionsAction = "crdt"
+)
+
+var errCRDTDisabled = errors.New("diagram is not in CRDT mode")
+
+type crdtRegister struct {
+	Path    string          `json:"path"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	// Order sorts items; it is assigned when an item is first seen.
+	Order   int64  `json:"order,omitempty"`
+	Counter int64  `json:"counter"`
+	Replica string `json:"replica"`
+	Seq     int64  `json:"seq"`
+}
+
+type crdtOp struct {
+	Type    string          `json:"type"`
+	Path    string          `json:"path"`
+	Value   json.RawMessage `json:"value"`
+	Counter int64           `json:"counter"`
+	Replica string          `json:"replica"`
+}
+
+// crdtEntry is a register value derived from a payload or an operation;
+// value is nil for item registers.
+type crdtEntry struct {
+	path  string
+	value []byte
+}
+
+type crdtSegment struct {
+	key string
+	id  string
+}
+
+// crdtState is a diagram's registers, loaded inside a transaction.
+type crdtState struct {
+	diagramID string
+	clock     int64
+	seq       int64
+	nextOrder int64
+	registers map[string]*crdtRegister
+	dirty     map[string]bool
+	// keys seal register values, which hold diagram content.
+	keys *payloadKeyring
+}
+
+// handleDiagramCRDT serves /api/diagrams/{id}/crdt: GET returns the
+// registers (changed after ?since=<seq>), PUT turns CRDT mode on and
+// DELETE turns it off.
+func (a *app) handleDiagramCRDT(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		var since int64
+		if value := r.URL.Query().Get("since"); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || parsed < 0 {
+				writeError(w, http.StatusBadRequest, "since must be a sequence number")
+				return
+			}
+			since = parsed
+		}
+		a.writeCRDTState(w, r, diagramID, since)
+	case http.MethodPut:
+		err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+			return a.enableCRDT(r.Context(), tx, diagramID)
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		a.writeCRDTState(w, r, diagramID, 0)
+	case http.MethodDelete:
+		err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+			return deleteCRDT(r.Context(), tx, diagramID)
+		})
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *app) writeCRDTState(w http.ResponseWriter, r *http.Request, diagramID string, since int64) {
+	var state *crdtState
+	err := a.readTx(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		state, err = a.loadCRDT(r.Context(), tx, diagramID)
+		return err
+	})
+	if errors.Is(err, errCRDTDisabled) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	registers := make([]*crdtRegister, 0)
+	for _, register := range state.registers {
+		if register.Seq > since {
+			registers = append(registers, register)
+		}
+	}
+	sort.Slice(registers, func(i, j int) bool {
+		if registers[i].Seq != registers[j].Seq {
+			return registers[i].Seq < registers[j].Seq
+		}
+		return registers[i].Path < registers[j].Path
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":   true,
+		"clock":     state.clock,
+		"seq":       state.seq,
+		"registers": registers,
+	})
+}
+
+// handleCRDTOps serves POST /api/diagrams/{id}/crdt/ops with {"ops": [{"type":
+// "set", "path": "tables[t1].x", "value": 120, "counter": 7, "replica":
+// "tab-3f"}]}. The operations are applied in one transaction and the
+// resulting diagram is saved; the response carries the server clock, which
+// clients move their counter past.
+func (a *app) handleCRDTOps(w http.ResponseWriter, r *http.Request, diagramID string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Ops []crdtOp `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	if len(req.Ops) == 0 {
+		writePayloadError(w, invalidField("ops", "must list at least one operation"))
+		return
+	}
+	if len(req.Ops) > maxCRDTOps {
+		writePayloadError(w, invalidField("ops", fmt.Sprintf("must list at most %d operations", maxCRDTOps)))
+		return
+	}
+	entries := make([][]crdtEntry, len(req.Ops))
+	for i, op := range req.Ops {
+		opEntries, err := crdtOpEntries(op)
+		if err != nil {
+			var invalid *fieldError
+			if errors.As(err, &invalid) {
+				err = invalidField(fmt.Sprintf("ops[%d].%s", i, invalid.field), invalid.problem)
+			}
+			writePayloadError(w, err)
+			return
+		}
+		entries[i] = opEntries
+	}
+
+	var applied int
+	var state *crdtState
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		var err error
+		state, err = a.loadCRDT(r.Context(), tx, diagramID)
+		if err != nil {
+			return err
+		}
+		applied = 0
+		for i, op := range req.Ops {
+			won := false
+			for _, entry := range entries[i] {
+				if state.write(entry.path, entry.value, op.Type == crdtOpDelete, op.Counter, op.Replica) {
+					won = true
+				}
+			}
+			if won {
+				applied++
+			}
+			state.clock = max(state.clock, op.Counter)
+		}
+		if applied == 0 {
+			return nil
+		}
+
+		now, _ := json.Marshal(time.Now().UTC().Format(time.RFC3339Nano))
+		state.clock++
+		state.write("updatedAt", now, false, state.clock, crdtServerReplica)
+		materialized, err := state.materialize()
+		if err != nil {
+			return err
+		}
+		payload, meta, err := normalizeDiagramPayload(materialized)
+		if err != nil {
+			return err
+		}
+		if err := state.save(r.Context(), tx); err != nil {
+			return err
+		}
+		return a.replaceDiagram(r.Context(), tx, diagramID, payload, meta, crdtVersionsAction, "")
+	})
+	switch {
+	case errors.Is(err, errCRDTDisabled):
+		writeErrorCode(w, http.StatusConflict, codeCRDTDisabled, "diagram is not in CRDT mode; enable it with PUT /api/diagrams/{id}/crdt")
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		return
+	case err != nil:
+		var invalid *fieldError
+		if errors.As(err, &invalid) {
+			writePayloadError(w, err)
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"applied": applied,
+		"clock":   state.clock,
+		"seq":     state.seq,
+	})
+}
+
+// crdtOpEntries validates an operation and returns the registers it
+// writes: one for a value, or an item and everything in it.
+func crdtOpEntries(op crdtOp) ([]crdtEntry, error) {
+	if op.Counter < 1 {
+		return nil, invalidField("counter", "must be a positive Lamport counter")
+	}
+	if op.Replica == "" || len(op.Replica) > maxCRDTReplicaLen || op.Replica == crdtServerReplica {
+		return nil, invalidField("replica", fmt.Sprintf("must be a replica id of at most %d characters other than %q", maxCRDTReplicaLen, crdtServerReplica))
+	}
+	segments, err := parseCRDTPath(op.Path)
+	if err != nil {
+		return nil, invalidField("path", err.Error())
+	}
+	if len(segments) == 1 && segments[0].key == "id" {
+		return nil, invalidField("path", "cannot change the diagram id")
+	}
+	last := segments[len(segments)-1]
+
+	switch op.Type {
+	case crdtOpDelete:
+		return []crdtEntry{{path: op.Path}}, nil
+	case crdtOpSet:
+	default:
+		return nil, invalidField("type", "must be set or delete")
+	}
+	if len(op.Value) == 0 {
+		return nil, invalidField("value", "is required")
+	}
+	value, err := decodeJSONValue(op.Value)
+	if err != nil {
+		return nil, invalidField("value", "must be JSON")
+	}
+	if last.id == "" {
+		if items, ok := value.([]interface{}); ok && len(items) > 0 {
+			if _, hasIDs := arrayItemIDs(items); hasIDs {
+				return nil, invalidField("value", "holds items with ids; set them one at a time")
+			}
+		}
+		canonical, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return []crdtEntry{{path: op.Path, value: canonical}}, nil
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, invalidField("value", "must be an object for an item path")
+	}
+	if id, ok := object["id"]; ok && id != last.id {
+		return nil, invalidField("value.id", "must match the item id in path")
+	}
+	entries := []crdtEntry{{path: op.Path}}
+	if err := flattenCRDT(op.Path, object, &entries); err != nil {
+		return nil, invalidField("value", err.Error())
+	}
+	return entries, nil
+}
+
+// parseCRDTPath splits a register path. Every segment but the last must be
+// an item.
+func parseCRDTPath(path string) ([]crdtSegment, error) {
+	if path == "" {
+		return nil, errors.New("is required")
+	}
+	parts := strings.Split(path, ".")
+	segments := make([]crdtSegment, 0, len(parts))
+	for i, part := range parts {
+		var segment crdtSegment
+		if open := strings.IndexByte(part, '['); open >= 0 {
+			if !strings.HasSuffix(part, "]") {
+				return nil, fmt.Errorf("segment %q is not key or key[id]", part)
+			}
+			segment = crdtSegment{key: part[:open], id: part[open+1 : len(part)-1]}
+			if segment.id == "" || strings.ContainsAny(segment.id, "[]") {
+				return nil, fmt.Errorf("segment %q has an invalid item id", part)
+			}
+		} else {
+			segment.key = part
+		}
+		if segment.key == "" || strings.ContainsAny(segment.key, "[]") {
+			return nil, fmt.Errorf("segment %q has an invalid key", part)
+		}
+		if i < len(parts)-1 && segment.id == "" {
+			return nil, fmt.Errorf("segment %q must be an item, key[id]", part)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// flattenCRDT appends the registers of an object: a value register per key,
+// except arrays of items, which add an item register per element and the
+// element's own registers, in array order.
+func flattenCRDT(prefix string, object map[string]interface{}, out *[]crdtEntry) error {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		if key == "" || strings.ContainsAny(key, ".[]") {
+			return fmt.Errorf("key %q cannot be tracked; keys must not contain '.', '[' or ']'", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		value := object[key]
+		if items, ok := value.([]interface{}); ok && len(items) > 0 {
+			if ids, ok := arrayItemIDs(items); ok && trackableCRDTIDs(ids) {
+				for i, id := range ids {
+					itemPath := path + "[" + id + "]"
+					*out = append(*out, crdtEntry{path: itemPath})
+					if err := flattenCRDT(itemPath, items[i].(map[string]interface{}), out); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+		}
+		canonical, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		*out = append(*out, crdtEntry{path: path, value: canonical})
+	}
+	return nil
+}
+
+func trackableCRDTIDs(ids []string) bool {
+	for _, id := range ids {
+		if id == "" || strings.ContainsAny(id, ".[]") {
+			return false
+		}
+	}
+	return true
+}
+
+// enableCRDT turns CRDT mode on, seeding the registers from the stored
+// payload. It does nothing when the mode is already on.
+func (a *app) enableCRDT(ctx context.Context, tx *sql.Tx, diagramID string) error {
+	payload, err := a.storedPayloadTx(ctx, tx, diagramID)
+	if err != nil {
+		return err
+	}
+	const query = `
+INSERT INTO crdt_documents (diagram_id, clock, seq, next_order, enabled_at)
+VALUES (?, 0, 0, 1, ?)
+ON CONFLICT(diagram_id) DO NOTHING`
+	res, err := tx.ExecContext(ctx, query, diagramID, time.Now().UTC().Format(sortableTimeFormat))
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+	return a.absorbCRDT(ctx, tx, diagramID, payload)
+}
+
+func (a *app) storedPayloadTx(ctx context.Context, tx *sql.Tx, diagramID string) ([]byte, error) {
+	const query = `
+SELECT b.payload
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.id = ?`
+	var raw []byte
+	if err := tx.QueryRowContext(ctx, query, diagramID).Scan(&raw); err != nil {
+		return nil, err
+	}
+	return a.decodePayload(raw)
+}
+
+// absorbCRDT brings the registers of a diagram in CRDT mode in line with a
+// payload saved without operations, writing the differences as server
+// operations that win over everything seen so far. It does nothing for
+// diagrams not in CRDT mode.
+func (a *app) absorbCRDT(ctx context.Context, tx *sql.Tx, diagramID string, payload []byte) error {
+	state, err := a.loadCRDT(ctx, tx, diagramID)
+	if errors.Is(err, errCRDTDisabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	value, err := decodeJSONValue(payload)
+	if err != nil {
+		return err
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.New("diagram payload is not an object")
+	}
+	var entries []crdtEntry
+	if err := flattenCRDT("", object, &entries); err != nil {
+		return err
+	}
+
+	counter := state.clock + 1
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.path] = true
+		register := state.registers[entry.path]
+		if register == nil || register.Deleted || !bytes.Equal(register.Value, entry.value) {
+			state.write(entry.path, entry.value, false, counter, crdtServerReplica)
+		}
+	}
+	for path := range state.registers {
+		if !seen[path] && state.visible(path) {
+			state.write(path, nil, true, counter, crdtServerReplica)
+		}
+	}
+	if len(state.dirty) == 0 {
+		return nil
+	}
+	state.clock = counter
+	return state.save(ctx, tx)
+}
+
+func (a *app) loadCRDT(ctx context.Context, tx *sql.Tx, diagramID string) (*crdtState, error) {
+	state := &crdtState{
+		diagramID: diagramID,
+		registers: map[string]*crdtRegister{},
+		dirty:     map[string]bool{},
+		keys:      a.payloadKeys,
+	}
+	const documentQuery = `SELECT clock, seq, next_order FROM crdt_documents WHERE diagram_id = ?`
+	err := tx.QueryRowContext(ctx, documentQuery, diagramID).Scan(&state.clock, &state.seq, &state.nextOrder)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errCRDTDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	const registerQuery = `
+SELECT path, value, deleted, ord, counter, replica, seq
+FROM crdt_registers
+WHERE diagram_id = ?`
+	rows, err := tx.QueryContext(ctx, registerQuery, diagramID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var register crdtRegister
+		var value []byte
+		if err := rows.Scan(&register.Path, &value, &register.Deleted, &register.Order, &register.Counter, &register.Replica, &register.Seq); err != nil {
+			return nil, err
+		}
+		if value != nil {
+			value, err = state.keys.openValue(value)
+			if err != nil {
+				return nil, err
+			}
+			register.Value = json.RawMessage(value)
+		}
+		state.registers[register.Path] = &register
+	}
+	return state, rows.Err()
+}
+
+// write sets a register when (counter, replica) is later than its current
+// timestamp and reports whether it did.
+func (s *crdtState) write(path string, value []byte, deleted bool, counter int64, replica string) bool {
+	register := s.registers[path]
+	if register == nil {
+		register = &crdtRegister{Path: path}
+		if strings.HasSuffix(path, "]") {
+			register.Order = s.nextOrder
+			s.nextOrder++
+		}
+		s.registers[path] = register
+	} else if counter < register.Counter || (counter == register.Counter && replica <= register.Replica) {
+		return false
+	}
+	register.Counter, register.Replica, register.Deleted = counter, replica, deleted
+	register.Value = nil
+	if !deleted && value != nil {
+		register.Value = json.RawMessage(value)
+	}
+	s.dirty[path] = true
+	return true
+}
+
+// visible reports whether a register shows in the diagram: it and every
+// item above it are not deleted.
+func (s *crdtState) visible(path string) bool {
+	for {
+		register := s.registers[path]
+		if register == nil || register.Deleted {
+			return false
+		}
+		end := strings.LastIndexByte(path, '.')
+		if end < 0 {
+			return true
+		}
+		path = path[:end]
+	}
+}
+
+// save writes the changed registers under the next sequence number.
+func (s *crdtState) save(ctx context.Context, tx *sql.Tx) error {
+	s.seq++
+	const query = `
+INSERT INTO crdt_registers (diagram_id, path, value, deleted, ord, counter, replica, seq)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(diagram_id, path) DO UPDATE SET
+	value = excluded.value,
+	deleted = excluded.deleted,
+	counter = excluded.counter,
+	replica = excluded.replica,
+	seq = excluded.seq`
+	for path := range s.dirty {
+		register := s.registers[path]
+		register.Seq = s.seq
+		var value interface{}
+		if register.Value != nil {
+			var err error
+			if value, err = s.keys.sealValue(register.Value, true); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, query, s.diagramID, path, value, register.Deleted, register.Order, register.Counter, register.Replica, register.Seq); err != nil {
+			return err
+		}
+	}
+	s.dirty = map[string]bool{}
+	const documentQuery = `UPDATE crdt_documents SET clock = ?, seq = ?, next_order = ? WHERE diagram_id = ?`
+	_, err := tx.ExecContext(ctx, documentQuery, s.clock, s.seq, s.nextOrder, s.diagramID)
+	return err
+}
+
+type crdtObject struct {
+	values map[string]json.RawMessage
+	arrays map[string]map[string]*crdtItem
+}
+
+type crdtItem struct {
+	order  int64
+	object *crdtObject
+}
+
+func newCRDTObject() *crdtObject {
+	return &crdtObject{values: map[string]json.RawMessage{}, arrays: map[string]map[string]*crdtItem{}}
+}
+
+func (o *crdtObject) item(key, id string, order int64) *crdtItem {
+	items := o.arrays[key]
+	if items == nil {
+		items = map[string]*crdtItem{}
+		o.arrays[key] = items
+	}
+	item := items[id]
+	if item == nil {
+		item = &crdtItem{order: order, object: newCRDTObject()}
+		items[id] = item
+	}
+	return item
+}
+
+// materialize builds the diagram payload the registers describe.
+func (s *crdtState) materialize() ([]byte, error) {
+	root := newCRDTObject()
+	for path, register := range s.registers {
+		segments, err := parseCRDTPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("register %q: %w", path, err)
+		}
+		object, visible := root, true
+		prefix := ""
+		for _, segment := range segments[:len(segments)-1] {
+			prefix = joinCRDTPath(prefix, segment)
+			parent := s.registers[prefix]
+			if parent == nil || parent.Deleted {
+				visible = false
+				break
+			}
+			object = object.item(segment.key, segment.id, parent.Order).object
+		}
+		if !visible {
+			continue
+		}
+		last := segments[len(segments)-1]
+		switch {
+		case last.id != "":
+			if object.arrays[last.key] == nil {
+				object.arrays[last.key] = map[string]*crdtItem{}
+			}
+			if !register.Deleted {
+				object.item(last.key, last.id, register.Order)
+			}
+		case !register.Deleted:
+			object.values[last.key] = register.Value
+		}
+	}
+	return json.Marshal(root.render())
+}
+
+func joinCRDTPath(prefix string, segment crdtSegment) string {
+	part := segment.key
+	if segment.id != "" {
+		part += "[" + segment.id + "]"
+	}
+	if prefix == "" {
+		return part
+	}
+	return prefix + "." + part
+}
+
+func (o *crdtObject) render() map[string]interface{} {
+	result := make(map[string]interface{}, len(o.values)+len(o.arrays))
+	for key, value := range o.values {
+		result[key] = value
+	}
+	for key, items := range o.arrays {
+		if len(items) == 0 {
+			if _, ok := result[key]; ok {
+				continue
+			}
+		}
+		ids := make([]string, 0, len(items))
+		for id := range items {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if items[ids[i]].order != items[ids[j]].order {
+				return items[ids[i]].order < items[ids[j]].order
+			}
+			return ids[i] < ids[j]
+		})
+		rendered := make([]interface{}, 0, len(ids))
+		for _, id := range ids {
+			object := items[id].object.render()
+			if _, ok := object["id"]; !ok {
+				object["id"] = id
+			}
+			rendered = append(rendered, object)
+		}
+		result[key] = rendered
+	}
+	return result
+}
+
+// deleteCRDT turns CRDT mode off and drops the registers.
+func deleteCRDT(ctx context.Context, tx *sql.Tx, diagramID string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM crdt_registers WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM crdt_documents WHERE diagram_id = ?`, diagramID)
+	return err
+}
+
+// renameCRDT moves the registers along with a renamed diagram.
+func renameCRDT(ctx context.Context, tx *sql.Tx, from, to string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE crdt_registers SET diagram_id = ? WHERE diagram_id = ?`, to, from); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE crdt_documents SET diagram_id = ? WHERE diagram_id = ?`, to, from)
+	return err
+}
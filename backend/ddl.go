@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	dialectPostgres = "postgres"
+	dialectMySQL    = "mysql"
+	dialectSQLite   = "sqlite"
+	dialectMSSQL    = "mssql"
+)
+
+var constraintNameSanitizer = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// dialectForDatabaseType picks the DDL dialect matching a diagram's
+// databaseType, falling back to postgres for generic diagrams.
+func dialectForDatabaseType(databaseType string) string {
+	switch databaseType {
+	case "mysql", "mariadb":
+		return dialectMySQL
+	case "sqlite":
+		return dialectSQLite
+	case "sql_server":
+		return dialectMSSQL
+	default:
+		return dialectPostgres
+	}
+}
+
+func isKnownDialect(dialect string) bool {
+	switch dialect {
+	case dialectPostgres, dialectMySQL, dialectSQLite, dialectMSSQL:
+		return true
+	default:
+		return false
+	}
+}
+
+type ddlWriter struct {
+	dialect string
+	doc     diagramDoc
+	b       strings.Builder
+}
+
+// generateDDL renders CREATE TABLE, CREATE INDEX and FOREIGN KEY statements
+// for every non-view table in the diagram.
+func generateDDL(doc diagramDoc, dialect string) string {
+	g := &ddlWriter{dialect: dialect, doc: doc}
+	g.printf("-- %s\n-- dialect: %s\n\n", strings.ReplaceAll(doc.Name, "\n", " "), dialect)
+
+	if dialect == dialectPostgres {
+		seen := map[string]bool{}
+		for _, table := range doc.Tables {
+			if table.IsView || table.Schema == "" || table.Schema == "public" || seen[table.Schema] {
+				continue
+			}
+			seen[table.Schema] = true
+			g.printf("CREATE SCHEMA IF NOT EXISTS %s;\n", g.quote(table.Schema))
+		}
+		if len(seen) > 0 {
+			g.printf("\n")
+		}
+	}
+
+	for _, table := range doc.Tables {
+		if table.IsView {
+			continue
+		}
+		g.writeTable(table)
+		g.writeIndexes(table)
+		g.writeComments(table)
+		g.printf("\n")
+	}
+
+	if dialect != dialectSQLite {
+		for _, rel := range doc.Relationships {
+			fkTable, fkField, refTable, refField, ok := doc.foreignKey(rel)
+			if !ok {
+				continue
+			}
+			g.printf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s);\n",
+				g.tableName(fkTable),
+				g.quote(foreignKeyName(fkTable, fkField, refTable, refField)),
+				g.quote(fkField.Name),
+				g.tableName(refTable),
+				g.quote(refField.Name),
+			)
+		}
+	}
+
+	return strings.TrimRight(g.b.String(), "\n") + "\n"
+}
+
+func (g *ddlWriter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.b, format, args...)
+}
+
+func (g *ddlWriter) writeTable(table dbTable) {
+	primaryKeys := make([]dbField, 0)
+	for _, field := range table.Fields {
+		if field.PrimaryKey {
+			primaryKeys = append(primaryKeys, field)
+		}
+	}
+	// SQLite only supports AUTOINCREMENT on an inline INTEGER PRIMARY KEY.
+	inlinePrimaryKey := g.dialect == dialectSQLite && len(primaryKeys) == 1 && primaryKeys[0].Increment
+
+	lines := make([]string, 0, len(table.Fields)+1)
+	for _, field := range table.Fields {
+		lines = append(lines, "  "+g.column(field, inlinePrimaryKey && field.PrimaryKey))
+	}
+	if len(primaryKeys) > 0 && !inlinePrimaryKey {
+		names := make([]string, 0, len(primaryKeys))
+		for _, field := range primaryKeys {
+			names = append(names, g.quote(field.Name))
+		}
+		lines = append(lines, "  PRIMARY KEY ("+strings.Join(names, ", ")+")")
+	}
+	if g.dialect == dialectSQLite {
+		for _, rel := range g.doc.Relationships {
+			fkTable, fkField, refTable, refField, ok := g.doc.foreignKey(rel)
+			if !ok || fkTable.ID != table.ID {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("  FOREIGN KEY (%s) REFERENCES %s (%s)",
+				g.quote(fkField.Name), g.quote(refTable.Name), g.quote(refField.Name)))
+		}
+	}
+
+	g.printf("CREATE TABLE %s (\n%s\n);\n", g.tableName(table), strings.Join(lines, ",\n"))
+}
+
+func (g *ddlWriter) column(field dbField, inlinePrimaryKey bool) string {
+	if inlinePrimaryKey {
+		return g.quote(field.Name) + " INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+
+	parts := []string{g.quote(field.Name), g.columnType(field)}
+	if field.Increment {
+		switch g.dialect {
+		case dialectPostgres:
+			parts = append(parts, "GENERATED BY DEFAULT AS IDENTITY")
+		case dialectMySQL:
+			parts = append(parts, "AUTO_INCREMENT")
+		case dialectMSSQL:
+			parts = append(parts, "IDENTITY(1,1)")
+		}
+	}
+	if !field.Nullable || field.PrimaryKey {
+		parts = append(parts, "NOT NULL")
+	}
+	if field.Unique && !field.PrimaryKey {
+		parts = append(parts, "UNIQUE")
+	}
+	if field.Default != "" && !field.Increment {
+		parts = append(parts, "DEFAULT "+field.Default)
+	}
+	if g.dialect == dialectMySQL && field.Comments != "" {
+		parts = append(parts, "COMMENT "+quoteSQLString(field.Comments))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (g *ddlWriter) columnType(field dbField) string {
+	typeName := field.Type.Name
+	if typeName == "" {
+		typeName = field.Type.ID
+	}
+	if typeName == "" {
+		typeName = "text"
+	}
+
+	switch {
+	case field.CharacterMaximumLength != "" && !strings.Contains(typeName, "("):
+		typeName += "(" + field.CharacterMaximumLength + ")"
+	case field.Precision != nil && !strings.Contains(typeName, "("):
+		if field.Scale != nil {
+			typeName += fmt.Sprintf("(%s, %s)", formatNumber(*field.Precision), formatNumber(*field.Scale))
+		} else {
+			typeName += "(" + formatNumber(*field.Precision) + ")"
+		}
+	}
+	if field.IsArray && g.dialect == dialectPostgres {
+		typeName += "[]"
+	}
+	return typeName
+}
+
+func (g *ddlWriter) writeIndexes(table dbTable) {
+	for _, index := range table.Indexes {
+		if index.IsPrimaryKey || len(index.FieldIDs) == 0 {
+			continue
+		}
+		columns := make([]string, 0, len(index.FieldIDs))
+		for _, fieldID := range index.FieldIDs {
+			if field, ok := table.fieldByID(fieldID); ok {
+				columns = append(columns, g.quote(field.Name))
+			}
+		}
+		if len(columns) == 0 {
+			continue
+		}
+
+		name := index.Name
+		if name == "" {
+			name = "idx_" + table.Name + "_" + index.ID
+		}
+		unique := ""
+		if index.Unique {
+			unique = "UNIQUE "
+		}
+		g.printf("CREATE %sINDEX %s ON %s (%s);\n", unique, g.quote(name), g.tableName(table), strings.Join(columns, ", "))
+	}
+}
+
+func (g *ddlWriter) writeComments(table dbTable) {
+	switch g.dialect {
+	case dialectPostgres:
+		if table.Comments != "" {
+			g.printf("COMMENT ON TABLE %s IS %s;\n", g.tableName(table), quoteSQLString(table.Comments))
+		}
+		for _, field := range table.Fields {
+			if field.Comments != "" {
+				g.printf("COMMENT ON COLUMN %s.%s IS %s;\n", g.tableName(table), g.quote(field.Name), quoteSQLString(field.Comments))
+			}
+		}
+	case dialectMySQL:
+		if table.Comments != "" {
+			g.printf("ALTER TABLE %s COMMENT = %s;\n", g.tableName(table), quoteSQLString(table.Comments))
+		}
+	}
+}
+
+func (g *ddlWriter) tableName(table dbTable) string {
+	// "public" is PostgreSQL's default schema; other dialects would read it
+	// as a real database or schema name.
+	if table.Schema == "" || g.dialect == dialectSQLite || (table.Schema == "public" && g.dialect != dialectPostgres) {
+		return g.quote(table.Name)
+	}
+	return g.quote(table.Schema) + "." + g.quote(table.Name)
+}
+
+func (g *ddlWriter) quote(identifier string) string {
+	switch g.dialect {
+	case dialectMySQL:
+		return "`" + strings.ReplaceAll(identifier, "`", "``") + "`"
+	case dialectMSSQL:
+		return "[" + strings.ReplaceAll(identifier, "]", "]]") + "]"
+	default:
+		return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+	}
+}
+
+// foreignKeyName builds the same constraint name as the frontend export,
+// kept under 60 characters to stay within PostgreSQL's identifier limit.
+func foreignKeyName(fkTable dbTable, fkField dbField, refTable dbTable, refField dbField) string {
+	name := fmt.Sprintf("fk_%s_%s_%s_%s", fkTable.Name, fkField.Name, refTable.Name, refField.Name)
+	if len(name) > 60 {
+		name = name[:60]
+	}
+	return constraintNameSanitizer.ReplaceAllString(name, "_")
+}
+
+func quoteSQLString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Versions are stored as a chain of deltas: a version either holds its full
+// payload (base_id IS NULL) or a delta against the version it was saved on
+// top of. Every snapshotInterval-th version in a chain is written in full so
+// reconstruction never has to replay more than that many deltas.
+//
+// A delta node is a JSON object with exactly one of these keys:
+//
+//	{"$v": value}                      replace the value
+//	{"$o": {key: node}, "$d": [key]}   patch an object's keys, deleting "$d"
+//	{"$a": {"order": [id], "items": {id: node}}}
+//	                                   patch an array of objects keyed by "id";
+//	                                   "order" is null when unchanged and
+//	                                   [] when the array was emptied
+//
+// Arrays of id-carrying objects (tables, fields, relationships, ...) are
+// diffed by id so that moving one table doesn't copy the whole tables array.
+
+type deltaNode struct {
+	Value  interface{}          `json:"$v,omitempty"`
+	Object map[string]deltaNode `json:"$o,omitempty"`
+	Delete []string             `json:"$d,omitempty"`
+	Array  *arrayDelta          `json:"$a,omitempty"`
+	// set distinguishes {"$v": null} from an absent value.
+	set bool
+}
+
+// arrayDelta keeps the null Order of an unchanged array apart from the
+// empty one of an emptied array, so Order must not be omitempty.
+type arrayDelta struct {
+	Order []string             `json:"order"`
+	Items map[string]deltaNode `json:"items,omitempty"`
+}
+
+func (n deltaNode) MarshalJSON() ([]byte, error) {
+	if n.set {
+		return json.Marshal(map[string]interface{}{"$v": n.Value})
+	}
+	type plain deltaNode
+	return json.Marshal(plain(n))
+}
+
+func (n *deltaNode) UnmarshalJSON(data []byte) error {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	if raw, ok := probe["$v"]; ok {
+		value, err := decodeJSONValue(raw)
+		if err != nil {
+			return err
+		}
+		n.set = true
+		n.Value = value
+		return nil
+	}
+	type plain deltaNode
+	return json.Unmarshal(data, (*plain)(n))
+}
+
+func replaceNode(value interface{}) deltaNode {
+	return deltaNode{Value: value, set: true}
+}
+
+// diffPayloads returns the delta turning previous into next.
+func diffPayloads(previous, next []byte) ([]byte, error) {
+	before, err := decodeJSONValue(previous)
+	if err != nil {
+		return nil, err
+	}
+	after, err := decodeJSONValue(next)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(diffValues(before, after))
+}
+
+// applyPayloadDelta reconstructs a payload from its base and a delta
+// produced by diffPayloads.
+func applyPayloadDelta(base, delta []byte) ([]byte, error) {
+	value, err := decodeJSONValue(base)
+	if err != nil {
+		return nil, err
+	}
+	var node deltaNode
+	decoder := json.NewDecoder(bytes.NewReader(delta))
+	decoder.UseNumber()
+	if err := decoder.Decode(&node); err != nil {
+		return nil, err
+	}
+	result, err := applyNode(value, node)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// decodeJSONValue keeps numbers as json.Number so reconstructed payloads
+// round-trip exactly.
+func decodeJSONValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func diffValues(before, after interface{}) deltaNode {
+	switch a := after.(type) {
+	case map[string]interface{}:
+		b, ok := before.(map[string]interface{})
+		if !ok {
+			break
+		}
+		node := deltaNode{Object: map[string]deltaNode{}}
+		for key, value := range a {
+			previous, existed := b[key]
+			if !existed {
+				node.Object[key] = replaceNode(value)
+				continue
+			}
+			if !reflect.DeepEqual(previous, value) {
+				node.Object[key] = diffValues(previous, value)
+			}
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				node.Delete = append(node.Delete, key)
+			}
+		}
+		return node
+	case []interface{}:
+		b, ok := before.([]interface{})
+		if !ok {
+			break
+		}
+		afterIDs, afterOK := arrayItemIDs(a)
+		beforeIDs, beforeOK := arrayItemIDs(b)
+		if !afterOK || !beforeOK {
+			break
+		}
+		previous := make(map[string]interface{}, len(b))
+		for i, id := range beforeIDs {
+			previous[id] = b[i]
+		}
+		delta := &arrayDelta{Items: map[string]deltaNode{}}
+		for i, id := range afterIDs {
+			old, existed := previous[id]
+			switch {
+			case !existed:
+				delta.Items[id] = replaceNode(a[i])
+			case !reflect.DeepEqual(old, a[i]):
+				delta.Items[id] = diffValues(old, a[i])
+			}
+		}
+		if !reflect.DeepEqual(beforeIDs, afterIDs) {
+			delta.Order = afterIDs
+			if delta.Order == nil {
+				delta.Order = []string{}
+			}
+		}
+		return deltaNode{Array: delta}
+	}
+	return replaceNode(after)
+}
+
+// arrayItemIDs returns the ids of an array whose items are all objects with
+// a unique string "id".
+func arrayItemIDs(items []interface{}) ([]string, bool) {
+	ids := make([]string, 0, len(items))
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		id, ok := object["id"].(string)
+		if !ok || seen[id] {
+			return nil, false
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+func applyNode(value interface{}, node deltaNode) (interface{}, error) {
+	switch {
+	case node.set:
+		return node.Value, nil
+	case node.Array != nil:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, errors.New("array delta applied to a non-array value")
+		}
+		ids, ok := arrayItemIDs(items)
+		if !ok {
+			return nil, errors.New("array delta applied to an array without item ids")
+		}
+		previous := make(map[string]interface{}, len(items))
+		for i, id := range ids {
+			previous[id] = items[i]
+		}
+		order := ids
+		if node.Array.Order != nil {
+			order = node.Array.Order
+		}
+		result := make([]interface{}, 0, len(order))
+		for _, id := range order {
+			item := previous[id]
+			if change, ok := node.Array.Items[id]; ok {
+				patched, err := applyNode(item, change)
+				if err != nil {
+					return nil, err
+				}
+				item = patched
+			}
+			result = append(result, item)
+		}
+		return result, nil
+	default:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("object delta applied to a non-object value")
+		}
+		result := make(map[string]interface{}, len(object)+len(node.Object))
+		for key, item := range object {
+			result[key] = item
+		}
+		for key, change := range node.Object {
+			patched, err := applyNode(result[key], change)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = patched
+		}
+		for _, key := range node.Delete {
+			delete(result, key)
+		}
+		return result, nil
+	}
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// loadVersionPayload returns a version's full payload, replaying its delta
+// chain back to the nearest full snapshot.
+func (a *app) loadVersionPayload(ctx context.Context, q rowQueryer, diagramID string, versionID int64) ([]byte, error) {
+	const query = `
+SELECT b.payload, v.base_id
+FROM diagram_versions v
+JOIN blobs b ON b.hash = v.blob_hash
+WHERE v.diagram_id = ? AND v.id = ?`
+
+	deltas := make([][]byte, 0)
+	id := versionID
+	for {
+		var (
+			raw    []byte
+			baseID sql.NullInt64
+		)
+		if err := q.QueryRowContext(ctx, query, diagramID, id).Scan(&raw, &baseID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) && id != versionID {
+				return nil, fmt.Errorf("version %d: missing delta base %d", versionID, id)
+			}
+			return nil, err
+		}
+		content, err := a.decodePayload(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !baseID.Valid {
+			payload := content
+			for i := len(deltas) - 1; i >= 0; i-- {
+				next, err := applyPayloadDelta(payload, deltas[i])
+				if err != nil {
+					return nil, fmt.Errorf("version %d: %w", versionID, err)
+				}
+				payload = next
+			}
+			return payload, nil
+		}
+		deltas = append(deltas, content)
+		id = baseID.Int64
+	}
+}
+
+// materializeDependents rewrites versions that delta against any of the
+// given versions as full snapshots, so the given versions can be deleted
+// without breaking the chain.
+func (a *app) materializeDependents(ctx context.Context, tx *sql.Tx, diagramID string, versionIDs []int64) error {
+	removed := make(map[int64]bool, len(versionIDs))
+	for _, id := range versionIDs {
+		removed[id] = true
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, base_id FROM diagram_versions WHERE diagram_id = ? AND base_id IS NOT NULL`, diagramID)
+	if err != nil {
+		return err
+	}
+	dependents := make([]int64, 0)
+	for rows.Next() {
+		var id, baseID int64
+		if err := rows.Scan(&id, &baseID); err != nil {
+			rows.Close()
+			return err
+		}
+		if removed[baseID] && !removed[id] {
+			dependents = append(dependents, id)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range dependents {
+		payload, err := a.loadVersionPayload(ctx, tx, diagramID, id)
+		if err != nil {
+			return err
+		}
+		blobHash, err := a.putBlob(ctx, tx, payload)
+		if err != nil {
+			return err
+		}
+		const query = `
+UPDATE diagram_versions
+SET blob_hash = ?, base_id = NULL, chain_depth = 0
+WHERE diagram_id = ? AND id = ?`
+		if _, err := tx.ExecContext(ctx, query, blobHash, diagramID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPayloadDeltaRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		previous, next string
+	}{
+		{"array emptied", `{"tables":[{"id":"t1"}]}`, `{"tables":[]}`},
+		{"nested array emptied", `{"tables":[{"id":"t1","fields":[{"id":"f1"},{"id":"f2"}]}]}`, `{"tables":[{"id":"t1","fields":[]}]}`},
+		{"item removed", `{"tables":[{"id":"t1"},{"id":"t2"}]}`, `{"tables":[{"id":"t2"}]}`},
+		{"order unchanged", `{"tables":[{"id":"t1","x":1}]}`, `{"tables":[{"id":"t1","x":2}]}`},
+		{"array filled", `{"tables":[]}`, `{"tables":[{"id":"t1"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta, err := diffPayloads([]byte(tt.previous), []byte(tt.next))
+			if err != nil {
+				t.Fatalf("diffPayloads: %v", err)
+			}
+			got, err := applyPayloadDelta([]byte(tt.previous), delta)
+			if err != nil {
+				t.Fatalf("applyPayloadDelta: %v", err)
+			}
+			if !jsonEqual(t, got, []byte(tt.next)) {
+				t.Errorf("delta %s applied to %s = %s, want %s", delta, tt.previous, got, tt.next)
+			}
+		})
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	left, err := decodeJSONValue(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := decodeJSONValue(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(left, right)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const maxSyncKnownDiagrams = 10000
+
+type syncKnownDiagram struct {
+	ID        string `json:"id"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type deltaSyncResult struct {
+	// Changed are diagrams the client has whose updatedAt differs, Created
+	// the ones it does not have, and Deleted the ids it should drop.
+	Changed  []json.RawMessage `json:"changed"`
+	Created  []json.RawMessage `json:"created"`
+	Deleted  []string          `json:"deleted"`
+	SyncedAt string            `json:"syncedAt"`
+}
+
+// handleDeltaSync serves POST /api/sync for clients that keep diagrams in
+// local storage. The client sends {"known": [{"id", "updatedAt"}]} for what
+// it holds and gets back only what differs, so it does not have to pull
+// every payload with ?full=1. Deleted lists the known ids that are gone,
+// trashed or, without "includeArchived", archived.
+func (a *app) handleDeltaSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Known           []syncKnownDiagram `json:"known"`
+		IncludeArchived bool               `json:"includeArchived"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	if len(req.Known) > maxSyncKnownDiagrams {
+		writePayloadError(w, invalidField("known", fmt.Sprintf("must list at most %d diagrams", maxSyncKnownDiagrams)))
+		return
+	}
+	known := make(map[string]string, len(req.Known))
+	for i, diagram := range req.Known {
+		if diagram.ID == "" {
+			writePayloadError(w, invalidField(fmt.Sprintf("known[%d].id", i), "is required"))
+			return
+		}
+		known[diagram.ID] = diagram.UpdatedAt
+	}
+
+	result, err := a.deltaSync(r.Context(), known, req.IncludeArchived)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// deltaSync compares the client's diagrams with the stored ones inside one
+// read transaction, so the answer reflects a single point in time.
+func (a *app) deltaSync(ctx context.Context, known map[string]string, includeArchived bool) (deltaSyncResult, error) {
+	result := deltaSyncResult{
+		Changed: []json.RawMessage{},
+		Created: []json.RawMessage{},
+		Deleted: []string{},
+	}
+	err := a.readTx(ctx, func(tx *sql.Tx) error {
+		query := `SELECT id, updated_at FROM diagrams WHERE deleted_at IS NULL`
+		if !includeArchived {
+			query += ` AND archived = 0`
+		}
+		rows, err := tx.QueryContext(ctx, query+` ORDER BY updated_at DESC`)
+		if err != nil {
+			return err
+		}
+		var changed, created []string
+		live := make(map[string]bool)
+		for rows.Next() {
+			var id, updatedAt string
+			if err := rows.Scan(&id, &updatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			live[id] = true
+			clientUpdatedAt, ok := known[id]
+			switch {
+			case !ok:
+				created = append(created, id)
+			case clientUpdatedAt != updatedAt:
+				changed = append(changed, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		result.SyncedAt = time.Now().UTC().Format(time.RFC3339Nano)
+
+		for _, id := range changed {
+			payload, err := a.syncPayload(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			result.Changed = append(result.Changed, payload)
+		}
+		for _, id := range created {
+			payload, err := a.syncPayload(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			result.Created = append(result.Created, payload)
+		}
+		for id := range known {
+			if !live[id] {
+				result.Deleted = append(result.Deleted, id)
+			}
+		}
+		sort.Strings(result.Deleted)
+		return nil
+	})
+	return result, err
+}
+
+func (a *app) syncPayload(ctx context.Context, tx *sql.Tx, diagramID string) (json.RawMessage, error) {
+	const query = `
+SELECT b.payload
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.id = ?`
+	var raw []byte
+	if err := tx.QueryRowContext(ctx, query, diagramID).Scan(&raw); err != nil {
+		return nil, err
+	}
+	payload, err := a.decodePayload(raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(payload), nil
+}
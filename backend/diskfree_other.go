@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+func diskFree(string) (int64, error) {
+	return 0, errDiskFreeUnsupported
+}
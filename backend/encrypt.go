@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Encrypted payloads start with a NUL byte, which can start neither a JSON
+// document nor a gzip stream, followed by a flags byte and the id of the key
+// that sealed them:
+//
+//	"\x00CE1" | flags | key id (4 bytes) | nonce (12 bytes) | AES-256-GCM ciphertext
+const (
+	encryptedPayloadMagic = "\x00CE1"
+	encryptedFlagGzip     = 1 << 0
+
+	encryptedHeaderSize = len(encryptedPayloadMagic) + 1 + payloadKeyIDSize
+	payloadKeyIDSize    = 4
+)
+
+var errUnknownPayloadKey = errors.New("payload was encrypted with a key that is not configured")
+
+type payloadKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// payloadKeyring holds the key new payloads are sealed with and any previous
+// keys that payloads written before a rotation can still be opened with.
+type payloadKeyring struct {
+	current  *payloadKey
+	previous []*payloadKey
+}
+
+// newPayloadKeyring returns nil when encryption is not configured.
+func newPayloadKeyring(cfg config) (*payloadKeyring, error) {
+	enc := cfg.Payload.Encryption
+	if enc.Key != "" && enc.KeyFile != "" {
+		return nil, errors.New("set only one of PAYLOAD_ENCRYPTION_KEY and PAYLOAD_ENCRYPTION_KEY_FILE")
+	}
+	value := enc.Key
+	if enc.KeyFile != "" {
+		content, err := os.ReadFile(enc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read PAYLOAD_ENCRYPTION_KEY_FILE: %w", err)
+		}
+		value = string(content)
+	}
+
+	keyring := &payloadKeyring{}
+	if value != "" {
+		key, err := parsePayloadKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload encryption key: %w", err)
+		}
+		keyring.current = key
+	}
+	for i, value := range enc.PreviousKeys {
+		key, err := parsePayloadKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PAYLOAD_ENCRYPTION_PREVIOUS_KEYS entry %d: %w", i+1, err)
+		}
+		keyring.previous = append(keyring.previous, key)
+	}
+	if keyring.current == nil && len(keyring.previous) == 0 {
+		return nil, nil
+	}
+	return keyring, nil
+}
+
+// parsePayloadKey accepts a 32-byte key as 64 hex characters or base64.
+func parsePayloadKey(value string) (*payloadKey, error) {
+	value = strings.TrimSpace(value)
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("expected 32 bytes, hex or base64 encoded (e.g. openssl rand -hex 32)")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &payloadKey{id: sum[:payloadKeyIDSize], aead: aead}, nil
+}
+
+// sealing reports whether new payloads are encrypted.
+func (k *payloadKeyring) sealing() bool {
+	return k != nil && k.current != nil
+}
+
+// header returns the prefix of payloads sealed with the current key, which
+// migratePayloads compares against to find payloads to rewrite.
+func (k *payloadKeyring) header(gzipped bool) []byte {
+	flags := byte(0)
+	if gzipped {
+		flags |= encryptedFlagGzip
+	}
+	header := append([]byte(encryptedPayloadMagic), flags)
+	return append(header, k.current.id...)
+}
+
+func (k *payloadKeyring) seal(content []byte, gzipped bool) ([]byte, error) {
+	header := k.header(gzipped)
+	nonce := make([]byte, k.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return k.current.aead.Seal(sealed, nonce, content, header), nil
+}
+
+func isEncryptedPayload(raw []byte) bool {
+	return len(raw) >= encryptedHeaderSize && bytes.HasPrefix(raw, []byte(encryptedPayloadMagic))
+}
+
+// open decrypts a sealed payload and returns its (possibly still gzipped)
+// content.
+func (k *payloadKeyring) open(raw []byte) ([]byte, error) {
+	if k == nil {
+		return nil, errUnknownPayloadKey
+	}
+	header, rest := raw[:encryptedHeaderSize], raw[encryptedHeaderSize:]
+	id := header[len(encryptedPayloadMagic)+1:]
+
+	keys := k.previous
+	if k.current != nil {
+		keys = append([]*payloadKey{k.current}, keys...)
+	}
+	for _, key := range keys {
+		if !bytes.Equal(key.id, id) {
+			continue
+		}
+		nonceSize := key.aead.NonceSize()
+		if len(rest) < nonceSize {
+			return nil, errors.New("encrypted payload is truncated")
+		}
+		content, err := key.aead.Open(nil, rest[:nonceSize], rest[nonceSize:], header)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt payload: %w", err)
+		}
+		return content, nil
+	}
+	return nil, errUnknownPayloadKey
+}
+
+// sealedColumns hold diagram content and credentials outside the blobs
+// table. They are sealed like payloads, without compression, while
+// PAYLOAD_ENCRYPTION_KEY is set; text columns go back to TEXT when it is
+// not. Names, ids, paths and timestamps beside them stay readable.
+var sealedColumns = []struct {
+	table, column string
+	text          bool
+}{
+	{"diagram_sync", "connection", true},
+	{"diagram_sync", "drift", true},
+	{"diagram_filters", "payload", true},
+	{"templates", "payload", true},
+	{"crdt_registers", "value", true},
+	{"diagram_thumbnails", "data", false},
+}
+
+// sealValue encodes a value of a sealed column for writing: sealed with the
+// current key, or as it is, TEXT for text columns, when payloads are not
+// encrypted.
+func (k *payloadKeyring) sealValue(content []byte, text bool) (interface{}, error) {
+	if k.sealing() {
+		return k.seal(content, false)
+	}
+	if text {
+		return string(content), nil
+	}
+	return content, nil
+}
+
+// openValue reverses sealValue. Values written before encryption was
+// switched on are read as they are.
+func (k *payloadKeyring) openValue(raw []byte) ([]byte, error) {
+	if !isEncryptedPayload(raw) {
+		return raw, nil
+	}
+	return k.open(raw)
+}
+
+// migrateSealedColumns rewrites the values of sealedColumns written under
+// a different key, or encryption setting, than the current one, as
+// migratePayloads does for blobs.
+func (a *app) migrateSealedColumns(ctx context.Context) (int, error) {
+	rewritten := 0
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		rewritten = 0
+		for _, sealed := range sealedColumns {
+			var (
+				query = `SELECT rowid, ` + sealed.column + ` FROM ` + sealed.table
+				args  []interface{}
+			)
+			if a.payloadKeys.sealing() {
+				header := a.payloadKeys.header(false)
+				query += ` WHERE substr(` + sealed.column + `, 1, ?) != ?`
+				args = []interface{}{len(header), header}
+			} else {
+				query += ` WHERE substr(` + sealed.column + `, 1, ?) = ?`
+				args = []interface{}{len(encryptedPayloadMagic), []byte(encryptedPayloadMagic)}
+			}
+			stale, err := staleSealedValues(ctx, tx, query, args...)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", sealed.table, sealed.column, err)
+			}
+			for rowid, raw := range stale {
+				content, err := a.payloadKeys.openValue(raw)
+				if err != nil {
+					return fmt.Errorf("%s.%s: %w", sealed.table, sealed.column, err)
+				}
+				value, err := a.payloadKeys.sealValue(content, sealed.text)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `UPDATE `+sealed.table+` SET `+sealed.column+` = ? WHERE rowid = ?`, value, rowid); err != nil {
+					return err
+				}
+				rewritten++
+			}
+		}
+		return nil
+	})
+	if err == nil && rewritten > 0 {
+		slog.Info("rewrote sealed columns", "count", rewritten, "encrypted", a.payloadKeys.sealing())
+	}
+	return rewritten, err
+}
+
+func staleSealedValues(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (map[int64][]byte, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stale := map[int64][]byte{}
+	for rows.Next() {
+		var (
+			rowid int64
+			raw   []byte
+		)
+		if err := rows.Scan(&rowid, &raw); err != nil {
+			return nil, err
+		}
+		stale[rowid] = raw
+	}
+	return stale, rows.Err()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventDiagramCreated  = "diagram.created"
+	eventDiagramSaved    = "diagram.saved"
+	eventDiagramPatched  = "diagram.patched"
+	eventDiagramDeleted  = "diagram.deleted"
+	eventDiagramRestored = "diagram.restored"
+	eventDiagramPurged   = "diagram.purged"
+
+	defaultEventPageSize  = 100
+	maxEventPageSize      = 1000
+	maxEventWait          = time.Minute
+	eventPruneInterval    = time.Hour
+	eventFollowBatch      = 100
+	eventPollInterval     = 30 * time.Second
+	defaultEventRetention = "30d"
+)
+
+var diagramEventTypes = []string{eventDiagramCreated, eventDiagramSaved, eventDiagramPatched, eventDiagramDeleted, eventDiagramRestored, eventDiagramPurged}
+
+// diagramEventVerbs complete "Diagram X was ..." in notifications.
+var diagramEventVerbs = map[string]string{
+	eventDiagramCreated:  "created",
+	eventDiagramSaved:    "saved",
+	eventDiagramPatched:  "updated",
+	eventDiagramDeleted:  "moved to the trash",
+	eventDiagramRestored: "restored",
+	eventDiagramPurged:   "permanently deleted",
+}
+
+// diagramEvent is a row of the events table. Seq increases monotonically and
+// is never reused, so consumers can resume from the last one they saw.
+type diagramEvent struct {
+	Seq         int64  `json:"seq"`
+	Type        string `json:"type"`
+	At          string `json:"at"`
+	DiagramID   string `json:"diagramId"`
+	DiagramName string `json:"diagramName"`
+	Actor       string `json:"actor,omitempty"`
+}
+
+// recordEvent appends an event in the transaction that makes the change, so
+// an event exists exactly when the change was committed. Call it while the
+// diagram row still exists.
+func (a *app) recordEvent(ctx context.Context, tx *sql.Tx, eventType, diagramID string) error {
+	id, _ := requestIdentity(ctx)
+	const query = `
+INSERT INTO events (type, at, diagram_id, diagram_name, actor)
+SELECT ?, ?, id, name, ? FROM diagrams WHERE id = ?`
+	_, err := tx.ExecContext(ctx, query, eventType, time.Now().UTC().Format(sortableTimeFormat), id.ID, diagramID)
+	return err
+}
+
+// diagramLink returns the UI address of an event's diagram, or "" when
+// PUBLIC_URL is not set or the diagram is no longer there.
+func diagramLink(publicURL string, event diagramEvent) string {
+	if publicURL == "" || event.Type == eventDiagramDeleted || event.Type == eventDiagramPurged {
+		return ""
+	}
+	return publicURL + "/diagrams/" + url.PathEscape(event.DiagramID)
+}
+
+// eventNotifier wakes everyone waiting for new events. wait returns a
+// channel that is closed by the next notify.
+type eventNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newEventNotifier() *eventNotifier {
+	return &eventNotifier{ch: make(chan struct{})}
+}
+
+func (n *eventNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+func (n *eventNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// listEvents returns up to limit events after since, oldest first.
+func (a *app) listEvents(ctx context.Context, since int64, diagramID string, limit int) ([]diagramEvent, error) {
+	query := `
+SELECT seq, type, at, diagram_id, diagram_name, actor
+FROM events
+WHERE seq > ?`
+	args := []interface{}{since}
+	if diagramID != "" {
+		query += ` AND diagram_id = ?`
+		args = append(args, diagramID)
+	}
+	query += ` ORDER BY seq LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := a.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]diagramEvent, 0)
+	for rows.Next() {
+		var event diagramEvent
+		if err := rows.Scan(&event.Seq, &event.Type, &event.At, &event.DiagramID, &event.DiagramName, &event.Actor); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// handleEvents serves GET /api/events?since=<seq>. Pass the returned next as
+// since to continue; with wait=<seconds> an empty page is held open until
+// an event arrives. 410 means events after since have already been pruned.
+func (a *app) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	since, limit, err := parseEventPage(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var wait time.Duration
+	if value := query.Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxEventWait {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("wait must be between 0 and %d seconds", int(maxEventWait.Seconds())))
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	diagramID := query.Get("diagramId")
+
+	if pruned, err := a.eventsPrunedAfter(r.Context(), since); err != nil {
+		writeServerError(w, err)
+		return
+	} else if pruned {
+		writeErrorCode(w, http.StatusGone, codeEventsPruned, "events after since have been pruned; start again without since")
+		return
+	}
+
+	deadline := time.After(wait)
+	for {
+		// Take the channel before querying so an event committed in between
+		// still wakes this request.
+		changed := a.events.wait()
+		events, err := a.listEvents(r.Context(), since, diagramID, limit)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if len(events) > 0 || wait == 0 {
+			next := since
+			if len(events) > 0 {
+				next = events[len(events)-1].Seq
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"events": events,
+				"next":   next,
+			})
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline:
+			wait = 0
+		case <-changed:
+		}
+	}
+}
+
+// parseEventPage reads the since and limit parameters of an event page.
+func parseEventPage(query url.Values) (int64, int, error) {
+	var since int64
+	if value := query.Get("since"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.New("since must be a sequence number")
+		}
+		since = parsed
+	}
+	limit := defaultEventPageSize
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxEventPageSize {
+			return 0, 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxEventPageSize))
+		}
+		limit = parsed
+	}
+	return since, limit, nil
+}
+
+// eventsPrunedAfter reports whether events following since are gone.
+// Sequence numbers have no gaps, so a first retained event beyond since+1
+// means the ones before it were pruned.
+func (a *app) eventsPrunedAfter(ctx context.Context, since int64) (bool, error) {
+	if since == 0 {
+		return false, nil
+	}
+	var first sql.NullInt64
+	if err := a.db.QueryRowContext(ctx, `SELECT MIN(seq) FROM events`).Scan(&first); err != nil {
+		return false, err
+	}
+	return first.Valid && first.Int64 > since+1, nil
+}
+
+// eventCursor returns the last event a consumer has handled. A new consumer
+// starts at the current end of the log instead of replaying history.
+func (a *app) eventCursor(ctx context.Context, consumer string) (int64, error) {
+	var seq int64
+	err := a.db.QueryRowContext(ctx, `SELECT seq FROM event_cursors WHERE consumer = ?`, consumer).Scan(&seq)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return seq, err
+	}
+	if err := a.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM events`).Scan(&seq); err != nil {
+		return 0, err
+	}
+	return seq, a.saveEventCursor(ctx, consumer, seq)
+}
+
+func (a *app) saveEventCursor(ctx context.Context, consumer string, seq int64) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO event_cursors (consumer, seq) VALUES (?, ?)
+ON CONFLICT(consumer) DO UPDATE SET seq = excluded.seq`, consumer, seq)
+		return err
+	})
+}
+
+// followEvents hands every event to handle in order, saving consumer's
+// cursor after each one, until ctx is done or handle returns false. A
+// consumer that is new starts with the events recorded after it was added.
+func (a *app) followEvents(ctx context.Context, consumer string, handle func(context.Context, diagramEvent) bool) {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	since := int64(-1)
+	for {
+		changed := a.events.wait()
+		if since < 0 {
+			seq, err := a.eventCursor(ctx, consumer)
+			if err != nil {
+				slog.Error("read event cursor failed", "consumer", consumer, "error", err)
+			} else {
+				since = seq
+			}
+		}
+
+		var events []diagramEvent
+		if since >= 0 {
+			var err error
+			events, err = a.listEvents(ctx, since, "", eventFollowBatch)
+			if err != nil {
+				slog.Error("read events failed", "consumer", consumer, "error", err)
+			}
+		}
+		for _, event := range events {
+			if !handle(ctx, event) {
+				return
+			}
+			since = event.Seq
+			if err := a.saveEventCursor(ctx, consumer, since); err != nil {
+				slog.Error("save event cursor failed", "consumer", consumer, "seq", since, "error", err)
+			}
+		}
+		if len(events) == eventFollowBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *app) pruneEvents(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-a.eventRetention).UTC().Format(sortableTimeFormat)
+	res, err := a.db.ExecContext(ctx, `DELETE FROM events WHERE at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (a *app) runEventPrune(ctx context.Context) {
+	ticker := time.NewTicker(eventPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := a.pruneEvents(ctx)
+		if err != nil {
+			slog.Error("event prune failed", "error", err)
+		} else if removed > 0 {
+			slog.Info("pruned old events", "count", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
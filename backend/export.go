@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type exportedVersion struct {
+	ID        int64           `json:"id"`
+	Name      string          `json:"name"`
+	Action    string          `json:"action"`
+	Message   string          `json:"message,omitempty"`
+	CreatedAt string          `json:"createdAt"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+func (a *app) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	includeFilters := queryFlag(r, "filters")
+	includeVersions := queryFlag(r, "versions")
+
+	ids, err := a.listDiagramIDs(r.Context())
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	fileName := fmt.Sprintf("chartdb-export-%s.zip", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	w.WriteHeader(http.StatusOK)
+
+	// Headers are already sent at this point, so failures can only be logged
+	// and the archive left truncated.
+	zw := zip.NewWriter(w)
+	for _, id := range ids {
+		if err := a.writeDiagramExport(r.Context(), zw, id, includeFilters, includeVersions); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			slog.ErrorContext(r.Context(), "export diagram failed", "diagram_id", id, "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.ErrorContext(r.Context(), "export: close archive failed", "error", err)
+	}
+}
+
+// writeDiagramExport appends a single diagram (and optionally its filter and
+// version history) to the archive, loading one payload at a time so the whole
+// database never has to be buffered in memory.
+func (a *app) writeDiagramExport(ctx context.Context, zw *zip.Writer, diagramID string, includeFilters, includeVersions bool) error {
+	entryName := url.PathEscape(diagramID) + ".json"
+
+	payload, err := a.getDiagramPayload(ctx, diagramID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipEntry(zw, "diagrams/"+entryName, payload); err != nil {
+		return err
+	}
+
+	if includeFilters {
+		filter, err := a.getDiagramFilter(ctx, diagramID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return err
+		default:
+			if err := writeZipEntry(zw, "filters/"+entryName, filter); err != nil {
+				return err
+			}
+		}
+	}
+
+	if includeVersions {
+		f, err := zw.Create("versions/" + entryName)
+		if err != nil {
+			return err
+		}
+		if err := a.streamVersions(ctx, diagramID, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *app) streamVersions(ctx context.Context, diagramID string, w io.Writer) error {
+	const query = `
+SELECT v.id, v.name, v.action, COALESCE(v.message, ''), v.created_at, b.payload, v.base_id
+FROM diagram_versions v
+JOIN blobs b ON b.hash = v.blob_hash
+WHERE v.diagram_id = ?
+ORDER BY v.id ASC`
+	rows, err := a.db.QueryContext(ctx, query, diagramID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if _, err := w.Write([]byte("[")); err != nil {
+		return err
+	}
+	// Deltas are almost always against the previous row, so keep that
+	// payload around instead of replaying each chain from its snapshot.
+	var (
+		previousID      int64
+		previousPayload []byte
+	)
+	for i := 0; rows.Next(); i++ {
+		var (
+			item   exportedVersion
+			raw    []byte
+			baseID sql.NullInt64
+		)
+		if err := rows.Scan(&item.ID, &item.Name, &item.Action, &item.Message, &item.CreatedAt, &raw, &baseID); err != nil {
+			return err
+		}
+		payload, err := a.decodePayload(raw)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !baseID.Valid:
+		case baseID.Int64 == previousID && previousPayload != nil:
+			if payload, err = applyPayloadDelta(previousPayload, payload); err != nil {
+				return err
+			}
+		default:
+			if payload, err = a.getVersionPayload(ctx, diagramID, item.ID); err != nil {
+				return err
+			}
+		}
+		previousID, previousPayload = item.ID, payload
+		item.Payload = json.RawMessage(payload)
+
+		encoded, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := w.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("]"))
+	return err
+}
+
+func (a *app) listDiagramIDs(ctx context.Context) ([]string, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT id FROM diagrams WHERE deleted_at IS NULL ORDER BY created_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+	return result, rows.Err()
+}
+
+func writeZipEntry(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// handleDiagramExport serves /api/diagrams/{id}/export/{format}, rendering
+// the stored payload into a text format that needs no frontend.
+func (a *app) handleDiagramExport(w http.ResponseWriter, r *http.Request, diagramID, format string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	payload, err := a.getDiagramPayload(r.Context(), diagramID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	switch format {
+	case "sql":
+		dialect := strings.ToLower(r.URL.Query().Get("dialect"))
+		if dialect == "" {
+			dialect = dialectForDatabaseType(doc.DatabaseType)
+		}
+		if !isKnownDialect(dialect) {
+			writeError(w, http.StatusBadRequest, "dialect must be one of postgres, mysql, sqlite, mssql")
+			return
+		}
+		writeText(w, http.StatusOK, generateDDL(doc, dialect))
+	case "plantuml":
+		writeText(w, http.StatusOK, generatePlantUML(doc))
+	default:
+		writeError(w, http.StatusNotFound, "unknown export format")
+	}
+}
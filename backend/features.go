@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// serverFeatures tells the frontend what this deployment supports, so it
+// can hide what would only fail. Everything is fixed at startup.
+type serverFeatures struct {
+	Auth struct {
+		Enabled bool `json:"enabled"`
+		// Required is set when every request must carry a client
+		// certificate rather than only being able to.
+		Required bool     `json:"required"`
+		Methods  []string `json:"methods"`
+		// Anonymous is ANONYMOUS_ACCESS: write, read or none.
+		Anonymous string `json:"anonymous"`
+	} `json:"auth"`
+	// Sharing links are not supported yet; the flag is there so the
+	// frontend can rely on the shape.
+	Sharing            bool `json:"sharing"`
+	AIProxy            bool `json:"aiProxy"`
+	MaxPayloadBytes    int  `json:"maxPayloadBytes"`
+	MaxAttachmentBytes int  `json:"maxAttachmentBytes"`
+	MaxDiagramBytes    int  `json:"maxDiagramBytes"`
+	Introspection      bool `json:"introspection"`
+	APIDocs            bool `json:"apiDocs"`
+	GRPC               bool `json:"grpc"`
+	LocksEnforced      bool `json:"locksEnforced"`
+	Webhooks           bool `json:"webhooks"`
+}
+
+func featuresFromConfig(cfg config) serverFeatures {
+	var features serverFeatures
+	features.Auth.Methods = []string{}
+	if cfg.TLS.ClientCA != "" {
+		features.Auth.Enabled = true
+		features.Auth.Required = !strings.EqualFold(cfg.TLS.ClientAuth, clientAuthOptional)
+		features.Auth.Methods = append(features.Auth.Methods, "mtls")
+	}
+	// Anyone who can authenticate can make tokens through /api/tokens.
+	if len(cfg.APITokens) > 0 || cfg.TLS.ClientCA != "" {
+		features.Auth.Enabled = true
+		features.Auth.Methods = append(features.Auth.Methods, "token")
+	}
+	if cfg.SAML.IdPSSOURL != "" {
+		features.Auth.Enabled = true
+		features.Auth.Methods = append(features.Auth.Methods, "saml")
+	}
+	if features.Auth.Enabled {
+		features.Auth.Methods = append(features.Auth.Methods, "session")
+	}
+	features.Auth.Anonymous = anonymousWrite
+	if access, err := newAnonymousAccess(cfg.Anonymous.Access, cfg.Anonymous.Diagrams); err == nil {
+		features.Auth.Anonymous = access.mode
+	}
+	features.AIProxy = cfg.AI.Provider != ""
+	features.MaxPayloadBytes = cfg.Payload.MaxBytes
+	features.MaxAttachmentBytes = cfg.Attachments.MaxBytes
+	features.MaxDiagramBytes = cfg.Payload.MaxDiagramBytes
+	features.Introspection = cfg.Introspection.Enabled
+	features.APIDocs = cfg.APIDocs.Enabled
+	features.GRPC = cfg.GRPC.Port != ""
+	features.LocksEnforced = cfg.Locks.Enforce
+	features.Webhooks = cfg.Webhook.URL != "" || len(cfg.Webhooks) > 0
+	return features
+}
+
+// handleFeatures serves GET /api/features.
+func (a *app) handleFeatures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.features)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	errFolderNotFound = errors.New("folder not found")
+	errFolderCycle    = errors.New("a folder cannot be moved into itself or one of its subfolders")
+	errFolderNotEmpty = errors.New("folder is not empty")
+)
+
+type folder struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	ParentID  *string `json:"parentId"`
+	CreatedAt string  `json:"createdAt"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+type folderRequest struct {
+	Name     string  `json:"name"`
+	ParentID *string `json:"parentId"`
+}
+
+// handleFolders serves /api/folders CRUD. Diagrams are assigned with
+// PATCH /api/diagrams/{id} {"folderId": ...} and listed with
+// GET /api/diagrams?folderId=....
+func (a *app) handleFolders(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// /api/folders
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			folders, err := a.listFolders(r.Context())
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, folders)
+		case http.MethodPost:
+			var req folderRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+				return
+			}
+			name := strings.TrimSpace(req.Name)
+			if name == "" {
+				writePayloadError(w, invalidField("folder.name", "is required"))
+				return
+			}
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			item := folder{ID: newDiagramID(), Name: name, ParentID: req.ParentID, CreatedAt: now, UpdatedAt: now}
+			if err := a.insertFolder(r.Context(), item); err != nil {
+				writeFolderError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, item)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	if len(parts) != 3 {
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+		return
+	}
+	folderID, err := url.PathUnescape(parts[2])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid folder id")
+		return
+	}
+
+	// /api/folders/{id}
+	switch r.Method {
+	case http.MethodGet:
+		item, err := a.getFolder(r.Context(), folderID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeFolderNotFound, "folder not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, item)
+	case http.MethodPut:
+		var req folderRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			writePayloadError(w, invalidField("folder.name", "is required"))
+			return
+		}
+		item := folder{ID: folderID, Name: name, ParentID: req.ParentID, UpdatedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+		if err := a.updateFolder(r.Context(), item); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeFolderNotFound, "folder not found")
+				return
+			}
+			writeFolderError(w, err)
+			return
+		}
+		updated, err := a.getFolder(r.Context(), folderID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		if err := a.deleteFolder(r.Context(), folderID); err != nil {
+			writeFolderError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeFolderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errFolderNotFound):
+		writeErrorCode(w, http.StatusBadRequest, codeFolderNotFound, err.Error())
+	case errors.Is(err, errFolderCycle):
+		writeErrorCode(w, http.StatusBadRequest, codeFolderCycle, err.Error())
+	case errors.Is(err, errFolderNotEmpty):
+		writeErrorCode(w, http.StatusConflict, codeFolderNotEmpty, err.Error())
+	default:
+		writeServerError(w, err)
+	}
+}
+
+func (a *app) listFolders(ctx context.Context) ([]folder, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT id, name, parent_id, created_at, updated_at FROM folders ORDER BY name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]folder, 0)
+	for rows.Next() {
+		var item folder
+		if err := rows.Scan(&item.ID, &item.Name, &item.ParentID, &item.CreatedAt, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+func (a *app) getFolder(ctx context.Context, folderID string) (folder, error) {
+	var item folder
+	err := a.db.QueryRowContext(ctx, `SELECT id, name, parent_id, created_at, updated_at FROM folders WHERE id = ?`, folderID).
+		Scan(&item.ID, &item.Name, &item.ParentID, &item.CreatedAt, &item.UpdatedAt)
+	return item, err
+}
+
+func (a *app) insertFolder(ctx context.Context, item folder) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+
+		if item.ParentID != nil {
+			if err := checkFolderExists(ctx, tx, *item.ParentID); err != nil {
+				return err
+			}
+		}
+		const query = `
+INSERT INTO folders (id, name, parent_id, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?)`
+		if _, err := tx.ExecContext(ctx, query, item.ID, item.Name, item.ParentID, item.CreatedAt, item.UpdatedAt); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (a *app) updateFolder(ctx context.Context, item folder) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+
+		if item.ParentID != nil {
+			if err := checkFolderExists(ctx, tx, *item.ParentID); err != nil {
+				return err
+			}
+			// Walk up from the new parent; reaching the folder itself means the
+			// move would create a cycle.
+			for ancestor := item.ParentID; ancestor != nil; {
+				if *ancestor == item.ID {
+					return errFolderCycle
+				}
+				var next *string
+				if err := tx.QueryRowContext(ctx, `SELECT parent_id FROM folders WHERE id = ?`, *ancestor).Scan(&next); err != nil {
+					return err
+				}
+				ancestor = next
+			}
+		}
+
+		res, err := tx.ExecContext(ctx, `UPDATE folders SET name = ?, parent_id = ?, updated_at = ? WHERE id = ?`, item.Name, item.ParentID, item.UpdatedAt, item.ID)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// deleteFolder removes an empty folder. Folders still holding subfolders or
+// diagrams (including trashed ones) are rejected.
+func (a *app) deleteFolder(ctx context.Context, folderID string) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+
+		const query = `
+SELECT EXISTS(SELECT 1 FROM folders WHERE parent_id = ?)
+	OR EXISTS(SELECT 1 FROM diagrams WHERE folder_id = ?)`
+		var inUse bool
+		if err := tx.QueryRowContext(ctx, query, folderID, folderID).Scan(&inUse); err != nil {
+			return err
+		}
+		if inUse {
+			return errFolderNotEmpty
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM folders WHERE id = ?`, folderID); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func checkFolderExists(ctx context.Context, q rowQueryer, folderID string) error {
+	var exists bool
+	if err := q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM folders WHERE id = ?)`, folderID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errFolderNotFound
+	}
+	return nil
+}
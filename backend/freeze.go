@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxFreezeReasonLen = 500
+
+// diagramFreeze marks a canonical diagram, such as the schema running in
+// production, as read-only. Unlike a lock it does not expire and is
+// enforced whatever LOCKS_ENFORCE says.
+type diagramFreeze struct {
+	DiagramID string `json:"diagramId"`
+	FrozenBy  string `json:"frozenBy,omitempty"`
+	FrozenAt  string `json:"frozenAt"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// handleDiagramFreeze serves /api/diagrams/{id}/freeze. POST
+// {"reason": "..."} freezes the diagram and DELETE unfreezes it; both are
+// limited to FREEZE_IDENTITIES when it is set. GET returns the freeze with
+// frozen.
+func (a *app) handleDiagramFreeze(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		freeze, err := currentFreeze(r.Context(), a.db, diagramID)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusOK, map[string]bool{"frozen": false})
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Frozen bool `json:"frozen"`
+			diagramFreeze
+		}{true, freeze})
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	actor := requestUserID(r)
+	if len(a.freezeIdentities) > 0 && !a.freezeIdentities[actor] {
+		writeErrorCode(w, http.StatusForbidden, codeForbidden, "only identities listed in FREEZE_IDENTITIES can freeze or unfreeze diagrams")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if _, err := a.db.ExecContext(r.Context(), `DELETE FROM diagram_freezes WHERE diagram_id = ?`, diagramID); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	freeze := diagramFreeze{
+		DiagramID: diagramID,
+		FrozenBy:  actor,
+		FrozenAt:  time.Now().UTC().Format(sortableTimeFormat),
+		Reason:    strings.TrimSpace(req.Reason),
+	}
+	if len(freeze.Reason) > maxFreezeReasonLen {
+		writePayloadError(w, invalidField("reason", "must be at most 500 bytes"))
+		return
+	}
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		exists, err := diagramExists(r.Context(), tx, diagramID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+		// Freezing a frozen diagram again keeps who froze it and when.
+		const query = `
+INSERT INTO diagram_freezes (diagram_id, frozen_by, frozen_at, reason)
+VALUES (?, ?, ?, ?)
+ON CONFLICT(diagram_id) DO UPDATE SET reason = excluded.reason`
+		if _, err := tx.ExecContext(r.Context(), query, freeze.DiagramID, freeze.FrozenBy, freeze.FrozenAt, freeze.Reason); err != nil {
+			return err
+		}
+		freeze, err = scanFreeze(tx.QueryRowContext(r.Context(), `SELECT `+freezeColumns+` FROM diagram_freezes WHERE diagram_id = ?`, diagramID))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, freeze)
+}
+
+const freezeColumns = `diagram_id, COALESCE(frozen_by, ''), frozen_at, COALESCE(reason, '')`
+
+func scanFreeze(row *sql.Row) (diagramFreeze, error) {
+	var freeze diagramFreeze
+	err := row.Scan(&freeze.DiagramID, &freeze.FrozenBy, &freeze.FrozenAt, &freeze.Reason)
+	return freeze, err
+}
+
+func currentFreeze(ctx context.Context, q rowQueryer, diagramID string) (diagramFreeze, error) {
+	return scanFreeze(q.QueryRowContext(ctx, `SELECT `+freezeColumns+` FROM diagram_freezes WHERE diagram_id = ?`, diagramID))
+}
+
+// checkDiagramFrozen returns the freeze a write to the diagram would
+// violate, or nil.
+func checkDiagramFrozen(ctx context.Context, q rowQueryer, diagramID string) (*diagramFreeze, error) {
+	freeze, err := currentFreeze(ctx, q, diagramID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &freeze, nil
+}
+
+func frozenMessage(freeze *diagramFreeze) string {
+	msg := "diagram is frozen"
+	if freeze.Reason != "" {
+		msg += ": " + freeze.Reason
+	}
+	return msg + "; DELETE /api/diagrams/{id}/freeze to change it"
+}
+
+func writeDiagramFrozen(w http.ResponseWriter, freeze *diagramFreeze) {
+	writeAPIErrorWith(w, http.StatusLocked, codeDiagramFrozen, frozenMessage(freeze), nil, map[string]interface{}{"freeze": freeze})
+}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// /api/graphql serves read-only GraphQL queries over diagrams with their
+// tables, relationships, filters and versions, so a dashboard can fetch
+// exactly the fields it needs in one request. Mutations, subscriptions and
+// introspection are not supported; the schema is listed in the README.
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// gqlField is a field of an object type. typ is its GraphQL type, such as
+// "[Table!]!", and args maps argument names to their types.
+type gqlField struct {
+	typ     string
+	args    map[string]string
+	resolve func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+// gqlSchema maps object type names to their fields. Any other named type
+// is a scalar.
+type gqlSchema map[string]map[string]gqlField
+
+// gqlScalars are the scalar types a variable may be declared with.
+var gqlScalars = map[string]bool{"ID": true, "String": true, "Int": true, "Float": true, "Boolean": true, "JSON": true}
+
+// gqlNamedType strips list and non-null wrappers: "[Table!]!" is "Table".
+func gqlNamedType(typ string) string {
+	return strings.Trim(typ, "[]!")
+}
+
+// gqlDiagram is a Diagram's source value. The payload is loaded the first
+// time a field needs it.
+type gqlDiagram struct {
+	meta    diagramMeta
+	payload []byte
+	doc     *diagramDoc
+}
+
+func (a *app) loadGQLDiagramDoc(ctx context.Context, d *gqlDiagram) (*diagramDoc, error) {
+	if d.doc != nil {
+		return d.doc, nil
+	}
+	if d.payload == nil {
+		payload, err := a.getDiagramPayload(ctx, d.meta.ID)
+		if err != nil {
+			return nil, err
+		}
+		d.payload = payload
+	}
+	doc, err := parseDiagramDoc(d.payload)
+	if err != nil {
+		return nil, err
+	}
+	d.doc = &doc
+	return d.doc, nil
+}
+
+// gqlProperty is a field read straight off its source value.
+func gqlProperty[T any](typ string, get func(T) interface{}) gqlField {
+	return gqlField{typ: typ, resolve: func(_ context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+		return get(source.(T)), nil
+	}}
+}
+
+func optionalString(value *string) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+func (a *app) graphQLSchema() gqlSchema {
+	return gqlSchema{
+		"Query": {
+			"diagrams": {
+				typ: "[Diagram!]!",
+				args: map[string]string{
+					"includeArchived": "Boolean",
+					"folderId":        "ID",
+					"starred":         "Boolean",
+					"databaseType":    "String",
+					"nameContains":    "String",
+					"first":           "Int",
+				},
+				resolve: a.gqlDiagrams,
+			},
+			"diagram": {
+				typ:     "Diagram",
+				args:    map[string]string{"id": "ID!"},
+				resolve: a.gqlDiagram,
+			},
+		},
+		"Diagram": {
+			"id":              gqlProperty("ID!", func(d *gqlDiagram) interface{} { return d.meta.ID }),
+			"name":            gqlProperty("String!", func(d *gqlDiagram) interface{} { return d.meta.Name }),
+			"databaseType":    gqlProperty("String!", func(d *gqlDiagram) interface{} { return d.meta.DatabaseType }),
+			"databaseEdition": gqlProperty("String", func(d *gqlDiagram) interface{} { return optionalString(d.meta.DatabaseEdition) }),
+			"createdAt":       gqlProperty("String!", func(d *gqlDiagram) interface{} { return d.meta.CreatedAt }),
+			"updatedAt":       gqlProperty("String!", func(d *gqlDiagram) interface{} { return d.meta.UpdatedAt }),
+			"archived":        gqlProperty("Boolean!", func(d *gqlDiagram) interface{} { return d.meta.Archived }),
+			"folderId":        gqlProperty("ID", func(d *gqlDiagram) interface{} { return optionalString(d.meta.FolderID) }),
+			"starred":         gqlProperty("Boolean!", func(d *gqlDiagram) interface{} { return d.meta.Starred }),
+			"payloadBytes":    gqlProperty("Int!", func(d *gqlDiagram) interface{} { return d.meta.PayloadBytes }),
+			"document": {typ: "JSON!", resolve: func(ctx context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+				d := source.(*gqlDiagram)
+				if _, err := a.loadGQLDiagramDoc(ctx, d); err != nil {
+					return nil, err
+				}
+				return json.RawMessage(d.payload), nil
+			}},
+			"tables": {
+				typ:     "[Table!]!",
+				args:    map[string]string{"schema": "String", "nameContains": "String"},
+				resolve: a.gqlTables,
+			},
+			"tableCount": {typ: "Int!", resolve: func(ctx context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+				doc, err := a.loadGQLDiagramDoc(ctx, source.(*gqlDiagram))
+				if err != nil {
+					return nil, err
+				}
+				return len(doc.Tables), nil
+			}},
+			"relationships": {typ: "[Relationship!]!", resolve: func(ctx context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+				doc, err := a.loadGQLDiagramDoc(ctx, source.(*gqlDiagram))
+				if err != nil {
+					return nil, err
+				}
+				if doc.Relationships == nil {
+					return []dbRelationship{}, nil
+				}
+				return doc.Relationships, nil
+			}},
+			"filter": {typ: "JSON", resolve: func(ctx context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+				filter, err := a.getDiagramFilter(ctx, source.(*gqlDiagram).meta.ID)
+				if errors.Is(err, sql.ErrNoRows) {
+					return nil, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				return json.RawMessage(filter), nil
+			}},
+			"versions": {
+				typ:     "[Version!]!",
+				args:    map[string]string{"first": "Int", "action": "String", "pinned": "Boolean"},
+				resolve: a.gqlVersions,
+			},
+		},
+		"Table": {
+			"id":       gqlProperty("ID!", func(t dbTable) interface{} { return t.ID }),
+			"name":     gqlProperty("String!", func(t dbTable) interface{} { return t.Name }),
+			"schema":   gqlProperty("String", func(t dbTable) interface{} { return nonEmpty(t.Schema) }),
+			"isView":   gqlProperty("Boolean!", func(t dbTable) interface{} { return t.IsView }),
+			"comments": gqlProperty("String", func(t dbTable) interface{} { return nonEmpty(t.Comments) }),
+			"fields": gqlProperty("[Field!]!", func(t dbTable) interface{} {
+				if t.Fields == nil {
+					return []dbField{}
+				}
+				return t.Fields
+			}),
+			"indexes": gqlProperty("[Index!]!", func(t dbTable) interface{} {
+				if t.Indexes == nil {
+					return []dbIndex{}
+				}
+				return t.Indexes
+			}),
+		},
+		"Field": {
+			"id":                     gqlProperty("ID!", func(f dbField) interface{} { return f.ID }),
+			"name":                   gqlProperty("String!", func(f dbField) interface{} { return f.Name }),
+			"type":                   gqlProperty("String!", func(f dbField) interface{} { return f.Type.Name }),
+			"primaryKey":             gqlProperty("Boolean!", func(f dbField) interface{} { return f.PrimaryKey }),
+			"unique":                 gqlProperty("Boolean!", func(f dbField) interface{} { return f.Unique }),
+			"nullable":               gqlProperty("Boolean!", func(f dbField) interface{} { return f.Nullable }),
+			"increment":              gqlProperty("Boolean!", func(f dbField) interface{} { return f.Increment }),
+			"isArray":                gqlProperty("Boolean!", func(f dbField) interface{} { return f.IsArray }),
+			"characterMaximumLength": gqlProperty("String", func(f dbField) interface{} { return nonEmpty(f.CharacterMaximumLength) }),
+			"default":                gqlProperty("String", func(f dbField) interface{} { return nonEmpty(f.Default) }),
+			"comments":               gqlProperty("String", func(f dbField) interface{} { return nonEmpty(f.Comments) }),
+		},
+		"Index": {
+			"id":           gqlProperty("ID!", func(i dbIndex) interface{} { return i.ID }),
+			"name":         gqlProperty("String!", func(i dbIndex) interface{} { return i.Name }),
+			"unique":       gqlProperty("Boolean!", func(i dbIndex) interface{} { return i.Unique }),
+			"isPrimaryKey": gqlProperty("Boolean!", func(i dbIndex) interface{} { return i.IsPrimaryKey }),
+			"fieldIds": gqlProperty("[ID!]!", func(i dbIndex) interface{} {
+				if i.FieldIDs == nil {
+					return []string{}
+				}
+				return i.FieldIDs
+			}),
+		},
+		"Relationship": {
+			"id":                gqlProperty("ID!", func(r dbRelationship) interface{} { return r.ID }),
+			"name":              gqlProperty("String!", func(r dbRelationship) interface{} { return r.Name }),
+			"sourceTableId":     gqlProperty("ID!", func(r dbRelationship) interface{} { return r.SourceTableID }),
+			"targetTableId":     gqlProperty("ID!", func(r dbRelationship) interface{} { return r.TargetTableID }),
+			"sourceFieldId":     gqlProperty("ID!", func(r dbRelationship) interface{} { return r.SourceFieldID }),
+			"targetFieldId":     gqlProperty("ID!", func(r dbRelationship) interface{} { return r.TargetFieldID }),
+			"sourceCardinality": gqlProperty("String!", func(r dbRelationship) interface{} { return r.SourceCardinality }),
+			"targetCardinality": gqlProperty("String!", func(r dbRelationship) interface{} { return r.TargetCardinality }),
+		},
+		"Version": {
+			"id":        gqlProperty("Int!", func(v diagramVersion) interface{} { return v.ID }),
+			"name":      gqlProperty("String!", func(v diagramVersion) interface{} { return v.Name }),
+			"action":    gqlProperty("String!", func(v diagramVersion) interface{} { return v.Action }),
+			"message":   gqlProperty("String", func(v diagramVersion) interface{} { return nonEmpty(v.Message) }),
+			"pinned":    gqlProperty("Boolean!", func(v diagramVersion) interface{} { return v.Pinned }),
+			"createdAt": gqlProperty("String!", func(v diagramVersion) interface{} { return v.CreatedAt }),
+			"document": {typ: "JSON!", resolve: func(ctx context.Context, source interface{}, _ map[string]interface{}) (interface{}, error) {
+				v := source.(diagramVersion)
+				payload, err := a.getVersionPayload(ctx, v.DiagramID, v.ID)
+				if err != nil {
+					return nil, err
+				}
+				return json.RawMessage(payload), nil
+			}},
+		},
+	}
+}
+
+// nonEmpty reports empty optional strings as null.
+func nonEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func gqlStringArg(args map[string]interface{}, name string) string {
+	value, _ := args[name].(string)
+	return value
+}
+
+func gqlBoolArg(args map[string]interface{}, name string) bool {
+	value, _ := args[name].(bool)
+	return value
+}
+
+// gqlFirstArg returns the "first" argument, or -1 when it was not given.
+func gqlFirstArg(args map[string]interface{}) (int, error) {
+	first, ok := args["first"].(int)
+	if !ok {
+		return -1, nil
+	}
+	if first < 0 {
+		return 0, errors.New("first must not be negative")
+	}
+	return first, nil
+}
+
+func (a *app) gqlDiagrams(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+	first, err := gqlFirstArg(args)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := requestIdentity(ctx)
+	metas, err := a.listDiagramMetas(ctx, diagramListFilter{
+		includeArchived: gqlBoolArg(args, "includeArchived"),
+		folderID:        gqlStringArg(args, "folderId"),
+		starredOnly:     gqlBoolArg(args, "starred"),
+		userID:          id.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	databaseType := gqlStringArg(args, "databaseType")
+	nameContains := strings.ToLower(gqlStringArg(args, "nameContains"))
+	diagrams := make([]*gqlDiagram, 0, len(metas))
+	for _, meta := range metas {
+		if first >= 0 && len(diagrams) == first {
+			break
+		}
+		if databaseType != "" && meta.DatabaseType != databaseType {
+			continue
+		}
+		if nameContains != "" && !strings.Contains(strings.ToLower(meta.Name), nameContains) {
+			continue
+		}
+		diagrams = append(diagrams, &gqlDiagram{meta: meta})
+	}
+	return diagrams, nil
+}
+
+func (a *app) gqlDiagram(ctx context.Context, _ interface{}, args map[string]interface{}) (interface{}, error) {
+	if gqlStringArg(args, "id") == "" {
+		return nil, nil
+	}
+	id, _ := requestIdentity(ctx)
+	metas, err := a.listDiagramMetas(ctx, diagramListFilter{
+		includeArchived: true,
+		userID:          id.ID,
+		diagramID:       gqlStringArg(args, "id"),
+	})
+	if err != nil || len(metas) == 0 {
+		return nil, err
+	}
+	return &gqlDiagram{meta: metas[0]}, nil
+}
+
+func (a *app) gqlTables(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+	doc, err := a.loadGQLDiagramDoc(ctx, source.(*gqlDiagram))
+	if err != nil {
+		return nil, err
+	}
+	schema, schemaGiven := args["schema"].(string)
+	nameContains := strings.ToLower(gqlStringArg(args, "nameContains"))
+	tables := make([]dbTable, 0, len(doc.Tables))
+	for _, table := range doc.Tables {
+		if schemaGiven && table.Schema != schema {
+			continue
+		}
+		if nameContains != "" && !strings.Contains(strings.ToLower(table.Name), nameContains) {
+			continue
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func (a *app) gqlVersions(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+	first, err := gqlFirstArg(args)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := a.listVersions(ctx, source.(*gqlDiagram).meta.ID)
+	if err != nil {
+		return nil, err
+	}
+	action := gqlStringArg(args, "action")
+	pinned, pinnedGiven := args["pinned"].(bool)
+	result := make([]diagramVersion, 0, len(versions))
+	for _, version := range versions {
+		if first >= 0 && len(result) == first {
+			break
+		}
+		if action != "" && version.Action != action {
+			continue
+		}
+		if pinnedGiven && version.Pinned != pinned {
+			continue
+		}
+		result = append(result, version)
+	}
+	return result, nil
+}
+
+func (a *app) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if raw := query.Get("variables"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &req.Variables); err != nil {
+				writeError(w, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeGraphQLErrors(w, http.StatusBadRequest, []*gqlError{{Message: "query is required"}})
+		return
+	}
+
+	executor, errs := prepareGraphQL(a.graphQLSchema(), req)
+	if len(errs) > 0 {
+		writeGraphQLErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+	data := executor.run(r.Context())
+	writeJSON(w, http.StatusOK, struct {
+		Data   gqlObject   `json:"data"`
+		Errors []*gqlError `json:"errors,omitempty"`
+	}{Data: data, Errors: executor.errors})
+}
+
+// writeGraphQLErrors reports a request that could not be executed at all.
+func writeGraphQLErrors(w http.ResponseWriter, status int, errs []*gqlError) {
+	writeJSON(w, status, map[string]interface{}{"errors": errs})
+}
+
+type gqlExecutor struct {
+	schema    gqlSchema
+	fragments map[string]*gqlFragment
+	operation *gqlOperation
+	variables map[string]interface{}
+	errors    []*gqlError
+}
+
+// prepareGraphQL parses and validates a request and coerces its variables,
+// returning the errors that keep it from running.
+func prepareGraphQL(schema gqlSchema, req graphQLRequest) (*gqlExecutor, []*gqlError) {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, []*gqlError{asGQLError(err)}
+	}
+	var operation *gqlOperation
+	for _, op := range doc.operations {
+		if req.OperationName == "" || op.name == req.OperationName {
+			if operation != nil {
+				return nil, []*gqlError{{Message: "operationName is required when the document has several operations"}}
+			}
+			operation = op
+		}
+	}
+	if operation == nil {
+		return nil, []*gqlError{{Message: fmt.Sprintf("unknown operation %q", req.OperationName)}}
+	}
+	if operation.kind != "query" {
+		return nil, []*gqlError{gqlErrorAt(operation.line, operation.col, "only queries are supported, not %ss", operation.kind)}
+	}
+
+	v := &gqlValidator{schema: schema, fragments: doc.fragments, fragmentFields: map[string]int{}, visiting: map[string]bool{}, variables: map[string]string{}}
+	variables := make(map[string]interface{}, len(operation.variables))
+	for _, def := range operation.variables {
+		if _, exists := v.variables[def.name]; exists {
+			v.errorf(def.line, def.col, "there can be only one variable named $%s", def.name)
+			continue
+		}
+		v.variables[def.name] = def.typ
+		if !gqlScalars[gqlNamedType(def.typ)] || strings.HasPrefix(def.typ, "[") {
+			v.errorf(def.line, def.col, "variable $%s cannot have type %s", def.name, def.typ)
+			continue
+		}
+		value, given := req.Variables[def.name]
+		if !given && def.def != nil {
+			value = def.def.resolve(nil)
+		}
+		coerced, err := coerceGQLInput(def.typ, value)
+		if err != nil {
+			v.errorf(def.line, def.col, "variable $%s: %s", def.name, err.Error())
+			continue
+		}
+		variables[def.name] = coerced
+	}
+	fields := v.selections("Query", operation.selections)
+	if fields > maxGraphQLFields && len(v.errors) == 0 {
+		v.errorf(operation.line, operation.col, "the query selects more than %d fields", maxGraphQLFields)
+	}
+	if len(v.errors) > 0 {
+		return nil, v.errors
+	}
+	return &gqlExecutor{schema: schema, fragments: doc.fragments, operation: operation, variables: variables}, nil
+}
+
+func asGQLError(err error) *gqlError {
+	var gqlErr *gqlError
+	if errors.As(err, &gqlErr) {
+		return gqlErr
+	}
+	return &gqlError{Message: err.Error()}
+}
+
+// gqlValidator checks a query against the schema before anything runs.
+// Fragments are validated once against their type condition; the field
+// count includes every spread, so nested fragments cannot amplify a small
+// document into a huge query.
+type gqlValidator struct {
+	schema         gqlSchema
+	fragments      map[string]*gqlFragment
+	fragmentFields map[string]int
+	visiting       map[string]bool
+	variables      map[string]string
+	errors         []*gqlError
+}
+
+func (v *gqlValidator) errorf(line, col int, format string, args ...interface{}) {
+	v.errors = append(v.errors, gqlErrorAt(line, col, format, args...))
+}
+
+// selections validates a selection set on typeName and returns the number
+// of fields it selects, fragments expanded.
+func (v *gqlValidator) selections(typeName string, selections []*gqlSelection) int {
+	count := 0
+	for _, s := range selections {
+		v.directives(s)
+		switch s.kind {
+		case gqlFragmentSpread:
+			fragment, ok := v.fragments[s.name]
+			if !ok {
+				v.errorf(s.line, s.col, "unknown fragment %q", s.name)
+				continue
+			}
+			if fragment.typeCondition != typeName {
+				v.errorf(s.line, s.col, "fragment %q on %s cannot be spread on %s", s.name, fragment.typeCondition, typeName)
+				continue
+			}
+			count += v.fragment(fragment)
+		case gqlInlineFragment:
+			if s.typeCondition != "" && s.typeCondition != typeName {
+				v.errorf(s.line, s.col, "an inline fragment on %s cannot be spread on %s", s.typeCondition, typeName)
+				continue
+			}
+			count += v.selections(typeName, s.selections)
+		default:
+			count += 1 + v.field(typeName, s)
+		}
+	}
+	return count
+}
+
+func (v *gqlValidator) fragment(fragment *gqlFragment) int {
+	if count, done := v.fragmentFields[fragment.name]; done {
+		return count
+	}
+	if v.visiting[fragment.name] {
+		v.errorf(fragment.line, fragment.col, "fragment %q spreads itself", fragment.name)
+		return 0
+	}
+	v.visiting[fragment.name] = true
+	count := 0
+	if _, ok := v.schema[fragment.typeCondition]; ok {
+		count = v.selections(fragment.typeCondition, fragment.selections)
+	} else {
+		v.errorf(fragment.line, fragment.col, "unknown type %q", fragment.typeCondition)
+	}
+	delete(v.visiting, fragment.name)
+	// Saturate so repeated spreads cannot overflow the count.
+	v.fragmentFields[fragment.name] = min(count, maxGraphQLFields+1)
+	return v.fragmentFields[fragment.name]
+}
+
+func (v *gqlValidator) field(typeName string, s *gqlSelection) int {
+	if s.name == "__typename" {
+		if s.args != nil || s.selections != nil {
+			v.errorf(s.line, s.col, "field \"__typename\" takes no arguments or subfields")
+		}
+		return 0
+	}
+	def, ok := v.schema[typeName][s.name]
+	if !ok {
+		v.errorf(s.line, s.col, "cannot query field %q on type %s", s.name, typeName)
+		return 0
+	}
+	given := map[string]bool{}
+	for _, arg := range s.args {
+		if _, ok := def.args[arg.name]; !ok {
+			v.errorf(s.line, s.col, "unknown argument %q on field %s.%s", arg.name, typeName, s.name)
+		}
+		if given[arg.name] {
+			v.errorf(s.line, s.col, "argument %q is given twice", arg.name)
+		}
+		given[arg.name] = true
+		v.value(s, arg.value)
+	}
+	for name, typ := range def.args {
+		if strings.HasSuffix(typ, "!") && !given[name] {
+			v.errorf(s.line, s.col, "field %s.%s requires argument %q of type %s", typeName, s.name, name, typ)
+		}
+	}
+	named := gqlNamedType(def.typ)
+	if _, object := v.schema[named]; object {
+		if s.selections == nil {
+			v.errorf(s.line, s.col, "field %q of type %s must have a selection of subfields", s.name, def.typ)
+			return 0
+		}
+		return v.selections(named, s.selections)
+	}
+	if s.selections != nil {
+		v.errorf(s.line, s.col, "field %q of type %s has no subfields", s.name, def.typ)
+	}
+	return 0
+}
+
+func (v *gqlValidator) directives(s *gqlSelection) {
+	for _, d := range s.directives {
+		if d.name != "skip" && d.name != "include" {
+			v.errorf(d.line, d.col, "unknown directive @%s", d.name)
+			continue
+		}
+		if len(d.args) != 1 || d.args[0].name != "if" {
+			v.errorf(d.line, d.col, "directive @%s takes a single \"if\" argument", d.name)
+			continue
+		}
+		v.value(s, d.args[0].value)
+	}
+}
+
+// value checks that the variables a literal refers to are declared.
+func (v *gqlValidator) value(s *gqlSelection, value gqlValue) {
+	switch value.kind {
+	case gqlVariableValue:
+		if _, ok := v.variables[value.raw]; !ok {
+			v.errorf(s.line, s.col, "variable $%s is not defined", value.raw)
+		}
+	case gqlListValue:
+		for _, item := range value.list {
+			v.value(s, item)
+		}
+	case gqlObjectValue:
+		for _, field := range value.fields {
+			v.value(s, field.value)
+		}
+	}
+}
+
+// coerceGQLInput converts an argument or variable value to typ: Int to
+// int, Float to float64, ID, String and enum values to string.
+func coerceGQLInput(typ string, value interface{}) (interface{}, error) {
+	if value == nil {
+		if strings.HasSuffix(typ, "!") {
+			return nil, fmt.Errorf("a value of type %s is required", typ)
+		}
+		return nil, nil
+	}
+	mismatch := fmt.Errorf("expected a value of type %s", strings.TrimSuffix(typ, "!"))
+	switch gqlNamedType(typ) {
+	case "Int":
+		switch n := value.(type) {
+		case int:
+			return n, nil
+		case int64:
+			if n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int(n), nil
+			}
+		case float64:
+			if n == math.Trunc(n) && n >= math.MinInt32 && n <= math.MaxInt32 {
+				return int(n), nil
+			}
+		}
+	case "Float":
+		switch n := value.(type) {
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case "String":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case "ID":
+		switch id := value.(type) {
+		case string:
+			return id, nil
+		case int:
+			return strconv.Itoa(id), nil
+		case int64:
+			return strconv.FormatInt(id, 10), nil
+		case float64:
+			if id == math.Trunc(id) {
+				return strconv.FormatFloat(id, 'f', -1, 64), nil
+			}
+		}
+	case "JSON":
+		return value, nil
+	}
+	return nil, mismatch
+}
+
+// gqlObject is a result object; it keeps its fields in query order.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, entry := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(entry.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (e *gqlExecutor) run(ctx context.Context) gqlObject {
+	return e.object(ctx, "Query", nil, [][]*gqlSelection{e.operation.selections}, nil)
+}
+
+func (e *gqlExecutor) fail(s *gqlSelection, path []interface{}, err error) {
+	message := err.Error()
+	if errors.Is(err, errDatabaseBusy) || isBusyError(err) {
+		message = errDatabaseBusy.Error()
+	}
+	e.errors = append(e.errors, &gqlError{
+		Message:   message,
+		Locations: []gqlLocation{{Line: s.line, Column: s.col}},
+		Path:      path,
+	})
+}
+
+// object resolves the fields selected on one value. Selection sets are
+// passed as a list so fields requested twice under the same key merge.
+func (e *gqlExecutor) object(ctx context.Context, typeName string, source interface{}, sets [][]*gqlSelection, path []interface{}) gqlObject {
+	keys := make([]string, 0)
+	fields := map[string][]*gqlSelection{}
+	for _, set := range sets {
+		e.collect(set, &keys, fields)
+	}
+	result := make(gqlObject, 0, len(keys))
+	for _, key := range keys {
+		group := fields[key]
+		fieldPath := append(append(make([]interface{}, 0, len(path)+1), path...), key)
+		result = append(result, gqlEntry{key: key, value: e.field(ctx, typeName, source, group, fieldPath)})
+	}
+	return result
+}
+
+func (e *gqlExecutor) collect(selections []*gqlSelection, keys *[]string, fields map[string][]*gqlSelection) {
+	for _, s := range selections {
+		if !e.included(s) {
+			continue
+		}
+		switch s.kind {
+		case gqlFragmentSpread:
+			e.collect(e.fragments[s.name].selections, keys, fields)
+		case gqlInlineFragment:
+			e.collect(s.selections, keys, fields)
+		default:
+			key := s.responseKey()
+			if _, seen := fields[key]; !seen {
+				*keys = append(*keys, key)
+			}
+			fields[key] = append(fields[key], s)
+		}
+	}
+}
+
+func (e *gqlExecutor) included(s *gqlSelection) bool {
+	for _, d := range s.directives {
+		condition, _ := d.args[0].value.resolve(e.variables).(bool)
+		if (d.name == "skip" && condition) || (d.name == "include" && !condition) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *gqlExecutor) field(ctx context.Context, typeName string, source interface{}, group []*gqlSelection, path []interface{}) interface{} {
+	s := group[0]
+	if s.name == "__typename" {
+		return typeName
+	}
+	for _, other := range group[1:] {
+		if other.name != s.name {
+			e.fail(other, path, fmt.Errorf("fields %q and %q both use the key %q", s.name, other.name, s.responseKey()))
+			return nil
+		}
+	}
+	def := e.schema[typeName][s.name]
+	args := make(map[string]interface{}, len(s.args))
+	for _, arg := range s.args {
+		value, err := coerceGQLInput(def.args[arg.name], arg.value.resolve(e.variables))
+		if err != nil {
+			e.fail(s, path, fmt.Errorf("argument %q: %w", arg.name, err))
+			return nil
+		}
+		if value != nil {
+			args[arg.name] = value
+		}
+	}
+	value, err := def.resolve(ctx, source, args)
+	if err != nil {
+		e.fail(s, path, err)
+		return nil
+	}
+	sets := make([][]*gqlSelection, len(group))
+	for i, field := range group {
+		sets[i] = field.selections
+	}
+	return e.complete(ctx, def.typ, value, s, sets, path)
+}
+
+// complete shapes a resolved value to its type: lists item by item, objects
+// by their selection sets, scalars as they are.
+func (e *gqlExecutor) complete(ctx context.Context, typ string, value interface{}, s *gqlSelection, sets [][]*gqlSelection, path []interface{}) interface{} {
+	if value == nil {
+		if strings.HasSuffix(typ, "!") {
+			e.fail(s, path, fmt.Errorf("field %q returned null for a non-null type", s.name))
+		}
+		return nil
+	}
+	typ = strings.TrimSuffix(typ, "!")
+	if strings.HasPrefix(typ, "[") {
+		items := reflect.ValueOf(value)
+		list := make([]interface{}, items.Len())
+		for i := range list {
+			itemPath := append(append(make([]interface{}, 0, len(path)+1), path...), i)
+			list[i] = e.complete(ctx, typ[1:len(typ)-1], items.Index(i).Interface(), s, sets, itemPath)
+		}
+		return list
+	}
+	if _, object := e.schema[typ]; object {
+		return e.object(ctx, typ, value, sets, path)
+	}
+	return value
+}
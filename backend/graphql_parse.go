@@ -0,0 +1,746 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A parser for the executable subset of GraphQL documents: operations with
+// variables, fields with aliases, arguments and directives, and named and
+// inline fragments. Type system definitions are not accepted.
+
+// maxGraphQLFields bounds the fields in one document, since aliases let a
+// short query ask for the same expensive field many times.
+const maxGraphQLFields = 1000
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	line  int
+	col   int
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlError is an entry of the response's "errors" list.
+type gqlError struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []interface{} `json:"path,omitempty"`
+}
+
+func (e *gqlError) Error() string { return e.Message }
+
+func gqlErrorAt(line, col int, format string, args ...interface{}) *gqlError {
+	return &gqlError{Message: fmt.Sprintf(format, args...), Locations: []gqlLocation{{Line: line, Column: col}}}
+}
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+	tokens := make([]gqlToken, 0, len(src)/4)
+	line, lineStart := 1, 0
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		col := i - lineStart + 1
+		switch {
+		case c == '\n':
+			i++
+			line, lineStart = line+1, i
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "\uFEFF"):
+			i += len("\uFEFF")
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{kind: gqlPunct, value: "...", line: line, col: col})
+			i += 3
+		case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+			tokens = append(tokens, gqlToken{kind: gqlPunct, value: string(c), line: line, col: col})
+			i++
+		case c == '_' || isASCIILetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || isASCIILetter(src[i]) || isASCIIDigit(src[i])) {
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind: gqlName, value: src[start:i], line: line, col: col})
+		case c == '-' || isASCIIDigit(c):
+			start, kind := i, gqlInt
+			if c == '-' {
+				i++
+			}
+			digits := i
+			for i < len(src) && isASCIIDigit(src[i]) {
+				i++
+			}
+			if i == digits || (src[digits] == '0' && i-digits > 1) {
+				return nil, gqlErrorAt(line, col, "invalid number")
+			}
+			if i < len(src) && src[i] == '.' {
+				kind = gqlFloat
+				i++
+				fraction := i
+				for i < len(src) && isASCIIDigit(src[i]) {
+					i++
+				}
+				if i == fraction {
+					return nil, gqlErrorAt(line, col, "invalid number")
+				}
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				kind = gqlFloat
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				exponent := i
+				for i < len(src) && isASCIIDigit(src[i]) {
+					i++
+				}
+				if i == exponent {
+					return nil, gqlErrorAt(line, col, "invalid number")
+				}
+			}
+			tokens = append(tokens, gqlToken{kind: kind, value: src[start:i], line: line, col: col})
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(strings.ReplaceAll(src[i+3:], `\"""`, "\x00\x00\x00\x00"), `"""`)
+			if end < 0 {
+				return nil, gqlErrorAt(line, col, "unterminated string")
+			}
+			raw := src[i+3 : i+3+end]
+			tokens = append(tokens, gqlToken{kind: gqlString, value: blockStringValue(raw), line: line, col: col})
+			line += strings.Count(raw, "\n")
+			if newline := strings.LastIndexByte(raw, '\n'); newline >= 0 {
+				lineStart = i + 3 + newline + 1
+			}
+			i += 3 + end + 3
+		case c == '"':
+			value, n, err := lexGraphQLString(src[i:])
+			if err != nil {
+				return nil, gqlErrorAt(line, col, "%s", err.Error())
+			}
+			tokens = append(tokens, gqlToken{kind: gqlString, value: value, line: line, col: col})
+			i += n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, gqlErrorAt(line, col, "unexpected character %q", r)
+		}
+	}
+	return append(tokens, gqlToken{kind: gqlEOF, line: line, col: i - lineStart + 1}), nil
+}
+
+// lexGraphQLString decodes the quoted string at the start of src and
+// returns it with the number of bytes consumed.
+func lexGraphQLString(src string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, fmt.Errorf("unterminated string")
+		case c == '\\':
+			if i+1 >= len(src) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			escapes := map[byte]string{'"': `"`, '\\': `\`, '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}
+			if replacement, ok := escapes[src[i+1]]; ok {
+				b.WriteString(replacement)
+				i += 2
+				continue
+			}
+			if src[i+1] != 'u' || i+6 > len(src) {
+				return "", 0, fmt.Errorf("invalid escape sequence")
+			}
+			code, err := strconv.ParseUint(src[i+2:i+6], 16, 32)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid escape sequence")
+			}
+			b.WriteRune(rune(code))
+			i += 6
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// blockStringValue strips the common indentation and the blank first and
+// last lines of a """block string""".
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(raw, `\"""`, `"""`), "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = strings.TrimLeft(lines[i], " \t")
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isASCIILetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+func isASCIIDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind       string // query, mutation or subscription
+	name       string
+	variables  []gqlVariableDef
+	selections []*gqlSelection
+	line, col  int
+}
+
+type gqlVariableDef struct {
+	name      string
+	typ       string
+	def       *gqlValue
+	line, col int
+}
+
+type gqlFragment struct {
+	name          string
+	typeCondition string
+	directives    []gqlDirective
+	selections    []*gqlSelection
+	line, col     int
+}
+
+type gqlSelectionKind int
+
+const (
+	gqlFieldSelection gqlSelectionKind = iota
+	gqlFragmentSpread
+	gqlInlineFragment
+)
+
+// gqlSelection is a field, a fragment spread (name holds the fragment) or
+// an inline fragment.
+type gqlSelection struct {
+	kind          gqlSelectionKind
+	alias         string
+	name          string
+	args          []gqlArgument
+	directives    []gqlDirective
+	typeCondition string
+	selections    []*gqlSelection
+	line, col     int
+}
+
+// responseKey is the field's key in the result: its alias or its name.
+func (s *gqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlArgument struct {
+	name  string
+	value gqlValue
+}
+
+type gqlDirective struct {
+	name      string
+	args      []gqlArgument
+	line, col int
+}
+
+type gqlValueKind int
+
+const (
+	gqlVariableValue gqlValueKind = iota
+	gqlIntValue
+	gqlFloatValue
+	gqlStringValue
+	gqlBoolValue
+	gqlNullValue
+	gqlEnumValue
+	gqlListValue
+	gqlObjectValue
+)
+
+type gqlValue struct {
+	kind   gqlValueKind
+	raw    string
+	list   []gqlValue
+	fields []gqlArgument
+}
+
+// resolve turns a literal into a Go value, substituting variables.
+func (v gqlValue) resolve(variables map[string]interface{}) interface{} {
+	switch v.kind {
+	case gqlVariableValue:
+		return variables[v.raw]
+	case gqlIntValue:
+		n, err := strconv.ParseInt(v.raw, 10, 64)
+		if err != nil {
+			f, _ := strconv.ParseFloat(v.raw, 64)
+			return f
+		}
+		return n
+	case gqlFloatValue:
+		f, _ := strconv.ParseFloat(v.raw, 64)
+		return f
+	case gqlStringValue, gqlEnumValue:
+		return v.raw
+	case gqlBoolValue:
+		return v.raw == "true"
+	case gqlListValue:
+		list := make([]interface{}, len(v.list))
+		for i, item := range v.list {
+			list[i] = item.resolve(variables)
+		}
+		return list
+	case gqlObjectValue:
+		object := make(map[string]interface{}, len(v.fields))
+		for _, field := range v.fields {
+			object[field.name] = field.value.resolve(variables)
+		}
+		return object
+	}
+	return nil
+}
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+	fields int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.peek().kind != gqlEOF {
+		tok := p.peek()
+		switch {
+		case tok.kind == gqlPunct && tok.value == "{":
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: selections, line: tok.line, col: tok.col})
+		case tok.kind == gqlName && (tok.value == "query" || tok.value == "mutation" || tok.value == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case tok.kind == gqlName && tok.value == "fragment":
+			fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := doc.fragments[fragment.name]; exists {
+				return nil, gqlErrorAt(fragment.line, fragment.col, "there can be only one fragment named %q", fragment.name)
+			}
+			doc.fragments[fragment.name] = fragment
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &gqlError{Message: "the document contains no operation"}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken { return p.tokens[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != gqlEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *gqlParser) peekPunct(value string) bool {
+	tok := p.peek()
+	return tok.kind == gqlPunct && tok.value == value
+}
+
+func (p *gqlParser) unexpected() error {
+	tok := p.peek()
+	if tok.kind == gqlEOF {
+		return gqlErrorAt(tok.line, tok.col, "unexpected end of document")
+	}
+	return gqlErrorAt(tok.line, tok.col, "unexpected %q", tok.value)
+}
+
+func (p *gqlParser) expectPunct(value string) error {
+	if !p.peekPunct(value) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) name() (gqlToken, error) {
+	if p.peek().kind != gqlName {
+		return gqlToken{}, p.unexpected()
+	}
+	return p.next(), nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	kind := p.next()
+	op := &gqlOperation{kind: kind.value, line: kind.line, col: kind.col}
+	if p.peek().kind == gqlName {
+		op.name = p.next().value
+	}
+	if p.peekPunct("(") {
+		p.next()
+		for !p.peekPunct(")") {
+			def, err := p.variableDef()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+		p.next()
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *gqlParser) variableDef() (gqlVariableDef, error) {
+	dollar := p.peek()
+	if err := p.expectPunct("$"); err != nil {
+		return gqlVariableDef{}, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return gqlVariableDef{}, err
+	}
+	if err := p.expectPunct(":"); err != nil {
+		return gqlVariableDef{}, err
+	}
+	typ, err := p.typeRef()
+	if err != nil {
+		return gqlVariableDef{}, err
+	}
+	def := gqlVariableDef{name: name.value, typ: typ, line: dollar.line, col: dollar.col}
+	if p.peekPunct("=") {
+		p.next()
+		value, err := p.value(true)
+		if err != nil {
+			return gqlVariableDef{}, err
+		}
+		def.def = &value
+	}
+	if _, err := p.directives(); err != nil {
+		return gqlVariableDef{}, err
+	}
+	return def, nil
+}
+
+// typeRef parses a type such as [String!]! back into its text.
+func (p *gqlParser) typeRef() (string, error) {
+	var typ string
+	if p.peekPunct("[") {
+		p.next()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name.value
+	}
+	if p.peekPunct("!") {
+		p.next()
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	keyword := p.next()
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name.value == "on" {
+		return nil, gqlErrorAt(name.line, name.col, "a fragment cannot be named \"on\"")
+	}
+	if on := p.peek(); on.kind != gqlName || on.value != "on" {
+		return nil, p.unexpected()
+	}
+	p.next()
+	typeCondition, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	directives, err := p.directives()
+	if err != nil {
+		return nil, err
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	return &gqlFragment{
+		name:          name.value,
+		typeCondition: typeCondition.value,
+		directives:    directives,
+		selections:    selections,
+		line:          keyword.line,
+		col:           keyword.col,
+	}, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	selections := make([]*gqlSelection, 0)
+	for !p.peekPunct("}") {
+		selection, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	p.next()
+	if len(selections) == 0 {
+		tok := p.tokens[p.pos-1]
+		return nil, gqlErrorAt(tok.line, tok.col, "a selection set cannot be empty")
+	}
+	return selections, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	start := p.peek()
+	if p.peekPunct("...") {
+		p.next()
+		selection := &gqlSelection{line: start.line, col: start.col}
+		if tok := p.peek(); tok.kind == gqlName && tok.value != "on" {
+			selection.kind = gqlFragmentSpread
+			selection.name = p.next().value
+		} else {
+			selection.kind = gqlInlineFragment
+			if tok.kind == gqlName {
+				p.next()
+				typeCondition, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				selection.typeCondition = typeCondition.value
+			}
+		}
+		directives, err := p.directives()
+		if err != nil {
+			return nil, err
+		}
+		selection.directives = directives
+		if selection.kind == gqlInlineFragment {
+			if selection.selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		return selection, nil
+	}
+
+	p.fields++
+	if p.fields > maxGraphQLFields {
+		return nil, gqlErrorAt(start.line, start.col, "the document selects more than %d fields", maxGraphQLFields)
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	selection := &gqlSelection{kind: gqlFieldSelection, name: name.value, line: name.line, col: name.col}
+	if p.peekPunct(":") {
+		p.next()
+		field, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		selection.alias, selection.name = name.value, field.value
+	}
+	if selection.args, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if selection.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peekPunct("{") {
+		if selection.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return selection, nil
+}
+
+func (p *gqlParser) arguments(constant bool) ([]gqlArgument, error) {
+	if !p.peekPunct("(") {
+		return nil, nil
+	}
+	p.next()
+	args := make([]gqlArgument, 0)
+	for !p.peekPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.value(constant)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, gqlArgument{name: name.value, value: value})
+	}
+	p.next()
+	if len(args) == 0 {
+		tok := p.tokens[p.pos-1]
+		return nil, gqlErrorAt(tok.line, tok.col, "an argument list cannot be empty")
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	directives := make([]gqlDirective, 0)
+	for p.peekPunct("@") {
+		at := p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments(false)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, gqlDirective{name: name.value, args: args, line: at.line, col: at.col})
+	}
+	return directives, nil
+}
+
+// value parses a literal; constant rejects variables, as in defaults.
+func (p *gqlParser) value(constant bool) (gqlValue, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case gqlInt:
+		p.next()
+		return gqlValue{kind: gqlIntValue, raw: tok.value}, nil
+	case gqlFloat:
+		p.next()
+		return gqlValue{kind: gqlFloatValue, raw: tok.value}, nil
+	case gqlString:
+		p.next()
+		return gqlValue{kind: gqlStringValue, raw: tok.value}, nil
+	case gqlName:
+		p.next()
+		switch tok.value {
+		case "true", "false":
+			return gqlValue{kind: gqlBoolValue, raw: tok.value}, nil
+		case "null":
+			return gqlValue{kind: gqlNullValue}, nil
+		}
+		return gqlValue{kind: gqlEnumValue, raw: tok.value}, nil
+	case gqlPunct:
+		switch tok.value {
+		case "$":
+			if constant {
+				return gqlValue{}, gqlErrorAt(tok.line, tok.col, "variables are not allowed here")
+			}
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return gqlValue{}, err
+			}
+			return gqlValue{kind: gqlVariableValue, raw: name.value}, nil
+		case "[":
+			p.next()
+			list := gqlValue{kind: gqlListValue, list: make([]gqlValue, 0)}
+			for !p.peekPunct("]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return gqlValue{}, err
+				}
+				list.list = append(list.list, item)
+			}
+			p.next()
+			return list, nil
+		case "{":
+			p.next()
+			object := gqlValue{kind: gqlObjectValue, fields: make([]gqlArgument, 0)}
+			for !p.peekPunct("}") {
+				name, err := p.name()
+				if err != nil {
+					return gqlValue{}, err
+				}
+				if err := p.expectPunct(":"); err != nil {
+					return gqlValue{}, err
+				}
+				value, err := p.value(constant)
+				if err != nil {
+					return gqlValue{}, err
+				}
+				object.fields = append(object.fields, gqlArgument{name: name.value, value: value})
+			}
+			p.next()
+			return object, nil
+		}
+	}
+	return gqlValue{}, p.unexpected()
+}
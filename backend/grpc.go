@@ -0,0 +1,726 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// The gRPC API described by proto/chartdb/v1/chartdb.proto. It is served on
+// GRPC_PORT over plain net/http: HTTP/2 over TLS when the REST API uses
+// TLS, cleartext HTTP/2 (h2c) otherwise.
+
+const grpcServicePrefix = "/chartdb.v1.ChartDB/"
+
+// gRPC status codes, from google.golang.org/grpc/codes.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// rpcError fails a call with the HTTP status the REST API would answer, so
+// the audit log records the same statuses for both APIs. The client gets
+// the matching gRPC code.
+type rpcError struct {
+	status  int
+	message string
+}
+
+func (e *rpcError) Error() string { return e.message }
+
+func rpcFailure(status int, message string) error {
+	return &rpcError{status: status, message: message}
+}
+
+// rpcServerError is writeServerError for RPCs.
+func rpcServerError(err error) error {
+	var (
+		quota    *quotaError
+		tooLarge *diagramTooLargeError
+	)
+	switch {
+	case errors.As(err, &quota):
+		return rpcFailure(quota.status, quota.message)
+	case errors.As(err, &tooLarge):
+		return rpcFailure(http.StatusRequestEntityTooLarge, tooLarge.Error())
+	case errors.Is(err, errDatabaseBusy) || isBusyError(err):
+		return rpcFailure(http.StatusServiceUnavailable, errDatabaseBusy.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return rpcFailure(http.StatusGatewayTimeout, "deadline exceeded")
+	}
+	return rpcFailure(http.StatusInternalServerError, err.Error())
+}
+
+func asRPCError(err error) *rpcError {
+	var failure *rpcError
+	if !errors.As(err, &failure) {
+		errors.As(rpcServerError(err), &failure)
+	}
+	return failure
+}
+
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusOK:
+		return grpcOK
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return grpcInvalidArgument
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcAlreadyExists
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusRequestEntityTooLarge:
+		return grpcResourceExhausted
+	case http.StatusGone, http.StatusLocked:
+		return grpcFailedPrecondition
+	case http.StatusNotImplemented:
+		return grpcUnimplemented
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// rpcCall is one unary call. Methods that change a diagram set diagramID
+// for the audit log.
+type rpcCall struct {
+	request   []byte
+	diagramID string
+}
+
+type rpcMethod struct {
+	handle   func(ctx context.Context, call *rpcCall) ([]byte, error)
+	mutating bool
+}
+
+func (a *app) rpcMethods() map[string]rpcMethod {
+	return map[string]rpcMethod{
+		"ListDiagrams":   {handle: a.rpcListDiagrams},
+		"GetDiagram":     {handle: a.rpcGetDiagram},
+		"CreateDiagram":  {handle: a.rpcCreateDiagram, mutating: true},
+		"SaveDiagram":    {handle: a.rpcSaveDiagram, mutating: true},
+		"DeleteDiagram":  {handle: a.rpcDeleteDiagram, mutating: true},
+		"ListVersions":   {handle: a.rpcListVersions},
+		"GetVersion":     {handle: a.rpcGetVersion},
+		"RestoreVersion": {handle: a.rpcRestoreVersion, mutating: true},
+		"GetFilter":      {handle: a.rpcGetFilter},
+		"SetFilter":      {handle: a.rpcSetFilter, mutating: true},
+		"DeleteFilter":   {handle: a.rpcDeleteFilter, mutating: true},
+		"GetConfig":      {handle: a.rpcGetConfig},
+		"UpdateConfig":   {handle: a.rpcUpdateConfig, mutating: true},
+	}
+}
+
+// grpcHandler serves the ChartDB service. Requests that are not gRPC get a
+// plain HTTP error.
+func (a *app) grpcHandler() http.Handler {
+	methods := a.rpcMethods()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/grpc" && contentType != "application/grpc+proto" {
+			writeError(w, http.StatusUnsupportedMediaType, "content type must be application/grpc")
+			return
+		}
+		if r.ProtoMajor != 2 {
+			writeError(w, http.StatusHTTPVersionNotSupported, "gRPC requires HTTP/2")
+			return
+		}
+
+		ctx := r.Context()
+		if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+
+		request, err := readGRPCMessage(r.Body)
+		if err != nil {
+			writeGRPCStatus(w, err)
+			return
+		}
+		if r.URL.Path == grpcServicePrefix+"WatchEvents" {
+			if requestUserID(r) == "" && !a.anonymous.allowsRPC(false) {
+				writeGRPCStatus(w, rpcFailure(http.StatusUnauthorized, "authentication required"))
+				return
+			}
+			writeGRPCStatus(w, a.rpcWatchEvents(ctx, w, request))
+			return
+		}
+		name, found := strings.CutPrefix(r.URL.Path, grpcServicePrefix)
+		method, ok := methods[name]
+		if !found || !ok {
+			writeGRPCStatus(w, rpcFailure(http.StatusNotImplemented, "unknown method "+r.URL.Path))
+			return
+		}
+
+		if requestUserID(r) == "" && !a.anonymous.allowsRPC(method.mutating) {
+			writeGRPCStatus(w, rpcFailure(http.StatusUnauthorized, "authentication required"))
+			return
+		}
+		scope := scopeDiagramsRead
+		if method.mutating {
+			scope = scopeDiagramsWrite
+		}
+		if id, _ := requestIdentity(r.Context()); !id.allows(scope) {
+			writeGRPCStatus(w, rpcFailure(http.StatusForbidden, "token lacks the "+scope+" scope"))
+			return
+		}
+		if method.mutating && a.readOnly.enabled() {
+			writeGRPCStatus(w, rpcFailure(http.StatusServiceUnavailable, "the server is in read-only mode"))
+			return
+		}
+		call := &rpcCall{request: request}
+		response, err := method.handle(ctx, call)
+		if method.mutating {
+			a.auditRPC(r, call, err)
+		}
+		if err == nil {
+			err = writeGRPCMessage(w, response)
+		}
+		writeGRPCStatus(w, err)
+	})
+}
+
+// runGRPCServer listens on addr until the process exits.
+func runGRPCServer(addr string, handler http.Handler, tlsConfig *tls.Config) {
+	server := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	var err error
+	if tlsConfig != nil {
+		// gRPC needs h2; the REST listener's ALPN list may not lead with it.
+		grpcTLS := tlsConfig.Clone()
+		grpcTLS.NextProtos = []string{"h2"}
+		server.TLSConfig = grpcTLS
+		server.Handler = handler
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		server.Handler = h2c.NewHandler(handler, &http2.Server{})
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("grpc server error", "error", err)
+	}
+}
+
+// readGRPCMessage reads the single length-prefixed message of a unary or
+// server-streaming request.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcReadError(err)
+	}
+	if prefix[0] != 0 {
+		return nil, rpcFailure(http.StatusNotImplemented, "compressed messages are not supported")
+	}
+	// Read rather than allocate the declared length, which the client
+	// controls.
+	length := int(binary.BigEndian.Uint32(prefix[1:]))
+	message, err := io.ReadAll(io.LimitReader(body, int64(length)))
+	if err != nil {
+		return nil, grpcReadError(err)
+	}
+	if len(message) < length {
+		return nil, grpcReadError(io.ErrUnexpectedEOF)
+	}
+	return message, nil
+}
+
+func grpcReadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return rpcFailure(http.StatusRequestEntityTooLarge, payloadTooLargeMessage(maxBytesErr.Limit))
+	}
+	return rpcFailure(http.StatusBadRequest, "missing or truncated request message")
+}
+
+func writeGRPCMessage(w http.ResponseWriter, message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+// writeGRPCStatus ends the response with the grpc-status trailers.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, message := grpcOK, ""
+	if err != nil {
+		failure := asRPCError(err)
+		code, message = grpcCode(failure.status), failure.message
+		if recorder, ok := w.(*responseRecorder); ok {
+			recorder.errorMsg = message
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", percentEncodeGRPCMessage(message))
+	}
+}
+
+// percentEncodeGRPCMessage escapes what the gRPC spec does not allow in
+// grpc-message.
+func percentEncodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses grpc-timeout values such as "500m" or "30S".
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
+
+// auditRPC writes the audit entry withAudit writes for REST requests.
+func (a *app) auditRPC(r *http.Request, call *rpcCall, err error) {
+	status := http.StatusOK
+	if err != nil {
+		status = asRPCError(err).status
+	}
+	id, _ := requestIdentity(r.Context())
+	entry := auditEntry{
+		At:          time.Now().UTC().Format(sortableTimeFormat),
+		Actor:       id.ID,
+		ActorSource: id.Source,
+		Action:      r.Method + " " + r.URL.Path,
+		Path:        r.URL.Path,
+		DiagramID:   call.diagramID,
+		Status:      status,
+		ClientIP:    clientIP(r),
+		RequestID:   requestIDFromContext(r.Context()),
+	}
+	if len(call.request) > 0 {
+		sum := sha256.Sum256(call.request)
+		entry.PayloadHash = hex.EncodeToString(sum[:])
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), auditWriteTimeout)
+	defer cancel()
+	if err := a.appendAudit(ctx, entry); err != nil {
+		slog.Error("audit log write failed", "action", entry.Action, "path", entry.Path, "error", err)
+	}
+}
+
+// rpcDiagram checks that a diagram id was given and is not in the trash,
+// which REST hides behind /api/trash.
+func (a *app) rpcDiagram(ctx context.Context, diagramID string) error {
+	if diagramID == "" {
+		return rpcFailure(http.StatusBadRequest, "diagram id is required")
+	}
+	inTrash, err := a.isInTrash(ctx, diagramID)
+	if err != nil {
+		return rpcServerError(err)
+	}
+	if inTrash {
+		return rpcFailure(http.StatusNotFound, "diagram not found")
+	}
+	return nil
+}
+
+// rpcUnlocked fails a write to a diagram someone else has locked while
+// LOCKS_ENFORCE is on, that is frozen, or that is in review or approved.
+// Calls act as the client identity.
+func (a *app) rpcUnlocked(ctx context.Context, diagramID string) error {
+	id, _ := requestIdentity(ctx)
+	lock, err := a.checkDiagramLock(ctx, a.db, diagramID, id.ID)
+	if err != nil {
+		return rpcServerError(err)
+	}
+	if lock != nil {
+		return rpcFailure(http.StatusLocked, "diagram is locked by "+lock.Owner)
+	}
+	freeze, err := checkDiagramFrozen(ctx, a.db, diagramID)
+	if err != nil {
+		return rpcServerError(err)
+	}
+	if freeze != nil {
+		return rpcFailure(http.StatusLocked, frozenMessage(freeze))
+	}
+	state, err := reviewLockedState(ctx, a.db, diagramID)
+	if err != nil {
+		return rpcServerError(err)
+	}
+	if state != "" {
+		return rpcFailure(http.StatusLocked, reviewLockedMessage(state))
+	}
+	return nil
+}
+
+func invalidMessage(err error) error {
+	return rpcFailure(http.StatusBadRequest, err.Error())
+}
+
+func (a *app) rpcListDiagrams(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbListDiagramsRequest
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	id, _ := requestIdentity(ctx)
+	metas, err := a.listDiagramMetas(ctx, diagramListFilter{
+		includeArchived: req.IncludeArchived,
+		folderID:        req.FolderID,
+		starredOnly:     req.Starred,
+		userID:          id.ID,
+	})
+	if err != nil {
+		return nil, rpcServerError(err)
+	}
+	return marshalListDiagramsResponse(metas), nil
+}
+
+func (a *app) rpcGetDiagram(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbDiagramRef
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := a.rpcDiagram(ctx, req.ID); err != nil {
+		return nil, err
+	}
+	payload, err := a.getDiagramPayload(ctx, req.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, rpcFailure(http.StatusNotFound, "diagram not found")
+		}
+		return nil, rpcServerError(err)
+	}
+	return marshalDiagram(payload)
+}
+
+func (a *app) rpcCreateDiagram(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbJSONDocument
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	newID := func() (string, error) { return a.unusedDiagramID(ctx, a.db) }
+	payload, meta, _, err := decodeAndNormalizeDiagramPayload(strings.NewReader(req.JSON), newID)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	call.diagramID = meta.ID
+	if err := a.insertDiagramWithVersion(ctx, payload, meta, "create"); err != nil {
+		if isUniqueConstraintError(err) {
+			return nil, rpcFailure(http.StatusConflict, "diagram already exists")
+		}
+		return nil, rpcServerError(err)
+	}
+	return marshalDiagram(payload)
+}
+
+func (a *app) rpcSaveDiagram(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbSaveDiagramRequest
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	payload, meta, opts, err := decodeAndNormalizeDiagramPayload(strings.NewReader(req.JSON), nil)
+	if err != nil {
+		return nil, invalidMessage(err)
+	}
+	if req.ID != "" && req.ID != meta.ID {
+		return nil, rpcFailure(http.StatusBadRequest, "diagram id in json must match id")
+	}
+	call.diagramID = meta.ID
+	if err := a.rpcDiagram(ctx, meta.ID); err != nil {
+		return nil, err
+	}
+	if err := a.rpcUnlocked(ctx, meta.ID); err != nil {
+		return nil, err
+	}
+	message := req.Message
+	if strings.TrimSpace(message) == "" {
+		message = opts.message
+	}
+	if err := a.replaceDiagramWithVersion(ctx, meta.ID, payload, meta, "save", trimVersionMessage(message)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, rpcFailure(http.StatusNotFound, "diagram not found")
+		}
+		return nil, rpcServerError(err)
+	}
+	return marshalDiagram(payload)
+}
+
+func (a *app) rpcDeleteDiagram(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbDiagramRef
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	call.diagramID = req.ID
+	if err := a.rpcDiagram(ctx, req.ID); err != nil {
+		return nil, err
+	}
+	if err := a.rpcUnlocked(ctx, req.ID); err != nil {
+		return nil, err
+	}
+	if err := a.deleteDiagram(ctx, req.ID); err != nil {
+		return nil, rpcServerError(err)
+	}
+	return nil, nil
+}
+
+func (a *app) rpcListVersions(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbDiagramRef
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := a.rpcDiagram(ctx, req.ID); err != nil {
+		return nil, err
+	}
+	versions, err := a.listVersions(ctx, req.ID)
+	if err != nil {
+		return nil, rpcServerError(err)
+	}
+	return marshalListVersionsResponse(versions), nil
+}
+
+func (a *app) rpcGetVersion(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbVersionRef
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := a.rpcDiagram(ctx, req.DiagramID); err != nil {
+		return nil, err
+	}
+	payload, err := a.getVersionPayload(ctx, req.DiagramID, req.VersionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, rpcFailure(http.StatusNotFound, "version not found")
+		}
+		return nil, rpcServerError(err)
+	}
+	return marshalDiagram(payload)
+}
+
+func (a *app) rpcRestoreVersion(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbVersionRef
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	call.diagramID = req.DiagramID
+	if err := a.rpcDiagram(ctx, req.DiagramID); err != nil {
+		return nil, err
+	}
+	if err := a.rpcUnlocked(ctx, req.DiagramID); err != nil {
+		return nil, err
+	}
+	payload, err := a.restoreVersion(ctx, req.DiagramID, req.VersionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, rpcFailure(http.StatusNotFound, "version or diagram not found")
+		}
+		return nil, rpcServerError(err)
+	}
+	return marshalDiagram(payload)
+}
+
+func (a *app) rpcGetFilter(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbDiagramRef
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	if err := a.rpcDiagram(ctx, req.ID); err != nil {
+		return nil, err
+	}
+	filter, err := a.getDiagramFilter(ctx, req.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, rpcFailure(http.StatusNotFound, "filter not found")
+		}
+		return nil, rpcServerError(err)
+	}
+	return pbFilter{DiagramID: req.ID, JSON: string(filter)}.marshal(), nil
+}
+
+func (a *app) rpcSetFilter(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbFilter
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	call.diagramID = req.DiagramID
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(req.JSON), &payload); err != nil {
+		return nil, rpcFailure(http.StatusBadRequest, "invalid json payload")
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, rpcFailure(http.StatusBadRequest, "invalid json payload")
+	}
+	if err := a.rpcDiagram(ctx, req.DiagramID); err != nil {
+		return nil, err
+	}
+	if err := a.setDiagramFilter(ctx, req.DiagramID, raw); err != nil {
+		return nil, rpcServerError(err)
+	}
+	return pbFilter{DiagramID: req.DiagramID, JSON: string(raw)}.marshal(), nil
+}
+
+func (a *app) rpcDeleteFilter(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbDiagramRef
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	call.diagramID = req.ID
+	if err := a.rpcDiagram(ctx, req.ID); err != nil {
+		return nil, err
+	}
+	if err := a.deleteDiagramFilter(ctx, req.ID); err != nil {
+		return nil, rpcServerError(err)
+	}
+	return nil, nil
+}
+
+func (a *app) rpcGetConfig(ctx context.Context, call *rpcCall) ([]byte, error) {
+	id, _ := requestIdentity(ctx)
+	config, err := a.getConfig(ctx, id.ID)
+	if err != nil {
+		return nil, rpcServerError(err)
+	}
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, rpcServerError(err)
+	}
+	return pbJSONDocument{JSON: string(raw)}.marshal(), nil
+}
+
+func (a *app) rpcUpdateConfig(ctx context.Context, call *rpcCall) ([]byte, error) {
+	var req pbJSONDocument
+	if err := req.unmarshal(call.request); err != nil {
+		return nil, invalidMessage(err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(req.JSON), &payload); err != nil {
+		return nil, rpcFailure(http.StatusBadRequest, "invalid json payload")
+	}
+	id, _ := requestIdentity(ctx)
+	config, err := a.updateConfig(ctx, id.ID, payload)
+	var invalid *configInvalidError
+	if errors.As(err, &invalid) {
+		return nil, rpcFailure(http.StatusUnprocessableEntity, invalid.Error())
+	}
+	if err != nil {
+		return nil, rpcServerError(err)
+	}
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, rpcServerError(err)
+	}
+	return pbJSONDocument{JSON: string(raw)}.marshal(), nil
+}
+
+// rpcWatchEvents streams the event log like a never-ending GET /api/events
+// long-poll. It returns when the client goes away or the deadline passes.
+func (a *app) rpcWatchEvents(ctx context.Context, w http.ResponseWriter, request []byte) error {
+	var req pbWatchEventsRequest
+	if err := req.unmarshal(request); err != nil {
+		return invalidMessage(err)
+	}
+	if req.Since < 0 {
+		return rpcFailure(http.StatusBadRequest, "since must be a non-negative sequence number")
+	}
+	if pruned, err := a.eventsPrunedAfter(ctx, req.Since); err != nil {
+		return rpcServerError(err)
+	} else if pruned {
+		return rpcFailure(http.StatusGone, "events after since have been pruned; start again without since")
+	}
+
+	// Send the headers now so the client sees the stream open.
+	controller := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	since := req.Since
+	for {
+		changed := a.events.wait()
+		events, err := a.listEvents(ctx, since, req.DiagramID, eventFollowBatch)
+		if err != nil {
+			if ctx.Err() != nil {
+				return rpcServerError(ctx.Err())
+			}
+			return rpcServerError(err)
+		}
+		for _, event := range events {
+			if err := writeGRPCMessage(w, marshalEvent(event)); err != nil {
+				return nil
+			}
+			since = event.Seq
+		}
+		if len(events) > 0 {
+			if err := controller.Flush(); err != nil {
+				return nil
+			}
+		}
+		if len(events) == eventFollowBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return rpcServerError(ctx.Err())
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthMinFreeBytes = 100 << 20
+	healthCheckTimeout        = 2 * time.Second
+	// quick_check reads the whole file, so its result is reused for a while.
+	healthIntegrityInterval = 5 * time.Minute
+
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthUnknown  = "unknown"
+)
+
+// errDiskFreeUnsupported is returned by diskFree on platforms where free
+// space cannot be read; the disk check then reports "unknown".
+var errDiskFreeUnsupported = errors.New("free disk space is not available on this platform")
+
+type healthCheck struct {
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	FreeBytes    *int64 `json:"freeBytes,omitempty"`
+	MinFreeBytes *int64 `json:"minFreeBytes,omitempty"`
+	CheckedAt    string `json:"checkedAt,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// integrityCache remembers the last PRAGMA quick_check so health probes
+// stay cheap on large databases.
+type integrityCache struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	problem   string
+}
+
+// handleHealth serves GET /api/health. It answers 503 with status
+// "degraded" when SQLite does not respond or reports corruption, the data
+// directory cannot be written or free disk space is below
+// HEALTH_MIN_FREE_BYTES.
+func (a *app) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	report := a.checkHealth(ctx)
+	status := http.StatusOK
+	if report.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
+
+func (a *app) checkHealth(ctx context.Context) healthReport {
+	report := healthReport{
+		Status: healthOK,
+		Checks: map[string]healthCheck{
+			"database": a.checkDatabaseHealth(ctx),
+			"dataDir":  checkDataDirWritable(filepath.Dir(a.dbPath)),
+			"disk":     a.checkDiskHealth(),
+		},
+	}
+	for _, check := range report.Checks {
+		if check.Status == healthDegraded {
+			report.Status = healthDegraded
+		}
+	}
+	return report
+}
+
+func (a *app) checkDatabaseHealth(ctx context.Context) healthCheck {
+	if err := a.db.PingContext(ctx); err != nil {
+		return healthCheck{Status: healthDegraded, Error: err.Error()}
+	}
+	var one int
+	if err := a.db.QueryRowContext(ctx, `SELECT 1 FROM sqlite_schema LIMIT 1`).Scan(&one); err != nil {
+		return healthCheck{Status: healthDegraded, Error: err.Error()}
+	}
+
+	a.integrity.mu.Lock()
+	defer a.integrity.mu.Unlock()
+	if time.Since(a.integrity.checkedAt) >= healthIntegrityInterval {
+		var result string
+		if err := a.db.QueryRowContext(ctx, `PRAGMA quick_check(1)`).Scan(&result); err != nil {
+			return healthCheck{Status: healthDegraded, Error: err.Error()}
+		}
+		a.integrity.problem = ""
+		if result != "ok" {
+			a.integrity.problem = result
+		}
+		a.integrity.checkedAt = time.Now()
+	}
+	check := healthCheck{Status: healthOK, CheckedAt: a.integrity.checkedAt.UTC().Format(time.RFC3339)}
+	if a.integrity.problem != "" {
+		check.Status = healthDegraded
+		check.Error = "integrity check failed: " + a.integrity.problem
+	}
+	return check
+}
+
+// checkDataDirWritable creates, syncs and removes a file in dir.
+func checkDataDirWritable(dir string) healthCheck {
+	file, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return healthCheck{Status: healthDegraded, Error: err.Error()}
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("ok")
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return healthCheck{Status: healthDegraded, Error: err.Error()}
+	}
+	return healthCheck{Status: healthOK}
+}
+
+func (a *app) checkDiskHealth() healthCheck {
+	minFree := a.healthMinFreeBytes
+	free, err := diskFree(filepath.Dir(a.dbPath))
+	if errors.Is(err, errDiskFreeUnsupported) {
+		return healthCheck{Status: healthUnknown, Error: err.Error(), MinFreeBytes: &minFree}
+	}
+	if err != nil {
+		return healthCheck{Status: healthDegraded, Error: err.Error(), MinFreeBytes: &minFree}
+	}
+	check := healthCheck{Status: healthOK, FreeBytes: &free, MinFreeBytes: &minFree}
+	if free < minFree {
+		check.Status = healthDegraded
+		check.Error = "free disk space is below the minimum"
+	}
+	return check
+}
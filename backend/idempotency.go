@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencyKeyRetention  = 24 * time.Hour
+)
+
+// createDiagramIdempotently serves POST /api/diagrams with an
+// Idempotency-Key. The first request with a key creates the diagram and
+// records the key in the same transaction; retries with the same body get
+// the original 201 back (marked Idempotent-Replayed) instead of a conflict.
+// Keys are per caller and kept for a day.
+func (a *app) createDiagramIdempotently(w http.ResponseWriter, r *http.Request, key string) {
+	if len(key) > maxIdempotencyKeyLength || !isPrintableASCII(key) {
+		writeErrorCode(w, http.StatusBadRequest, codeIdempotencyKeyInvalid, "Idempotency-Key must be at most 255 printable ASCII characters")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	sum := sha256.Sum256(body)
+	requestHash := hex.EncodeToString(sum[:])
+	scope := requestUserID(r)
+
+	// Concurrent retries would otherwise both miss the lookup below.
+	inFlight := scope + "\x00" + key
+	if _, busy := a.idempotencyInFlight.LoadOrStore(inFlight, struct{}{}); busy {
+		writeErrorCode(w, http.StatusConflict, codeIdempotencyKeyInUse, "a request with this Idempotency-Key is still in progress")
+		return
+	}
+	defer a.idempotencyInFlight.Delete(inFlight)
+
+	replay, storedHash, err := a.lookupIdempotencyKey(r.Context(), scope, key)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		writeServerError(w, err)
+		return
+	case storedHash != requestHash:
+		writeErrorCode(w, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was already used with a different request body")
+		return
+	default:
+		w.Header().Set(idempotentReplayedHeader, "true")
+		writeCreatedDiagram(w, replay)
+		return
+	}
+
+	newID := func() (string, error) { return a.unusedDiagramID(r.Context(), a.db) }
+	payload, meta, _, err := decodeAndNormalizeDiagramPayload(bytes.NewReader(body), newID)
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+	err = a.inTx(r.Context(), func(tx *sql.Tx) error {
+		if err := a.createDiagram(r.Context(), tx, payload, meta, "create"); err != nil {
+			return err
+		}
+		const query = `
+INSERT INTO idempotency_keys (scope, key, request_hash, diagram_id, blob_hash, created_at)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(scope, key) DO UPDATE SET
+	request_hash = excluded.request_hash,
+	diagram_id = excluded.diagram_id,
+	blob_hash = excluded.blob_hash,
+	created_at = excluded.created_at`
+		_, err := tx.ExecContext(r.Context(), query, scope, key, requestHash, meta.ID, blobHash(payload), time.Now().UTC().Format(sortableTimeFormat))
+		return err
+	})
+	if err != nil {
+		if isUniqueConstraintError(err) {
+			writeErrorCode(w, http.StatusConflict, codeDiagramExists, "diagram already exists")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	writeCreatedDiagram(w, payload)
+}
+
+// lookupIdempotencyKey returns the response payload and request hash
+// recorded for an unexpired key, or sql.ErrNoRows.
+func (a *app) lookupIdempotencyKey(ctx context.Context, scope, key string) ([]byte, string, error) {
+	const query = `
+SELECT k.request_hash, b.payload
+FROM idempotency_keys k
+JOIN blobs b ON b.hash = k.blob_hash
+WHERE k.scope = ? AND k.key = ? AND k.created_at >= ?`
+	cutoff := time.Now().Add(-idempotencyKeyRetention).UTC().Format(sortableTimeFormat)
+	var requestHash string
+	var raw []byte
+	if err := a.db.QueryRowContext(ctx, query, scope, key, cutoff).Scan(&requestHash, &raw); err != nil {
+		return nil, "", err
+	}
+	payload, err := a.decodePayload(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, requestHash, nil
+}
+
+// pruneIdempotencyKeys deletes expired keys so their payload blobs can be
+// collected.
+func (a *app) pruneIdempotencyKeys(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-idempotencyKeyRetention).UTC().Format(sortableTimeFormat)
+	res, err := a.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func isPrintableASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// identity is the authenticated caller of a request. ID scopes per-user
+// data such as stars. Scopes limits what an API token may do; it is nil
+// for callers without one.
+type identity struct {
+	ID     string
+	Source string
+	Scopes []string
+}
+
+type identityKey struct{}
+
+func withRequestIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func requestIdentity(ctx context.Context) (identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(identity)
+	return id, ok
+}
+
+// requestUserID returns the caller's identity id, or "" for anonymous
+// requests.
+func requestUserID(r *http.Request) string {
+	id, _ := requestIdentity(r.Context())
+	return id.ID
+}
+
+const (
+	clientAuthRequire  = "require"
+	clientAuthOptional = "optional"
+)
+
+// configureClientAuth enables client certificate verification against
+// TLS_CLIENT_CA on an existing TLS config.
+func configureClientAuth(tlsConfig *tls.Config, cfg config) error {
+	if cfg.TLS.ClientCA == "" {
+		if len(cfg.TLS.ClientIdentities) > 0 {
+			return errors.New("TLS_CLIENT_IDENTITIES requires TLS_CLIENT_CA")
+		}
+		return nil
+	}
+	if tlsConfig == nil {
+		return errors.New("TLS_CLIENT_CA requires TLS_CERT/TLS_KEY or TLS_AUTOCERT_DOMAINS")
+	}
+
+	pem, err := os.ReadFile(cfg.TLS.ClientCA)
+	if err != nil {
+		return fmt.Errorf("read TLS_CLIENT_CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("TLS_CLIENT_CA contains no PEM certificates")
+	}
+	tlsConfig.ClientCAs = pool
+
+	switch strings.ToLower(cfg.TLS.ClientAuth) {
+	case "", clientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case clientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("invalid TLS_CLIENT_AUTH %q: use %q or %q", cfg.TLS.ClientAuth, clientAuthRequire, clientAuthOptional)
+	}
+	return nil
+}
+
+// parseClientIdentities reads "CN=identity" pairs. An empty list maps each
+// verified certificate to its own CN.
+func parseClientIdentities(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	identities := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		cn, id, ok := strings.Cut(pair, "=")
+		cn, id = strings.TrimSpace(cn), strings.TrimSpace(id)
+		if !ok || cn == "" || id == "" {
+			return nil, fmt.Errorf("invalid TLS_CLIENT_IDENTITIES entry %q: expected CN=identity", pair)
+		}
+		identities[cn] = id
+	}
+	return identities, nil
+}
+
+// withClientCertIdentity sets the request identity from a verified client
+// certificate. When an identity mapping is configured, certificates whose
+// CN is not listed are rejected, as are users SCIM has deactivated.
+func (a *app) withClientCertIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		id := cn
+		if a.clientIdentities != nil {
+			mapped, ok := a.clientIdentities[cn]
+			if !ok {
+				writeError(w, http.StatusForbidden, "client certificate is not authorized")
+				return
+			}
+			id = mapped
+		}
+		if isServiceAccountIdentity(id) {
+			writeError(w, http.StatusForbidden, "client certificate claims an identity reserved for service accounts")
+			return
+		}
+		deprovisioned, err := a.identityDeprovisioned(r.Context(), id)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if deprovisioned {
+			writeError(w, http.StatusForbidden, "user is deactivated")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withRequestIdentity(r.Context(), identity{ID: id, Source: "mtls"})))
+	})
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	maxImportUploadBytes = 64 << 20
+	maxImportEntryBytes  = 32 << 20
+)
+
+type importItem struct {
+	source   string
+	payload  []byte
+	meta     diagramMeta
+	filter   []byte
+	versions []exportedVersion
+}
+
+type importResult struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Source   string `json:"source"`
+	Status   string `json:"status"`
+	Versions int    `json:"versions,omitempty"`
+	Filter   bool   `json:"filter,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	DryRun  bool           `json:"dryRun"`
+	Created int            `json:"created"`
+	Skipped int            `json:"skipped"`
+	Invalid int            `json:"invalid"`
+	Results []importResult `json:"results"`
+}
+
+func (a *app) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrorCode(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportUploadBytes)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeErrorCode(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "upload too large")
+			return
+		}
+		writeErrorCode(w, http.StatusBadRequest, codeInvalidRequest, "multipart field \"file\" is required")
+		return
+	}
+	defer file.Close()
+
+	var (
+		items   []importItem
+		results []importResult
+	)
+	if isZipUpload(header.Filename, file) {
+		items, results, err = readImportArchive(file, header.Size)
+	} else {
+		items, results, err = readImportJSON(file, header.Filename)
+	}
+	if err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, err.Error())
+		return
+	}
+
+	dryRun := queryFlag(r, "dryRun") || queryFlag(r, "dry_run")
+	imported, err := a.importDiagrams(r.Context(), items, dryRun)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	report := importReport{DryRun: dryRun, Results: append(imported, results...)}
+	for _, result := range report.Results {
+		switch result.Status {
+		case "created", "would_create":
+			report.Created++
+		case "exists":
+			report.Skipped++
+		case "invalid":
+			report.Invalid++
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// importDiagrams inserts every item that does not already exist in a single
+// transaction. In dry-run mode the transaction is rolled back so the report
+// reflects exactly what a real import would do.
+func (a *app) importDiagrams(ctx context.Context, items []importItem, dryRun bool) ([]importResult, error) {
+	var results []importResult
+	errDryRun := errors.New("dry run")
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		results = make([]importResult, 0, len(items))
+		for _, item := range items {
+			result := importResult{
+				ID:       item.meta.ID,
+				Name:     item.meta.Name,
+				Source:   item.source,
+				Versions: len(item.versions),
+				Filter:   item.filter != nil,
+			}
+
+			var exists int
+			err := tx.QueryRowContext(ctx, `SELECT 1 FROM diagrams WHERE id = ?`, item.meta.ID).Scan(&exists)
+			switch {
+			case err == nil:
+				result.Status = "exists"
+				results = append(results, result)
+				continue
+			case !errors.Is(err, sql.ErrNoRows):
+				return err
+			}
+
+			if err := a.insertDiagram(ctx, tx, item.payload, item.meta); err != nil {
+				return err
+			}
+			for _, version := range item.versions {
+				if err := a.insertImportedVersion(ctx, tx, item.meta.ID, version); err != nil {
+					return err
+				}
+			}
+			if err := a.insertVersion(ctx, tx, item.meta.ID, item.meta.Name, item.payload, "import", ""); err != nil {
+				return err
+			}
+			if err := a.pruneVersions(ctx, tx, item.meta.ID); err != nil {
+				return err
+			}
+			if item.filter != nil {
+				filter, err := a.payloadKeys.sealValue(item.filter, true)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `INSERT INTO diagram_filters (diagram_id, payload) VALUES (?, ?)`, item.meta.ID, filter); err != nil {
+					return err
+				}
+			}
+			if err := a.recordEvent(ctx, tx, eventDiagramCreated, item.meta.ID); err != nil {
+				return err
+			}
+
+			result.Status = "created"
+			if dryRun {
+				result.Status = "would_create"
+			}
+			results = append(results, result)
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+func (a *app) insertImportedVersion(ctx context.Context, tx *sql.Tx, diagramID string, version exportedVersion) error {
+	if err := a.reserveVersion(ctx, tx, diagramID, len(version.Payload)); err != nil {
+		return err
+	}
+	blobHash, err := a.putBlob(ctx, tx, version.Payload)
+	if err != nil {
+		return err
+	}
+	const query = `
+INSERT INTO diagram_versions (diagram_id, name, payload, blob_hash, action, message, created_at)
+VALUES (?, ?, '', ?, ?, ?, ?)`
+	_, err = tx.ExecContext(ctx, query, diagramID, version.Name, blobHash, version.Action, nullableString(version.Message), version.CreatedAt)
+	return err
+}
+
+func isZipUpload(fileName string, file io.ReadSeeker) bool {
+	if strings.EqualFold(path.Ext(fileName), ".zip") {
+		return true
+	}
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(file, magic)
+	_, _ = file.Seek(0, io.SeekStart)
+	return n == 4 && bytes.Equal(magic, []byte("PK\x03\x04"))
+}
+
+// readImportJSON accepts either a single diagram object or an array of them,
+// which is what GET /api/diagrams?full=1 returns.
+func readImportJSON(file io.Reader, fileName string) ([]importItem, []importResult, error) {
+	raw, err := io.ReadAll(io.LimitReader(file, maxImportEntryBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var list []json.RawMessage
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, nil, errors.New("invalid json payload")
+		}
+		items := make([]importItem, 0, len(list))
+		invalid := make([]importResult, 0)
+		for i, entry := range list {
+			source := fmt.Sprintf("%s[%d]", fileName, i)
+			item, result, ok := parseImportDiagram(entry, source)
+			if !ok {
+				invalid = append(invalid, result)
+				continue
+			}
+			items = append(items, item)
+		}
+		return items, invalid, nil
+	}
+
+	item, result, ok := parseImportDiagram(trimmed, fileName)
+	if !ok {
+		return nil, []importResult{result}, nil
+	}
+	return []importItem{item}, nil, nil
+}
+
+// readImportArchive reads the layout produced by GET /api/export:
+// diagrams/{id}.json, filters/{id}.json and versions/{id}.json.
+func readImportArchive(file io.ReaderAt, size int64) ([]importItem, []importResult, error) {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, nil, errors.New("invalid zip archive")
+	}
+
+	diagrams := map[string]importItem{}
+	filters := map[string][]byte{}
+	versions := map[string][]exportedVersion{}
+	invalid := make([]importResult, 0)
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !strings.HasSuffix(f.Name, ".json") {
+			continue
+		}
+		dir, base := path.Split(f.Name)
+		key := strings.TrimSuffix(base, ".json")
+
+		raw, err := readZipFile(f)
+		if err != nil {
+			invalid = append(invalid, importResult{Source: f.Name, Status: "invalid", Error: err.Error()})
+			continue
+		}
+
+		switch strings.Trim(dir, "/") {
+		case "filters":
+			if !json.Valid(raw) {
+				invalid = append(invalid, importResult{Source: f.Name, Status: "invalid", Error: "invalid json payload"})
+				continue
+			}
+			filters[key] = raw
+		case "versions":
+			var list []exportedVersion
+			if err := json.Unmarshal(raw, &list); err != nil {
+				invalid = append(invalid, importResult{Source: f.Name, Status: "invalid", Error: "invalid json payload"})
+				continue
+			}
+			versions[key] = list
+		case "diagrams", "":
+			item, result, ok := parseImportDiagram(raw, f.Name)
+			if !ok {
+				invalid = append(invalid, result)
+				continue
+			}
+			diagrams[url.PathEscape(item.meta.ID)] = item
+		}
+	}
+
+	keys := make([]string, 0, len(diagrams))
+	for key := range diagrams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([]importItem, 0, len(keys))
+	for _, key := range keys {
+		item := diagrams[key]
+		list, err := normalizeImportedVersions(versions[key])
+		if err != nil {
+			invalid = append(invalid, importResult{ID: item.meta.ID, Name: item.meta.Name, Source: item.source, Status: "invalid", Error: err.Error()})
+			continue
+		}
+		item.filter = filters[key]
+		item.versions = list
+		items = append(items, item)
+	}
+	return items, invalid, nil
+}
+
+// normalizeImportedVersions decodes every version payload the way a normal
+// save does, so a malformed history entry rejects its diagram up front
+// instead of failing the whole import transaction.
+func normalizeImportedVersions(list []exportedVersion) ([]exportedVersion, error) {
+	for i, version := range list {
+		payload, _, err := normalizeDiagramPayload(version.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("versions[%d]: %w", i, err)
+		}
+		list[i].Payload = payload
+	}
+	return list, nil
+}
+
+func parseImportDiagram(raw []byte, source string) (importItem, importResult, bool) {
+	payload, meta, err := normalizeDiagramPayload(raw)
+	if err != nil {
+		return importItem{}, importResult{Source: source, Status: "invalid", Error: err.Error()}, false
+	}
+	return importItem{source: source, payload: payload, meta: meta}, importResult{}, true
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(rc, maxImportEntryBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxImportEntryBytes {
+		return nil, errors.New("archive entry too large")
+	}
+	return raw, nil
+}
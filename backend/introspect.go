@@ -0,0 +1,852 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+const (
+	introspectConnectTimeout = 10 * time.Second
+	introspectQueryTimeout   = 60 * time.Second
+
+	defaultTableColor = "#8eb7ff"
+	viewColor         = "#b0b0b0"
+)
+
+// introspectRequest describes how to reach the database whose schema should
+// be imported. Credentials are only used for the duration of the request.
+type introspectRequest struct {
+	Type     string   `json:"type"`
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	User     string   `json:"user"`
+	Password string   `json:"password"`
+	Database string   `json:"database"`
+	Schemas  []string `json:"schemas"`
+	SSLMode  string   `json:"sslMode"`
+	Name     string   `json:"name"`
+}
+
+type schemaTable struct {
+	Schema  string
+	Name    string
+	IsView  bool
+	Comment string
+}
+
+type schemaColumn struct {
+	Schema     string
+	Table      string
+	Name       string
+	DataType   string
+	IsArray    bool
+	Nullable   bool
+	Default    string
+	MaxLength  sql.NullInt64
+	Precision  sql.NullInt64
+	Scale      sql.NullInt64
+	Increment  bool
+	Comment    string
+	PrimaryKey bool
+	Unique     bool
+}
+
+type schemaIndex struct {
+	Schema  string
+	Table   string
+	Name    string
+	Unique  bool
+	Primary bool
+	Columns []string
+}
+
+type schemaForeignKey struct {
+	Name      string
+	Schema    string
+	Table     string
+	Column    string
+	RefSchema string
+	RefTable  string
+	RefColumn string
+}
+
+// schemaSnapshot is the engine-neutral result of reading a live database's
+// catalog, later turned into a ChartDB diagram payload.
+type schemaSnapshot struct {
+	DatabaseType string
+	Tables       []schemaTable
+	Columns      []schemaColumn
+	Indexes      []schemaIndex
+	ForeignKeys  []schemaForeignKey
+}
+
+func (a *app) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !a.introspectionEnabled {
+		writeErrorCode(w, http.StatusForbidden, codeIntrospectionDisabled, "database introspection is disabled (set INTROSPECTION_ENABLED=true)")
+		return
+	}
+
+	var req introspectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+
+	snapshot, err := introspectDatabase(r.Context(), req)
+	if err != nil {
+		var validationErr introspectValidationError
+		if errors.As(err, &validationErr) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusBadGateway, "introspect database: "+err.Error())
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = req.Database
+	}
+	// The id is picked with the handle that inserts the diagram, so it is
+	// still free when it does.
+	build := func(q rowQueryer) ([]byte, diagramMeta, error) {
+		id, err := a.unusedDiagramID(r.Context(), q)
+		if err != nil {
+			return nil, diagramMeta{}, err
+		}
+		raw, err := json.Marshal(buildDiagramFromSnapshot(snapshot, id, name))
+		if err != nil {
+			return nil, diagramMeta{}, err
+		}
+		return normalizeDiagramPayload(raw)
+	}
+
+	if queryFlag(r, "dryRun") {
+		payload, _, err := build(a.db)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeRawJSON(w, http.StatusOK, payload)
+		return
+	}
+	var payload []byte
+	err = a.inTx(r.Context(), func(tx *sql.Tx) error {
+		var (
+			meta diagramMeta
+			err  error
+		)
+		if payload, meta, err = build(tx); err != nil {
+			return err
+		}
+		return a.createDiagram(r.Context(), tx, payload, meta, "introspect")
+	})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeCreatedDiagram(w, payload)
+}
+
+type introspectValidationError struct {
+	message string
+}
+
+func (e introspectValidationError) Error() string {
+	return e.message
+}
+
+// introspectDatabase connects with the given parameters and reads tables,
+// columns, keys and indexes from information_schema (and pg_catalog for
+// PostgreSQL indexes, which information_schema does not expose).
+func introspectDatabase(ctx context.Context, req introspectRequest) (schemaSnapshot, error) {
+	if strings.TrimSpace(req.Host) == "" {
+		return schemaSnapshot{}, introspectValidationError{"host is required"}
+	}
+	if strings.TrimSpace(req.Database) == "" {
+		return schemaSnapshot{}, introspectValidationError{"database is required"}
+	}
+
+	var (
+		driver string
+		dsn    string
+	)
+	switch strings.ToLower(req.Type) {
+	case "postgres", "postgresql":
+		driver, dsn = "postgres", postgresDSN(req)
+	case "mysql", "mariadb":
+		driver = "mysql"
+		var err error
+		if dsn, err = mysqlDSN(req); err != nil {
+			return schemaSnapshot{}, err
+		}
+	default:
+		return schemaSnapshot{}, introspectValidationError{"type must be postgres or mysql"}
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(ctx, introspectQueryTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	var snapshot schemaSnapshot
+	if driver == "postgres" {
+		snapshot, err = introspectPostgres(ctx, db)
+	} else {
+		snapshot, err = introspectMySQL(ctx, db)
+	}
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	if strings.ToLower(req.Type) == "mariadb" {
+		snapshot.DatabaseType = "mariadb"
+	}
+	return snapshot.filterSchemas(req.Schemas), nil
+}
+
+func postgresDSN(req introspectRequest) string {
+	port := req.Port
+	if port == 0 {
+		port = 5432
+	}
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(req.User, req.Password),
+		Host:   net.JoinHostPort(req.Host, strconv.Itoa(port)),
+		Path:   "/" + req.Database,
+	}
+	query := url.Values{}
+	if req.SSLMode != "" {
+		query.Set("sslmode", req.SSLMode)
+	}
+	query.Set("connect_timeout", strconv.Itoa(int(introspectConnectTimeout.Seconds())))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// mysqlTLSModes maps the PostgreSQL sslMode names to the TLS settings of
+// the MySQL driver, which verifies certificates for "true". Skipping the
+// verification takes the explicit skip-verify.
+var mysqlTLSModes = map[string]string{
+	"disable":     "false",
+	"allow":       "preferred",
+	"prefer":      "preferred",
+	"require":     "true",
+	"verify-ca":   "true",
+	"verify-full": "true",
+	"skip-verify": "skip-verify",
+}
+
+func mysqlDSN(req introspectRequest) (string, error) {
+	port := req.Port
+	if port == 0 {
+		port = 3306
+	}
+	cfg := mysql.NewConfig()
+	cfg.User = req.User
+	cfg.Passwd = req.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(req.Host, strconv.Itoa(port))
+	cfg.DBName = req.Database
+	cfg.Timeout = introspectConnectTimeout
+	if req.SSLMode != "" {
+		tls, ok := mysqlTLSModes[req.SSLMode]
+		if !ok {
+			return "", introspectValidationError{"sslMode must be disable, allow, prefer, require, verify-ca, verify-full or skip-verify for mysql"}
+		}
+		cfg.TLSConfig = tls
+	}
+	return cfg.FormatDSN(), nil
+}
+
+func introspectPostgres(ctx context.Context, db *sql.DB) (schemaSnapshot, error) {
+	const excluded = `('pg_catalog', 'information_schema')`
+	snapshot := schemaSnapshot{DatabaseType: "postgresql"}
+
+	rows, err := db.QueryContext(ctx, `
+SELECT t.table_schema, t.table_name, t.table_type,
+	COALESCE(obj_description(c.oid, 'pg_class'), '')
+FROM information_schema.tables t
+JOIN pg_catalog.pg_namespace n ON n.nspname = t.table_schema
+JOIN pg_catalog.pg_class c ON c.relnamespace = n.oid AND c.relname = t.table_name
+WHERE t.table_schema NOT IN `+excluded+` AND t.table_schema NOT LIKE 'pg_toast%'
+ORDER BY t.table_schema, t.table_name`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	err = scanRows(rows, func() error {
+		var (
+			item      schemaTable
+			tableType string
+		)
+		if err := rows.Scan(&item.Schema, &item.Name, &tableType, &item.Comment); err != nil {
+			return err
+		}
+		item.IsView = tableType == "VIEW"
+		snapshot.Tables = append(snapshot.Tables, item)
+		return nil
+	})
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT c.table_schema, c.table_name, c.column_name, c.data_type, c.udt_name, c.is_nullable,
+	c.column_default, c.character_maximum_length, c.numeric_precision, c.numeric_scale,
+	c.is_identity = 'YES',
+	COALESCE(col_description(format('%I.%I', c.table_schema, c.table_name)::regclass, c.ordinal_position), '')
+FROM information_schema.columns c
+WHERE c.table_schema NOT IN `+excluded+` AND c.table_schema NOT LIKE 'pg_toast%'
+ORDER BY c.table_schema, c.table_name, c.ordinal_position`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	err = scanRows(rows, func() error {
+		var (
+			item       schemaColumn
+			udtName    string
+			isNullable string
+			def        sql.NullString
+		)
+		if err := rows.Scan(&item.Schema, &item.Table, &item.Name, &item.DataType, &udtName, &isNullable,
+			&def, &item.MaxLength, &item.Precision, &item.Scale, &item.Increment, &item.Comment); err != nil {
+			return err
+		}
+		item.Nullable = isNullable == "YES"
+		item.Default = def.String
+		if strings.HasPrefix(item.Default, "nextval(") {
+			item.Increment = true
+			item.Default = ""
+		}
+		switch item.DataType {
+		case "ARRAY":
+			item.IsArray = true
+			item.DataType = postgresTypeName(strings.TrimPrefix(udtName, "_"))
+		case "USER-DEFINED":
+			item.DataType = udtName
+		default:
+			item.DataType = postgresTypeName(item.DataType)
+		}
+		if item.DataType != "numeric" && item.DataType != "decimal" {
+			item.Precision, item.Scale = sql.NullInt64{}, sql.NullInt64{}
+		}
+		snapshot.Columns = append(snapshot.Columns, item)
+		return nil
+	})
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	if err := introspectKeyConstraints(ctx, db, &snapshot); err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT n.nspname, t.relname, i.relname, ix.indisunique, ix.indisprimary, a.attname
+FROM pg_catalog.pg_index ix
+JOIN pg_catalog.pg_class t ON t.oid = ix.indrelid
+JOIN pg_catalog.pg_class i ON i.oid = ix.indexrelid
+JOIN pg_catalog.pg_namespace n ON n.oid = t.relnamespace
+JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord) ON true
+JOIN pg_catalog.pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+WHERE n.nspname NOT IN `+excluded+` AND n.nspname NOT LIKE 'pg_toast%'
+ORDER BY n.nspname, t.relname, i.relname, k.ord`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	if err := scanIndexRows(rows, &snapshot); err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT rc.constraint_name, kcu.table_schema, kcu.table_name, kcu.column_name,
+	ref.table_schema, ref.table_name, ref.column_name
+FROM information_schema.referential_constraints rc
+JOIN information_schema.key_column_usage kcu
+	ON kcu.constraint_schema = rc.constraint_schema AND kcu.constraint_name = rc.constraint_name
+JOIN information_schema.key_column_usage ref
+	ON ref.constraint_schema = rc.unique_constraint_schema
+	AND ref.constraint_name = rc.unique_constraint_name
+	AND ref.ordinal_position = kcu.position_in_unique_constraint
+ORDER BY kcu.table_schema, kcu.table_name, rc.constraint_name, kcu.ordinal_position`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	if err := scanForeignKeyRows(rows, &snapshot); err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	return snapshot, nil
+}
+
+func introspectMySQL(ctx context.Context, db *sql.DB) (schemaSnapshot, error) {
+	snapshot := schemaSnapshot{DatabaseType: "mysql"}
+
+	rows, err := db.QueryContext(ctx, `
+SELECT table_schema, table_name, table_type, COALESCE(table_comment, '')
+FROM information_schema.tables
+WHERE table_schema = DATABASE()
+ORDER BY table_name`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	err = scanRows(rows, func() error {
+		var (
+			item      schemaTable
+			tableType string
+		)
+		if err := rows.Scan(&item.Schema, &item.Name, &tableType, &item.Comment); err != nil {
+			return err
+		}
+		item.IsView = tableType == "VIEW"
+		snapshot.Tables = append(snapshot.Tables, item)
+		return nil
+	})
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT table_schema, table_name, column_name, data_type, is_nullable, column_default,
+	character_maximum_length, numeric_precision, numeric_scale,
+	extra LIKE '%auto_increment%', COALESCE(column_comment, '')
+FROM information_schema.columns
+WHERE table_schema = DATABASE()
+ORDER BY table_name, ordinal_position`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	err = scanRows(rows, func() error {
+		var (
+			item       schemaColumn
+			isNullable string
+			def        sql.NullString
+		)
+		if err := rows.Scan(&item.Schema, &item.Table, &item.Name, &item.DataType, &isNullable, &def,
+			&item.MaxLength, &item.Precision, &item.Scale, &item.Increment, &item.Comment); err != nil {
+			return err
+		}
+		item.Nullable = isNullable == "YES"
+		item.Default = def.String
+		item.DataType = strings.ToLower(item.DataType)
+		if item.DataType != "decimal" && item.DataType != "numeric" {
+			item.Precision, item.Scale = sql.NullInt64{}, sql.NullInt64{}
+		}
+		snapshot.Columns = append(snapshot.Columns, item)
+		return nil
+	})
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	if err := introspectKeyConstraints(ctx, db, &snapshot); err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT table_schema, table_name, index_name, non_unique = 0, index_name = 'PRIMARY', column_name
+FROM information_schema.statistics
+WHERE table_schema = DATABASE()
+ORDER BY table_name, index_name, seq_in_index`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	if err := scanIndexRows(rows, &snapshot); err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+SELECT constraint_name, table_schema, table_name, column_name,
+	referenced_table_schema, referenced_table_name, referenced_column_name
+FROM information_schema.key_column_usage
+WHERE table_schema = DATABASE() AND referenced_table_name IS NOT NULL
+ORDER BY table_name, constraint_name, ordinal_position`)
+	if err != nil {
+		return schemaSnapshot{}, err
+	}
+	if err := scanForeignKeyRows(rows, &snapshot); err != nil {
+		return schemaSnapshot{}, err
+	}
+
+	// A MySQL schema is the database itself, so it is not repeated on every
+	// table the way PostgreSQL schemas are.
+	snapshot.clearSchemas()
+	return snapshot, nil
+}
+
+// introspectKeyConstraints marks primary key and single-column unique
+// columns using the information_schema views shared by both engines.
+func introspectKeyConstraints(ctx context.Context, db *sql.DB, snapshot *schemaSnapshot) error {
+	rows, err := db.QueryContext(ctx, `
+SELECT tc.table_schema, tc.table_name, tc.constraint_name, tc.constraint_type, kcu.column_name
+FROM information_schema.table_constraints tc
+JOIN information_schema.key_column_usage kcu
+	ON kcu.constraint_schema = tc.constraint_schema
+	AND kcu.constraint_name = tc.constraint_name
+	AND kcu.table_schema = tc.table_schema
+	AND kcu.table_name = tc.table_name
+WHERE tc.constraint_type IN ('PRIMARY KEY', 'UNIQUE')
+ORDER BY tc.table_schema, tc.table_name, tc.constraint_name, kcu.ordinal_position`)
+	if err != nil {
+		return err
+	}
+
+	type constraintKey struct{ schema, table, name string }
+	uniqueColumns := map[constraintKey][]string{}
+	primary := map[[3]string]bool{}
+	err = scanRows(rows, func() error {
+		var schema, table, name, constraintType, column string
+		if err := rows.Scan(&schema, &table, &name, &constraintType, &column); err != nil {
+			return err
+		}
+		if constraintType == "PRIMARY KEY" {
+			primary[[3]string{schema, table, column}] = true
+			return nil
+		}
+		key := constraintKey{schema, table, name}
+		uniqueColumns[key] = append(uniqueColumns[key], column)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	primaryCount := map[[2]string]int{}
+	for key := range primary {
+		primaryCount[[2]string{key[0], key[1]}]++
+	}
+	unique := map[[3]string]bool{}
+	for key, columns := range uniqueColumns {
+		if len(columns) == 1 {
+			unique[[3]string{key.schema, key.table, columns[0]}] = true
+		}
+	}
+	for i := range snapshot.Columns {
+		column := &snapshot.Columns[i]
+		key := [3]string{column.Schema, column.Table, column.Name}
+		column.PrimaryKey = primary[key]
+		column.Unique = unique[key] || (column.PrimaryKey && primaryCount[[2]string{column.Schema, column.Table}] == 1)
+	}
+	return nil
+}
+
+func scanIndexRows(rows *sql.Rows, snapshot *schemaSnapshot) error {
+	return scanRows(rows, func() error {
+		var (
+			schema, table, name, column string
+			unique, primary             bool
+		)
+		if err := rows.Scan(&schema, &table, &name, &unique, &primary, &column); err != nil {
+			return err
+		}
+		last := len(snapshot.Indexes) - 1
+		if last >= 0 {
+			prev := &snapshot.Indexes[last]
+			if prev.Schema == schema && prev.Table == table && prev.Name == name {
+				prev.Columns = append(prev.Columns, column)
+				return nil
+			}
+		}
+		snapshot.Indexes = append(snapshot.Indexes, schemaIndex{
+			Schema:  schema,
+			Table:   table,
+			Name:    name,
+			Unique:  unique,
+			Primary: primary,
+			Columns: []string{column},
+		})
+		return nil
+	})
+}
+
+func scanForeignKeyRows(rows *sql.Rows, snapshot *schemaSnapshot) error {
+	return scanRows(rows, func() error {
+		var item schemaForeignKey
+		if err := rows.Scan(&item.Name, &item.Schema, &item.Table, &item.Column,
+			&item.RefSchema, &item.RefTable, &item.RefColumn); err != nil {
+			return err
+		}
+		snapshot.ForeignKeys = append(snapshot.ForeignKeys, item)
+		return nil
+	})
+}
+
+func scanRows(rows *sql.Rows, scan func() error) error {
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s schemaSnapshot) filterSchemas(schemas []string) schemaSnapshot {
+	if len(schemas) == 0 {
+		return s
+	}
+	allowed := make(map[string]bool, len(schemas))
+	for _, schema := range schemas {
+		allowed[schema] = true
+	}
+
+	filtered := schemaSnapshot{DatabaseType: s.DatabaseType}
+	for _, item := range s.Tables {
+		if allowed[item.Schema] {
+			filtered.Tables = append(filtered.Tables, item)
+		}
+	}
+	for _, item := range s.Columns {
+		if allowed[item.Schema] {
+			filtered.Columns = append(filtered.Columns, item)
+		}
+	}
+	for _, item := range s.Indexes {
+		if allowed[item.Schema] {
+			filtered.Indexes = append(filtered.Indexes, item)
+		}
+	}
+	for _, item := range s.ForeignKeys {
+		if allowed[item.Schema] && allowed[item.RefSchema] {
+			filtered.ForeignKeys = append(filtered.ForeignKeys, item)
+		}
+	}
+	return filtered
+}
+
+func (s *schemaSnapshot) clearSchemas() {
+	for i := range s.Tables {
+		s.Tables[i].Schema = ""
+	}
+	for i := range s.Columns {
+		s.Columns[i].Schema = ""
+	}
+	for i := range s.Indexes {
+		s.Indexes[i].Schema = ""
+	}
+	for i := range s.ForeignKeys {
+		s.ForeignKeys[i].Schema = ""
+		s.ForeignKeys[i].RefSchema = ""
+	}
+}
+
+// postgresTypeName maps information_schema's long-form type names to the
+// short names the ChartDB frontend uses for PostgreSQL.
+func postgresTypeName(dataType string) string {
+	switch dataType {
+	case "character varying":
+		return "varchar"
+	case "character":
+		return "char"
+	case "timestamp without time zone":
+		return "timestamp"
+	case "timestamp with time zone":
+		return "timestamptz"
+	case "time without time zone":
+		return "time"
+	case "time with time zone":
+		return "timetz"
+	case "int4":
+		return "integer"
+	case "int8":
+		return "bigint"
+	case "int2":
+		return "smallint"
+	case "bool":
+		return "boolean"
+	default:
+		return dataType
+	}
+}
+
+// buildDiagramFromSnapshot converts a schema snapshot into a ChartDB diagram
+// payload with tables laid out on a simple grid.
+func buildDiagramFromSnapshot(snapshot schemaSnapshot, diagramID, name string) map[string]interface{} {
+	now := time.Now().UTC()
+	createdAt := now.UnixMilli()
+
+	type tableKey struct{ schema, name string }
+	tableIDs := map[tableKey]string{}
+	fieldIDs := map[[3]string]string{}
+
+	columnsByTable := map[tableKey][]schemaColumn{}
+	for _, column := range snapshot.Columns {
+		key := tableKey{column.Schema, column.Table}
+		columnsByTable[key] = append(columnsByTable[key], column)
+	}
+	indexesByTable := map[tableKey][]schemaIndex{}
+	for _, index := range snapshot.Indexes {
+		key := tableKey{index.Schema, index.Table}
+		indexesByTable[key] = append(indexesByTable[key], index)
+	}
+
+	tables := make([]interface{}, 0, len(snapshot.Tables))
+	for i, table := range snapshot.Tables {
+		key := tableKey{table.Schema, table.Name}
+		tableID := randomID(25)
+		tableIDs[key] = tableID
+
+		fields := make([]interface{}, 0, len(columnsByTable[key]))
+		for _, column := range columnsByTable[key] {
+			fieldID := randomID(25)
+			fieldIDs[[3]string{column.Schema, column.Table, column.Name}] = fieldID
+			fields = append(fields, buildSnapshotField(column, fieldID, createdAt))
+		}
+
+		indexes := make([]interface{}, 0, len(indexesByTable[key]))
+		for _, index := range indexesByTable[key] {
+			ids := make([]string, 0, len(index.Columns))
+			for _, column := range index.Columns {
+				if id, ok := fieldIDs[[3]string{table.Schema, table.Name, column}]; ok {
+					ids = append(ids, id)
+				}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			indexes = append(indexes, map[string]interface{}{
+				"id":           randomID(25),
+				"name":         index.Name,
+				"unique":       index.Unique,
+				"fieldIds":     ids,
+				"isPrimaryKey": index.Primary,
+				"createdAt":    createdAt,
+			})
+		}
+
+		color := defaultTableColor
+		if table.IsView {
+			color = viewColor
+		}
+		item := map[string]interface{}{
+			"id":        tableID,
+			"name":      table.Name,
+			"x":         (i % 6) * 350,
+			"y":         (i / 6) * 450,
+			"fields":    fields,
+			"indexes":   indexes,
+			"color":     color,
+			"isView":    table.IsView,
+			"createdAt": createdAt,
+		}
+		if table.Schema != "" {
+			item["schema"] = table.Schema
+		}
+		if table.Comment != "" {
+			item["comments"] = table.Comment
+		}
+		tables = append(tables, item)
+	}
+
+	relationships := make([]interface{}, 0, len(snapshot.ForeignKeys))
+	for _, fk := range snapshot.ForeignKeys {
+		fkTableID, ok1 := tableIDs[tableKey{fk.Schema, fk.Table}]
+		refTableID, ok2 := tableIDs[tableKey{fk.RefSchema, fk.RefTable}]
+		fkFieldID, ok3 := fieldIDs[[3]string{fk.Schema, fk.Table, fk.Column}]
+		refFieldID, ok4 := fieldIDs[[3]string{fk.RefSchema, fk.RefTable, fk.RefColumn}]
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			continue
+		}
+
+		// Like the frontend's metadata import, the referenced (key) side is
+		// the relationship source and the referencing table its target.
+		targetCardinality := "many"
+		if snapshot.isUniqueColumn(fk.Schema, fk.Table, fk.Column) {
+			targetCardinality = "one"
+		}
+		rel := map[string]interface{}{
+			"id":                randomID(25),
+			"name":              fk.Name,
+			"sourceTableId":     refTableID,
+			"targetTableId":     fkTableID,
+			"sourceFieldId":     refFieldID,
+			"targetFieldId":     fkFieldID,
+			"sourceCardinality": "one",
+			"targetCardinality": targetCardinality,
+			"createdAt":         createdAt,
+		}
+		if fk.RefSchema != "" {
+			rel["sourceSchema"] = fk.RefSchema
+		}
+		if fk.Schema != "" {
+			rel["targetSchema"] = fk.Schema
+		}
+		relationships = append(relationships, rel)
+	}
+
+	return map[string]interface{}{
+		"id":            diagramID,
+		"name":          name,
+		"databaseType":  snapshot.DatabaseType,
+		"tables":        tables,
+		"relationships": relationships,
+		"createdAt":     now.Format(time.RFC3339Nano),
+		"updatedAt":     now.Format(time.RFC3339Nano),
+	}
+}
+
+func buildSnapshotField(column schemaColumn, fieldID string, createdAt int64) map[string]interface{} {
+	field := map[string]interface{}{
+		"id":         fieldID,
+		"name":       column.Name,
+		"type":       map[string]string{"id": strings.ReplaceAll(column.DataType, " ", "_"), "name": column.DataType},
+		"primaryKey": column.PrimaryKey,
+		"unique":     column.Unique,
+		"nullable":   column.Nullable,
+		"createdAt":  createdAt,
+	}
+	if column.Increment {
+		field["increment"] = true
+	}
+	if column.IsArray {
+		field["isArray"] = true
+	}
+	if column.MaxLength.Valid {
+		field["characterMaximumLength"] = strconv.FormatInt(column.MaxLength.Int64, 10)
+	}
+	if column.Precision.Valid {
+		field["precision"] = column.Precision.Int64
+	}
+	if column.Scale.Valid {
+		field["scale"] = column.Scale.Int64
+	}
+	if column.Default != "" {
+		field["default"] = column.Default
+	}
+	if column.Comment != "" {
+		field["comments"] = column.Comment
+	}
+	return field
+}
+
+func (s schemaSnapshot) isUniqueColumn(schema, table, column string) bool {
+	for _, item := range s.Columns {
+		if item.Schema == schema && item.Table == table && item.Name == column {
+			return item.Unique
+		}
+	}
+	return false
+}
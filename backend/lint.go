@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+)
+
+// lintFinding is one problem found in a stored diagram. Rule is a stable
+// identifier clients can filter on; path points into the payload as in
+// validation warnings.
+type lintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Path     string `json:"path"`
+	TableID  string `json:"tableId,omitempty"`
+	FieldID  string `json:"fieldId,omitempty"`
+}
+
+// handleDiagramLint serves GET /api/diagrams/{id}/lint.
+func (a *app) handleDiagramLint(w http.ResponseWriter, r *http.Request, diagramID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	payload, err := a.getDiagramPayload(r.Context(), diagramID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	findings := lintDiagram(doc)
+	counts := map[string]int{lintError: 0, lintWarning: 0}
+	for _, finding := range findings {
+		counts[finding.Severity]++
+	}
+	writeJSON(w, http.StatusOK, struct {
+		DiagramID string         `json:"diagramId"`
+		Findings  []lintFinding  `json:"findings"`
+		Counts    map[string]int `json:"counts"`
+	}{DiagramID: diagramID, Findings: findings, Counts: counts})
+}
+
+// lintDiagram checks a diagram for references to missing tables and
+// fields, duplicate table names, fields without a type and tables without
+// a primary key. Errors are broken references; warnings are likely
+// mistakes.
+func lintDiagram(doc diagramDoc) []lintFinding {
+	findings := make([]lintFinding, 0)
+	add := func(finding lintFinding) {
+		findings = append(findings, finding)
+	}
+
+	names := map[string]string{}
+	for i, table := range doc.Tables {
+		path := fmt.Sprintf("tables[%d]", i)
+
+		qualified := strings.ToLower(table.Name)
+		if table.Schema != "" {
+			qualified = strings.ToLower(table.Schema) + "." + qualified
+		}
+		if first, dup := names[qualified]; dup && table.Name != "" {
+			add(lintFinding{
+				Rule:     "duplicate-table-name",
+				Severity: lintWarning,
+				Message:  fmt.Sprintf("table %q has the same name as %s", qualifiedTableName(table), first),
+				Path:     path + ".name",
+				TableID:  table.ID,
+			})
+		} else {
+			names[qualified] = path
+		}
+
+		fieldIDs := make(map[string]bool, len(table.Fields))
+		hasPrimaryKey := false
+		for j, field := range table.Fields {
+			fieldIDs[field.ID] = true
+			hasPrimaryKey = hasPrimaryKey || field.PrimaryKey
+			if strings.TrimSpace(field.Type.Name) == "" && strings.TrimSpace(field.Type.ID) == "" {
+				add(lintFinding{
+					Rule:     "field-missing-type",
+					Severity: lintWarning,
+					Message:  fmt.Sprintf("field %q of table %q has no type", field.Name, qualifiedTableName(table)),
+					Path:     fmt.Sprintf("%s.fields[%d].type", path, j),
+					TableID:  table.ID,
+					FieldID:  field.ID,
+				})
+			}
+		}
+		for j, index := range table.Indexes {
+			hasPrimaryKey = hasPrimaryKey || index.IsPrimaryKey
+			for k, fieldID := range index.FieldIDs {
+				if !fieldIDs[fieldID] {
+					add(lintFinding{
+						Rule:     "index-unknown-field",
+						Severity: lintError,
+						Message:  fmt.Sprintf("index %q of table %q refers to missing field %q", index.Name, qualifiedTableName(table), fieldID),
+						Path:     fmt.Sprintf("%s.indexes[%d].fieldIds[%d]", path, j, k),
+						TableID:  table.ID,
+						FieldID:  fieldID,
+					})
+				}
+			}
+		}
+		if !hasPrimaryKey && !table.IsView {
+			add(lintFinding{
+				Rule:     "table-missing-primary-key",
+				Severity: lintWarning,
+				Message:  fmt.Sprintf("table %q has no primary key", qualifiedTableName(table)),
+				Path:     path,
+				TableID:  table.ID,
+			})
+		}
+	}
+
+	for i, relationship := range doc.Relationships {
+		path := fmt.Sprintf("relationships[%d]", i)
+		ends := []struct{ side, tableID, fieldID string }{
+			{"source", relationship.SourceTableID, relationship.SourceFieldID},
+			{"target", relationship.TargetTableID, relationship.TargetFieldID},
+		}
+		for _, end := range ends {
+			table, ok := doc.tableByID(end.tableID)
+			if !ok {
+				add(lintFinding{
+					Rule:     "relationship-unknown-table",
+					Severity: lintError,
+					Message:  fmt.Sprintf("relationship %q refers to missing %s table %q", relationship.Name, end.side, end.tableID),
+					Path:     path + "." + end.side + "TableId",
+					TableID:  end.tableID,
+				})
+				continue
+			}
+			if _, ok := table.fieldByID(end.fieldID); !ok {
+				add(lintFinding{
+					Rule:     "relationship-unknown-field",
+					Severity: lintError,
+					Message:  fmt.Sprintf("relationship %q refers to missing %s field %q of table %q", relationship.Name, end.side, end.fieldID, qualifiedTableName(table)),
+					Path:     path + "." + end.side + "FieldId",
+					TableID:  end.tableID,
+					FieldID:  end.fieldID,
+				})
+			}
+		}
+	}
+	return findings
+}
+
+func qualifiedTableName(table dbTable) string {
+	if table.Schema == "" {
+		return table.Name
+	}
+	return table.Schema + "." + table.Name
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	lockOwnerHeader = "X-Lock-Owner"
+	defaultLockTTL  = 5 * time.Minute
+	maxLockTTL      = time.Hour
+	maxLockOwnerLen = 255
+)
+
+// diagramLock is a check-out of a diagram. It lasts until it is released
+// or expiresAt passes without the owner renewing it.
+type diagramLock struct {
+	DiagramID  string `json:"diagramId"`
+	Owner      string `json:"owner"`
+	Actor      string `json:"actor,omitempty"`
+	AcquiredAt string `json:"acquiredAt"`
+	ExpiresAt  string `json:"expiresAt"`
+}
+
+// lockExemptRoutes are the writes under /api/diagrams/{id} that do not
+// change the diagram, so a lock held by someone else, a freeze or an
+// approved review does not block them.
+var lockExemptRoutes = map[string]bool{
+	"lock":     true,
+	"presence": true,
+	"star":     true,
+	"watch":    true,
+	"merge":    true,
+	"clone":    true,
+	"comments": true,
+	"review":   true,
+	"freeze":   true,
+}
+
+// handleDiagramLock serves /api/diagrams/{id}/lock. POST takes
+// {"owner": "alice", "ttl": "5m"} and acquires the lock, or renews it when
+// the owner already holds it, which is how clients heartbeat. DELETE
+// releases it; ?force=1 breaks a lock held by someone else.
+func (a *app) handleDiagramLock(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		lock, err := a.currentLock(r.Context(), a.db, diagramID)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, http.StatusOK, map[string]bool{"locked": false})
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Locked bool `json:"locked"`
+			diagramLock
+		}{true, lock})
+	case http.MethodPost:
+		var req struct {
+			Owner string `json:"owner"`
+			TTL   string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		owner := strings.TrimSpace(req.Owner)
+		if owner == "" {
+			owner = lockOwner(r)
+		}
+		if owner == "" {
+			writePayloadError(w, invalidField("owner", "is required without a client identity"))
+			return
+		}
+		if len(owner) > maxLockOwnerLen {
+			writePayloadError(w, invalidField("owner", "must be at most 255 characters"))
+			return
+		}
+		ttl := defaultLockTTL
+		if req.TTL != "" {
+			parsed, err := time.ParseDuration(req.TTL)
+			if err != nil || parsed <= 0 || parsed > maxLockTTL {
+				writePayloadError(w, invalidField("ttl", "must be a duration between 1s and 1h"))
+				return
+			}
+			ttl = parsed
+		}
+
+		lock, err := a.acquireLock(r.Context(), diagramID, owner, requestUserID(r), ttl)
+		var held *lockHeldError
+		switch {
+		case errors.As(err, &held):
+			writeAPIErrorWith(w, http.StatusConflict, codeDiagramLocked, "diagram is locked by "+held.lock.Owner, nil, map[string]interface{}{"lock": held.lock})
+		case errors.Is(err, sql.ErrNoRows):
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		case err != nil:
+			writeServerError(w, err)
+		default:
+			writeJSON(w, http.StatusOK, lock)
+		}
+	case http.MethodDelete:
+		owner := r.URL.Query().Get("owner")
+		if owner == "" {
+			owner = lockOwner(r)
+		}
+		err := a.releaseLock(r.Context(), diagramID, owner, queryFlag(r, "force"))
+		var held *lockHeldError
+		switch {
+		case errors.As(err, &held):
+			writeAPIErrorWith(w, http.StatusConflict, codeDiagramLocked, "diagram is locked by "+held.lock.Owner+"; release it as that owner or with force=1", nil, map[string]interface{}{"lock": held.lock})
+		case err != nil:
+			writeServerError(w, err)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// lockOwner is who a request acts as for locks: the X-Lock-Owner header,
+// or else the caller's identity.
+func lockOwner(r *http.Request) string {
+	if owner := strings.TrimSpace(r.Header.Get(lockOwnerHeader)); owner != "" {
+		return owner
+	}
+	return requestUserID(r)
+}
+
+// lockHeldError reports a lock held by another owner.
+type lockHeldError struct {
+	lock diagramLock
+}
+
+func (e *lockHeldError) Error() string { return "diagram is locked by " + e.lock.Owner }
+
+// currentLock returns the unexpired lock on a diagram, or sql.ErrNoRows.
+func (a *app) currentLock(ctx context.Context, q rowQueryer, diagramID string) (diagramLock, error) {
+	const query = `
+SELECT diagram_id, owner, actor, acquired_at, expires_at
+FROM diagram_locks
+WHERE diagram_id = ? AND expires_at > ?`
+	var lock diagramLock
+	now := time.Now().UTC().Format(sortableTimeFormat)
+	err := q.QueryRowContext(ctx, query, diagramID, now).Scan(&lock.DiagramID, &lock.Owner, &lock.Actor, &lock.AcquiredAt, &lock.ExpiresAt)
+	return lock, err
+}
+
+func (a *app) acquireLock(ctx context.Context, diagramID, owner, actor string, ttl time.Duration) (diagramLock, error) {
+	var lock diagramLock
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, diagramID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+
+		now := time.Now().UTC()
+		current, err := a.currentLock(ctx, tx, diagramID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			lock = diagramLock{DiagramID: diagramID, Owner: owner, Actor: actor, AcquiredAt: now.Format(sortableTimeFormat)}
+		case err != nil:
+			return err
+		case current.Owner != owner:
+			return &lockHeldError{lock: current}
+		default:
+			lock = current
+		}
+		lock.ExpiresAt = now.Add(ttl).Format(sortableTimeFormat)
+
+		const query = `
+INSERT INTO diagram_locks (diagram_id, owner, actor, acquired_at, expires_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT(diagram_id) DO UPDATE SET
+	owner = excluded.owner,
+	actor = excluded.actor,
+	acquired_at = excluded.acquired_at,
+	expires_at = excluded.expires_at`
+		_, err = tx.ExecContext(ctx, query, lock.DiagramID, lock.Owner, lock.Actor, lock.AcquiredAt, lock.ExpiresAt)
+		return err
+	})
+	return lock, err
+}
+
+func (a *app) releaseLock(ctx context.Context, diagramID, owner string, force bool) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := a.currentLock(ctx, tx, diagramID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return err
+		case current.Owner != owner && !force:
+			return &lockHeldError{lock: current}
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM diagram_locks WHERE diagram_id = ?`, diagramID)
+		return err
+	})
+}
+
+// checkDiagramLock returns the lock a write by owner would violate when
+// LOCKS_ENFORCE is on, or nil.
+func (a *app) checkDiagramLock(ctx context.Context, q rowQueryer, diagramID, owner string) (*diagramLock, error) {
+	if !a.enforceLocks {
+		return nil, nil
+	}
+	lock, err := a.currentLock(ctx, q, diagramID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil || lock.Owner == owner {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// diagramWriteRefusal returns the error code and message refusing a write
+// by owner to the diagram, or "" when the write may go ahead. Writes that
+// don't pass the guards of /api/diagrams/{id}, such as bulk operations and
+// scheduled syncs, check every diagram this way inside their transaction.
+func (a *app) diagramWriteRefusal(ctx context.Context, q rowQueryer, diagramID, owner string) (string, string, error) {
+	lock, err := a.checkDiagramLock(ctx, q, diagramID, owner)
+	if err != nil {
+		return "", "", err
+	}
+	if lock != nil {
+		return codeDiagramLocked, "diagram is locked by " + lock.Owner, nil
+	}
+	freeze, err := checkDiagramFrozen(ctx, q, diagramID)
+	if err != nil {
+		return "", "", err
+	}
+	if freeze != nil {
+		return codeDiagramFrozen, frozenMessage(freeze), nil
+	}
+	state, err := reviewLockedState(ctx, q, diagramID)
+	if err != nil || state == "" {
+		return "", "", err
+	}
+	return reviewLockedCode(state), reviewLockedMessage(state), nil
+}
+
+// isLockedWrite reports whether a request under /api/diagrams/{id} changes
+// the diagram and so needs its lock.
+func isLockedWrite(r *http.Request, parts []string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return len(parts) == 3 || !lockExemptRoutes[parts[3]]
+}
+
+func writeDiagramLocked(w http.ResponseWriter, lock *diagramLock) {
+	writeAPIErrorWith(w, http.StatusLocked, codeDiagramLocked, "diagram is locked by "+lock.Owner+"; send X-Lock-Owner to write as the lock holder", nil, map[string]interface{}{"lock": lock})
+}
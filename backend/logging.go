@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLogLevel = "info"
+
+	accessLogJSON = "json"
+	accessLogCLF  = "clf"
+	accessLogOff  = "off"
+)
+
+// logLevel is shared by the default logger so the level can be changed
+// without rebuilding the handler.
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown level %q: use debug, info, warn or error", value)
+	}
+}
+
+func isKnownAccessLogFormat(format string) bool {
+	return format == accessLogJSON || format == accessLogCLF || format == accessLogOff
+}
+
+// setupLogging installs a JSON logger on stderr as the slog default. The
+// stdlib log package is redirected to it as well.
+func setupLogging(level slog.Level) {
+	logLevel.Set(level)
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(requestIDLogHandler{handler}))
+}
+
+// fatal logs at error level and exits, replacing log.Fatalf.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// responseRecorder captures the status and error message of a response for
+// the logging, tracing and metrics middleware. They share one recorder so
+// writeError can attach its message to it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytes     int
+	errorMsg  string
+	requestID string
+	// bodyLimit is set once the request body exceeded MAX_PAYLOAD_BYTES.
+	bodyLimit int64
+	// diagramID names a diagram created by the request, for the audit log.
+	diagramID string
+	// errorEnvelope selects the structured /api/v1 error body.
+	errorEnvelope bool
+}
+
+// recordResponse returns the recorder already wrapping w, or a new one.
+func recordResponse(w http.ResponseWriter) *responseRecorder {
+	if recorder, ok := w.(*responseRecorder); ok {
+		return recorder
+	}
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed gRPC messages.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// withRequestLogging writes one access log line per request: a JSON log
+// record (format "json"), a Common Log Format line on stdout with the
+// duration appended ("clf"), or nothing ("off"). Server errors are logged in
+// every format so they always leave a trace.
+func withRequestLogging(format string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := recordResponse(w)
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.statusCode()
+		elapsed := time.Since(start)
+		if format == accessLogCLF {
+			writeCommonLogLine(os.Stdout, r, status, recorder.bytes, start, elapsed)
+		}
+		if format != accessLogJSON && status < http.StatusInternalServerError {
+			return
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+			slog.Int("bytes", recorder.bytes),
+			slog.String("client_ip", clientIP(r)),
+		}
+		if diagramID := requestDiagramID(r.URL.Path); diagramID != "" {
+			attrs = append(attrs, slog.String("diagram_id", diagramID))
+		}
+		if recorder.errorMsg != "" {
+			attrs = append(attrs, slog.String("error", recorder.errorMsg))
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+func writeCommonLogLine(out io.Writer, r *http.Request, status, size int, start time.Time, elapsed time.Duration) {
+	sizeField := "-"
+	if size > 0 {
+		sizeField = strconv.Itoa(size)
+	}
+	line := fmt.Sprintf("%s - - [%s] %q %d %s %.6f\n",
+		clientIP(r),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		status,
+		sizeField,
+		elapsed.Seconds(),
+	)
+	_, _ = io.WriteString(out, line)
+}
+
+// requestDiagramID returns the diagram id from /api/diagrams/{id}/... and
+// /api/trash/{id}/... paths.
+func requestDiagramID(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "api" || (parts[1] != "diagrams" && parts[1] != "trash") {
+		return ""
+	}
+	if parts[1] == "diagrams" && len(parts) == 3 && diagramCollectionActions[parts[2]] {
+		return ""
+	}
+	diagramID, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return ""
+	}
+	return diagramID
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevelOverride is a level set through PUT /api/admin/loglevel. It lasts
+// until it expires, is replaced, or the configuration is reloaded.
+type logLevelOverride struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	until time.Time
+}
+
+type logLevelState struct {
+	Level      string `json:"level"`
+	Configured string `json:"configured"`
+	RevertAt   string `json:"revertAt,omitempty"`
+}
+
+// handleLogLevel serves GET and PUT /api/admin/loglevel. PUT takes
+// {"level": "debug", "duration": "15m"}; without a duration the level holds
+// until the next reload or restart.
+func (a *app) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Level    string `json:"level"`
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		if strings.TrimSpace(req.Level) == "" {
+			writePayloadError(w, invalidField("level", "is required"))
+			return
+		}
+		level, err := parseLogLevel(req.Level)
+		if err != nil {
+			writePayloadError(w, invalidField("level", "must be debug, info, warn or error"))
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			if duration, err = time.ParseDuration(req.Duration); err != nil || duration <= 0 {
+				writePayloadError(w, invalidField("duration", "must be a positive duration such as 15m"))
+				return
+			}
+		}
+		a.overrideLogLevel(level, duration)
+		slog.Warn("log level changed", "level", levelName(level), "duration", duration.String())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.logLevelState())
+}
+
+// overrideLogLevel sets the level of the default logger, going back to the
+// configured level after duration unless it is zero.
+func (a *app) overrideLogLevel(level slog.Level, duration time.Duration) {
+	override := &a.logLevelOverride
+	override.mu.Lock()
+	defer override.mu.Unlock()
+	override.stop()
+	logLevel.Set(level)
+	if duration <= 0 {
+		return
+	}
+	override.until = time.Now().Add(duration)
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		override.mu.Lock()
+		defer override.mu.Unlock()
+		if override.timer != timer {
+			return
+		}
+		override.stop()
+		configured := a.runtime().logLevel
+		logLevel.Set(configured)
+		slog.Warn("log level reverted", "level", levelName(configured))
+	})
+	override.timer = timer
+}
+
+// clearLogLevelOverride drops a pending revert; the caller sets the level.
+func (a *app) clearLogLevelOverride() {
+	a.logLevelOverride.mu.Lock()
+	defer a.logLevelOverride.mu.Unlock()
+	a.logLevelOverride.stop()
+}
+
+func (o *logLevelOverride) stop() {
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.timer = nil
+	o.until = time.Time{}
+}
+
+func (a *app) logLevelState() logLevelState {
+	a.logLevelOverride.mu.Lock()
+	defer a.logLevelOverride.mu.Unlock()
+	state := logLevelState{
+		Level:      levelName(logLevel.Level()),
+		Configured: levelName(a.runtime().logLevel),
+	}
+	if !a.logLevelOverride.until.IsZero() {
+		state.RevertAt = a.logLevelOverride.until.UTC().Format(time.RFC3339)
+	}
+	return state
+}
+
+func levelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	smtpTLSStartTLS = "starttls"
+	smtpTLSImplicit = "tls"
+	smtpTLSNone     = "none"
+
+	defaultSMTPPort            = 587
+	defaultEmailDigestInterval = 24 * time.Hour
+	smtpTimeout                = 30 * time.Second
+	emailDigestConsumer        = "email-digest"
+)
+
+// mailer sends notification emails to the addresses watching a diagram,
+// either one per event or a digest every digestInterval.
+type mailer struct {
+	host           string
+	port           int
+	username       string
+	password       string
+	from           *mail.Address
+	tlsMode        string
+	publicURL      string
+	digestInterval time.Duration
+}
+
+// newMailer returns nil when SMTP_HOST is not set.
+func newMailer(cfg config) (*mailer, error) {
+	smtpCfg := cfg.SMTP
+	if smtpCfg.Host == "" {
+		return nil, nil
+	}
+	from, err := mail.ParseAddress(smtpCfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM %q: %w", smtpCfg.From, err)
+	}
+	if smtpCfg.Port < 1 || smtpCfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid SMTP_PORT %d", smtpCfg.Port)
+	}
+	tlsMode := strings.ToLower(smtpCfg.TLS)
+	switch tlsMode {
+	case smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		return nil, fmt.Errorf("invalid SMTP_TLS %q: use %q, %q or %q", smtpCfg.TLS, smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone)
+	}
+	digestInterval, err := time.ParseDuration(smtpCfg.DigestInterval)
+	if err != nil || digestInterval < time.Minute {
+		return nil, fmt.Errorf("invalid SMTP_DIGEST_INTERVAL %q: use a duration of at least 1m", smtpCfg.DigestInterval)
+	}
+	return &mailer{
+		host:           smtpCfg.Host,
+		port:           smtpCfg.Port,
+		username:       smtpCfg.Username,
+		password:       smtpCfg.Password,
+		from:           from,
+		tlsMode:        tlsMode,
+		publicURL:      strings.TrimRight(cfg.PublicURL, "/"),
+		digestInterval: digestInterval,
+	}, nil
+}
+
+// send delivers one message. The returned bool reports whether the error is
+// temporary: SMTP 5xx replies are permanent, anything else may be retried.
+func (m *mailer) send(ctx context.Context, to, subject, body string) (bool, error) {
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	conn, err := (&net.Dialer{Timeout: smtpTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return true, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if m.tlsMode == smtpTLSImplicit {
+		conn = tls.Client(conn, &tls.Config{ServerName: m.host})
+	}
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return true, err
+	}
+	defer client.Close()
+
+	err = m.transact(client, to, m.message(to, subject, body))
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return false, err
+	}
+	return err != nil, err
+}
+
+func (m *mailer) transact(client *smtp.Client, to string, message []byte) error {
+	if m.tlsMode == smtpTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("server does not offer STARTTLS (set SMTP_TLS=none to send in plain text)")
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		// PlainAuth refuses to send the password unencrypted, except to
+		// localhost.
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (m *mailer) message(to, subject, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", randomHex(16), m.host)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	_, _ = qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	_ = qp.Close()
+	return buf.Bytes()
+}
+
+// eventSentence renders e.g. `Diagram "Shop" was saved by alice`.
+func eventSentence(event diagramEvent) string {
+	name := event.DiagramName
+	if name == "" {
+		name = event.DiagramID
+	}
+	sentence := fmt.Sprintf("Diagram %q was %s", name, diagramEventVerbs[event.Type])
+	if event.Actor != "" {
+		sentence += " by " + event.Actor
+	}
+	return sentence
+}
+
+const (
+	emailFooter       = "\n\nYou are receiving this email because you watch this diagram in ChartDB.\n"
+	emailDigestFooter = "\n\nYou are receiving this digest because you watch these diagrams in ChartDB.\n"
+)
+
+// runEmailNotifier emails every event to the diagram's instant watchers.
+// Nobody is emailed about their own changes.
+func (a *app) runEmailNotifier(ctx context.Context) {
+	a.followEvents(ctx, "email", func(ctx context.Context, event diagramEvent) bool {
+		rows, err := a.db.QueryContext(ctx, `
+SELECT email FROM diagram_watches
+WHERE diagram_id = ? AND digest = 0 AND (? = '' OR user_id <> ?)`, event.DiagramID, event.Actor, event.Actor)
+		if err != nil {
+			slog.Error("list diagram watchers failed", "diagram_id", event.DiagramID, "error", err)
+			return true
+		}
+		recipients := make([]string, 0)
+		for rows.Next() {
+			var email string
+			if err := rows.Scan(&email); err == nil {
+				recipients = append(recipients, email)
+			}
+		}
+		rows.Close()
+
+		sentence := eventSentence(event)
+		body := sentence + " at " + event.At + "."
+		if link := diagramLink(a.mailer.publicURL, event); link != "" {
+			body += "\n\n" + link
+		}
+		body += emailFooter
+		for _, to := range recipients {
+			send := func() (bool, error) { return a.mailer.send(ctx, to, "[ChartDB] "+sentence, body) }
+			if !retryDelivery(ctx, send, "to", to, "type", event.Type, "seq", event.Seq, "diagram_id", event.DiagramID) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (a *app) runEmailDigest(ctx context.Context) {
+	ticker := time.NewTicker(a.mailer.digestInterval)
+	defer ticker.Stop()
+
+	// Create the cursor now, so the first digest covers the first interval.
+	if _, err := a.eventCursor(ctx, emailDigestConsumer); err != nil {
+		slog.Error("read email digest cursor failed", "error", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.sendEmailDigests(ctx); err != nil {
+			slog.Error("email digest failed", "error", err)
+		}
+	}
+}
+
+// sendEmailDigests sends every digest watcher one email listing the events
+// on their diagrams since the previous digest.
+func (a *app) sendEmailDigests(ctx context.Context) error {
+	since, err := a.eventCursor(ctx, emailDigestConsumer)
+	if err != nil {
+		return err
+	}
+	var until int64
+	if err := a.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM events`).Scan(&until); err != nil {
+		return err
+	}
+	if until <= since {
+		return nil
+	}
+
+	rows, err := a.db.QueryContext(ctx, `
+SELECT w.email, e.seq, e.type, e.at, e.diagram_id, e.diagram_name, e.actor
+FROM events e
+JOIN diagram_watches w ON w.diagram_id = e.diagram_id AND w.digest = 1
+WHERE e.seq > ? AND e.seq <= ? AND e.at >= w.created_at AND (e.actor = '' OR w.user_id <> e.actor)
+ORDER BY w.email, e.seq`, since, until)
+	if err != nil {
+		return err
+	}
+	digests := map[string][]diagramEvent{}
+	recipients := make([]string, 0)
+	for rows.Next() {
+		var email string
+		var event diagramEvent
+		if err := rows.Scan(&email, &event.Seq, &event.Type, &event.At, &event.DiagramID, &event.DiagramName, &event.Actor); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := digests[email]; !ok {
+			recipients = append(recipients, email)
+		}
+		digests[email] = append(digests[email], event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, to := range recipients {
+		events := digests[to]
+		var body strings.Builder
+		for _, event := range events {
+			fmt.Fprintf(&body, "%s  %s\n", event.At, eventSentence(event))
+			if link := diagramLink(a.mailer.publicURL, event); link != "" {
+				fmt.Fprintf(&body, "    %s\n", link)
+			}
+		}
+		subject := fmt.Sprintf("[ChartDB] %d changes to diagrams you watch", len(events))
+		if len(events) == 1 {
+			subject = "[ChartDB] 1 change to a diagram you watch"
+		}
+		content := strings.TrimSuffix(body.String(), "\n") + emailDigestFooter
+		send := func() (bool, error) { return a.mailer.send(ctx, to, subject, content) }
+		if !retryDelivery(ctx, send, "to", to, "digest_events", len(events)) {
+			return ctx.Err()
+		}
+	}
+	return a.saveEventCursor(ctx, emailDigestConsumer, until)
+}
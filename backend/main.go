@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math/big"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 )
 
 const (
@@ -23,11 +31,60 @@ const (
 	defaultDataDir               = "/data"
 	defaultDBFileName            = "chartdb.sqlite"
 	defaultMaxVersionsPerDiagram = 100
+	defaultSnapshotInterval      = 20
+	maxVersionMessageLength      = 500
+	maxBatchDiagramIDs           = 100
+
+	// idAlphabet matches the nanoid alphabet used by the frontend.
+	idAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
 )
 
 type app struct {
-	db                    *sql.DB
-	maxVersionsPerDiagram int
+	db                   *sql.DB
+	dbPath               string
+	metrics              *httpMetrics
+	tracer               *tracer
+	clientIdentities     map[string]string
+	ui                   http.Handler
+	configArgs           []string
+	settings             atomic.Pointer[runtimeSettings]
+	payloadCompression   string
+	payloadKeys          *payloadKeyring
+	trashRetention       time.Duration
+	eventRetention       time.Duration
+	events               *eventNotifier
+	introspectionEnabled bool
+	openAPISpec          []byte
+	apiDocsEnabled       bool
+	syncMu               sync.Mutex
+	backupDir            string
+	backupKeep           int
+	backupMu             sync.Mutex
+	backupS3             *s3Client
+	replicator           *replicator
+	webhooks             *webhookDispatcher
+	chat                 *chatNotifier
+	mailer               *mailer
+	backupExportDiagrams bool
+	healthMinFreeBytes   int64
+	integrity            integrityCache
+	draining             atomic.Bool
+	logLevelOverride     logLevelOverride
+	readOnly             readOnlyMode
+	idempotencyInFlight  sync.Map
+	enforceLocks         bool
+	presence             *presenceTracker
+	features             serverFeatures
+	ai                   *aiClient
+	maxAttachmentBytes   int64
+	maxDiagramBytes      int64
+	reviewApprovers      map[string]bool
+	requiredApprovals    int
+	freezeIdentities     map[string]bool
+	anonymous            anonymousAccess
+	apiTokens            map[[sha256.Size]byte]apiToken
+	sessions             sessionSettings
+	saml                 *samlProvider
 }
 
 type diagramMeta struct {
@@ -37,6 +94,12 @@ type diagramMeta struct {
 	DatabaseEdition *string `json:"databaseEdition,omitempty"`
 	CreatedAt       string  `json:"createdAt"`
 	UpdatedAt       string  `json:"updatedAt"`
+	Archived        bool    `json:"archived"`
+	FolderID        *string `json:"folderId,omitempty"`
+	Starred         bool    `json:"starred"`
+	// PayloadBytes is the size of the normalized payload, before
+	// compression and encryption.
+	PayloadBytes int64 `json:"payloadBytes"`
 }
 
 type diagramVersion struct {
@@ -44,117 +107,504 @@ type diagramVersion struct {
 	DiagramID string `json:"diagramId"`
 	Name      string `json:"name"`
 	Action    string `json:"action"`
+	Message   string `json:"message,omitempty"`
+	Pinned    bool   `json:"pinned"`
 	CreatedAt string `json:"createdAt"`
 }
 
 func main() {
-	port := envOrDefault("PORT", defaultPort)
-	dataDir := envOrDefault("DATA_DIR", defaultDataDir)
-	maxVersions := envIntOrDefault("MAX_VERSIONS_PER_DIAGRAM", defaultMaxVersionsPerDiagram)
+	setupLogging(slog.LevelInfo)
+	// "migrate-payloads" rewrites stored payloads for the current compression
+	// and encryption settings, then exits instead of serving.
+	args := os.Args[1:]
+	migrateOnly := len(args) > 0 && args[0] == "migrate-payloads"
+	if migrateOnly {
+		args = args[1:]
+	}
+	cfg, err := loadConfig(args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fatal("invalid configuration", "error", err)
+	}
+
+	settings, err := runtimeSettingsFromConfig(cfg)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	setupLogging(settings.logLevel)
+
+	accessLogFormat := strings.ToLower(cfg.Log.Access)
+	if !isKnownAccessLogFormat(accessLogFormat) {
+		fatal(fmt.Sprintf("invalid ACCESS_LOG %q: use %q, %q or %q", accessLogFormat, accessLogJSON, accessLogCLF, accessLogOff))
+	}
+
+	port := cfg.Port
+	dataDir := cfg.DataDir
+	trashRetention, err := parseRetentionAge(cfg.Trash.Retention)
+	if err != nil {
+		fatal("invalid TRASH_RETENTION", "error", err)
+	}
+	eventRetention, err := parseRetentionAge(cfg.Events.Retention)
+	if err != nil {
+		fatal("invalid EVENT_RETENTION", "error", err)
+	}
+	if cfg.Review.RequiredApprovals < 1 {
+		fatal(fmt.Sprintf("invalid REVIEW_REQUIRED_APPROVALS %d: must be at least 1", cfg.Review.RequiredApprovals))
+	}
+	reviewApprovers := make(map[string]bool, len(cfg.Review.Approvers))
+	for _, approver := range cfg.Review.Approvers {
+		reviewApprovers[approver] = true
+	}
+	apiTokens, err := parseAPITokens(cfg.APITokens)
+	if err != nil {
+		fatal("invalid apiTokens", "error", err)
+	}
+	for _, token := range apiTokens {
+		if token.expired(time.Now()) {
+			slog.Warn("api token has expired", "name", token.name, "expiresAt", token.expiresAt)
+		}
+	}
+	anonymous, err := newAnonymousAccess(cfg.Anonymous.Access, cfg.Anonymous.Diagrams)
+	if err != nil {
+		fatal("invalid anonymous access", "error", err)
+	}
+	saml, err := newSAMLProvider(cfg)
+	if err != nil {
+		fatal("invalid SAML configuration", "error", err)
+	}
+	if anonymous.mode != anonymousWrite && cfg.TLS.ClientCA == "" && apiTokens == nil && saml == nil {
+		slog.Warn("ANONYMOUS_ACCESS restricts anonymous callers but none of TLS_CLIENT_CA, apiTokens and SAML_IDP_SSO_URL is set, so nobody can authenticate", "anonymousAccess", anonymous.mode)
+	}
+	freezeIdentities := make(map[string]bool, len(cfg.Freeze.Identities))
+	for _, id := range cfg.Freeze.Identities {
+		freezeIdentities[id] = true
+	}
+	if cfg.Attachments.MaxBytes <= 0 {
+		fatal(fmt.Sprintf("invalid ATTACHMENTS_MAX_BYTES %d: must be positive", cfg.Attachments.MaxBytes))
+	}
+	if cfg.Payload.MaxDiagramBytes < 0 {
+		fatal(fmt.Sprintf("invalid MAX_DIAGRAM_BYTES %d: must not be negative", cfg.Payload.MaxDiagramBytes))
+	}
+	if cfg.Health.MinFreeBytes < 0 {
+		fatal(fmt.Sprintf("invalid HEALTH_MIN_FREE_BYTES %d: must not be negative", cfg.Health.MinFreeBytes))
+	}
+	sessionTTL, err := time.ParseDuration(cfg.Session.TTL)
+	if err != nil || sessionTTL <= 0 {
+		fatal(fmt.Sprintf("invalid SESSION_TTL %q: use a duration such as 12h", cfg.Session.TTL))
+	}
+	sessionSameSite, err := parseSameSite(cfg.Session.CookieSameSite)
+	if err != nil {
+		fatal("invalid session settings", "error", err)
+	}
+	drainDelay, err := time.ParseDuration(cfg.Shutdown.DrainDelay)
+	if err != nil || drainDelay < 0 {
+		fatal(fmt.Sprintf("invalid SHUTDOWN_DRAIN_DELAY %q: use a duration such as 5s", cfg.Shutdown.DrainDelay))
+	}
+	shutdownTimeout, err := time.ParseDuration(cfg.Shutdown.Timeout)
+	if err != nil || shutdownTimeout <= 0 {
+		fatal(fmt.Sprintf("invalid SHUTDOWN_TIMEOUT %q: use a duration such as 30s", cfg.Shutdown.Timeout))
+	}
+	sqliteOpts, err := parseSQLiteOptions(cfg)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	var backupSchedule *cronSchedule
+	if cfg.Backup.Schedule != "" {
+		if backupSchedule, err = parseCronSchedule(cfg.Backup.Schedule); err != nil {
+			fatal("invalid BACKUP_SCHEDULE", "error", err)
+		}
+	}
+	backupS3, err := newS3Client(cfg)
+	if err != nil {
+		fatal("invalid backup configuration", "error", err)
+	}
+	if cfg.Replication.Enabled && backupS3 == nil {
+		fatal("invalid replication configuration", "error", "REPLICATION_ENABLED requires BACKUP_S3_BUCKET")
+	}
+	sqliteOpts.replicating = cfg.Replication.Enabled
+	var restoreUntil time.Time
+	if cfg.Replication.RestoreTimestamp != "" {
+		if restoreUntil, err = time.Parse(time.RFC3339, cfg.Replication.RestoreTimestamp); err != nil {
+			fatal("invalid REPLICATION_RESTORE_TIMESTAMP", "error", err)
+		}
+	}
+	webhooks, err := newWebhookDispatcher(cfg)
+	if err != nil {
+		fatal("invalid webhook configuration", "error", err)
+	}
+	chat, err := newChatNotifier(cfg)
+	if err != nil {
+		fatal("invalid chat configuration", "error", err)
+	}
+	mailer, err := newMailer(cfg)
+	if err != nil {
+		fatal("invalid SMTP configuration", "error", err)
+	}
+	ai, err := newAIClient(cfg)
+	if err != nil {
+		fatal("invalid AI configuration", "error", err)
+	}
+	backupDir := cfg.Backup.Dir
+	if backupDir == "" {
+		backupDir = filepath.Join(cfg.DataDir, defaultBackupDir)
+	}
+	payloadCompression := strings.ToLower(cfg.Payload.Compression)
+	if !isKnownCompression(payloadCompression) {
+		fatal(fmt.Sprintf("invalid PAYLOAD_COMPRESSION %q: use %q or %q", payloadCompression, compressionNone, compressionGzip))
+	}
+	payloadKeys, err := newPayloadKeyring(cfg)
+	if err != nil {
+		fatal("invalid payload encryption configuration", "error", err)
+	}
+	introspectionEnabled := cfg.Introspection.Enabled
+	tlsConfig, challengeHandler, err := newTLSConfig(cfg)
+	if err != nil {
+		fatal("invalid TLS configuration", "error", err)
+	}
+	if err := configureClientAuth(tlsConfig, cfg); err != nil {
+		fatal("invalid TLS configuration", "error", err)
+	}
+	clientIdentities, err := parseClientIdentities(cfg.TLS.ClientIdentities)
+	if err != nil {
+		fatal("invalid TLS configuration", "error", err)
+	}
+	basePath, err := normalizeBasePath(cfg.BasePath)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	legacyAPISunset, err := parseLegacyAPISunset(cfg.API.LegacySunset)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	ui, err := newUIHandler(cfg, basePath)
+	if err != nil {
+		fatal("invalid frontend configuration", "error", err)
+	}
+	openAPISpec, err := newOpenAPISpec(basePath)
+	if err != nil {
+		fatal("invalid OpenAPI description", "error", err)
+	}
+	tracer, err := newTracer(cfg)
+	if err != nil {
+		fatal("invalid OTLP trace exporter config", "error", err)
+	}
 
 	if err := os.MkdirAll(dataDir, 0o755); err != nil {
-		log.Fatalf("create data dir: %v", err)
+		fatal("create data dir failed", "error", err)
 	}
 
 	dbPath := filepath.Join(dataDir, defaultDBFileName)
-	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=foreign_keys(ON)", dbPath)
+	if cfg.Replication.Enabled {
+		if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+			restored, err := restoreReplica(context.Background(), backupS3, dbPath, restoreUntil)
+			if err != nil {
+				fatal("restore from replica failed", "error", err)
+			}
+			if !restored {
+				slog.Info("no replica to restore, starting with an empty database")
+			}
+		}
+	}
+	dsn := sqliteDSN(dbPath, sqliteOpts)
 
-	db, err := sql.Open("sqlite", dsn)
-	if err != nil {
-		log.Fatalf("open sqlite: %v", err)
+	var db *sql.DB
+	if tracer != nil {
+		db = sql.OpenDB(&tracedConnector{dsn: dsn, driver: &sqlite.Driver{}, tracer: tracer})
+	} else {
+		db, err = sql.Open("sqlite", dsn)
+		if err != nil {
+			fatal("open sqlite failed", "error", err)
+		}
 	}
 	defer db.Close()
+	configurePool(db, sqliteOpts)
+	if sqliteOpts.replicating {
+		// The replicator keeps two connections of its own.
+		db.SetMaxOpenConns(sqliteOpts.maxOpenConns + 2)
+	}
 
 	if err := initSchema(db); err != nil {
-		log.Fatalf("init schema: %v", err)
+		fatal("init schema failed", "error", err)
 	}
 
 	application := &app{
-		db:                    db,
-		maxVersionsPerDiagram: maxVersions,
+		db:                   db,
+		dbPath:               dbPath,
+		metrics:              newHTTPMetrics(),
+		tracer:               tracer,
+		clientIdentities:     clientIdentities,
+		configArgs:           args,
+		payloadCompression:   payloadCompression,
+		payloadKeys:          payloadKeys,
+		trashRetention:       trashRetention,
+		eventRetention:       eventRetention,
+		events:               newEventNotifier(),
+		introspectionEnabled: introspectionEnabled,
+		openAPISpec:          openAPISpec,
+		apiDocsEnabled:       cfg.APIDocs.Enabled,
+		backupDir:            backupDir,
+		backupKeep:           cfg.Backup.Keep,
+		backupS3:             backupS3,
+		webhooks:             webhooks,
+		chat:                 chat,
+		mailer:               mailer,
+		backupExportDiagrams: cfg.Backup.S3.ExportDiagrams,
+		healthMinFreeBytes:   int64(cfg.Health.MinFreeBytes),
+		enforceLocks:         cfg.Locks.Enforce,
+		maxAttachmentBytes:   int64(cfg.Attachments.MaxBytes),
+		maxDiagramBytes:      int64(cfg.Payload.MaxDiagramBytes),
+		reviewApprovers:      reviewApprovers,
+		requiredApprovals:    cfg.Review.RequiredApprovals,
+		freezeIdentities:     freezeIdentities,
+		anonymous:            anonymous,
+		apiTokens:            apiTokens,
+		sessions:             sessionSettings{ttl: sessionTTL, sameSite: sessionSameSite, path: basePath + "/"},
+		saml:                 saml,
+		presence:             newPresenceTracker(),
+		features:             featuresFromConfig(cfg),
+		ai:                   ai,
+	}
+
+	if ui != nil {
+		application.ui = ui
+	}
+	application.applyRuntimeSettings(settings)
+
+	if err := application.migratePayloadBlobs(context.Background()); err != nil {
+		fatal("migrate payload blobs failed", "error", err)
+	}
+	rewritten, err := application.migratePayloads(context.Background())
+	if err != nil {
+		fatal("migrate payloads failed", "error", err)
+	}
+	resealed, err := application.migrateSealedColumns(context.Background())
+	if err != nil {
+		fatal("migrate sealed columns failed", "error", err)
+	}
+	rewritten += resealed
+	if migrateOnly {
+		slog.Info("payload migration finished", "rewritten", rewritten)
+		return
+	}
+	if tracer != nil {
+		go tracer.run(context.Background())
+		slog.Info("exporting traces", "endpoint", tracer.endpoint)
+	}
+	if cfg.Replication.Enabled {
+		replicator, err := newReplicator(db, dbPath, backupS3, cfg)
+		if err != nil {
+			fatal("invalid replication configuration", "error", err)
+		}
+		if err := replicator.start(context.Background()); err != nil {
+			fatal("start wal replication failed", "error", err)
+		}
+		application.replicator = replicator
+		go replicator.run(context.Background())
+		slog.Info("wal replication enabled", "bucket", cfg.Backup.S3.Bucket, "sync_interval", replicator.sync.String())
+	}
+	if webhooks != nil {
+		go application.runWebhooks(context.Background())
+		slog.Info("webhooks enabled", "targets", len(webhooks.targets))
+	}
+	if chat != nil {
+		go application.runChatNotifier(context.Background())
+		slog.Info("chat notifications enabled", "format", chat.format)
+	}
+	if mailer != nil {
+		go application.runEmailNotifier(context.Background())
+		go application.runEmailDigest(context.Background())
+		slog.Info("email notifications enabled", "host", mailer.host, "digest_interval", mailer.digestInterval.String())
+	}
+	go application.runBlobGC(context.Background())
+	if backupSchedule != nil {
+		go application.runBackupSchedule(context.Background(), backupSchedule)
+		slog.Info("scheduled backups enabled", "schedule", cfg.Backup.Schedule, "dir", backupDir, "keep", cfg.Backup.Keep)
+	}
+	if sqliteOpts.checkpointInterval > 0 {
+		go application.runWALCheckpoint(context.Background(), sqliteOpts.checkpointInterval)
+	}
+	if trashRetention > 0 {
+		go application.runTrashPurge(context.Background())
+	}
+	if eventRetention > 0 {
+		go application.runEventPrune(context.Background())
+	}
+
+	if introspectionEnabled {
+		go application.runSyncScheduler(context.Background())
+	}
+
+	go application.reloadOnSIGHUP()
+
+	if cfg.Debug.Addr != "" {
+		go runDebugServer(newDebugServer(cfg.Debug.Addr, cfg.Debug.Token))
+	}
+
+	// Middleware listed innermost first; the request ID, forwarded headers
+	// and access log wrap everything so they also cover requests rejected
+	// further in.
+	handler := application.routes()
+	handler = application.withReadOnly(handler)
+	handler = withBodyLimit(int64(cfg.Payload.MaxBytes), handler)
+	handler = application.withAudit(handler)
+	handler = application.withAnonymousAccess(handler)
+	handler = application.withSessions(handler)
+	handler = application.withAPITokens(handler)
+	handler = application.withClientCertIdentity(handler)
+	handler = application.withRecovery(handler)
+	handler = application.withMetrics(handler)
+	handler = application.withTracing(handler)
+	handler = application.withCORS(handler)
+	handler = withAPIVersion(basePath, legacyAPISunset, handler)
+	handler = withBasePath(basePath, handler)
+	handler = withRequestLogging(accessLogFormat, handler)
+	handler = withForwardedHeaders(proxies, handler)
+	handler = withRequestID(handler)
+
+	if cfg.GRPC.Port != "" {
+		grpcHandler := application.grpcHandler()
+		grpcHandler = withBodyLimit(int64(cfg.Payload.MaxBytes), grpcHandler)
+		grpcHandler = application.withAPITokens(grpcHandler)
+		grpcHandler = application.withClientCertIdentity(grpcHandler)
+		grpcHandler = application.withRecovery(grpcHandler)
+		grpcHandler = withRequestLogging(accessLogFormat, grpcHandler)
+		grpcHandler = withRequestID(grpcHandler)
+		go runGRPCServer(":"+cfg.GRPC.Port, grpcHandler, tlsConfig)
+		slog.Info("grpc api is listening", "addr", ":"+cfg.GRPC.Port, "tls", tlsConfig != nil)
 	}
 
-	handler := withCORS(application.routes())
 	server := &http.Server{
 		Addr:              ":" + port,
 		Handler:           handler,
+		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
-	log.Printf("backend is listening on :%s (db: %s)", port, dbPath)
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("server error: %v", err)
+	if challengeHandler != nil && cfg.TLS.Autocert.HTTPAddr != "" {
+		go func() {
+			challengeServer := &http.Server{
+				Addr:              cfg.TLS.Autocert.HTTPAddr,
+				Handler:           challengeHandler,
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			if err := challengeServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("ACME challenge server error", "error", err)
+			}
+		}()
+	}
+
+	stopped := application.shutdownOnSignal(server, drainDelay, shutdownTimeout)
+	slog.Info("backend is listening", "version", version, "addr", ":"+port, "tls", tlsConfig != nil, "base_path", basePath, "db", dbPath)
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("server error", "error", err)
 	}
+	<-stopped
+	slog.Info("backend stopped")
 }
 
 func (a *app) routes() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch {
 		case r.Method == http.MethodGet && r.URL.Path == "/api/health":
-			writeJSON(w, http.StatusOK, map[string]string{
-				"status": "ok",
-			})
+			a.handleHealth(w, r)
+			return
+		case r.Method == http.MethodGet && r.URL.Path == "/healthz":
+			a.handleLiveness(w, r)
+			return
+		case r.Method == http.MethodGet && r.URL.Path == "/readyz":
+			a.handleReadiness(w, r)
+			return
+		case r.URL.Path == "/api/version":
+			a.handleVersion(w, r)
+			return
+		case r.URL.Path == "/api/openapi.json":
+			a.handleOpenAPI(w, r)
+			return
+		case r.URL.Path == "/api/docs":
+			a.handleAPIDocs(w, r)
+			return
+		case r.URL.Path == "/metrics":
+			a.handleMetrics(w, r)
+			return
+		case r.URL.Path == "/api/export":
+			a.handleExport(w, r)
+			return
+		case r.URL.Path == "/api/import":
+			a.handleImport(w, r)
+			return
+		case strings.HasPrefix(r.URL.Path, "/api/admin"):
+			a.handleAdmin(w, r)
+			return
+		case r.URL.Path == "/api/introspect":
+			a.handleIntrospect(w, r)
+			return
+		case r.URL.Path == "/api/events":
+			a.handleEvents(w, r)
+			return
+		case r.URL.Path == "/api/changes":
+			a.handleChanges(w, r)
+			return
+		case r.URL.Path == "/api/graphql":
+			a.handleGraphQL(w, r)
+			return
+		case r.URL.Path == "/api/mcp":
+			a.handleMCP(w, r)
+			return
+		case r.URL.Path == "/api/features":
+			a.handleFeatures(w, r)
+			return
+		case r.URL.Path == "/api/usage":
+			a.handleUsage(w, r)
+			return
+		case r.URL.Path == "/api/sync":
+			a.handleDeltaSync(w, r)
+			return
+		case strings.HasPrefix(r.URL.Path, "/api/ai/"):
+			a.handleAI(w, r)
 			return
 		case strings.HasPrefix(r.URL.Path, "/api/config"):
 			a.handleConfig(w, r)
 			return
-		case strings.HasPrefix(r.URL.Path, "/api/diagrams"):
-			a.handleDiagrams(w, r)
+		case strings.HasPrefix(r.URL.Path, "/api/folders"):
+			a.handleFolders(w, r)
 			return
-		default:
-			writeError(w, http.StatusNotFound, "route not found")
+		case strings.HasPrefix(r.URL.Path, "/api/templates"):
+			a.handleTemplates(w, r)
 			return
-		}
-	})
-}
-
-func withCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/api/auth/"):
+			a.handleAuth(w, r)
 			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-func (a *app) handleConfig(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		config, err := a.getConfig(r.Context())
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err.Error())
+		case strings.HasPrefix(r.URL.Path, "/api/scim/"):
+			a.handleSCIM(w, r)
 			return
-		}
-		writeJSON(w, http.StatusOK, config)
-	case http.MethodPut:
-		var payload map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			writeError(w, http.StatusBadRequest, "invalid json payload")
+		case r.URL.Path == "/api/tokens" || strings.HasPrefix(r.URL.Path, "/api/tokens/"):
+			a.handleTokens(w, r)
 			return
-		}
-
-		current, err := a.getConfig(r.Context())
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err.Error())
+		case strings.HasPrefix(r.URL.Path, "/api/trash"):
+			a.handleTrash(w, r)
 			return
-		}
-		for k, v := range payload {
-			current[k] = v
-		}
-
-		if err := a.setConfig(r.Context(), current); err != nil {
-			writeError(w, http.StatusInternalServerError, err.Error())
+		case strings.HasPrefix(r.URL.Path, "/api/diagrams"):
+			a.handleDiagrams(w, r)
+			return
+		case a.ui != nil && r.URL.Path != "/api" && !strings.HasPrefix(r.URL.Path, "/api/"):
+			a.ui.ServeHTTP(w, r)
+			return
+		default:
+			writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
 			return
 		}
-		writeJSON(w, http.StatusOK, current)
-	default:
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
-	}
+	})
 }
 
 func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
@@ -164,42 +614,90 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 	// /api/diagrams
 	if len(parts) == 2 {
 		switch r.Method {
-		case http.MethodGet:
-			full := r.URL.Query().Get("full") == "1" || r.URL.Query().Get("full") == "true"
+		case http.MethodGet, http.MethodHead:
+			filter := diagramListFilter{
+				includeArchived: queryFlag(r, "includeArchived"),
+				folderID:        r.URL.Query().Get("folderId"),
+				starredOnly:     queryFlag(r, "starred"),
+				userID:          requestUserID(r),
+			}
+			full := queryFlag(r, "full")
+			// ?ids= fetches those payloads in one round-trip, archived
+			// ones included as with GET by id; unknown ids are left out.
+			if r.URL.Query().Has("ids") {
+				ids, err := parseDiagramIDs(r.URL.Query().Get("ids"))
+				if err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				filter.ids = ids
+				filter.includeArchived = true
+				full = true
+			}
+			filter.ids = a.anonymous.listableIDs(r, filter.ids)
+			// Removing a diagram from the list does not advance its
+			// Last-Modified, so lists are only revalidated by ETag.
 			if full {
-				payloads, err := a.listDiagramPayloads(r.Context())
+				payloads, modified, err := a.listDiagramPayloads(r.Context(), filter)
 				if err != nil {
-					writeError(w, http.StatusInternalServerError, err.Error())
+					writeServerError(w, err)
 					return
 				}
+				if setValidators(w, r, contentETag(payloads...), modified, false) {
+					return
+				}
+				size := 2 + max(len(payloads)-1, 0)
+				for _, payload := range payloads {
+					size += len(payload)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(size))
 				writeRawJSONArray(w, http.StatusOK, payloads)
 				return
 			}
 
-			metas, err := a.listDiagramMetas(r.Context())
+			metas, err := a.listDiagramMetas(r.Context(), filter)
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			body, err := json.Marshal(metas)
 			if err != nil {
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
+				return
+			}
+			var modified time.Time
+			if len(metas) > 0 {
+				modified = parseStoredTime(metas[0].UpdatedAt)
+			}
+			if setValidators(w, r, contentETag(body), modified, false) {
 				return
 			}
-			writeJSON(w, http.StatusOK, metas)
+			body = append(body, '\n')
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			writeRawJSON(w, http.StatusOK, body)
 			return
 		case http.MethodPost:
-			payload, meta, err := decodeAndNormalizeDiagramPayload(r.Body)
+			if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+				a.createDiagramIdempotently(w, r, key)
+				return
+			}
+			newID := func() (string, error) { return a.unusedDiagramID(r.Context(), a.db) }
+			payload, meta, _, err := decodeAndNormalizeDiagramPayload(r.Body, newID)
 			if err != nil {
-				writeError(w, http.StatusBadRequest, err.Error())
+				writePayloadError(w, err)
 				return
 			}
 
 			if err := a.insertDiagramWithVersion(r.Context(), payload, meta, "create"); err != nil {
 				if isUniqueConstraintError(err) {
-					writeError(w, http.StatusConflict, "diagram already exists")
+					writeErrorCode(w, http.StatusConflict, codeDiagramExists, "diagram already exists")
 					return
 				}
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
 				return
 			}
 
-			writeRawJSON(w, http.StatusCreated, payload)
+			writeCreatedDiagram(w, payload)
 			return
 		default:
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -208,7 +706,22 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(parts) < 3 {
-		writeError(w, http.StatusNotFound, "route not found")
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+		return
+	}
+
+	// /api/diagrams/validate, /api/diagrams/bulk-delete and bulk-patch;
+	// diagrams are never POSTed to by id, so GET still reaches a diagram
+	// that happens to be called "validate".
+	if len(parts) == 3 && diagramCollectionActions[parts[2]] && r.Method == http.MethodPost {
+		switch parts[2] {
+		case "validate":
+			a.handleValidateDiagram(w, r)
+		case "bulk-delete":
+			a.handleBulkDelete(w, r)
+		case "bulk-patch":
+			a.handleBulkPatch(w, r)
+		}
 		return
 	}
 
@@ -218,39 +731,124 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Trashed diagrams are only reachable through /api/trash.
+	inTrash, err := a.isInTrash(r.Context(), diagramID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if inTrash {
+		writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		return
+	}
+
+	if isLockedWrite(r, parts) {
+		lock, err := a.checkDiagramLock(r.Context(), a.db, diagramID, lockOwner(r))
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if lock != nil {
+			writeDiagramLocked(w, lock)
+			return
+		}
+		freeze, err := checkDiagramFrozen(r.Context(), a.db, diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if freeze != nil {
+			writeDiagramFrozen(w, freeze)
+			return
+		}
+		state, err := reviewLockedState(r.Context(), a.db, diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if state != "" {
+			writeDiagramReviewLocked(w, state)
+			return
+		}
+	}
+
 	// /api/diagrams/{id}
 	if len(parts) == 3 {
 		switch r.Method {
-		case http.MethodGet:
-			payload, err := a.getDiagramPayload(r.Context(), diagramID)
+		case http.MethodGet, http.MethodHead:
+			raw, hash, size, updatedAt, err := a.getStoredDiagram(r.Context(), diagramID)
 			if err != nil {
 				if errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusNotFound, "diagram not found")
+					writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
 					return
 				}
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
+				return
+			}
+			// The blob hash is the SHA-256 of the payload, so it is a strong
+			// ETag, checked before the payload is decrypted.
+			if setValidators(w, r, `"`+hash+`"`, parseStoredTime(updatedAt), true) {
+				return
+			}
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			if r.Method == http.MethodHead {
+				writeRawJSON(w, http.StatusOK, nil)
+				return
+			}
+			payload, err := a.decodePayload(raw)
+			if err != nil {
+				writeServerError(w, err)
 				return
 			}
 			writeRawJSON(w, http.StatusOK, payload)
 			return
 		case http.MethodPut:
-			payload, meta, err := decodeAndNormalizeDiagramPayload(r.Body)
+			payload, meta, opts, err := decodeAndNormalizeDiagramPayload(r.Body, nil)
 			if err != nil {
-				writeError(w, http.StatusBadRequest, err.Error())
+				writePayloadError(w, err)
 				return
 			}
 
 			if meta.ID != diagramID {
-				writeError(w, http.StatusBadRequest, "diagram id in payload must match route id")
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "diagram id in payload must match route id")
+				return
+			}
+			opts.message = versionMessage(r, opts.message)
+
+			var stale *staleWriteError
+			if wantsUpsert(r) {
+				w.Header().Set("Preference-Applied", preferCreateIfMissing)
+				created, err := a.upsertDiagramWithVersion(r.Context(), payload, meta, opts)
+				if err != nil {
+					if errors.As(err, &stale) {
+						writeStaleWrite(w, stale)
+						return
+					}
+					if isUniqueConstraintError(err) {
+						writeErrorCode(w, http.StatusConflict, codeDiagramExists, "diagram already exists")
+						return
+					}
+					writeServerError(w, err)
+					return
+				}
+				if created {
+					writeCreatedDiagram(w, payload)
+					return
+				}
+				writeRawJSON(w, http.StatusOK, payload)
 				return
 			}
 
-			if err := a.replaceDiagramWithVersion(r.Context(), diagramID, payload, meta, "save"); err != nil {
+			if err := a.saveDiagramWithVersion(r.Context(), payload, meta, opts); err != nil {
+				if errors.As(err, &stale) {
+					writeStaleWrite(w, stale)
+					return
+				}
 				if errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusNotFound, "diagram not found")
+					writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
 					return
 				}
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
 				return
 			}
 
@@ -259,21 +857,58 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 		case http.MethodPatch:
 			patchData := map[string]interface{}{}
 			if err := json.NewDecoder(r.Body).Decode(&patchData); err != nil {
-				writeError(w, http.StatusBadRequest, "invalid json payload")
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
 				return
 			}
 
-			updatedPayload, err := a.patchDiagramWithVersion(r.Context(), diagramID, patchData)
+			message, _ := asString(patchData["message"])
+			delete(patchData, "message")
+
+			state, err := takeDiagramState(patchData)
+			if err != nil {
+				writePayloadError(w, err)
+				return
+			}
+			if !state.empty() {
+				if err := a.setDiagramState(r.Context(), diagramID, state); err != nil {
+					if errors.Is(err, sql.ErrNoRows) {
+						writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+						return
+					}
+					if errors.Is(err, errFolderNotFound) {
+						writeErrorCode(w, http.StatusBadRequest, codeFolderNotFound, err.Error())
+						return
+					}
+					writeServerError(w, err)
+					return
+				}
+				if len(patchData) == 0 {
+					payload, err := a.getDiagramPayload(r.Context(), diagramID)
+					if err != nil {
+						writeServerError(w, err)
+						return
+					}
+					writeRawJSON(w, http.StatusOK, payload)
+					return
+				}
+			}
+
+			updatedPayload, err := a.patchDiagramWithVersion(r.Context(), diagramID, patchData, versionMessage(r, message))
 			if err != nil {
 				if errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusNotFound, "diagram not found")
+					writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
 					return
 				}
 				if isUniqueConstraintError(err) {
-					writeError(w, http.StatusConflict, "diagram id already exists")
+					writeErrorCode(w, http.StatusConflict, codeDiagramExists, "diagram id already exists")
+					return
+				}
+				var invalid *fieldError
+				if errors.As(err, &invalid) {
+					writePayloadError(w, err)
 					return
 				}
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
 				return
 			}
 
@@ -281,7 +916,7 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 			return
 		case http.MethodDelete:
 			if err := a.deleteDiagram(r.Context(), diagramID); err != nil {
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
 				return
 			}
 			w.WriteHeader(http.StatusNoContent)
@@ -299,10 +934,10 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 			filter, err := a.getDiagramFilter(r.Context(), diagramID)
 			if err != nil {
 				if errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusNotFound, "filter not found")
+					writeErrorCode(w, http.StatusNotFound, codeFilterNotFound, "filter not found")
 					return
 				}
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
 				return
 			}
 			writeRawJSON(w, http.StatusOK, filter)
@@ -310,23 +945,23 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 		case http.MethodPut:
 			var payload map[string]interface{}
 			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-				writeError(w, http.StatusBadRequest, "invalid json payload")
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
 				return
 			}
 			raw, err := json.Marshal(payload)
 			if err != nil {
-				writeError(w, http.StatusBadRequest, "invalid json payload")
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
 				return
 			}
 			if err := a.setDiagramFilter(r.Context(), diagramID, raw); err != nil {
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
 				return
 			}
 			writeRawJSON(w, http.StatusOK, raw)
 			return
 		case http.MethodDelete:
 			if err := a.deleteDiagramFilter(r.Context(), diagramID); err != nil {
-				writeError(w, http.StatusInternalServerError, err.Error())
+				writeServerError(w, err)
 				return
 			}
 			w.WriteHeader(http.StatusNoContent)
@@ -337,6 +972,12 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// /api/diagrams/{id}/sync
+	if len(parts) == 4 && parts[3] == "sync" {
+		a.handleDiagramSync(w, r, diagramID)
+		return
+	}
+
 	// /api/diagrams/{id}/versions
 	if len(parts) == 4 && parts[3] == "versions" {
 		if r.Method != http.MethodGet {
@@ -345,7 +986,7 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 		}
 		versions, err := a.listVersions(r.Context(), diagramID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err.Error())
+			writeServerError(w, err)
 			return
 		}
 		writeJSON(w, http.StatusOK, versions)
@@ -368,10 +1009,10 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 		payload, err := a.getVersionPayload(r.Context(), diagramID, versionID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusNotFound, "version not found")
+				writeErrorCode(w, http.StatusNotFound, codeVersionNotFound, "version not found")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, err.Error())
+			writeServerError(w, err)
 			return
 		}
 		writeRawJSON(w, http.StatusOK, payload)
@@ -393,61 +1034,313 @@ func (a *app) handleDiagrams(w http.ResponseWriter, r *http.Request) {
 		payload, err := a.restoreVersion(r.Context(), diagramID, versionID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusNotFound, "version or diagram not found")
+				writeErrorCode(w, http.StatusNotFound, codeVersionNotFound, "version or diagram not found")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, err.Error())
+			writeServerError(w, err)
 			return
 		}
 		writeRawJSON(w, http.StatusOK, payload)
 		return
 	}
 
-	writeError(w, http.StatusNotFound, "route not found")
-}
+	// /api/diagrams/{id}/versions/{versionId}/pin
+	if len(parts) == 6 && parts[3] == "versions" && parts[5] == "pin" {
+		versionID, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid version id")
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
 
-func (a *app) getConfig(ctx context.Context) (map[string]interface{}, error) {
-	const query = `SELECT value FROM settings WHERE key = 'config'`
-	var raw string
-	err := a.db.QueryRowContext(ctx, query).Scan(&raw)
-	if errors.Is(err, sql.ErrNoRows) {
-		return map[string]interface{}{
-			"defaultDiagramId": "",
-		}, nil
-	}
-	if err != nil {
-		return nil, err
+		if err := a.setVersionPinned(r.Context(), diagramID, versionID, r.Method == http.MethodPost); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeVersionNotFound, "version not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	config := map[string]interface{}{}
-	if err := json.Unmarshal([]byte(raw), &config); err != nil {
-		return nil, err
-	}
-	if _, ok := config["defaultDiagramId"]; !ok {
-		config["defaultDiagramId"] = ""
-	}
-	return config, nil
-}
+	// /api/diagrams/{id}/versions/{versionId}/fork
+	if len(parts) == 6 && parts[3] == "versions" && parts[5] == "fork" {
+		versionID, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid version id")
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
 
-func (a *app) setConfig(ctx context.Context, config map[string]interface{}) error {
-	raw, err := json.Marshal(config)
-	if err != nil {
-		return err
+		var options struct {
+			Name string `json:"name"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&options); err != nil && !errors.Is(err, io.EOF) {
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+				return
+			}
+		}
+
+		payload, err := a.forkVersion(r.Context(), diagramID, versionID, strings.TrimSpace(options.Name))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeVersionNotFound, "version not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		writeCreatedDiagram(w, payload)
+		return
 	}
-	const query = `
-INSERT INTO settings (key, value)
-VALUES ('config', ?)
-ON CONFLICT(key) DO UPDATE SET value=excluded.value`
-	_, err = a.db.ExecContext(ctx, query, string(raw))
-	return err
+
+	// /api/diagrams/{id}/star
+	if len(parts) == 4 && parts[3] == "star" {
+		switch r.Method {
+		case http.MethodPost:
+			if err := a.setDiagramStarred(r.Context(), diagramID, requestUserID(r), true); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+					return
+				}
+				writeServerError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if err := a.setDiagramStarred(r.Context(), diagramID, requestUserID(r), false); err != nil {
+				writeServerError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	// /api/diagrams/{id}/watch
+	if len(parts) == 4 && parts[3] == "watch" {
+		a.handleDiagramWatch(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/clone
+	if len(parts) == 4 && parts[3] == "clone" {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		var options struct {
+			Name   string `json:"name"`
+			Filter bool   `json:"filter"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&options); err != nil && !errors.Is(err, io.EOF) {
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+				return
+			}
+		}
+
+		payload, err := a.cloneDiagram(r.Context(), diagramID, strings.TrimSpace(options.Name), options.Filter)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		writeCreatedDiagram(w, payload)
+		return
+	}
+
+	// /api/diagrams/{id}/stats
+	if len(parts) == 4 && parts[3] == "stats" {
+		a.handleDiagramStats(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/lint
+	if len(parts) == 4 && parts[3] == "lint" {
+		a.handleDiagramLint(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/merge
+	if len(parts) == 4 && parts[3] == "merge" {
+		a.handleDiagramMerge(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/lock
+	if len(parts) == 4 && parts[3] == "lock" {
+		a.handleDiagramLock(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/thumbnail
+	if len(parts) == 4 && parts[3] == "thumbnail" {
+		a.handleDiagramThumbnail(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/attachments
+	if len(parts) == 4 && parts[3] == "attachments" {
+		a.handleDiagramAttachments(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/attachments/{attachmentId}
+	if len(parts) == 5 && parts[3] == "attachments" {
+		a.handleDiagramAttachment(w, r, diagramID, parts[4])
+		return
+	}
+
+	// /api/diagrams/{id}/comments
+	if len(parts) == 4 && parts[3] == "comments" {
+		a.handleDiagramComments(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/comments/by-anchor
+	if len(parts) == 5 && parts[3] == "comments" && parts[4] == "by-anchor" {
+		a.handleCommentThreads(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/comments/{commentId}
+	if len(parts) == 5 && parts[3] == "comments" {
+		a.handleDiagramComment(w, r, diagramID, parts[4])
+		return
+	}
+
+	// /api/diagrams/{id}/freeze
+	if len(parts) == 4 && parts[3] == "freeze" {
+		a.handleDiagramFreeze(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/review
+	if len(parts) == 4 && parts[3] == "review" {
+		a.handleDiagramReview(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/presence
+	if len(parts) == 4 && parts[3] == "presence" {
+		a.handleDiagramPresence(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/crdt
+	if len(parts) == 4 && parts[3] == "crdt" {
+		a.handleDiagramCRDT(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/crdt/ops
+	if len(parts) == 5 && parts[3] == "crdt" && parts[4] == "ops" {
+		a.handleCRDTOps(w, r, diagramID)
+		return
+	}
+
+	// /api/diagrams/{id}/export/{format}
+	if len(parts) == 5 && parts[3] == "export" {
+		a.handleDiagramExport(w, r, diagramID, parts[4])
+		return
+	}
+
+	writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
 }
 
-func (a *app) listDiagramMetas(ctx context.Context) ([]diagramMeta, error) {
-	const query = `
-SELECT id, name, database_type, database_edition, created_at, updated_at
-FROM diagrams
-ORDER BY updated_at DESC`
-	rows, err := a.db.QueryContext(ctx, query)
+// diagramListFilter narrows the diagram listing. Trashed diagrams are never
+// listed and archived ones only on request.
+type diagramListFilter struct {
+	includeArchived bool
+	// folderID lists only the folder's direct children; "root" lists
+	// diagrams outside any folder.
+	folderID    string
+	starredOnly bool
+	// userID scopes stars; it is empty for anonymous requests.
+	userID string
+	// diagramID lists only that diagram.
+	diagramID string
+	// ids, when not nil, lists only these diagrams.
+	ids []string
+}
+
+// parseDiagramIDs reads the comma-separated ids of GET /api/diagrams?ids=,
+// dropping duplicates.
+func parseDiagramIDs(value string) ([]string, error) {
+	ids := make([]string, 0)
+	seen := map[string]bool{}
+	for _, id := range splitList(value) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("ids must list at least one diagram id")
+	}
+	if len(ids) > maxBatchDiagramIDs {
+		return nil, fmt.Errorf("ids lists more than %d diagrams", maxBatchDiagramIDs)
+	}
+	return ids, nil
+}
+
+func (f diagramListFilter) where() (string, []interface{}) {
+	clauses := []string{"d.deleted_at IS NULL"}
+	args := make([]interface{}, 0, 2)
+	if !f.includeArchived {
+		clauses = append(clauses, "d.archived = 0")
+	}
+	if f.starredOnly {
+		clauses = append(clauses, "EXISTS(SELECT 1 FROM diagram_stars s WHERE s.diagram_id = d.id AND s.user_id = ?)")
+		args = append(args, f.userID)
+	}
+	if f.diagramID != "" {
+		clauses = append(clauses, "d.id = ?")
+		args = append(args, f.diagramID)
+	}
+	if f.ids != nil {
+		clauses = append(clauses, "d.id IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(f.ids)), ", ")+")")
+		for _, id := range f.ids {
+			args = append(args, id)
+		}
+	}
+	switch f.folderID {
+	case "":
+	case "root":
+		clauses = append(clauses, "d.folder_id IS NULL")
+	default:
+		clauses = append(clauses, "d.folder_id = ?")
+		args = append(args, f.folderID)
+	}
+	return "WHERE " + strings.Join(clauses, " AND "), args
+}
+
+func (a *app) listDiagramMetas(ctx context.Context, filter diagramListFilter) ([]diagramMeta, error) {
+	where, args := filter.where()
+	query := `
+SELECT d.id, d.name, d.database_type, d.database_edition, d.created_at, d.updated_at, d.archived, d.folder_id,
+	EXISTS(SELECT 1 FROM diagram_stars s WHERE s.diagram_id = d.id AND s.user_id = ?), b.size
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+` + where + `
+ORDER BY d.updated_at DESC`
+	rows, err := a.db.QueryContext(ctx, query, append([]interface{}{filter.userID}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -463,6 +1356,10 @@ ORDER BY updated_at DESC`
 			&item.DatabaseEdition,
 			&item.CreatedAt,
 			&item.UpdatedAt,
+			&item.Archived,
+			&item.FolderID,
+			&item.Starred,
+			&item.PayloadBytes,
 		); err != nil {
 			return nil, err
 		}
@@ -471,68 +1368,121 @@ ORDER BY updated_at DESC`
 	return result, rows.Err()
 }
 
-func (a *app) listDiagramPayloads(ctx context.Context) ([][]byte, error) {
-	const query = `SELECT payload FROM diagrams ORDER BY updated_at DESC`
-	rows, err := a.db.QueryContext(ctx, query)
+// listDiagramPayloads returns the payloads of the listed diagrams, most
+// recently updated first, and when the first of them was updated.
+func (a *app) listDiagramPayloads(ctx context.Context, filter diagramListFilter) ([][]byte, time.Time, error) {
+	where, args := filter.where()
+	query := `
+SELECT b.payload, d.updated_at
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+` + where + `
+ORDER BY d.updated_at DESC`
+	rows, err := a.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 	defer rows.Close()
 
 	result := make([][]byte, 0)
+	var modified time.Time
 	for rows.Next() {
-		var raw string
-		if err := rows.Scan(&raw); err != nil {
-			return nil, err
+		var raw []byte
+		var updatedAt string
+		if err := rows.Scan(&raw, &updatedAt); err != nil {
+			return nil, time.Time{}, err
 		}
-		result = append(result, []byte(raw))
+		payload, err := a.decodePayload(raw)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if len(result) == 0 {
+			modified = parseStoredTime(updatedAt)
+		}
+		result = append(result, payload)
 	}
-	return result, rows.Err()
+	return result, modified, rows.Err()
+}
+
+// getStoredDiagram returns a diagram's payload as stored (see
+// decodePayload), its blob hash, the size of the decoded payload and when
+// it was last updated.
+func (a *app) getStoredDiagram(ctx context.Context, diagramID string) ([]byte, string, int64, string, error) {
+	const query = `
+SELECT b.payload, d.blob_hash, b.size, d.updated_at
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.id = ?`
+	var raw []byte
+	var hash, updatedAt string
+	var size int64
+	if err := a.db.QueryRowContext(ctx, query, diagramID).Scan(&raw, &hash, &size, &updatedAt); err != nil {
+		return nil, "", 0, "", err
+	}
+	return raw, hash, size, updatedAt, nil
 }
 
 func (a *app) getDiagramPayload(ctx context.Context, diagramID string) ([]byte, error) {
-	const query = `SELECT payload FROM diagrams WHERE id = ?`
-	var raw string
+	const query = `
+SELECT b.payload
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.id = ?`
+	var raw []byte
 	if err := a.db.QueryRowContext(ctx, query, diagramID).Scan(&raw); err != nil {
 		return nil, err
 	}
-	return []byte(raw), nil
+	return a.decodePayload(raw)
 }
 
 func (a *app) insertDiagramWithVersion(ctx context.Context, payload []byte, meta diagramMeta, action string) error {
-	tx, err := a.db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer rollback(tx)
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		return a.createDiagram(ctx, tx, payload, meta, action)
+	})
+}
 
-	if err := insertDiagram(ctx, tx, payload, meta); err != nil {
+// createDiagram inserts a new diagram together with its first version and
+// the created event.
+func (a *app) createDiagram(ctx context.Context, tx *sql.Tx, payload []byte, meta diagramMeta, action string) error {
+	if err := a.insertDiagram(ctx, tx, payload, meta); err != nil {
 		return err
 	}
-	if err := insertVersion(ctx, tx, meta.ID, meta.Name, payload, action); err != nil {
+	if err := a.insertVersion(ctx, tx, meta.ID, meta.Name, payload, action, ""); err != nil {
 		return err
 	}
-	if err := pruneVersions(ctx, tx, meta.ID, a.maxVersionsPerDiagram); err != nil {
+	if err := a.pruneVersions(ctx, tx, meta.ID); err != nil {
 		return err
 	}
-	return tx.Commit()
+	return a.recordEvent(ctx, tx, eventDiagramCreated, meta.ID)
+}
+
+func (a *app) replaceDiagramWithVersion(ctx context.Context, diagramID string, payload []byte, meta diagramMeta, action, message string) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		return a.replaceDiagram(ctx, tx, diagramID, payload, meta, action, message)
+	})
 }
 
-func (a *app) replaceDiagramWithVersion(ctx context.Context, diagramID string, payload []byte, meta diagramMeta, action string) error {
-	tx, err := a.db.BeginTx(ctx, nil)
+// replaceDiagram stores a new payload for an existing diagram together with
+// a version and the saved event, or returns sql.ErrNoRows.
+func (a *app) replaceDiagram(ctx context.Context, tx *sql.Tx, diagramID string, payload []byte, meta diagramMeta, action, message string) error {
+	if err := a.checkDiagramSize(payload); err != nil {
+		return err
+	}
+	if err := a.reserveQuota(ctx, tx, 0, 0, len(payload)); err != nil {
+		return err
+	}
+	blobHash, err := a.putBlob(ctx, tx, payload)
 	if err != nil {
 		return err
 	}
-	defer rollback(tx)
-
 	res, err := tx.ExecContext(ctx, `
 UPDATE diagrams
-SET name=?, database_type=?, database_edition=?, payload=?, updated_at=?
+SET name=?, database_type=?, database_edition=?, payload='', blob_hash=?, updated_at=?
 WHERE id=?`,
 		meta.Name,
 		meta.DatabaseType,
 		meta.DatabaseEdition,
-		string(payload),
+		blobHash,
 		meta.UpdatedAt,
 		diagramID,
 	)
@@ -546,17 +1496,20 @@ WHERE id=?`,
 	if affected == 0 {
 		return sql.ErrNoRows
 	}
+	if err := a.absorbCRDT(ctx, tx, diagramID, payload); err != nil {
+		return err
+	}
 
-	if err := insertVersion(ctx, tx, diagramID, meta.Name, payload, action); err != nil {
+	if err := a.insertVersion(ctx, tx, diagramID, meta.Name, payload, action, message); err != nil {
 		return err
 	}
-	if err := pruneVersions(ctx, tx, diagramID, a.maxVersionsPerDiagram); err != nil {
+	if err := a.pruneVersions(ctx, tx, diagramID); err != nil {
 		return err
 	}
-	return tx.Commit()
+	return a.recordEvent(ctx, tx, eventDiagramSaved, diagramID)
 }
 
-func (a *app) patchDiagramWithVersion(ctx context.Context, diagramID string, patch map[string]interface{}) ([]byte, error) {
+func (a *app) patchDiagramWithVersion(ctx context.Context, diagramID string, patch map[string]interface{}, message string) ([]byte, error) {
 	payload, err := a.getDiagramPayload(ctx, diagramID)
 	if err != nil {
 		return nil, err
@@ -588,108 +1541,234 @@ func (a *app) patchDiagramWithVersion(ctx context.Context, diagramID string, pat
 		meta.ID = diagramID
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer rollback(tx)
-
-	if targetID == diagramID {
-		res, err := tx.ExecContext(ctx, `
-UPDATE diagrams
-SET name=?, database_type=?, database_edition=?, payload=?, updated_at=?
-WHERE id=?`,
-			meta.Name,
-			meta.DatabaseType,
-			meta.DatabaseEdition,
-			string(normalizedPayload),
-			meta.UpdatedAt,
-			diagramID,
-		)
-		if err != nil {
-			return nil, err
+	if err := a.inTx(ctx, func(tx *sql.Tx) error {
+		if err := a.checkDiagramSize(normalizedPayload); err != nil {
+			return err
 		}
-		affected, err := res.RowsAffected()
-		if err != nil {
-			return nil, err
+		if err := a.reserveQuota(ctx, tx, 0, 0, len(normalizedPayload)); err != nil {
+			return err
 		}
-		if affected == 0 {
-			return nil, sql.ErrNoRows
+		blobHash, err := a.putBlob(ctx, tx, normalizedPayload)
+		if err != nil {
+			return err
 		}
-	} else {
-		res, err := tx.ExecContext(ctx, `
+		if targetID == diagramID {
+			res, err := tx.ExecContext(ctx, `
 UPDATE diagrams
-SET id=?, name=?, database_type=?, database_edition=?, payload=?, updated_at=?
+SET name=?, database_type=?, database_edition=?, payload='', blob_hash=?, updated_at=?
 WHERE id=?`,
-			targetID,
-			meta.Name,
-			meta.DatabaseType,
-			meta.DatabaseEdition,
-			string(normalizedPayload),
-			meta.UpdatedAt,
-			diagramID,
-		)
-		if err != nil {
-			return nil, err
+				meta.Name,
+				meta.DatabaseType,
+				meta.DatabaseEdition,
+				blobHash,
+				meta.UpdatedAt,
+				diagramID,
+			)
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if affected == 0 {
+				return sql.ErrNoRows
+			}
+		} else {
+			res, err := tx.ExecContext(ctx, `
+UPDATE diagrams
+SET id=?, name=?, database_type=?, database_edition=?, payload='', blob_hash=?, updated_at=?
+WHERE id=?`,
+				targetID,
+				meta.Name,
+				meta.DatabaseType,
+				meta.DatabaseEdition,
+				blobHash,
+				meta.UpdatedAt,
+				diagramID,
+			)
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if affected == 0 {
+				return sql.ErrNoRows
+			}
+
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_versions SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_filters SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_sync SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_stars SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_watches SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if err := renameCRDT(ctx, tx, diagramID, targetID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_locks SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_thumbnails SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_attachments SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_comments SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_reviews SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE diagram_review_approvals SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
+				return err
+			}
 		}
-		affected, err := res.RowsAffected()
-		if err != nil {
-			return nil, err
+		if err := a.absorbCRDT(ctx, tx, targetID, normalizedPayload); err != nil {
+			return err
 		}
-		if affected == 0 {
-			return nil, sql.ErrNoRows
+
+		if !isOnlyUpdatedAtPatch(patch) {
+			if err := a.insertVersion(ctx, tx, targetID, meta.Name, normalizedPayload, "patch", message); err != nil {
+				return err
+			}
+			if err := a.pruneVersions(ctx, tx, targetID); err != nil {
+				return err
+			}
 		}
+		return a.recordEvent(ctx, tx, eventDiagramPatched, targetID)
+	}); err != nil {
+		return nil, err
+	}
+	return normalizedPayload, nil
+}
 
-		if _, err := tx.ExecContext(ctx, `UPDATE diagram_versions SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
-			return nil, err
+func (a *app) setDiagramStarred(ctx context.Context, diagramID, userID string, starred bool) error {
+	if !starred {
+		_, err := a.db.ExecContext(ctx, `DELETE FROM diagram_stars WHERE diagram_id = ? AND user_id = ?`, diagramID, userID)
+		return err
+	}
+
+	const query = `
+INSERT INTO diagram_stars (diagram_id, user_id, created_at)
+SELECT id, ?, ? FROM diagrams WHERE id = ?
+ON CONFLICT(diagram_id, user_id) DO NOTHING`
+	res, err := a.db.ExecContext(ctx, query, userID, time.Now().UTC().Format(time.RFC3339Nano), diagramID)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// Either already starred or the diagram doesn't exist.
+		var exists bool
+		if err := a.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, diagramID).Scan(&exists); err != nil {
+			return err
 		}
-		if _, err := tx.ExecContext(ctx, `UPDATE diagram_filters SET diagram_id=? WHERE diagram_id=?`, targetID, diagramID); err != nil {
-			return nil, err
+		if !exists {
+			return sql.ErrNoRows
 		}
 	}
+	return nil
+}
 
-	if !isOnlyUpdatedAtPatch(patch) {
-		if err := insertVersion(ctx, tx, targetID, meta.Name, normalizedPayload, "patch"); err != nil {
-			return nil, err
+// diagramState holds the PATCH-able fields kept in diagram columns rather
+// than in the diagram payload.
+type diagramState struct {
+	archived  *bool
+	folderID  *string
+	setFolder bool
+}
+
+func (s diagramState) empty() bool {
+	return s.archived == nil && !s.setFolder
+}
+
+// takeDiagramState removes server-side fields from a PATCH body.
+func takeDiagramState(patch map[string]interface{}) (diagramState, error) {
+	var state diagramState
+	if value, ok := patch["archived"]; ok {
+		archived, isBool := value.(bool)
+		if !isBool {
+			return diagramState{}, invalidField("archived", "must be a boolean")
 		}
-		if err := pruneVersions(ctx, tx, targetID, a.maxVersionsPerDiagram); err != nil {
-			return nil, err
+		state.archived = &archived
+		delete(patch, "archived")
+	}
+	if value, ok := patch["folderId"]; ok {
+		if value != nil {
+			folderID, isString := asString(value)
+			if !isString || folderID == "" {
+				return diagramState{}, invalidField("folderId", "must be a folder id or null")
+			}
+			state.folderID = &folderID
 		}
+		state.setFolder = true
+		delete(patch, "folderId")
 	}
+	return state, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return nil, err
-	}
-	return normalizedPayload, nil
+func (a *app) setDiagramState(ctx context.Context, diagramID string, state diagramState) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		return a.setDiagramStateTx(ctx, tx, diagramID, state)
+	})
 }
 
-func (a *app) deleteDiagram(ctx context.Context, diagramID string) error {
-	tx, err := a.db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+func (a *app) setDiagramStateTx(ctx context.Context, tx *sql.Tx, diagramID string, state diagramState) error {
+	if state.archived != nil {
+		if err := updateDiagramColumn(ctx, tx, diagramID, "archived", *state.archived); err != nil {
+			return err
+		}
 	}
-	defer rollback(tx)
+	if state.setFolder {
+		if state.folderID != nil {
+			if err := checkFolderExists(ctx, tx, *state.folderID); err != nil {
+				return err
+			}
+		}
+		if err := updateDiagramColumn(ctx, tx, diagramID, "folder_id", state.folderID); err != nil {
+			return err
+		}
+	}
+	return a.recordEvent(ctx, tx, eventDiagramPatched, diagramID)
+}
 
-	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_filters WHERE diagram_id = ?`, diagramID); err != nil {
+func updateDiagramColumn(ctx context.Context, tx *sql.Tx, diagramID, column string, value interface{}) error {
+	res, err := tx.ExecContext(ctx, `UPDATE diagrams SET `+column+` = ? WHERE id = ?`, value, diagramID)
+	if err != nil {
 		return err
 	}
-	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_versions WHERE diagram_id = ?`, diagramID); err != nil {
+	affected, err := res.RowsAffected()
+	if err != nil {
 		return err
 	}
-	if _, err := tx.ExecContext(ctx, `DELETE FROM diagrams WHERE id = ?`, diagramID); err != nil {
-		return err
+	if affected == 0 {
+		return sql.ErrNoRows
 	}
-
-	return tx.Commit()
+	return nil
 }
 
 func (a *app) getDiagramFilter(ctx context.Context, diagramID string) ([]byte, error) {
 	const query = `SELECT payload FROM diagram_filters WHERE diagram_id = ?`
-	var raw string
+	var raw []byte
 	if err := a.db.QueryRowContext(ctx, query, diagramID).Scan(&raw); err != nil {
 		return nil, err
 	}
-	return []byte(raw), nil
+	return a.payloadKeys.openValue(raw)
 }
 
 func (a *app) setDiagramFilter(ctx context.Context, diagramID string, payload []byte) error {
@@ -697,7 +1776,11 @@ func (a *app) setDiagramFilter(ctx context.Context, diagramID string, payload []
 INSERT INTO diagram_filters (diagram_id, payload)
 VALUES (?, ?)
 ON CONFLICT(diagram_id) DO UPDATE SET payload=excluded.payload`
-	_, err := a.db.ExecContext(ctx, query, diagramID, string(payload))
+	value, err := a.payloadKeys.sealValue(payload, true)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.ExecContext(ctx, query, diagramID, value)
 	return err
 }
 
@@ -708,7 +1791,7 @@ func (a *app) deleteDiagramFilter(ctx context.Context, diagramID string) error {
 
 func (a *app) listVersions(ctx context.Context, diagramID string) ([]diagramVersion, error) {
 	const query = `
-SELECT id, diagram_id, name, action, created_at
+SELECT id, diagram_id, name, action, COALESCE(message, ''), pinned, created_at
 FROM diagram_versions
 WHERE diagram_id = ?
 ORDER BY id DESC`
@@ -721,7 +1804,7 @@ ORDER BY id DESC`
 	result := make([]diagramVersion, 0)
 	for rows.Next() {
 		item := diagramVersion{}
-		if err := rows.Scan(&item.ID, &item.DiagramID, &item.Name, &item.Action, &item.CreatedAt); err != nil {
+		if err := rows.Scan(&item.ID, &item.DiagramID, &item.Name, &item.Action, &item.Message, &item.Pinned, &item.CreatedAt); err != nil {
 			return nil, err
 		}
 		result = append(result, item)
@@ -730,15 +1813,7 @@ ORDER BY id DESC`
 }
 
 func (a *app) getVersionPayload(ctx context.Context, diagramID string, versionID int64) ([]byte, error) {
-	const query = `
-SELECT payload
-FROM diagram_versions
-WHERE diagram_id = ? AND id = ?`
-	var raw string
-	if err := a.db.QueryRowContext(ctx, query, diagramID, versionID).Scan(&raw); err != nil {
-		return nil, err
-	}
-	return []byte(raw), nil
+	return a.loadVersionPayload(ctx, a.db, diagramID, versionID)
 }
 
 func (a *app) restoreVersion(ctx context.Context, diagramID string, versionID int64) ([]byte, error) {
@@ -770,111 +1845,459 @@ func (a *app) restoreVersion(ctx context.Context, diagramID string, versionID in
 		return nil, err
 	}
 
-	tx, err := a.db.BeginTx(ctx, nil)
-	if err != nil {
+	if err := a.inTx(ctx, func(tx *sql.Tx) error {
+		if err := a.checkDiagramSize(restoredPayload); err != nil {
+			return err
+		}
+		if err := a.reserveQuota(ctx, tx, 0, 0, len(restoredPayload)); err != nil {
+			return err
+		}
+		blobHash, err := a.putBlob(ctx, tx, restoredPayload)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+UPDATE diagrams
+SET name=?, database_type=?, database_edition=?, payload='', blob_hash=?, updated_at=?
+WHERE id=?`,
+			meta.Name,
+			meta.DatabaseType,
+			meta.DatabaseEdition,
+			blobHash,
+			meta.UpdatedAt,
+			diagramID,
+		)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		if err := a.absorbCRDT(ctx, tx, diagramID, restoredPayload); err != nil {
+			return err
+		}
+
+		if err := a.insertVersion(ctx, tx, diagramID, meta.Name, restoredPayload, "restore", fmt.Sprintf("Restored from version %d", versionID)); err != nil {
+			return err
+		}
+		if err := a.pruneVersions(ctx, tx, diagramID); err != nil {
+			return err
+		}
+		return a.recordEvent(ctx, tx, eventDiagramRestored, diagramID)
+	}); err != nil {
 		return nil, err
 	}
-	defer rollback(tx)
+	return restoredPayload, nil
+}
 
-	res, err := tx.ExecContext(ctx, `
-UPDATE diagrams
-SET name=?, database_type=?, database_edition=?, payload=?, updated_at=?
-WHERE id=?`,
-		meta.Name,
-		meta.DatabaseType,
-		meta.DatabaseEdition,
-		string(restoredPayload),
-		meta.UpdatedAt,
-		diagramID,
-	)
+// forkVersion creates a new diagram with a fresh id from a stored version,
+// leaving the source diagram untouched.
+func (a *app) forkVersion(ctx context.Context, diagramID string, versionID int64, name string) ([]byte, error) {
+	versionPayload, err := a.getVersionPayload(ctx, diagramID, versionID)
 	if err != nil {
 		return nil, err
 	}
-	affected, err := res.RowsAffected()
-	if err != nil {
+
+	forked := map[string]interface{}{}
+	if err := json.Unmarshal(versionPayload, &forked); err != nil {
 		return nil, err
 	}
-	if affected == 0 {
-		return nil, sql.ErrNoRows
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	forked["createdAt"] = now
+	forked["updatedAt"] = now
+	if name != "" {
+		forked["name"] = name
 	}
 
-	if err := insertVersion(ctx, tx, diagramID, meta.Name, restoredPayload, "restore"); err != nil {
-		return nil, err
-	}
-	if err := pruneVersions(ctx, tx, diagramID, a.maxVersionsPerDiagram); err != nil {
+	var payload []byte
+	if err := a.inTx(ctx, func(tx *sql.Tx) error {
+		id, err := a.unusedDiagramID(ctx, tx)
+		if err != nil {
+			return err
+		}
+		forked["id"] = id
+		raw, err := json.Marshal(forked)
+		if err != nil {
+			return err
+		}
+		var meta diagramMeta
+		payload, meta, err = normalizeDiagramPayload(raw)
+		if err != nil {
+			return err
+		}
+
+		if err := a.insertDiagram(ctx, tx, payload, meta); err != nil {
+			return err
+		}
+		message := fmt.Sprintf("Forked from %s version %d", diagramID, versionID)
+		if err := a.insertVersion(ctx, tx, meta.ID, meta.Name, payload, "fork", message); err != nil {
+			return err
+		}
+		return a.recordEvent(ctx, tx, eventDiagramCreated, meta.ID)
+	}); err != nil {
 		return nil, err
 	}
+	return payload, nil
+}
+
+// cloneDiagram copies a diagram's current payload, and optionally its filter,
+// to a new diagram with a fresh id. The name defaults to the source name with
+// a " (copy)" suffix.
+func (a *app) cloneDiagram(ctx context.Context, diagramID, name string, copyFilter bool) ([]byte, error) {
+	var payload []byte
+	if err := a.inTx(ctx, func(tx *sql.Tx) error {
+		const query = `
+SELECT b.payload
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.id = ?`
+		var raw []byte
+		if err := tx.QueryRowContext(ctx, query, diagramID).Scan(&raw); err != nil {
+			return err
+		}
+		source, err := a.decodePayload(raw)
+		if err != nil {
+			return err
+		}
+
+		cloned := map[string]interface{}{}
+		if err := json.Unmarshal(source, &cloned); err != nil {
+			return err
+		}
+		if name == "" {
+			sourceName, _ := asString(cloned["name"])
+			name = sourceName + " (copy)"
+		}
+		id, err := a.unusedDiagramID(ctx, tx)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		cloned["id"] = id
+		cloned["name"] = name
+		cloned["createdAt"] = now
+		cloned["updatedAt"] = now
+
+		encoded, err := json.Marshal(cloned)
+		if err != nil {
+			return err
+		}
+		var meta diagramMeta
+		payload, meta, err = normalizeDiagramPayload(encoded)
+		if err != nil {
+			return err
+		}
 
-	if err := tx.Commit(); err != nil {
+		if err := a.insertDiagram(ctx, tx, payload, meta); err != nil {
+			return err
+		}
+		if err := a.insertVersion(ctx, tx, meta.ID, meta.Name, payload, "clone", "Cloned from "+diagramID); err != nil {
+			return err
+		}
+		if copyFilter {
+			const copyQuery = `
+INSERT INTO diagram_filters (diagram_id, payload)
+SELECT ?, payload FROM diagram_filters WHERE diagram_id = ?`
+			if _, err := tx.ExecContext(ctx, copyQuery, meta.ID, diagramID); err != nil {
+				return err
+			}
+		}
+		return a.recordEvent(ctx, tx, eventDiagramCreated, meta.ID)
+	}); err != nil {
 		return nil, err
 	}
-	return restoredPayload, nil
+	return payload, nil
 }
 
-func insertDiagram(ctx context.Context, tx *sql.Tx, payload []byte, meta diagramMeta) error {
+func (a *app) insertDiagram(ctx context.Context, tx *sql.Tx, payload []byte, meta diagramMeta) error {
+	if err := a.checkDiagramSize(payload); err != nil {
+		return err
+	}
+	if err := a.reserveQuota(ctx, tx, 1, 0, len(payload)); err != nil {
+		return err
+	}
+	blobHash, err := a.putBlob(ctx, tx, payload)
+	if err != nil {
+		return err
+	}
+	creator, _ := requestIdentity(ctx)
 	const query = `
-INSERT INTO diagrams (id, name, database_type, database_edition, payload, created_at, updated_at)
-VALUES (?, ?, ?, ?, ?, ?, ?)`
-	_, err := tx.ExecContext(
+INSERT INTO diagrams (id, name, database_type, database_edition, payload, blob_hash, created_at, updated_at, created_by)
+VALUES (?, ?, ?, ?, '', ?, ?, ?, ?)`
+	_, err = tx.ExecContext(
 		ctx,
 		query,
 		meta.ID,
 		meta.Name,
 		meta.DatabaseType,
 		meta.DatabaseEdition,
-		string(payload),
+		blobHash,
 		meta.CreatedAt,
 		meta.UpdatedAt,
+		nullableString(creator.ID),
 	)
 	return err
 }
 
-func insertVersion(ctx context.Context, tx *sql.Tx, diagramID, diagramName string, payload []byte, action string) error {
+// insertVersion records a new version unless its content is identical to
+// the diagram's latest version and no message was given, so auto-saving
+// clients don't flood the history with duplicate rows. The version is stored
+// as a delta against the latest version until the chain reaches
+// snapshotInterval deltas, at which point a full snapshot starts a new chain.
+func (a *app) insertVersion(ctx context.Context, tx *sql.Tx, diagramID, diagramName string, payload []byte, action, message string) error {
+	hash, err := payloadHash(payload)
+	if err != nil {
+		return err
+	}
+	latest, found, err := a.latestVersion(ctx, tx, diagramID)
+	if err != nil {
+		return err
+	}
+	if found && message == "" && latest.hash == hash {
+		return nil
+	}
+
+	content := payload
+	var (
+		baseID     interface{}
+		chainDepth int
+	)
+	if found && latest.chainDepth+1 < a.runtime().snapshotInterval {
+		basePayload, err := a.loadVersionPayload(ctx, tx, diagramID, latest.id)
+		if err != nil {
+			return err
+		}
+		delta, err := diffPayloads(basePayload, payload)
+		if err != nil {
+			return err
+		}
+		// Small diagrams or wholesale rewrites don't benefit from a delta.
+		if len(delta) < len(payload)/2 {
+			content = delta
+			baseID = latest.id
+			chainDepth = latest.chainDepth + 1
+		}
+	}
+
+	// A full snapshot shares its blob with the diagram, whose write already
+	// reserved the space.
+	deltaBytes := 0
+	if baseID != nil {
+		deltaBytes = len(content)
+	}
+	if err := a.reserveVersion(ctx, tx, diagramID, deltaBytes); err != nil {
+		return err
+	}
+
 	const query = `
-INSERT INTO diagram_versions (diagram_id, name, payload, action, created_at)
-VALUES (?, ?, ?, ?, ?)`
-	_, err := tx.ExecContext(
+INSERT INTO diagram_versions (diagram_id, name, payload, blob_hash, action, message, payload_hash, base_id, chain_depth, created_at)
+VALUES (?, ?, '', ?, ?, ?, ?, ?, ?, ?)`
+	blobHash, err := a.putBlob(ctx, tx, content)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
 		ctx,
 		query,
 		diagramID,
 		diagramName,
-		string(payload),
+		blobHash,
 		action,
+		nullableString(message),
+		hash,
+		baseID,
+		chainDepth,
 		time.Now().UTC().Format(time.RFC3339Nano),
 	)
 	return err
 }
 
-func pruneVersions(ctx context.Context, tx *sql.Tx, diagramID string, keep int) error {
-	if keep <= 0 {
+type versionHead struct {
+	id         int64
+	hash       string
+	chainDepth int
+}
+
+func (a *app) latestVersion(ctx context.Context, tx *sql.Tx, diagramID string) (versionHead, bool, error) {
+	const query = `
+SELECT id, payload_hash, chain_depth
+FROM diagram_versions
+WHERE diagram_id = ?
+ORDER BY id DESC
+LIMIT 1`
+	var (
+		head versionHead
+		hash sql.NullString
+	)
+	err := tx.QueryRowContext(ctx, query, diagramID).Scan(&head.id, &hash, &head.chainDepth)
+	if errors.Is(err, sql.ErrNoRows) {
+		return versionHead{}, false, nil
+	}
+	if err != nil {
+		return versionHead{}, false, err
+	}
+	head.hash = hash.String
+	if !hash.Valid {
+		// Versions written before hashes were stored are always full copies.
+		var raw []byte
+		if err := tx.QueryRowContext(ctx, `SELECT b.payload FROM diagram_versions v JOIN blobs b ON b.hash = v.blob_hash WHERE v.id = ?`, head.id).Scan(&raw); err != nil {
+			return versionHead{}, false, err
+		}
+		payload, err := a.decodePayload(raw)
+		if err != nil {
+			return versionHead{}, false, err
+		}
+		if head.hash, err = payloadHash(payload); err != nil {
+			return versionHead{}, false, err
+		}
+	}
+	return head, true, nil
+}
+
+// payloadHash fingerprints a diagram payload's content. The diagram-level
+// timestamps are ignored because they are (re)stamped on save even when
+// nothing else changed.
+func payloadHash(payload []byte) (string, error) {
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return "", err
+	}
+	delete(data, "createdAt")
+	delete(data, "updatedAt")
+	canonical, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// pruneVersions applies the retention policy to a diagram's history: only
+// the newest maxVersionsPerDiagram unpinned versions are kept, and unpinned
+// versions older than maxVersionAge are dropped. Pinned versions and the
+// newest version are never pruned. Surviving versions stored as deltas
+// against a pruned version are rewritten in full first.
+func (a *app) pruneVersions(ctx context.Context, tx *sql.Tx, diagramID string) error {
+	settings := a.runtime()
+	prunable := make([]int64, 0)
+	if keep := settings.maxVersionsPerDiagram; keep > 0 {
+		const query = `
+SELECT id
+FROM diagram_versions
+WHERE diagram_id = ? AND pinned = 0
+ORDER BY id DESC
+LIMIT -1 OFFSET ?`
+		ids, err := queryVersionIDs(ctx, tx, query, diagramID, keep)
+		if err != nil {
+			return err
+		}
+		prunable = append(prunable, ids...)
+	}
+
+	if settings.maxVersionAge > 0 {
+		const query = `
+SELECT id
+FROM diagram_versions
+WHERE diagram_id = ?
+	AND pinned = 0
+	AND created_at < ?
+	AND id <> (SELECT MAX(id) FROM diagram_versions WHERE diagram_id = ?)`
+		cutoff := time.Now().UTC().Add(-settings.maxVersionAge).Format(time.RFC3339Nano)
+		ids, err := queryVersionIDs(ctx, tx, query, diagramID, cutoff, diagramID)
+		if err != nil {
+			return err
+		}
+		prunable = append(prunable, ids...)
+	}
+
+	if len(prunable) == 0 {
 		return nil
 	}
+	if err := a.materializeDependents(ctx, tx, diagramID, prunable); err != nil {
+		return err
+	}
+	for _, id := range prunable {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_versions WHERE diagram_id = ? AND id = ?`, diagramID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	const query = `
-DELETE FROM diagram_versions
-WHERE id IN (
-	SELECT id
-	FROM diagram_versions
-	WHERE diagram_id = ?
-	ORDER BY id DESC
-	LIMIT -1 OFFSET ?
-)`
-	_, err := tx.ExecContext(ctx, query, diagramID, keep)
-	return err
+func queryVersionIDs(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (a *app) setVersionPinned(ctx context.Context, diagramID string, versionID int64, pinned bool) error {
+	res, err := a.db.ExecContext(ctx, `UPDATE diagram_versions SET pinned = ? WHERE diagram_id = ? AND id = ?`, pinned, diagramID, versionID)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
+// decodeAndNormalizeDiagramPayload reads a diagram from a request body. When
+// newID is set, a payload without an id gets one from it. An optional
+// top-level "message" field is stripped: it is a version commit message
+// rather than part of the diagram.
 func decodeAndNormalizeDiagramPayload(bodyReader interface {
 	Read(p []byte) (n int, err error)
-}) ([]byte, diagramMeta, error) {
+}, newID func() (string, error)) ([]byte, diagramMeta, saveOptions, error) {
 	var payload map[string]interface{}
 	if err := json.NewDecoder(bodyReader).Decode(&payload); err != nil {
-		return nil, diagramMeta{}, errors.New("invalid json payload")
+		return nil, diagramMeta{}, saveOptions{}, errors.New("invalid json payload")
+	}
+	var opts saveOptions
+	opts.message, _ = asString(payload["message"])
+	delete(payload, "message")
+	if value, ok := payload["baseUpdatedAt"]; ok {
+		base, isString := asString(value)
+		if !isString || base == "" {
+			return nil, diagramMeta{}, saveOptions{}, invalidField("baseUpdatedAt", "must be the updatedAt the edit started from")
+		}
+		opts.baseUpdatedAt = base
+		delete(payload, "baseUpdatedAt")
+	}
+
+	if id, _ := asString(payload["id"]); newID != nil && strings.TrimSpace(id) == "" {
+		generated, err := newID()
+		if err != nil {
+			return nil, diagramMeta{}, saveOptions{}, err
+		}
+		payload["id"] = generated
 	}
+
 	raw, err := json.Marshal(payload)
 	if err != nil {
-		return nil, diagramMeta{}, errors.New("invalid json payload")
+		return nil, diagramMeta{}, saveOptions{}, errors.New("invalid json payload")
 	}
-	return normalizeDiagramPayload(raw)
+	normalized, meta, err := normalizeDiagramPayload(raw)
+	return normalized, meta, opts, err
 }
 
 func normalizeDiagramPayload(raw []byte) ([]byte, diagramMeta, error) {
@@ -885,15 +2308,15 @@ func normalizeDiagramPayload(raw []byte) ([]byte, diagramMeta, error) {
 
 	id, ok := asString(data["id"])
 	if !ok || strings.TrimSpace(id) == "" {
-		return nil, diagramMeta{}, errors.New("diagram.id is required")
+		return nil, diagramMeta{}, invalidField("diagram.id", "is required")
 	}
 	name, ok := asString(data["name"])
 	if !ok || strings.TrimSpace(name) == "" {
-		return nil, diagramMeta{}, errors.New("diagram.name is required")
+		return nil, diagramMeta{}, invalidField("diagram.name", "is required")
 	}
 	databaseType, ok := asString(data["databaseType"])
 	if !ok || strings.TrimSpace(databaseType) == "" {
-		return nil, diagramMeta{}, errors.New("diagram.databaseType is required")
+		return nil, diagramMeta{}, invalidField("diagram.databaseType", "is required")
 	}
 
 	nowISO := time.Now().UTC().Format(time.RFC3339Nano)
@@ -962,12 +2385,297 @@ CREATE TABLE IF NOT EXISTS diagram_filters (
 	payload TEXT NOT NULL
 );
 
+CREATE TABLE IF NOT EXISTS diagram_sync (
+	diagram_id TEXT PRIMARY KEY,
+	connection TEXT NOT NULL,
+	interval TEXT NOT NULL,
+	mode TEXT NOT NULL,
+	enabled INTEGER NOT NULL DEFAULT 1,
+	last_run_at TEXT,
+	next_run_at TEXT,
+	last_status TEXT,
+	last_error TEXT,
+	drift TEXT
+);
+
+CREATE TABLE IF NOT EXISTS blobs (
+	hash TEXT PRIMARY KEY,
+	payload BLOB NOT NULL,
+	size INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS diagram_stars (
+	diagram_id TEXT NOT NULL,
+	user_id TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL,
+	PRIMARY KEY (diagram_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS folders (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	parent_id TEXT,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS templates (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	description TEXT,
+	database_type TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS settings (
 	key TEXT PRIMARY KEY,
 	value TEXT NOT NULL
 );`
-	_, err := db.Exec(schema)
-	return err
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	return migrateSchema(db)
+}
+
+// schemaMigrations are applied in order on top of the base schema, tracked
+// through PRAGMA user_version. Only ever append to this list.
+var schemaMigrations = []string{
+	`ALTER TABLE diagram_versions ADD COLUMN message TEXT`,
+	`ALTER TABLE diagram_versions ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE diagram_versions ADD COLUMN payload_hash TEXT`,
+	`ALTER TABLE diagram_versions ADD COLUMN base_id INTEGER`,
+	`ALTER TABLE diagram_versions ADD COLUMN chain_depth INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE diagrams ADD COLUMN blob_hash TEXT`,
+	`ALTER TABLE diagram_versions ADD COLUMN blob_hash TEXT`,
+	`CREATE INDEX IF NOT EXISTS idx_diagrams_blob_hash ON diagrams(blob_hash)`,
+	`CREATE INDEX IF NOT EXISTS idx_diagram_versions_blob_hash ON diagram_versions(blob_hash)`,
+	`ALTER TABLE diagrams ADD COLUMN deleted_at TEXT`,
+	`ALTER TABLE diagrams ADD COLUMN archived INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE diagrams ADD COLUMN folder_id TEXT`,
+	`CREATE INDEX IF NOT EXISTS idx_diagrams_folder_id ON diagrams(folder_id)`,
+	`CREATE TABLE audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	at TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	actor_source TEXT NOT NULL,
+	action TEXT NOT NULL,
+	path TEXT NOT NULL,
+	diagram_id TEXT,
+	status INTEGER NOT NULL,
+	client_ip TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	payload_hash TEXT
+);
+CREATE INDEX idx_audit_log_diagram_id ON audit_log(diagram_id, id);
+CREATE INDEX idx_audit_log_actor ON audit_log(actor, id);
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;`,
+	`CREATE TABLE events (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	at TEXT NOT NULL,
+	diagram_id TEXT NOT NULL,
+	diagram_name TEXT NOT NULL,
+	actor TEXT NOT NULL
+);
+CREATE INDEX idx_events_diagram_id ON events(diagram_id, seq);
+CREATE INDEX idx_events_at ON events(at);
+CREATE TABLE event_cursors (
+	consumer TEXT PRIMARY KEY,
+	seq INTEGER NOT NULL
+);`,
+	`CREATE TABLE diagram_watches (
+	diagram_id TEXT NOT NULL,
+	email TEXT NOT NULL COLLATE NOCASE,
+	digest INTEGER NOT NULL DEFAULT 0,
+	user_id TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL,
+	PRIMARY KEY (diagram_id, email)
+)`,
+	`CREATE TABLE idempotency_keys (
+	scope TEXT NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	diagram_id TEXT NOT NULL,
+	blob_hash TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	PRIMARY KEY (scope, key)
+);
+CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+CREATE INDEX idx_idempotency_keys_blob_hash ON idempotency_keys(blob_hash);`,
+	`CREATE TABLE crdt_documents (
+	diagram_id TEXT PRIMARY KEY,
+	clock INTEGER NOT NULL,
+	seq INTEGER NOT NULL,
+	next_order INTEGER NOT NULL,
+	enabled_at TEXT NOT NULL
+);
+CREATE TABLE crdt_registers (
+	diagram_id TEXT NOT NULL,
+	path TEXT NOT NULL,
+	value TEXT,
+	deleted INTEGER NOT NULL DEFAULT 0,
+	ord INTEGER NOT NULL DEFAULT 0,
+	counter INTEGER NOT NULL,
+	replica TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	PRIMARY KEY (diagram_id, path)
+);
+CREATE INDEX idx_crdt_registers_seq ON crdt_registers(diagram_id, seq);`,
+	`CREATE TABLE diagram_locks (
+	diagram_id TEXT PRIMARY KEY,
+	owner TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	acquired_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL
+)`,
+	`CREATE TABLE user_config (
+	user_id TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+)`,
+	`CREATE TABLE diagram_thumbnails (
+	diagram_id TEXT PRIMARY KEY,
+	content_type TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	data BLOB NOT NULL
+)`,
+	`CREATE TABLE diagram_attachments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	diagram_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	blob_hash TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	created_by TEXT
+);
+CREATE INDEX idx_diagram_attachments_diagram ON diagram_attachments(diagram_id);`,
+	`CREATE TABLE diagram_comments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	diagram_id TEXT NOT NULL,
+	author TEXT NOT NULL,
+	author_id TEXT,
+	body TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE INDEX idx_diagram_comments_diagram ON diagram_comments(diagram_id);`,
+	`ALTER TABLE diagram_comments ADD COLUMN anchor_table_id TEXT;
+ALTER TABLE diagram_comments ADD COLUMN anchor_field_id TEXT;`,
+	`CREATE TABLE diagram_reviews (
+	diagram_id TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	revision INTEGER NOT NULL,
+	submitted_by TEXT,
+	submitted_at TEXT,
+	updated_at TEXT NOT NULL,
+	message TEXT
+);
+CREATE TABLE diagram_review_approvals (
+	diagram_id TEXT NOT NULL,
+	approver TEXT NOT NULL,
+	approved_at TEXT NOT NULL,
+	PRIMARY KEY (diagram_id, approver)
+);`,
+	`CREATE TABLE diagram_freezes (
+	diagram_id TEXT PRIMARY KEY,
+	frozen_by TEXT,
+	frozen_at TEXT NOT NULL,
+	reason TEXT
+)`,
+	`CREATE TABLE api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner TEXT NOT NULL,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	hash TEXT NOT NULL UNIQUE,
+	scopes TEXT NOT NULL,
+	expires_at TEXT,
+	created_at TEXT NOT NULL,
+	rotated_at TEXT,
+	last_used_at TEXT
+);
+CREATE INDEX idx_api_tokens_owner ON api_tokens(owner);`,
+	`CREATE TABLE sessions (
+	id_hash TEXT PRIMARY KEY,
+	identity TEXT NOT NULL,
+	source TEXT NOT NULL,
+	scopes TEXT,
+	csrf_token TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL
+);
+CREATE INDEX idx_sessions_expires ON sessions(expires_at);`,
+	`CREATE TABLE service_accounts (
+	name TEXT PRIMARY KEY,
+	description TEXT,
+	created_by TEXT,
+	created_at TEXT NOT NULL,
+	disabled_at TEXT
+)`,
+	`CREATE TABLE saml_requests (
+	id TEXT PRIMARY KEY,
+	binding_hash TEXT NOT NULL,
+	return_to TEXT NOT NULL,
+	expires_at TEXT NOT NULL
+)`,
+	`CREATE TABLE scim_users (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	external_id TEXT,
+	active INTEGER NOT NULL DEFAULT 1,
+	attributes TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE TABLE scim_groups (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	external_id TEXT,
+	attributes TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE TABLE scim_group_members (
+	group_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	PRIMARY KEY (group_id, user_id)
+);
+CREATE INDEX idx_scim_group_members_user ON scim_group_members(user_id);`,
+	`ALTER TABLE diagrams ADD COLUMN created_by TEXT;
+CREATE INDEX idx_diagrams_created_by ON diagrams(created_by);`,
+}
+
+func migrateSchema(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(schemaMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(schemaMigrations[i]); err != nil {
+			rollback(tx)
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			rollback(tx)
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
@@ -982,6 +2690,12 @@ func writeRawJSON(w http.ResponseWriter, status int, payload []byte) {
 	_, _ = w.Write(payload)
 }
 
+func writeText(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body))
+}
+
 func writeRawJSONArray(w http.ResponseWriter, status int, payloads [][]byte) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -995,40 +2709,74 @@ func writeRawJSONArray(w http.ResponseWriter, status int, payloads [][]byte) {
 	_, _ = w.Write([]byte("]"))
 }
 
-func writeError(w http.ResponseWriter, status int, message string) {
-	writeJSON(w, status, map[string]string{
-		"error": message,
-	})
-}
-
 func rollback(tx *sql.Tx) {
 	_ = tx.Rollback()
 }
 
-func envOrDefault(key, fallback string) string {
-	value := strings.TrimSpace(os.Getenv(key))
-	if value == "" {
-		return fallback
+// parseRetentionAge accepts Go durations plus day ("90d") and week ("12w")
+// suffixes. An empty value disables age-based retention.
+func parseRetentionAge(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit > 0 {
+		count, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(value, "d"), "w"))
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(count) * unit, nil
 	}
-	return value
-}
 
-func envIntOrDefault(key string, fallback int) int {
-	value := strings.TrimSpace(os.Getenv(key))
-	if value == "" {
-		return fallback
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
 	}
-	parsed, err := strconv.Atoi(value)
-	if err != nil {
-		return fallback
-	}
-	return parsed
+	return duration, nil
+}
+
+func queryFlag(r *http.Request, key string) bool {
+	value := r.URL.Query().Get(key)
+	return value == "1" || value == "true"
 }
 
 func isUniqueConstraintError(err error) bool {
 	return strings.Contains(strings.ToLower(err.Error()), "unique")
 }
 
+// versionMessage prefers the X-Version-Message header over a message field
+// sent in the body.
+func versionMessage(r *http.Request, bodyMessage string) string {
+	message := strings.TrimSpace(r.Header.Get("X-Version-Message"))
+	if message == "" {
+		message = bodyMessage
+	}
+	return trimVersionMessage(message)
+}
+
+func trimVersionMessage(message string) string {
+	message = strings.TrimSpace(message)
+	if len(message) > maxVersionMessageLength {
+		message = message[:maxVersionMessageLength]
+	}
+	return message
+}
+
+func nullableString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
 func isOnlyUpdatedAtPatch(patch map[string]interface{}) bool {
 	if len(patch) != 1 {
 		return false
@@ -1037,6 +2785,43 @@ func isOnlyUpdatedAtPatch(patch map[string]interface{}) bool {
 	return ok
 }
 
+// randomID returns an n-character id drawn from the frontend's alphabet.
+func randomID(n int) string {
+	max := big.NewInt(int64(len(idAlphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(fmt.Sprintf("read random: %v", err))
+		}
+		b[i] = idAlphabet[idx.Int64()]
+	}
+	return string(b)
+}
+
+// newDiagramID returns an id of the same length as the frontend's
+// generateDiagramId (8-character workspace prefix plus 4 characters).
+func newDiagramID() string {
+	return randomID(12)
+}
+
+// unusedDiagramID returns a new diagram id that no stored diagram (trashed
+// ones included) already uses. Callers that insert the diagram in a
+// transaction pass it as q, so the id is still free when they do.
+func (a *app) unusedDiagramID(ctx context.Context, q rowQueryer) (string, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		id := newDiagramID()
+		var exists bool
+		if err := q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, id).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return id, nil
+		}
+	}
+	return "", errors.New("could not generate a unique diagram id")
+}
+
 func asString(v interface{}) (string, bool) {
 	value, ok := v.(string)
 	return value, ok
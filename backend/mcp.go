@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// /api/mcp is a Model Context Protocol server over the Streamable HTTP
+// transport, so LLM agents and IDE assistants can browse the diagrams as
+// tools. It is stateless and read-only: every POST carries a JSON-RPC
+// request (or a batch) and gets its responses back as JSON; there is no
+// server-to-client stream.
+
+const (
+	mcpServerName = "chartdb-server"
+
+	defaultMCPSearchLimit = 50
+	maxMCPSearchLimit     = 200
+
+	// JSON-RPC 2.0 error codes.
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCInternalError  = -32603
+)
+
+// mcpProtocolVersions are the protocol revisions the server speaks, newest
+// first. A client asking for another one gets the newest.
+var mcpProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *mcpError) Error() string { return e.Message }
+
+// mcpTool is a tool the server offers. call returns the tool's output, or
+// an error the agent sees as a failed tool call.
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+	call        func(ctx context.Context, args mcpArgs) (string, error)
+}
+
+// mcpArgs are a tool call's arguments.
+type mcpArgs map[string]interface{}
+
+func (args mcpArgs) string(name string) (string, error) {
+	value, ok := args[name]
+	if !ok {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", name)
+	}
+	return s, nil
+}
+
+func (args mcpArgs) required(name string) (string, error) {
+	s, err := args.string(name)
+	if err == nil && strings.TrimSpace(s) == "" {
+		err = fmt.Errorf("%s is required", name)
+	}
+	return s, err
+}
+
+func mcpObjectSchema(required []string, properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+func (a *app) mcpTools() []mcpTool {
+	diagramID := map[string]interface{}{"type": "string", "description": "The diagram id, as returned by list_diagrams."}
+	return []mcpTool{
+		{
+			Name:        "list_diagrams",
+			Description: "List the stored database diagrams with their id, name, database type and last update.",
+			InputSchema: mcpObjectSchema([]string{}, map[string]interface{}{
+				"includeArchived": map[string]interface{}{"type": "boolean", "description": "Also list archived diagrams."},
+			}),
+			call: a.mcpListDiagrams,
+		},
+		{
+			Name:        "get_diagram",
+			Description: "Get a diagram's full ChartDB JSON: tables with their fields and indexes, relationships and areas.",
+			InputSchema: mcpObjectSchema([]string{"id"}, map[string]interface{}{"id": diagramID}),
+			call:        a.mcpGetDiagram,
+		},
+		{
+			Name:        "search_diagrams",
+			Description: "Find diagrams, tables and columns whose name or comment contains the query, case-insensitively.",
+			InputSchema: mcpObjectSchema([]string{"query"}, map[string]interface{}{
+				"query": map[string]interface{}{"type": "string"},
+				"limit": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxMCPSearchLimit, "default": defaultMCPSearchLimit},
+			}),
+			call: a.mcpSearchDiagrams,
+		},
+		{
+			Name:        "get_diagram_ddl",
+			Description: "Get CREATE TABLE, CREATE INDEX and foreign key statements for a diagram.",
+			InputSchema: mcpObjectSchema([]string{"id"}, map[string]interface{}{
+				"id":      diagramID,
+				"dialect": map[string]interface{}{"type": "string", "enum": []string{dialectPostgres, dialectMySQL, dialectSQLite, dialectMSSQL}, "description": "Defaults to the diagram's database type."},
+			}),
+			call: a.mcpGetDiagramDDL,
+		},
+	}
+}
+
+// handleMCP serves /api/mcp.
+func (a *app) handleMCP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		// GET would open a server-to-client stream, which this server
+		// does not have.
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeJSON(w, http.StatusOK, mcpResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &mcpError{Code: jsonRPCParseError, Message: "invalid json"}})
+		return
+	}
+
+	raw = bytes.TrimSpace(raw)
+	batch := len(raw) > 0 && raw[0] == '['
+	var messages []json.RawMessage
+	if batch {
+		if err := json.Unmarshal(raw, &messages); err != nil || len(messages) == 0 {
+			writeJSON(w, http.StatusOK, mcpResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &mcpError{Code: jsonRPCInvalidRequest, Message: "batch must be a non-empty array"}})
+			return
+		}
+	} else {
+		messages = []json.RawMessage{raw}
+	}
+
+	responses := make([]mcpResponse, 0, len(messages))
+	for _, message := range messages {
+		if response, ok := a.mcpDispatch(r.Context(), message); ok {
+			responses = append(responses, response)
+		}
+	}
+	switch {
+	case len(responses) == 0:
+		// Only notifications and client responses.
+		w.WriteHeader(http.StatusAccepted)
+	case batch:
+		writeJSON(w, http.StatusOK, responses)
+	default:
+		writeJSON(w, http.StatusOK, responses[0])
+	}
+}
+
+// mcpDispatch handles one message. It reports false for messages that get
+// no response: notifications and the client's responses to us.
+func (a *app) mcpDispatch(ctx context.Context, message json.RawMessage) (mcpResponse, bool) {
+	var req mcpRequest
+	if err := json.Unmarshal(message, &req); err != nil || req.JSONRPC != "2.0" {
+		return mcpResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &mcpError{Code: jsonRPCInvalidRequest, Message: "not a JSON-RPC 2.0 message"}}, true
+	}
+	if req.Method == "" {
+		return mcpResponse{}, false
+	}
+	notification := len(req.ID) == 0 || string(req.ID) == "null"
+
+	result, err := a.mcpCall(ctx, req)
+	if notification {
+		return mcpResponse{}, false
+	}
+	response := mcpResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+	if err != nil {
+		var rpcErr *mcpError
+		if !errors.As(err, &rpcErr) {
+			slog.ErrorContext(ctx, "mcp request failed", "method", req.Method, "error", err)
+			rpcErr = &mcpError{Code: jsonRPCInternalError, Message: "internal error"}
+		}
+		response.Result, response.Error = nil, rpcErr
+	}
+	return response, true
+}
+
+func (a *app) mcpCall(ctx context.Context, req mcpRequest) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		if err := unmarshalMCPParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		version := mcpProtocolVersions[0]
+		if slices.Contains(mcpProtocolVersions, params.ProtocolVersion) {
+			version = params.ProtocolVersion
+		}
+		return map[string]interface{}{
+			"protocolVersion": version,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": mcpServerName, "version": currentBuildInfo().Version},
+			"instructions":    "Read-only access to the database diagrams stored in this ChartDB server.",
+		}, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": a.mcpTools()}, nil
+	case "tools/call":
+		var params struct {
+			Name      string  `json:"name"`
+			Arguments mcpArgs `json:"arguments"`
+		}
+		if err := unmarshalMCPParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		for _, tool := range a.mcpTools() {
+			if tool.Name != params.Name {
+				continue
+			}
+			text, err := tool.call(ctx, params.Arguments)
+			if err != nil {
+				return mcpToolResult(err.Error(), true), nil
+			}
+			return mcpToolResult(text, false), nil
+		}
+		return nil, &mcpError{Code: jsonRPCInvalidParams, Message: "unknown tool " + params.Name}
+	default:
+		if strings.HasPrefix(req.Method, "notifications/") {
+			return nil, nil
+		}
+		return nil, &mcpError{Code: jsonRPCMethodNotFound, Message: "method not found: " + req.Method}
+	}
+}
+
+func unmarshalMCPParams(raw json.RawMessage, params interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, params); err != nil {
+		return &mcpError{Code: jsonRPCInvalidParams, Message: "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+func mcpToolResult(text string, isError bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
+
+// mcpDiagramPayload loads a diagram that is not in the trash.
+func (a *app) mcpDiagramPayload(ctx context.Context, args mcpArgs) ([]byte, error) {
+	id, err := args.required("id")
+	if err != nil {
+		return nil, err
+	}
+	inTrash, err := a.isInTrash(ctx, id)
+	if err == nil && inTrash {
+		err = sql.ErrNoRows
+	}
+	if err == nil {
+		var payload []byte
+		payload, err = a.getDiagramPayload(ctx, id)
+		if err == nil {
+			return payload, nil
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("diagram %s not found", id)
+	}
+	return nil, err
+}
+
+func (a *app) mcpListDiagrams(ctx context.Context, args mcpArgs) (string, error) {
+	includeArchived, _ := args["includeArchived"].(bool)
+	metas, err := a.listDiagramMetas(ctx, diagramListFilter{includeArchived: includeArchived})
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(metas)
+	return string(raw), err
+}
+
+func (a *app) mcpGetDiagram(ctx context.Context, args mcpArgs) (string, error) {
+	payload, err := a.mcpDiagramPayload(ctx, args)
+	return string(payload), err
+}
+
+func (a *app) mcpGetDiagramDDL(ctx context.Context, args mcpArgs) (string, error) {
+	dialect, err := args.string("dialect")
+	if err != nil {
+		return "", err
+	}
+	if dialect != "" && !isKnownDialect(dialect) {
+		return "", errors.New("dialect must be one of postgres, mysql, sqlite, mssql")
+	}
+	payload, err := a.mcpDiagramPayload(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		return "", err
+	}
+	if dialect == "" {
+		dialect = dialectForDatabaseType(doc.DatabaseType)
+	}
+	return generateDDL(doc, dialect), nil
+}
+
+// mcpSearchMatch is one hit of search_diagrams.
+type mcpSearchMatch struct {
+	DiagramID   string `json:"diagramId"`
+	DiagramName string `json:"diagramName"`
+	Kind        string `json:"kind"`
+	Table       string `json:"table,omitempty"`
+	Column      string `json:"column,omitempty"`
+	Type        string `json:"type,omitempty"`
+}
+
+func (a *app) mcpSearchDiagrams(ctx context.Context, args mcpArgs) (string, error) {
+	query, err := args.required("query")
+	if err != nil {
+		return "", err
+	}
+	limit := defaultMCPSearchLimit
+	if value, ok := args["limit"]; ok {
+		n, ok := value.(float64)
+		if !ok || n < 1 || n > maxMCPSearchLimit || n != float64(int(n)) {
+			return "", fmt.Errorf("limit must be an integer from 1 to %d", maxMCPSearchLimit)
+		}
+		limit = int(n)
+	}
+	needle := strings.ToLower(query)
+	matches := func(values ...string) bool {
+		for _, value := range values {
+			if strings.Contains(strings.ToLower(value), needle) {
+				return true
+			}
+		}
+		return false
+	}
+
+	metas, err := a.listDiagramMetas(ctx, diagramListFilter{})
+	if err != nil {
+		return "", err
+	}
+	found := make([]mcpSearchMatch, 0)
+search:
+	for _, meta := range metas {
+		if matches(meta.Name) {
+			found = append(found, mcpSearchMatch{DiagramID: meta.ID, DiagramName: meta.Name, Kind: "diagram"})
+		}
+		payload, err := a.getDiagramPayload(ctx, meta.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		doc, err := parseDiagramDoc(payload)
+		if err != nil {
+			continue
+		}
+		for _, table := range doc.Tables {
+			if len(found) >= limit {
+				break search
+			}
+			if matches(table.Name, table.Comments) {
+				found = append(found, mcpSearchMatch{DiagramID: meta.ID, DiagramName: meta.Name, Kind: "table", Table: table.Name})
+			}
+			for _, field := range table.Fields {
+				if matches(field.Name, field.Comments) {
+					found = append(found, mcpSearchMatch{DiagramID: meta.ID, DiagramName: meta.Name, Kind: "column", Table: table.Name, Column: field.Name, Type: field.Type.Name})
+				}
+			}
+		}
+		if len(found) >= limit {
+			break
+		}
+	}
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	raw, err := json.Marshal(found)
+	return string(raw), err
+}
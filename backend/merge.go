@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// missingValue stands for a key or array item that one side of a merge
+// does not have.
+type missingValue struct{}
+
+// mergeConflict is a value both sides changed differently. Conflicts inside
+// a table name the table.
+type mergeConflict struct {
+	Path      string `json:"path"`
+	TableID   string `json:"tableId,omitempty"`
+	TableName string `json:"tableName,omitempty"`
+}
+
+type mergeResult struct {
+	Merged          json.RawMessage `json:"merged"`
+	Conflicts       []mergeConflict `json:"conflicts"`
+	BaseVersionID   int64           `json:"baseVersionId"`
+	ServerUpdatedAt string          `json:"serverUpdatedAt"`
+}
+
+// handleDiagramMerge serves POST /api/diagrams/{id}/merge with
+// {"baseVersionId": 3, "payload": {...}, "prefer": "client"}. It merges the
+// changes the client made since that version with the ones saved on the
+// server since, and returns the result without storing it; conflicting
+// values are taken from the preferred side and listed in conflicts. Save
+// the merge with PUT and baseUpdatedAt set to serverUpdatedAt.
+func (a *app) handleDiagramMerge(w http.ResponseWriter, r *http.Request, diagramID string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		BaseVersionID int64           `json:"baseVersionId"`
+		Payload       json.RawMessage `json:"payload"`
+		Prefer        string          `json:"prefer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	if req.BaseVersionID <= 0 {
+		writePayloadError(w, invalidField("baseVersionId", "is required"))
+		return
+	}
+	if len(req.Payload) == 0 {
+		writePayloadError(w, invalidField("payload", "is required"))
+		return
+	}
+	switch req.Prefer {
+	case "", "client", "server":
+	default:
+		writePayloadError(w, invalidField("prefer", "must be client or server"))
+		return
+	}
+	clientPayload, meta, err := normalizeDiagramPayload(req.Payload)
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+	if meta.ID != diagramID {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "diagram id in payload must match route id")
+		return
+	}
+
+	raw, _, _, updatedAt, err := a.getStoredDiagram(r.Context(), diagramID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	serverPayload, err := a.decodePayload(raw)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	basePayload, err := a.loadVersionPayload(r.Context(), a.db, diagramID, req.BaseVersionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeVersionNotFound, "version not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	merged, conflicts, err := mergeDiagramPayloads(basePayload, clientPayload, serverPayload, req.Prefer == "server")
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	normalized, _, err := normalizeDiagramPayload(merged)
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, mergeResult{
+		Merged:          normalized,
+		Conflicts:       conflicts,
+		BaseVersionID:   req.BaseVersionID,
+		ServerUpdatedAt: updatedAt,
+	})
+}
+
+// mergeDiagramPayloads three-way merges two payloads derived from base.
+// Objects are merged key by key and arrays of id-carrying objects item by
+// item, the way delta.go diffs versions, so edits to different tables,
+// fields or relationships combine. createdAt is the server's and updatedAt
+// the client's.
+func mergeDiagramPayloads(base, client, server []byte, preferServer bool) ([]byte, []mergeConflict, error) {
+	values := make([]interface{}, 3)
+	for i, payload := range [][]byte{base, client, server} {
+		value, err := decodeJSONValue(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i] = value
+	}
+	m := &merger{preferServer: preferServer, conflicts: []mergeConflict{}}
+	result, err := json.Marshal(m.merge("", nil, values[0], values[1], values[2]))
+	return result, m.conflicts, err
+}
+
+type merger struct {
+	preferServer bool
+	conflicts    []mergeConflict
+}
+
+type mergeTable struct {
+	id   string
+	name string
+}
+
+func (m *merger) merge(path string, table *mergeTable, base, client, server interface{}) interface{} {
+	switch {
+	case path == "createdAt":
+		return server
+	case path == "updatedAt":
+		return client
+	case reflect.DeepEqual(client, server):
+		return client
+	case reflect.DeepEqual(base, client):
+		return server
+	case reflect.DeepEqual(base, server):
+		return client
+	}
+
+	if c, ok := client.(map[string]interface{}); ok {
+		if s, ok := server.(map[string]interface{}); ok {
+			b, ok := base.(map[string]interface{})
+			if !ok {
+				b = map[string]interface{}{}
+			}
+			return m.mergeObjects(path, table, b, c, s)
+		}
+	}
+	if c, ok := client.([]interface{}); ok {
+		if s, ok := server.([]interface{}); ok {
+			b, ok := base.([]interface{})
+			if !ok {
+				b = []interface{}{}
+			}
+			if merged, ok := m.mergeArrays(path, table, b, c, s); ok {
+				return merged
+			}
+		}
+	}
+
+	conflict := mergeConflict{Path: path}
+	if table != nil {
+		conflict.TableID, conflict.TableName = table.id, table.name
+	}
+	m.conflicts = append(m.conflicts, conflict)
+	if m.preferServer {
+		return server
+	}
+	return client
+}
+
+func (m *merger) mergeObjects(path string, table *mergeTable, base, client, server map[string]interface{}) interface{} {
+	keys := make([]string, 0, len(client)+len(server))
+	seen := make(map[string]bool, len(client)+len(server))
+	for _, object := range []map[string]interface{}{base, client, server} {
+		for key := range object {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	result := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		child := key
+		if path != "" {
+			child = path + "." + key
+		}
+		value := m.merge(child, table, lookupMissing(base, key), lookupMissing(client, key), lookupMissing(server, key))
+		if _, gone := value.(missingValue); !gone {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// mergeArrays merges arrays of objects with unique ids, keeping the
+// server's order and appending items only the client added. It reports
+// false for other arrays, which are merged as one value.
+func (m *merger) mergeArrays(path string, table *mergeTable, base, client, server []interface{}) ([]interface{}, bool) {
+	baseIDs, baseOK := arrayItemIDs(base)
+	clientIDs, clientOK := arrayItemIDs(client)
+	serverIDs, serverOK := arrayItemIDs(server)
+	if !baseOK || !clientOK || !serverOK {
+		return nil, false
+	}
+	baseItems := indexArrayItems(baseIDs, base)
+	clientItems := indexArrayItems(clientIDs, client)
+	serverItems := indexArrayItems(serverIDs, server)
+
+	order := append([]string{}, serverIDs...)
+	placed := make(map[string]bool, len(order))
+	for _, id := range order {
+		placed[id] = true
+	}
+	for _, ids := range [][]string{clientIDs, baseIDs} {
+		for _, id := range ids {
+			if !placed[id] {
+				placed[id] = true
+				order = append(order, id)
+			}
+		}
+	}
+
+	result := make([]interface{}, 0, len(order))
+	for _, id := range order {
+		itemTable := table
+		if path == "tables" {
+			itemTable = &mergeTable{id: id, name: itemName(clientItems[id], serverItems[id], baseItems[id])}
+		}
+		value := m.merge(path+"["+id+"]", itemTable, lookupMissing(baseItems, id), lookupMissing(clientItems, id), lookupMissing(serverItems, id))
+		if _, gone := value.(missingValue); !gone {
+			result = append(result, value)
+		}
+	}
+	return result, true
+}
+
+func indexArrayItems(ids []string, items []interface{}) map[string]interface{} {
+	index := make(map[string]interface{}, len(items))
+	for i, id := range ids {
+		index[id] = items[i]
+	}
+	return index
+}
+
+func lookupMissing(object map[string]interface{}, key string) interface{} {
+	if value, ok := object[key]; ok {
+		return value
+	}
+	return missingValue{}
+}
+
+// itemName is the first name any side gives an array item.
+func itemName(items ...interface{}) string {
+	for _, item := range items {
+		if object, ok := item.(map[string]interface{}); ok {
+			if name, ok := object["name"].(string); ok && name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets matches the Prometheus client's default histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	route  string
+}
+
+type latencyHistogram struct {
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+// httpMetrics collects request counts and latencies. It is exposed in the
+// Prometheus text format by handleMetrics, so no client library is needed.
+type httpMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]map[int]uint64
+	latencies map[requestKey]*latencyHistogram
+	panics    uint64
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  map[requestKey]map[int]uint64{},
+		latencies: map[requestKey]*latencyHistogram{},
+	}
+}
+
+func (m *httpMetrics) observe(method, route string, status int, elapsed time.Duration) {
+	key := requestKey{method: method, route: route}
+	seconds := elapsed.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byStatus, ok := m.requests[key]
+	if !ok {
+		byStatus = map[int]uint64{}
+		m.requests[key] = byStatus
+	}
+	byStatus[status]++
+
+	histogram, ok := m.latencies[key]
+	if !ok {
+		histogram = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[key] = histogram
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += seconds
+	histogram.total++
+}
+
+func (m *httpMetrics) recordPanic() {
+	m.mu.Lock()
+	m.panics++
+	m.mu.Unlock()
+}
+
+func (a *app) withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := recordResponse(w)
+		next.ServeHTTP(recorder, r)
+		a.metrics.observe(r.Method, routeLabel(r.URL.Path), recorder.statusCode(), time.Since(start))
+	})
+}
+
+// routeLabel maps a request path to its route template so ids don't end up
+// as label values.
+func routeLabel(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) == 0 || parts[0] == "" {
+		return "/"
+	}
+	if parts[0] != "api" {
+		switch {
+		case len(parts) > 1:
+		case parts[0] == "metrics", parts[0] == "healthz", parts[0] == "readyz":
+			return "/" + parts[0]
+		}
+		return "other"
+	}
+	if len(parts) == 1 {
+		return "other"
+	}
+
+	switch parts[1] {
+	case "health", "version", "export", "import", "introspect", "config", "events", "changes", "openapi.json", "docs", "graphql", "sync", "features", "usage", "mcp":
+		if len(parts) == 3 && parts[1] == "config" {
+			parts[2] = ":key"
+		} else if len(parts) > 2 {
+			return "other"
+		}
+	case "scim":
+		switch {
+		case len(parts) == 5 && parts[2] == "v2" && (parts[3] == "Users" || parts[3] == "Groups"):
+			parts[4] = ":id"
+		case len(parts) != 4 || parts[2] != "v2":
+			return "other"
+		}
+	case "ai", "auth":
+		if len(parts) != 3 && (len(parts) != 4 || parts[1] != "auth" || parts[2] != "saml") {
+			return "other"
+		}
+	case "admin":
+		if len(parts) > 3 && (parts[2] == "backups" || parts[2] == "service-accounts") {
+			parts[3] = ":name"
+		}
+		switch {
+		case len(parts) == 4 && parts[2] == "config":
+			parts[3] = ":key"
+		case parts[2] == "service-accounts" && len(parts) <= 7:
+			if len(parts) > 5 {
+				parts[5] = ":tokenId"
+			}
+		case len(parts) > 5 || (len(parts) > 3 && parts[2] != "backups"):
+			return "other"
+		}
+	case "diagrams", "templates", "folders", "trash", "tokens":
+		if len(parts) > 2 && !(parts[1] == "diagrams" && len(parts) == 3 && diagramCollectionActions[parts[2]]) {
+			parts[2] = ":id"
+		}
+		if len(parts) > 4 && parts[1] == "diagrams" {
+			switch parts[3] {
+			case "versions":
+				parts[4] = ":versionId"
+			case "export":
+				parts[4] = ":format"
+			case "attachments":
+				parts[4] = ":attachmentId"
+			case "comments":
+				if parts[4] != "by-anchor" {
+					parts[4] = ":commentId"
+				}
+			}
+		}
+		if len(parts) > 6 {
+			return "other"
+		}
+	default:
+		return "other"
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func (a *app) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var b strings.Builder
+	a.metrics.write(&b)
+	a.writeDatabaseMetrics(r, &b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func (m *httpMetrics) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	b.WriteString("# HELP chartdb_http_requests_total HTTP requests by method, route and status.\n")
+	b.WriteString("# TYPE chartdb_http_requests_total counter\n")
+	for _, key := range keys {
+		statuses := make([]int, 0, len(m.requests[key]))
+		for status := range m.requests[key] {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(b, "chartdb_http_requests_total{method=%q,route=%q,status=\"%d\"} %d\n", key.method, key.route, status, m.requests[key][status])
+		}
+	}
+
+	b.WriteString("# HELP chartdb_http_panics_total Handler panics recovered.\n")
+	b.WriteString("# TYPE chartdb_http_panics_total counter\n")
+	fmt.Fprintf(b, "chartdb_http_panics_total %d\n", m.panics)
+
+	b.WriteString("# HELP chartdb_http_request_duration_seconds HTTP request latency by method and route.\n")
+	b.WriteString("# TYPE chartdb_http_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		histogram := m.latencies[key]
+		labels := fmt.Sprintf("method=%q,route=%q", key.method, key.route)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(b, "chartdb_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), histogram.counts[i])
+		}
+		fmt.Fprintf(b, "chartdb_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, histogram.total)
+		fmt.Fprintf(b, "chartdb_http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "chartdb_http_request_duration_seconds_count{%s} %d\n", labels, histogram.total)
+	}
+}
+
+func (a *app) writeDatabaseMetrics(r *http.Request, b *strings.Builder) {
+	stats := a.db.Stats()
+	writeGauge(b, "chartdb_db_max_open_connections", "SQLite connection pool limit.", float64(stats.MaxOpenConnections))
+	writeGauge(b, "chartdb_db_open_connections", "Open SQLite connections.", float64(stats.OpenConnections))
+	writeGauge(b, "chartdb_db_in_use_connections", "SQLite connections currently in use.", float64(stats.InUse))
+	writeGauge(b, "chartdb_db_idle_connections", "Idle SQLite connections.", float64(stats.Idle))
+	writeCounter(b, "chartdb_db_wait_count_total", "Connections waited for.", float64(stats.WaitCount))
+	writeCounter(b, "chartdb_db_wait_duration_seconds_total", "Time spent waiting for connections.", stats.WaitDuration.Seconds())
+
+	counts := []struct {
+		name, help, query string
+	}{
+		{"chartdb_diagrams", "Stored diagrams, excluding the trash.", `SELECT COUNT(*) FROM diagrams WHERE deleted_at IS NULL`},
+		{"chartdb_diagrams_trashed", "Diagrams in the trash.", `SELECT COUNT(*) FROM diagrams WHERE deleted_at IS NOT NULL`},
+		{"chartdb_diagram_versions", "Stored diagram versions.", `SELECT COUNT(*) FROM diagram_versions`},
+		{"chartdb_blobs", "Stored payload blobs.", `SELECT COUNT(*) FROM blobs`},
+	}
+	for _, count := range counts {
+		var value int64
+		if err := a.db.QueryRowContext(r.Context(), count.query).Scan(&value); err != nil {
+			continue
+		}
+		writeGauge(b, count.name, count.help, float64(value))
+	}
+
+	b.WriteString("# HELP chartdb_db_file_size_bytes Size of the SQLite database files.\n")
+	b.WriteString("# TYPE chartdb_db_file_size_bytes gauge\n")
+	for _, file := range []struct{ label, path string }{{"db", a.dbPath}, {"wal", a.dbPath + "-wal"}} {
+		if info, err := os.Stat(file.path); err == nil {
+			fmt.Fprintf(b, "chartdb_db_file_size_bytes{file=%q} %d\n", file.label, info.Size())
+		}
+	}
+}
+
+func writeGauge(b *strings.Builder, name, help string, value float64) {
+	writeMetric(b, name, help, "gauge", value)
+}
+
+func writeCounter(b *strings.Builder, name, help string, value float64) {
+	writeMetric(b, name, help, "counter", value)
+}
+
+func writeMetric(b *strings.Builder, name, help, kind string, value float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
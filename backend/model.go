@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// diagramDoc is a typed, read-only view of the parts of a stored diagram
+// payload that server-side features (exports, linting, stats) need. The
+// payload itself stays opaque JSON everywhere else.
+type diagramDoc struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	DatabaseType  string           `json:"databaseType"`
+	Tables        []dbTable        `json:"tables"`
+	Relationships []dbRelationship `json:"relationships"`
+}
+
+type dbTable struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Schema   string    `json:"schema"`
+	Fields   []dbField `json:"fields"`
+	Indexes  []dbIndex `json:"indexes"`
+	IsView   bool      `json:"isView"`
+	Comments string    `json:"comments"`
+}
+
+type dbDataType struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type dbField struct {
+	ID                     string     `json:"id"`
+	Name                   string     `json:"name"`
+	Type                   dbDataType `json:"type"`
+	PrimaryKey             bool       `json:"primaryKey"`
+	Unique                 bool       `json:"unique"`
+	Nullable               bool       `json:"nullable"`
+	Increment              bool       `json:"increment"`
+	IsArray                bool       `json:"isArray"`
+	CharacterMaximumLength string     `json:"characterMaximumLength"`
+	Precision              *float64   `json:"precision"`
+	Scale                  *float64   `json:"scale"`
+	Default                string     `json:"default"`
+	Comments               string     `json:"comments"`
+}
+
+type dbIndex struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Unique       bool     `json:"unique"`
+	FieldIDs     []string `json:"fieldIds"`
+	IsPrimaryKey bool     `json:"isPrimaryKey"`
+}
+
+type dbRelationship struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	SourceTableID     string `json:"sourceTableId"`
+	TargetTableID     string `json:"targetTableId"`
+	SourceFieldID     string `json:"sourceFieldId"`
+	TargetFieldID     string `json:"targetFieldId"`
+	SourceCardinality string `json:"sourceCardinality"`
+	TargetCardinality string `json:"targetCardinality"`
+}
+
+func parseDiagramDoc(payload []byte) (diagramDoc, error) {
+	var doc diagramDoc
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return diagramDoc{}, errors.New("stored diagram payload is not a valid diagram")
+	}
+	return doc, nil
+}
+
+func (d diagramDoc) tableByID(id string) (dbTable, bool) {
+	for _, table := range d.Tables {
+		if table.ID == id {
+			return table, true
+		}
+	}
+	return dbTable{}, false
+}
+
+func (t dbTable) fieldByID(id string) (dbField, bool) {
+	for _, field := range t.Fields {
+		if field.ID == id {
+			return field, true
+		}
+	}
+	return dbField{}, false
+}
+
+// foreignKey resolves which side of a relationship holds the foreign key,
+// mirroring the frontend SQL export: the "many" side references the "one"
+// side, and one-to-one relationships put the key on the target table.
+// Many-to-many relationships need a junction table and are reported as !ok.
+func (d diagramDoc) foreignKey(rel dbRelationship) (fkTable dbTable, fkField dbField, refTable dbTable, refField dbField, ok bool) {
+	if rel.SourceCardinality == "many" && rel.TargetCardinality == "many" {
+		return dbTable{}, dbField{}, dbTable{}, dbField{}, false
+	}
+
+	source, sourceOK := d.tableByID(rel.SourceTableID)
+	target, targetOK := d.tableByID(rel.TargetTableID)
+	if !sourceOK || !targetOK || source.IsView || target.IsView {
+		return dbTable{}, dbField{}, dbTable{}, dbField{}, false
+	}
+	sourceField, sourceFieldOK := source.fieldByID(rel.SourceFieldID)
+	targetField, targetFieldOK := target.fieldByID(rel.TargetFieldID)
+	if !sourceFieldOK || !targetFieldOK {
+		return dbTable{}, dbField{}, dbTable{}, dbField{}, false
+	}
+
+	if rel.SourceCardinality == "many" && rel.TargetCardinality == "one" {
+		return source, sourceField, target, targetField, true
+	}
+	return target, targetField, source, sourceField, true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPISource is the API description, kept in YAML so it can be reviewed
+// next to the handlers it documents.
+//
+//go:embed openapi.yaml
+var openAPISource []byte
+
+// newOpenAPISpec converts the embedded description to JSON with the server
+// URL pointing at basePath, so "Try it out" in API clients works behind a
+// prefix. It fails when openapi.yaml is invalid.
+func newOpenAPISpec(basePath string) ([]byte, error) {
+	var spec map[string]interface{}
+	if err := yaml.Unmarshal(openAPISource, &spec); err != nil {
+		return nil, fmt.Errorf("parse openapi.yaml: %w", err)
+	}
+	spec["servers"] = []map[string]string{{"url": basePath + "/api/v1"}}
+	return json.Marshal(spec)
+}
+
+// handleOpenAPI serves GET /api/openapi.json.
+func (a *app) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeRawJSON(w, http.StatusOK, a.openAPISpec)
+}
+
+// apiDocsPage loads Swagger UI from a CDN so the binary does not have to
+// ship it. The spec URL is relative, which keeps it working under BASE_PATH.
+const apiDocsPage = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ChartDB API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+<script>
+window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+// handleAPIDocs serves the Swagger UI page at GET /api/docs when
+// API_DOCS_ENABLED is set.
+func (a *app) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	if !a.apiDocsEnabled {
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(apiDocsPage))
+}
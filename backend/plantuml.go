@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// generatePlantUML renders the diagram as a PlantUML entity-relationship
+// diagram using information engineering (crow's foot) notation.
+func generatePlantUML(doc diagramDoc) string {
+	var b strings.Builder
+	types := &ddlWriter{dialect: dialectForDatabaseType(doc.DatabaseType)}
+
+	b.WriteString("@startuml\n")
+	b.WriteString("hide circle\n")
+	b.WriteString("skinparam linetype ortho\n")
+	if doc.Name != "" {
+		fmt.Fprintf(&b, "title %s\n", strings.ReplaceAll(doc.Name, "\n", " "))
+	}
+
+	foreignKeys := map[string]bool{}
+	for _, rel := range doc.Relationships {
+		if _, fkField, _, _, ok := doc.foreignKey(rel); ok {
+			foreignKeys[fkField.ID] = true
+		}
+	}
+
+	aliases := make(map[string]string, len(doc.Tables))
+	for i, table := range doc.Tables {
+		alias := fmt.Sprintf("e%d", i+1)
+		aliases[table.ID] = alias
+
+		name := table.Name
+		if table.Schema != "" {
+			name = table.Schema + "." + table.Name
+		}
+		stereotype := ""
+		if table.IsView {
+			stereotype = " <<view>>"
+		}
+		fmt.Fprintf(&b, "\nentity \"%s\" as %s%s {\n", plantUMLString(name), alias, stereotype)
+
+		keys := make([]dbField, 0)
+		rest := make([]dbField, 0, len(table.Fields))
+		for _, field := range table.Fields {
+			if field.PrimaryKey {
+				keys = append(keys, field)
+			} else {
+				rest = append(rest, field)
+			}
+		}
+		for _, field := range keys {
+			b.WriteString(plantUMLField(field, types, foreignKeys[field.ID]))
+		}
+		if len(keys) > 0 && len(rest) > 0 {
+			b.WriteString("  --\n")
+		}
+		for _, field := range rest {
+			b.WriteString(plantUMLField(field, types, foreignKeys[field.ID]))
+		}
+		b.WriteString("}\n")
+	}
+
+	if len(doc.Relationships) > 0 {
+		b.WriteString("\n")
+	}
+	for _, rel := range doc.Relationships {
+		source, sourceOK := aliases[rel.SourceTableID]
+		target, targetOK := aliases[rel.TargetTableID]
+		if !sourceOK || !targetOK {
+			continue
+		}
+		left, right := "||", "||"
+		if rel.SourceCardinality == "many" {
+			left = "}o"
+		}
+		if rel.TargetCardinality == "many" {
+			right = "o{"
+		}
+		label := ""
+		if rel.Name != "" {
+			label = " : " + plantUMLString(rel.Name)
+		}
+		fmt.Fprintf(&b, "%s %s--%s %s%s\n", source, left, right, target, label)
+	}
+
+	b.WriteString("@enduml\n")
+	return b.String()
+}
+
+func plantUMLField(field dbField, types *ddlWriter, isForeignKey bool) string {
+	marker := "  "
+	if !field.Nullable || field.PrimaryKey {
+		marker = "  * "
+	}
+
+	tags := make([]string, 0, 3)
+	if field.PrimaryKey {
+		tags = append(tags, "<<PK>>")
+	}
+	if isForeignKey {
+		tags = append(tags, "<<FK>>")
+	}
+	if field.Unique && !field.PrimaryKey {
+		tags = append(tags, "<<unique>>")
+	}
+
+	line := fmt.Sprintf("%s%s : %s", marker, plantUMLString(field.Name), types.columnType(field))
+	if len(tags) > 0 {
+		line += " " + strings.Join(tags, " ")
+	}
+	return line + "\n"
+}
+
+func plantUMLString(value string) string {
+	return strings.NewReplacer(`"`, `'`, "\n", " ", "\r", "").Replace(value)
+}
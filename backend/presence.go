@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// presenceTTL is how long a client counts as present after its last
+	// heartbeat; clients should heartbeat about every 10 seconds.
+	presenceTTL              = 30 * time.Second
+	maxPresenceFieldLen      = 255
+	maxPresenceClientsPerMap = 200
+)
+
+// presenceEntry is one client that has a diagram open.
+type presenceEntry struct {
+	ClientID  string `json:"clientId"`
+	Name      string `json:"name"`
+	UserID    string `json:"userId,omitempty"`
+	Editing   bool   `json:"editing"`
+	Since     string `json:"since"`
+	LastSeen  string `json:"lastSeen"`
+	ExpiresAt string `json:"expiresAt"`
+
+	expires time.Time
+}
+
+// presenceTracker keeps who has which diagram open. It lives in memory
+// only: presence is gone after a restart and is not shared between
+// instances, which is fine for a hint like "Alice is editing this diagram".
+type presenceTracker struct {
+	mu       sync.Mutex
+	diagrams map[string]map[string]presenceEntry
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{diagrams: make(map[string]map[string]presenceEntry)}
+}
+
+// heartbeat records entry for diagramID, keeping when the client was first
+// seen. It reports false when the diagram already has too many clients.
+func (t *presenceTracker) heartbeat(diagramID string, entry presenceEntry, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clients := t.pruneLocked(diagramID, now)
+	if clients == nil {
+		clients = make(map[string]presenceEntry)
+		t.diagrams[diagramID] = clients
+	}
+	previous, known := clients[entry.ClientID]
+	if !known && len(clients) >= maxPresenceClientsPerMap {
+		return false
+	}
+	entry.Since = now.Format(sortableTimeFormat)
+	if known {
+		entry.Since = previous.Since
+	}
+	entry.LastSeen = now.Format(sortableTimeFormat)
+	entry.expires = now.Add(presenceTTL)
+	entry.ExpiresAt = entry.expires.Format(sortableTimeFormat)
+	clients[entry.ClientID] = entry
+	return true
+}
+
+func (t *presenceTracker) leave(diagramID, clientID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.diagrams[diagramID], clientID)
+	if len(t.diagrams[diagramID]) == 0 {
+		delete(t.diagrams, diagramID)
+	}
+}
+
+// forget drops everyone from a diagram, for example once it is deleted.
+func (t *presenceTracker) forget(diagramID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.diagrams, diagramID)
+}
+
+// list returns the clients present on a diagram, longest present first.
+func (t *presenceTracker) list(diagramID string, now time.Time) []presenceEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clients := t.pruneLocked(diagramID, now)
+	entries := make([]presenceEntry, 0, len(clients))
+	for _, entry := range clients {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Since != entries[j].Since {
+			return entries[i].Since < entries[j].Since
+		}
+		return entries[i].ClientID < entries[j].ClientID
+	})
+	return entries
+}
+
+func (t *presenceTracker) pruneLocked(diagramID string, now time.Time) map[string]presenceEntry {
+	clients := t.diagrams[diagramID]
+	for clientID, entry := range clients {
+		if !entry.expires.After(now) {
+			delete(clients, clientID)
+		}
+	}
+	if clients != nil && len(clients) == 0 {
+		delete(t.diagrams, diagramID)
+		return nil
+	}
+	return clients
+}
+
+// handleDiagramPresence serves /api/diagrams/{id}/presence. Clients with the
+// diagram open POST {"clientId": "tab-1", "name": "Alice", "editing": true}
+// as a heartbeat and get everyone present back; GET lists them without
+// joining, and DELETE ?clientId= leaves.
+func (a *app) handleDiagramPresence(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		a.writePresence(w, diagramID)
+	case http.MethodPost:
+		var req struct {
+			ClientID string `json:"clientId"`
+			Name     string `json:"name"`
+			Editing  bool   `json:"editing"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		entry := presenceEntry{
+			ClientID: strings.TrimSpace(req.ClientID),
+			Name:     strings.TrimSpace(req.Name),
+			UserID:   requestUserID(r),
+			Editing:  req.Editing,
+		}
+		if entry.ClientID == "" {
+			writePayloadError(w, invalidField("clientId", "is required"))
+			return
+		}
+		if len(entry.ClientID) > maxPresenceFieldLen {
+			writePayloadError(w, invalidField("clientId", "must be at most 255 characters"))
+			return
+		}
+		if len(entry.Name) > maxPresenceFieldLen {
+			writePayloadError(w, invalidField("name", "must be at most 255 characters"))
+			return
+		}
+		if entry.Name == "" {
+			entry.Name = entry.UserID
+		}
+
+		var exists bool
+		err := a.db.QueryRowContext(r.Context(), `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, diagramID).Scan(&exists)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			writeServerError(w, err)
+			return
+		}
+		if !exists {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		if !a.presence.heartbeat(diagramID, entry, time.Now().UTC()) {
+			writeError(w, http.StatusTooManyRequests, "too many clients have this diagram open")
+			return
+		}
+		a.writePresence(w, diagramID)
+	case http.MethodDelete:
+		clientID := r.URL.Query().Get("clientId")
+		if clientID == "" {
+			writePayloadError(w, invalidField("clientId", "is required"))
+			return
+		}
+		a.presence.leave(diagramID, clientID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *app) writePresence(w http.ResponseWriter, diagramID string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"diagramId":  diagramID,
+		"clients":    a.presence.list(diagramID, time.Now().UTC()),
+		"ttlSeconds": int(presenceTTL / time.Second),
+	})
+}
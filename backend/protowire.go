@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A minimal protobuf codec for the messages in proto/chartdb/v1/chartdb.proto.
+// The API only uses strings, bools, int64s and embedded messages, so this is
+// all the wire format the gRPC server needs. Keep the field numbers in step
+// with the .proto file.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errInvalidProto = errors.New("invalid protobuf message")
+
+// protoWriter appends fields to a message. Zero values are left out, as
+// proto3 does.
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (w *protoWriter) string(field int, value string) {
+	if value == "" {
+		return
+	}
+	w.tag(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *protoWriter) bool(field int, value bool) {
+	if !value {
+		return
+	}
+	w.tag(field, protoVarint)
+	w.buf = append(w.buf, 1)
+}
+
+func (w *protoWriter) int64(field int, value int64) {
+	if value == 0 {
+		return
+	}
+	w.tag(field, protoVarint)
+	w.buf = binary.AppendUvarint(w.buf, uint64(value))
+}
+
+// message writes an embedded message, even an empty one, so repeated
+// fields keep their length.
+func (w *protoWriter) message(field int, value []byte) {
+	w.tag(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+// protoField is one decoded field; varint holds varint values and bytes
+// length-delimited ones.
+type protoField struct {
+	number int
+	varint uint64
+	bytes  []byte
+}
+
+func (f protoField) string() string { return string(f.bytes) }
+func (f protoField) bool() bool     { return f.varint != 0 }
+func (f protoField) int64() int64   { return int64(f.varint) }
+
+// parseProto splits a message into its fields. Fixed-width fields are
+// skipped, since no message here uses them.
+func parseProto(data []byte) ([]protoField, error) {
+	fields := make([]protoField, 0)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 || key>>3 == 0 {
+			return nil, errInvalidProto
+		}
+		data = data[n:]
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case protoVarint:
+			field.varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errInvalidProto
+			}
+			data = data[n:]
+		case protoBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, errInvalidProto
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case protoFixed64:
+			if len(data) < 8 {
+				return nil, errInvalidProto
+			}
+			data = data[8:]
+			continue
+		case protoFixed32:
+			if len(data) < 4 {
+				return nil, errInvalidProto
+			}
+			data = data[4:]
+			continue
+		default:
+			return nil, errInvalidProto
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+type pbDiagramRef struct {
+	ID string
+}
+
+func (m *pbDiagramRef) unmarshal(data []byte) error {
+	fields, err := parseProto(data)
+	for _, f := range fields {
+		if f.number == 1 {
+			m.ID = f.string()
+		}
+	}
+	return err
+}
+
+type pbVersionRef struct {
+	DiagramID string
+	VersionID int64
+}
+
+func (m *pbVersionRef) unmarshal(data []byte) error {
+	fields, err := parseProto(data)
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			m.DiagramID = f.string()
+		case 2:
+			m.VersionID = f.int64()
+		}
+	}
+	return err
+}
+
+type pbListDiagramsRequest struct {
+	IncludeArchived bool
+	FolderID        string
+	Starred         bool
+}
+
+func (m *pbListDiagramsRequest) unmarshal(data []byte) error {
+	fields, err := parseProto(data)
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			m.IncludeArchived = f.bool()
+		case 2:
+			m.FolderID = f.string()
+		case 3:
+			m.Starred = f.bool()
+		}
+	}
+	return err
+}
+
+// pbJSONDocument decodes the messages holding a single JSON document in
+// field 1: CreateDiagramRequest and Config.
+type pbJSONDocument struct {
+	JSON string
+}
+
+func (m *pbJSONDocument) unmarshal(data []byte) error {
+	fields, err := parseProto(data)
+	for _, f := range fields {
+		if f.number == 1 {
+			m.JSON = f.string()
+		}
+	}
+	return err
+}
+
+func (m pbJSONDocument) marshal() []byte {
+	var w protoWriter
+	w.string(1, m.JSON)
+	return w.buf
+}
+
+type pbSaveDiagramRequest struct {
+	ID      string
+	JSON    string
+	Message string
+}
+
+func (m *pbSaveDiagramRequest) unmarshal(data []byte) error {
+	fields, err := parseProto(data)
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			m.ID = f.string()
+		case 2:
+			m.JSON = f.string()
+		case 3:
+			m.Message = f.string()
+		}
+	}
+	return err
+}
+
+type pbFilter struct {
+	DiagramID string
+	JSON      string
+}
+
+func (m *pbFilter) unmarshal(data []byte) error {
+	fields, err := parseProto(data)
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			m.DiagramID = f.string()
+		case 2:
+			m.JSON = f.string()
+		}
+	}
+	return err
+}
+
+func (m pbFilter) marshal() []byte {
+	var w protoWriter
+	w.string(1, m.DiagramID)
+	w.string(2, m.JSON)
+	return w.buf
+}
+
+type pbWatchEventsRequest struct {
+	Since     int64
+	DiagramID string
+}
+
+func (m *pbWatchEventsRequest) unmarshal(data []byte) error {
+	fields, err := parseProto(data)
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			m.Since = f.int64()
+		case 2:
+			m.DiagramID = f.string()
+		}
+	}
+	return err
+}
+
+func marshalDiagramMeta(meta diagramMeta) []byte {
+	var w protoWriter
+	w.string(1, meta.ID)
+	w.string(2, meta.Name)
+	w.string(3, meta.DatabaseType)
+	if meta.DatabaseEdition != nil {
+		w.string(4, *meta.DatabaseEdition)
+	}
+	w.string(5, meta.CreatedAt)
+	w.string(6, meta.UpdatedAt)
+	w.bool(7, meta.Archived)
+	if meta.FolderID != nil {
+		w.string(8, *meta.FolderID)
+	}
+	w.bool(9, meta.Starred)
+	return w.buf
+}
+
+func marshalListDiagramsResponse(metas []diagramMeta) []byte {
+	var w protoWriter
+	for _, meta := range metas {
+		w.message(1, marshalDiagramMeta(meta))
+	}
+	return w.buf
+}
+
+// marshalDiagram encodes a stored payload as a Diagram message.
+func marshalDiagram(payload []byte) ([]byte, error) {
+	_, meta, err := normalizeDiagramPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	var w protoWriter
+	w.string(1, meta.ID)
+	w.string(2, meta.Name)
+	w.string(3, meta.DatabaseType)
+	if meta.DatabaseEdition != nil {
+		w.string(4, *meta.DatabaseEdition)
+	}
+	w.string(5, meta.CreatedAt)
+	w.string(6, meta.UpdatedAt)
+	w.string(7, string(payload))
+	return w.buf, nil
+}
+
+func marshalListVersionsResponse(versions []diagramVersion) []byte {
+	var w protoWriter
+	for _, version := range versions {
+		var v protoWriter
+		v.int64(1, version.ID)
+		v.string(2, version.DiagramID)
+		v.string(3, version.Name)
+		v.string(4, version.Action)
+		v.string(5, version.Message)
+		v.bool(6, version.Pinned)
+		v.string(7, version.CreatedAt)
+		w.message(1, v.buf)
+	}
+	return w.buf
+}
+
+func marshalEvent(event diagramEvent) []byte {
+	var w protoWriter
+	w.int64(1, event.Seq)
+	w.string(2, event.Type)
+	w.string(3, event.At)
+	w.string(4, event.DiagramID)
+	w.string(5, event.DiagramName)
+	w.string(6, event.Actor)
+	return w.buf
+}
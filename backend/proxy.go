@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies lists the networks whose X-Forwarded-For and
+// X-Forwarded-Proto headers are believed. Headers from any other peer are
+// ignored, so clients cannot spoof their address.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies accepts CIDRs ("10.0.0.0/8") and single addresses
+// ("127.0.0.1").
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedRequest is what a trusted proxy told us about the original
+// request.
+type forwardedRequest struct {
+	clientIP string
+	scheme   string
+}
+
+type forwardedKey struct{}
+
+// withForwardedHeaders resolves the client address and scheme from
+// X-Forwarded-For and X-Forwarded-Proto when the peer is a trusted proxy.
+// X-Forwarded-For is read right to left, skipping trusted hops, so a client
+// cannot prepend a fake address.
+func withForwardedHeaders(proxies trustedProxies, next http.Handler) http.Handler {
+	if len(proxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := net.ParseIP(peerIP(r))
+		if peer == nil || !proxies.contains(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var forwarded forwardedRequest
+		hops := forwardedFor(r.Header)
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(hops[i])
+			if ip == nil {
+				break
+			}
+			forwarded.clientIP = ip.String()
+			if !proxies.contains(ip) {
+				break
+			}
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			proto, _, _ = strings.Cut(proto, ",")
+			switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+			case "http", "https":
+				forwarded.scheme = proto
+			}
+		}
+		if forwarded == (forwardedRequest{}) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedKey{}, forwarded)))
+	})
+}
+
+// forwardedFor returns the addresses from all X-Forwarded-For headers in
+// order, nearest hop last.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// clientIP returns the address of the client, as reported by a trusted
+// proxy when there is one.
+func clientIP(r *http.Request) string {
+	if forwarded, ok := r.Context().Value(forwardedKey{}).(forwardedRequest); ok && forwarded.clientIP != "" {
+		return forwarded.clientIP
+	}
+	return peerIP(r)
+}
+
+// requestScheme returns "https" or "http" for the original request,
+// honoring X-Forwarded-Proto from a trusted proxy.
+func requestScheme(r *http.Request) string {
+	if forwarded, ok := r.Context().Value(forwardedKey{}).(forwardedRequest); ok && forwarded.scheme != "" {
+		return forwarded.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// peerIP returns the address of the directly connected peer.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
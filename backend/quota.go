@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// quotaLimits cap what the server stores, so one team can't fill the disk.
+// The server is a single workspace whose diagrams every caller shares, so
+// most limits apply to it as a whole; maxDiagramsPerUser also caps the
+// diagrams each identity creates. Versions and storage stay server-wide
+// because anyone may save to a shared diagram. Zero means no limit.
+type quotaLimits struct {
+	maxDiagrams        int
+	maxDiagramsPerUser int
+	maxVersions        int
+	maxStorageBytes    int
+}
+
+func quotaLimitsFromConfig(cfg config) (quotaLimits, error) {
+	limits := quotaLimits{
+		maxDiagrams:        cfg.Quotas.MaxDiagrams,
+		maxDiagramsPerUser: cfg.Quotas.MaxDiagramsPerUser,
+		maxVersions:        cfg.Quotas.MaxVersions,
+		maxStorageBytes:    cfg.Quotas.MaxStorageBytes,
+	}
+	for _, limit := range []struct {
+		env   string
+		value int
+	}{
+		{"QUOTA_MAX_DIAGRAMS", limits.maxDiagrams},
+		{"QUOTA_MAX_DIAGRAMS_PER_USER", limits.maxDiagramsPerUser},
+		{"QUOTA_MAX_VERSIONS", limits.maxVersions},
+		{"QUOTA_MAX_STORAGE_BYTES", limits.maxStorageBytes},
+	} {
+		if limit.value < 0 {
+			return quotaLimits{}, fmt.Errorf("%s %d: must not be negative", limit.env, limit.value)
+		}
+	}
+	return limits, nil
+}
+
+// quotaError is returned by a write that would take the server over one
+// of its quotas. Handlers report it through writeServerError.
+type quotaError struct {
+	status  int
+	message string
+}
+
+func (e *quotaError) Error() string { return e.message }
+
+// reserveQuota fails unless the server can store diagrams more diagrams,
+// versions more versions and bytes more bytes of content within its
+// quotas. New diagrams also count against the caller's own diagrams;
+// anonymous callers only have the server-wide quota. Storage is checked against the stored size of what is there and
+// the plain size of what is added, which compression only makes smaller.
+func (a *app) reserveQuota(ctx context.Context, tx *sql.Tx, diagrams, versions, bytes int) error {
+	limits := a.runtime().quotas
+	if limits.maxDiagrams > 0 && diagrams > 0 {
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM diagrams`).Scan(&count); err != nil {
+			return err
+		}
+		if count+diagrams > limits.maxDiagrams {
+			return &quotaError{http.StatusForbidden, fmt.Sprintf("the server may store at most %d diagrams, including the trash (QUOTA_MAX_DIAGRAMS)", limits.maxDiagrams)}
+		}
+	}
+	if user, _ := requestIdentity(ctx); limits.maxDiagramsPerUser > 0 && diagrams > 0 && user.ID != "" {
+		count, err := userDiagramCount(ctx, tx, user.ID)
+		if err != nil {
+			return err
+		}
+		if count+int64(diagrams) > int64(limits.maxDiagramsPerUser) {
+			return &quotaError{http.StatusForbidden, fmt.Sprintf("each user may create at most %d diagrams, including the trash (QUOTA_MAX_DIAGRAMS_PER_USER)", limits.maxDiagramsPerUser)}
+		}
+	}
+	if limits.maxVersions > 0 && versions > 0 {
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM diagram_versions`).Scan(&count); err != nil {
+			return err
+		}
+		if count+versions > limits.maxVersions {
+			return &quotaError{http.StatusForbidden, fmt.Sprintf("the server may store at most %d versions (QUOTA_MAX_VERSIONS)", limits.maxVersions)}
+		}
+	}
+	if limits.maxStorageBytes > 0 && bytes > 0 {
+		used, err := storedContentBytes(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if used+int64(bytes) > int64(limits.maxStorageBytes) {
+			return &quotaError{http.StatusRequestEntityTooLarge, fmt.Sprintf("the server may store at most %d bytes of diagrams, versions and attachments (QUOTA_MAX_STORAGE_BYTES)", limits.maxStorageBytes)}
+		}
+	}
+	return nil
+}
+
+// reserveVersion is reserveQuota for one more version of a diagram. A
+// diagram already holding its MAX_VERSIONS_PER_DIAGRAM unpinned versions
+// loses its oldest one to retention, so the total does not grow.
+func (a *app) reserveVersion(ctx context.Context, tx *sql.Tx, diagramID string, bytes int) error {
+	versions := 1
+	if keep := a.runtime().maxVersionsPerDiagram; keep > 0 && a.runtime().quotas.maxVersions > 0 {
+		var unpinned int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM diagram_versions WHERE diagram_id = ? AND pinned = 0`, diagramID).Scan(&unpinned); err != nil {
+			return err
+		}
+		if unpinned >= keep {
+			versions = 0
+		}
+	}
+	return a.reserveQuota(ctx, tx, 0, versions, bytes)
+}
+
+// userDiagramCount is the number of stored diagrams user created.
+func userDiagramCount(ctx context.Context, q rowQueryer, user string) (int64, error) {
+	var count int64
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM diagrams WHERE created_by = ?`, user).Scan(&count)
+	return count, err
+}
+
+// storedContentBytes is the stored size of the blobs diagrams, versions and
+// attachments use. Blobs waiting for garbage collection don't count.
+func storedContentBytes(ctx context.Context, q rowQueryer) (int64, error) {
+	const query = `
+SELECT COALESCE(SUM(LENGTH(payload)), 0)
+FROM blobs
+WHERE hash IN (
+	SELECT blob_hash FROM diagrams
+	UNION SELECT blob_hash FROM diagram_versions
+	UNION SELECT blob_hash FROM diagram_attachments
+)`
+	var used int64
+	err := q.QueryRowContext(ctx, query).Scan(&used)
+	return used, err
+}
+
+type quotaUsage struct {
+	Used  int64 `json:"used"`
+	Limit int   `json:"limit"`
+}
+
+// handleUsage reports how much of each quota is used. userDiagrams counts
+// the caller's own diagrams and is left out for anonymous callers.
+func (a *app) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limits := a.runtime().quotas
+	var usage struct {
+		Diagrams     quotaUsage  `json:"diagrams"`
+		UserDiagrams *quotaUsage `json:"userDiagrams,omitempty"`
+		Versions     quotaUsage  `json:"versions"`
+		StorageBytes quotaUsage  `json:"storageBytes"`
+	}
+	usage.Diagrams.Limit = limits.maxDiagrams
+	usage.Versions.Limit = limits.maxVersions
+	usage.StorageBytes.Limit = limits.maxStorageBytes
+
+	const query = `SELECT (SELECT COUNT(*) FROM diagrams), (SELECT COUNT(*) FROM diagram_versions)`
+	if err := a.db.QueryRowContext(r.Context(), query).Scan(&usage.Diagrams.Used, &usage.Versions.Used); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	used, err := storedContentBytes(r.Context(), a.db)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	usage.StorageBytes.Used = used
+	if user := requestUserID(r); user != "" {
+		count, err := userDiagramCount(r.Context(), a.db, user)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		usage.UserDiagrams = &quotaUsage{Used: count, Limit: limits.maxDiagramsPerUser}
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
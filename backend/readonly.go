@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxReadOnlyReasonLen = 500
+
+// readOnlyMode refuses writes while the data must not change, such as
+// during migrations, restores or maintenance windows. It starts from
+// READ_ONLY, can be switched through PUT /api/admin/read-only, and goes
+// back to READ_ONLY when the configuration is reloaded.
+type readOnlyMode struct {
+	mu         sync.Mutex
+	on         bool
+	configured bool
+	reason     string
+	since      string
+}
+
+type readOnlyState struct {
+	Enabled    bool   `json:"enabled"`
+	Configured bool   `json:"configured"`
+	Reason     string `json:"reason,omitempty"`
+	Since      string `json:"since,omitempty"`
+}
+
+func (m *readOnlyMode) enabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.on
+}
+
+func (m *readOnlyMode) state() readOnlyState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return readOnlyState{Enabled: m.on, Configured: m.configured, Reason: m.reason, Since: m.since}
+}
+
+func (m *readOnlyMode) set(on bool, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if on != m.on {
+		m.since = time.Now().UTC().Format(sortableTimeFormat)
+	}
+	if !on {
+		m.since = ""
+		reason = ""
+	}
+	m.on = on
+	m.reason = reason
+}
+
+// reset applies READ_ONLY, dropping a switch made through the admin API.
+func (m *readOnlyMode) reset(configured bool) {
+	m.set(configured, "")
+	m.mu.Lock()
+	m.configured = configured
+	m.mu.Unlock()
+}
+
+// readOnlyExempt reports whether a write request may run in read-only mode:
+// the admin API, so operators can back up, restore and switch the mode
+// off, signing in and out, and the POSTs that only read, or only touch
+// in-memory state. Introspection only reads with ?dryRun.
+func readOnlyExempt(r *http.Request) bool {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path != "/api" && !strings.HasPrefix(path, "/api/") {
+		return true
+	}
+	switch path {
+	case "/api/introspect":
+		return queryFlag(r, "dryRun")
+	case "/api/graphql", "/api/mcp", "/api/sync", "/api/diagrams/validate", "/api/auth/login", "/api/auth/logout", samlACSPath:
+		return true
+	}
+	if strings.HasPrefix(path, "/api/admin") || strings.HasPrefix(path, "/api/ai/") {
+		return true
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	return r.Method == http.MethodPost && len(parts) == 4 && parts[1] == "diagrams" && (parts[3] == "merge" || parts[3] == "presence")
+}
+
+// withReadOnly answers writes with 503 READ_ONLY while read-only mode is
+// on. Reads keep working.
+func (a *app) withReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.readOnly.enabled() || readOnlyExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeReadOnly(w, a.readOnly.state())
+	})
+}
+
+func writeReadOnly(w http.ResponseWriter, state readOnlyState) {
+	msg := "the server is in read-only mode"
+	if state.Reason != "" {
+		msg += ": " + state.Reason
+	}
+	writeErrorCode(w, http.StatusServiceUnavailable, codeReadOnly, msg)
+}
+
+// handleReadOnly serves GET and PUT /api/admin/read-only. PUT takes
+// {"enabled": true, "reason": "restoring last night's backup"}; the switch
+// holds until the next reload or restart.
+func (a *app) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Enabled *bool  `json:"enabled"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		if req.Enabled == nil {
+			writePayloadError(w, invalidField("enabled", "is required"))
+			return
+		}
+		reason := strings.TrimSpace(req.Reason)
+		if len(reason) > maxReadOnlyReasonLen {
+			writePayloadError(w, invalidField("reason", "must be at most 500 bytes"))
+			return
+		}
+		a.readOnly.set(*req.Enabled, reason)
+		slog.Warn("read-only mode changed", "enabled", *req.Enabled, "reason", reason)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.readOnly.state())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecovery turns a handler panic into a logged stack trace and a 500
+// JSON error instead of a dropped connection.
+func (a *app) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := recordResponse(w)
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			a.metrics.recordPanic()
+			slog.ErrorContext(r.Context(), "handler panic",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()),
+			)
+			// Once the status line is out, the response can only be cut short.
+			if recorder.status == 0 {
+				writeError(recorder, http.StatusInternalServerError, "internal server error")
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runtimeSettings are the settings that can change without a restart. They
+// are swapped as a whole so readers always see a consistent set.
+type runtimeSettings struct {
+	logLevel              slog.Level
+	maxVersionsPerDiagram int
+	maxVersionAge         time.Duration
+	snapshotInterval      int
+	cors                  *corsPolicy
+	readOnly              bool
+	quotas                quotaLimits
+}
+
+func runtimeSettingsFromConfig(cfg config) (*runtimeSettings, error) {
+	level, err := parseLogLevel(cfg.Log.Level)
+	if err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	maxVersionAge, err := parseRetentionAge(cfg.Versions.MaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("MAX_VERSION_AGE: %w", err)
+	}
+	cors, err := newCORSPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := quotaLimitsFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &runtimeSettings{
+		logLevel:              level,
+		maxVersionsPerDiagram: cfg.Versions.MaxPerDiagram,
+		maxVersionAge:         maxVersionAge,
+		snapshotInterval:      cfg.Versions.SnapshotInterval,
+		cors:                  cors,
+		readOnly:              cfg.ReadOnly,
+		quotas:                quotas,
+	}, nil
+}
+
+func (a *app) runtime() *runtimeSettings {
+	return a.settings.Load()
+}
+
+func (a *app) applyRuntimeSettings(settings *runtimeSettings) {
+	a.settings.Store(settings)
+	a.clearLogLevelOverride()
+	logLevel.Set(settings.logLevel)
+	a.readOnly.reset(settings.readOnly)
+}
+
+// reload re-reads the config file, flags and environment and applies the
+// runtime settings. Other settings (port, data dir, compression, ...) still
+// need a restart. On error the current settings are kept.
+func (a *app) reload() error {
+	cfg, err := loadConfig(a.configArgs)
+	if err != nil {
+		return err
+	}
+	settings, err := runtimeSettingsFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	a.applyRuntimeSettings(settings)
+	slog.Info("configuration reloaded",
+		"log_level", settings.logLevel.String(),
+		"max_versions_per_diagram", settings.maxVersionsPerDiagram,
+		"max_version_age", settings.maxVersionAge.String(),
+		"snapshot_interval", settings.snapshotInterval,
+		"read_only", settings.readOnly,
+		"quota_max_diagrams", settings.quotas.maxDiagrams,
+		"quota_max_versions", settings.quotas.maxVersions,
+		"quota_max_storage_bytes", settings.quotas.maxStorageBytes,
+	)
+	return nil
+}
+
+func (a *app) reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := a.reload(); err != nil {
+			slog.Error("configuration reload failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replicaPrefix = "replica/"
+
+	defaultReplicationSyncInterval     = time.Second
+	defaultReplicationSnapshotInterval = 24 * time.Hour
+	// Older generations are deleted once this many newer ones exist, so a
+	// point in time at least one snapshot interval back can be restored.
+	replicaGenerationsKept = 2
+
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+// replicator streams the SQLite WAL to S3, litestream-style. A generation
+// starts with a copy of the database file; after that every committed WAL
+// frame is uploaded in segments that end on a commit, so any prefix of the
+// segments is a consistent database.
+//
+// SQLite may only reuse the WAL from the start once every frame has been
+// checkpointed into the database. Automatic checkpoints are disabled while
+// replicating and checkpoint() holds the write lock while it uploads the
+// remaining frames and checkpoints, so a WAL reset never discards frames
+// that have not been uploaded. Each WAL reset starts a new index; restore
+// applies the indexes in order, checkpointing in between.
+type replicator struct {
+	db      *sql.DB
+	dbPath  string
+	s3      *s3Client
+	sync    time.Duration
+	refresh time.Duration
+
+	// lockConn takes the write lock and checkpointConn checkpoints while it
+	// is held. Keeping them open also stops SQLite from checkpointing and
+	// deleting the WAL when the last pooled connection closes.
+	lockConn, checkpointConn *sql.Conn
+
+	mu         sync.Mutex
+	generation string
+	startedAt  time.Time
+	index      int
+	salt       []byte
+	offset     int64
+}
+
+func newReplicator(db *sql.DB, dbPath string, s3 *s3Client, cfg config) (*replicator, error) {
+	syncInterval, err := time.ParseDuration(cfg.Replication.SyncInterval)
+	if err != nil || syncInterval <= 0 {
+		return nil, fmt.Errorf("invalid REPLICATION_SYNC_INTERVAL %q", cfg.Replication.SyncInterval)
+	}
+	snapshotInterval, err := parseRetentionAge(cfg.Replication.SnapshotInterval)
+	if err != nil || snapshotInterval <= 0 {
+		return nil, fmt.Errorf("invalid REPLICATION_SNAPSHOT_INTERVAL %q", cfg.Replication.SnapshotInterval)
+	}
+	return &replicator{db: db, dbPath: dbPath, s3: s3, sync: syncInterval, refresh: snapshotInterval}, nil
+}
+
+func (r *replicator) run(ctx context.Context) {
+	ticker := time.NewTicker(r.sync)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		var err error
+		if time.Since(r.startedAt) >= r.refresh {
+			err = r.startGeneration(ctx)
+		} else {
+			err = r.syncLocked(ctx, false)
+		}
+		r.mu.Unlock()
+		if err != nil {
+			slog.Error("wal replication failed", "generation", r.generation, "error", err)
+		}
+	}
+}
+
+// start begins a new generation; call it once the database is ready and
+// before run.
+func (r *replicator) start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	if r.lockConn, err = r.db.Conn(ctx); err != nil {
+		return err
+	}
+	if r.checkpointConn, err = r.db.Conn(ctx); err != nil {
+		return err
+	}
+	return r.startGeneration(ctx)
+}
+
+// lockWrites takes SQLite's write lock, so no commit is in progress while
+// the WAL is read. The returned function releases it.
+func (r *replicator) lockWrites(ctx context.Context) (func(), error) {
+	if _, err := r.lockConn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return nil, err
+	}
+	return func() {
+		_, _ = r.lockConn.ExecContext(context.Background(), `ROLLBACK`)
+	}, nil
+}
+
+func (r *replicator) startGeneration(ctx context.Context) error {
+	generation := time.Now().UTC().Format(backupTimeFormat) + "-" + randomHex(4)
+
+	unlock, err := r.lockWrites(ctx)
+	if err != nil {
+		return err
+	}
+	// With writes locked and checkpoints only run by this replicator, the
+	// database file and the WAL's committed frames form a consistent pair.
+	snapshot, err := os.CreateTemp(filepath.Dir(r.dbPath), ".replica-")
+	if err != nil {
+		unlock()
+		return err
+	}
+	defer os.Remove(snapshot.Name())
+	defer snapshot.Close()
+	err = copyFileTo(snapshot, r.dbPath)
+	var wal walSegment
+	if err == nil {
+		wal, err = readWAL(r.dbPath+"-wal", nil, 0)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, err := snapshot.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := r.s3.putObject(ctx, replicaPrefix+generation+"/snapshot.sqlite", snapshot, "application/vnd.sqlite3"); err != nil {
+		return err
+	}
+	r.generation, r.startedAt = generation, time.Now()
+	r.index, r.salt, r.offset = 0, wal.salt, 0
+	if len(wal.data) > 0 {
+		if err := r.upload(ctx, wal); err != nil {
+			return err
+		}
+	}
+	slog.Info("wal replication generation started", "generation", generation)
+
+	if err := r.pruneGenerations(ctx); err != nil {
+		slog.Warn("removing old replica generations failed", "error", err)
+	}
+	return nil
+}
+
+// syncLocked uploads the frames committed since the last sync. r.mu must be
+// held, and with holdLock the write lock too.
+func (r *replicator) syncLocked(ctx context.Context, holdLock bool) error {
+	if r.generation == "" {
+		return r.startGeneration(ctx)
+	}
+	read := func() (walSegment, error) { return readWAL(r.dbPath+"-wal", r.salt, r.offset) }
+	var (
+		segment walSegment
+		err     error
+	)
+	if holdLock {
+		segment, err = read()
+	} else {
+		unlock, lockErr := r.lockWrites(ctx)
+		if lockErr != nil {
+			return lockErr
+		}
+		segment, err = read()
+		unlock()
+	}
+	if err != nil {
+		return err
+	}
+	if segment.reset {
+		r.index++
+		r.salt, r.offset = segment.salt, 0
+	}
+	if len(segment.data) == 0 {
+		return nil
+	}
+	return r.upload(ctx, segment)
+}
+
+func (r *replicator) upload(ctx context.Context, segment walSegment) error {
+	key := fmt.Sprintf("%s%s/%08x/%016x-%d.wal", replicaPrefix, r.generation, r.index, segment.offset, time.Now().UnixMilli())
+	if err := r.s3.putObject(ctx, key, bytes.NewReader(segment.data), "application/octet-stream"); err != nil {
+		return err
+	}
+	r.offset = segment.offset + int64(len(segment.data))
+	return nil
+}
+
+// checkpoint uploads the remaining frames and checkpoints them into the
+// database while holding the write lock, so SQLite can only start over at
+// the beginning of the WAL once everything has been replicated.
+func (r *replicator) checkpoint(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	unlock, err := r.lockWrites(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.syncLocked(ctx, true); err != nil {
+		return fmt.Errorf("sync before checkpoint: %w", err)
+	}
+	// TRUNCATE would wait for the write lock held above; PASSIVE does not,
+	// and the WAL is reused from the start by the next write instead.
+	var busy, walPages, checkpointed int
+	return r.checkpointConn.QueryRowContext(ctx, `PRAGMA wal_checkpoint(PASSIVE)`).Scan(&busy, &walPages, &checkpointed)
+}
+
+func (r *replicator) pruneGenerations(ctx context.Context) error {
+	generations, err := listReplicaGenerations(ctx, r.s3)
+	if err != nil {
+		return err
+	}
+	if len(generations) <= replicaGenerationsKept {
+		return nil
+	}
+	for _, generation := range generations[:len(generations)-replicaGenerationsKept] {
+		for _, object := range generation.objects {
+			if err := r.s3.deleteObject(ctx, object.Key); err != nil {
+				return err
+			}
+		}
+		slog.Info("removed old replica generation", "generation", generation.name)
+	}
+	return nil
+}
+
+// walSegment is a run of whole WAL frames ending on a commit. When offset is
+// 0 it starts with the WAL header.
+type walSegment struct {
+	salt   []byte
+	offset int64
+	data   []byte
+	// reset reports that the WAL was restarted with new salts since the
+	// previous read.
+	reset bool
+}
+
+// readWAL returns the committed frames of the WAL at path from offset on.
+// If the WAL header no longer carries salt the WAL was restarted, and the
+// whole new WAL is returned instead. Frames with other salts are left-overs
+// from before a restart.
+func readWAL(path string, salt []byte, offset int64) (walSegment, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return walSegment{salt: salt, offset: offset}, nil
+	}
+	if err != nil {
+		return walSegment{}, err
+	}
+	defer file.Close()
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		// Empty after a truncating checkpoint, or not written yet.
+		return walSegment{salt: salt, offset: offset}, nil
+	}
+	segment := walSegment{salt: header[16:24], offset: offset}
+	if !bytes.Equal(segment.salt, salt) {
+		segment.reset, segment.offset = true, 0
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return walSegment{}, err
+	}
+
+	start := max(segment.offset, walHeaderSize)
+	if info.Size() <= start {
+		return segment, nil
+	}
+	frames := make([]byte, info.Size()-start)
+	if _, err := file.ReadAt(frames, start); err != nil && !errors.Is(err, io.EOF) {
+		return walSegment{}, err
+	}
+
+	frameSize := walFrameHeaderSize + int(binary.BigEndian.Uint32(header[8:12]))
+	end := 0
+	for pos := 0; pos+frameSize <= len(frames); pos += frameSize {
+		frame := frames[pos : pos+walFrameHeaderSize]
+		if !bytes.Equal(frame[8:16], segment.salt) {
+			break
+		}
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			end = pos + frameSize
+		}
+	}
+	if end == 0 {
+		return segment, nil
+	}
+	if segment.offset == 0 {
+		segment.data = append(header, frames[:end]...)
+	} else {
+		segment.data = frames[:end]
+	}
+	return segment, nil
+}
+
+type replicaGeneration struct {
+	name     string
+	started  time.Time
+	snapshot string
+	objects  []s3Object
+	// segments are ordered by WAL index and offset.
+	segments []replicaSegment
+}
+
+type replicaSegment struct {
+	key      string
+	index    int64
+	offset   int64
+	uploaded time.Time
+}
+
+// listReplicaGenerations returns the generations in the bucket, oldest
+// first.
+func listReplicaGenerations(ctx context.Context, s3 *s3Client) ([]*replicaGeneration, error) {
+	objects, err := s3.listObjects(ctx, replicaPrefix)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*replicaGeneration{}
+	for _, object := range objects {
+		parts := strings.Split(strings.TrimPrefix(object.Key, replicaPrefix), "/")
+		stamp, _, _ := strings.Cut(parts[0], "-")
+		started, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		generation := byName[parts[0]]
+		if generation == nil {
+			generation = &replicaGeneration{name: parts[0], started: started}
+			byName[parts[0]] = generation
+		}
+		generation.objects = append(generation.objects, object)
+
+		switch {
+		case len(parts) == 2 && parts[1] == "snapshot.sqlite":
+			generation.snapshot = object.Key
+		case len(parts) == 3:
+			segment, ok := parseReplicaSegment(object.Key, parts[1], parts[2])
+			if ok {
+				generation.segments = append(generation.segments, segment)
+			}
+		}
+	}
+
+	generations := make([]*replicaGeneration, 0, len(byName))
+	for _, generation := range byName {
+		sort.Slice(generation.segments, func(i, j int) bool {
+			a, b := generation.segments[i], generation.segments[j]
+			if a.index != b.index {
+				return a.index < b.index
+			}
+			return a.offset < b.offset
+		})
+		generations = append(generations, generation)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].name < generations[j].name })
+	return generations, nil
+}
+
+func parseReplicaSegment(key, index, name string) (replicaSegment, bool) {
+	offsetPart, millisPart, ok := strings.Cut(strings.TrimSuffix(name, ".wal"), "-")
+	if !ok || !strings.HasSuffix(name, ".wal") {
+		return replicaSegment{}, false
+	}
+	indexValue, err1 := strconv.ParseInt(index, 16, 64)
+	offset, err2 := strconv.ParseInt(offsetPart, 16, 64)
+	millis, err3 := strconv.ParseInt(millisPart, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return replicaSegment{}, false
+	}
+	return replicaSegment{key: key, index: indexValue, offset: offset, uploaded: time.UnixMilli(millis)}, true
+}
+
+// restoreReplica rebuilds the database at dbPath from the newest generation
+// in the bucket, or with until set, from the state replicated at that time.
+// It reports false when there is nothing to restore.
+func restoreReplica(ctx context.Context, s3 *s3Client, dbPath string, until time.Time) (bool, error) {
+	generations, err := listReplicaGenerations(ctx, s3)
+	if err != nil {
+		return false, err
+	}
+	var generation *replicaGeneration
+	for _, candidate := range generations {
+		if candidate.snapshot != "" && (until.IsZero() || !candidate.started.After(until)) {
+			generation = candidate
+		}
+	}
+	if generation == nil {
+		return false, nil
+	}
+
+	tmpPath := dbPath + ".restore"
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		_ = os.Remove(tmpPath + suffix)
+	}
+	if err := downloadObject(ctx, s3, generation.snapshot, tmpPath); err != nil {
+		return false, err
+	}
+
+	applied := 0
+	for start := 0; start < len(generation.segments); {
+		index := generation.segments[start].index
+		var wal bytes.Buffer
+		next := start
+		for ; next < len(generation.segments) && generation.segments[next].index == index; next++ {
+			segment := generation.segments[next]
+			if !until.IsZero() && segment.uploaded.After(until) {
+				break
+			}
+			if segment.offset != int64(wal.Len()) {
+				return false, fmt.Errorf("replica segment %s does not continue the WAL", segment.key)
+			}
+			body, err := s3.getObject(ctx, segment.key)
+			if err != nil {
+				return false, err
+			}
+			_, err = io.Copy(&wal, body)
+			body.Close()
+			if err != nil {
+				return false, err
+			}
+			applied++
+		}
+		if wal.Len() > 0 {
+			if err := applyWAL(ctx, tmpPath, wal.Bytes()); err != nil {
+				return false, err
+			}
+		}
+		if next < len(generation.segments) && generation.segments[next].index == index {
+			// Stopped at until.
+			break
+		}
+		start = next
+	}
+
+	if err := verifyBackup(ctx, tmpPath); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return false, err
+	}
+	slog.Info("database restored from replica", "generation", generation.name, "segments", applied)
+	return true, nil
+}
+
+// applyWAL lets SQLite recover the WAL into the database file.
+func applyWAL(ctx context.Context, dbPath string, wal []byte) error {
+	if err := os.WriteFile(dbPath+"-wal", wal, 0o600); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var busy, walPages, checkpointed int
+	if err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &walPages, &checkpointed); err != nil {
+		return fmt.Errorf("apply replica wal: %w", err)
+	}
+	return nil
+}
+
+func downloadObject(ctx context.Context, s3 *s3Client, key, path string) error {
+	body, err := s3.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func copyFileTo(dst io.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	reviewDraft    = "draft"
+	reviewInReview = "in_review"
+	reviewApproved = "approved"
+
+	reviewSubmit  = "submit"
+	reviewApprove = "approve"
+	reviewReject  = "reject"
+	reviewRevise  = "revise"
+
+	defaultRequiredApprovals = 1
+	maxReviewMessageLen      = 2000
+)
+
+// diagramReview is where a diagram is in review. Diagrams without a row
+// are drafts of revision 1. A diagram in review refuses writes, so
+// approvers approve what they were shown, until it is rejected back to a
+// draft; an approved one refuses them until someone starts its next
+// revision, which makes it a draft again.
+type diagramReview struct {
+	DiagramID         string           `json:"diagramId"`
+	State             string           `json:"state"`
+	Revision          int              `json:"revision"`
+	SubmittedBy       string           `json:"submittedBy,omitempty"`
+	SubmittedAt       string           `json:"submittedAt,omitempty"`
+	UpdatedAt         string           `json:"updatedAt,omitempty"`
+	Message           string           `json:"message,omitempty"`
+	Approvals         []reviewApproval `json:"approvals"`
+	RequiredApprovals int              `json:"requiredApprovals"`
+}
+
+type reviewApproval struct {
+	Approver   string `json:"approver"`
+	ApprovedAt string `json:"approvedAt"`
+}
+
+type reviewQueryer interface {
+	rowQueryer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// reviewError is a refused review action and the status it is answered
+// with.
+type reviewError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *reviewError) Error() string { return e.msg }
+
+// handleDiagramReview serves /api/diagrams/{id}/review. GET returns the
+// review state and POST {"action": "submit|approve|reject|revise",
+// "message": "..."} moves it:
+//
+//	draft --submit--> in_review --approve--> approved --revise--> draft
+//	                  in_review --reject---> draft
+//
+// Approving takes requiredApprovals distinct approvers, who must be listed
+// in REVIEW_APPROVERS when it is set and cannot include the submitter.
+// Rejecting and revising are for approvers and the submitter.
+func (a *app) handleDiagramReview(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		review, err := a.getReview(r.Context(), a.db, diagramID)
+		if err == nil {
+			var exists bool
+			exists, err = diagramExists(r.Context(), a.db, diagramID)
+			if err == nil && !exists {
+				err = sql.ErrNoRows
+			}
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, review)
+	case http.MethodPost:
+		var req struct {
+			Action  string `json:"action"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		switch req.Action {
+		case reviewSubmit, reviewApprove, reviewReject, reviewRevise:
+		default:
+			writePayloadError(w, invalidField("action", "must be one of submit, approve, reject, revise"))
+			return
+		}
+		if len(req.Message) > maxReviewMessageLen {
+			writePayloadError(w, invalidField("message", fmt.Sprintf("must be at most %d bytes", maxReviewMessageLen)))
+			return
+		}
+
+		review, err := a.applyReviewAction(r.Context(), diagramID, req.Action, req.Message, requestUserID(r))
+		var refused *reviewError
+		switch {
+		case errors.As(err, &refused):
+			writeErrorCode(w, refused.status, refused.code, refused.msg)
+		case errors.Is(err, sql.ErrNoRows):
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+		case err != nil:
+			writeServerError(w, err)
+		default:
+			writeJSON(w, http.StatusOK, review)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *app) applyReviewAction(ctx context.Context, diagramID, action, message, actor string) (diagramReview, error) {
+	var review diagramReview
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		exists, err := diagramExists(ctx, tx, diagramID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+		review, err = a.getReview(ctx, tx, diagramID)
+		if err != nil {
+			return err
+		}
+
+		from := map[string]string{
+			reviewSubmit:  reviewDraft,
+			reviewApprove: reviewInReview,
+			reviewReject:  reviewInReview,
+			reviewRevise:  reviewApproved,
+		}[action]
+		if review.State != from {
+			return &reviewError{http.StatusConflict, codeConflict, fmt.Sprintf("cannot %s a diagram that is %s", action, review.State)}
+		}
+
+		now := time.Now().UTC().Format(sortableTimeFormat)
+		switch action {
+		case reviewSubmit:
+			review.State = reviewInReview
+			review.SubmittedBy = actor
+			review.SubmittedAt = now
+			review.Approvals = []reviewApproval{}
+		case reviewApprove:
+			if err := a.checkApprover(actor, review); err != nil {
+				return err
+			}
+			for _, approval := range review.Approvals {
+				if approval.Approver == actor {
+					return &reviewError{http.StatusConflict, codeConflict, "you have already approved this revision"}
+				}
+			}
+			review.Approvals = append(review.Approvals, reviewApproval{Approver: actor, ApprovedAt: now})
+			const query = `INSERT INTO diagram_review_approvals (diagram_id, approver, approved_at) VALUES (?, ?, ?)`
+			if _, err := tx.ExecContext(ctx, query, diagramID, actor, now); err != nil {
+				return err
+			}
+			if len(review.Approvals) >= a.requiredApprovals {
+				review.State = reviewApproved
+			}
+		case reviewReject:
+			if actor == "" || actor != review.SubmittedBy {
+				if err := a.checkApprover(actor, review); err != nil {
+					return err
+				}
+			}
+			review.State = reviewDraft
+			review.Approvals = []reviewApproval{}
+		case reviewRevise:
+			if actor == "" || actor != review.SubmittedBy {
+				if len(a.reviewApprovers) > 0 && !a.reviewApprovers[actor] {
+					return &reviewError{http.StatusForbidden, codeForbidden, "only the submitter and identities listed in REVIEW_APPROVERS can revise an approved diagram"}
+				}
+			}
+			review.State = reviewDraft
+			review.Revision++
+			review.SubmittedBy = ""
+			review.SubmittedAt = ""
+			review.Approvals = []reviewApproval{}
+		}
+		if len(review.Approvals) == 0 {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_review_approvals WHERE diagram_id = ?`, diagramID); err != nil {
+				return err
+			}
+		}
+		review.UpdatedAt = now
+		review.Message = message
+
+		const query = `
+INSERT INTO diagram_reviews (diagram_id, state, revision, submitted_by, submitted_at, updated_at, message)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(diagram_id) DO UPDATE SET
+	state = excluded.state,
+	revision = excluded.revision,
+	submitted_by = excluded.submitted_by,
+	submitted_at = excluded.submitted_at,
+	updated_at = excluded.updated_at,
+	message = excluded.message`
+		_, err = tx.ExecContext(ctx, query, diagramID, review.State, review.Revision, review.SubmittedBy, review.SubmittedAt, review.UpdatedAt, review.Message)
+		return err
+	})
+	return review, err
+}
+
+// checkApprover refuses approvals and rejections from callers without the
+// approver role. Without REVIEW_APPROVERS anyone may approve, anonymous
+// callers included, so deployments without client certificates can use
+// the workflow; nobody approves their own submission.
+func (a *app) checkApprover(actor string, review diagramReview) error {
+	if len(a.reviewApprovers) > 0 && !a.reviewApprovers[actor] {
+		return &reviewError{http.StatusForbidden, codeForbidden, "only identities listed in REVIEW_APPROVERS can approve or reject diagrams"}
+	}
+	if actor != "" && actor == review.SubmittedBy {
+		return &reviewError{http.StatusForbidden, codeForbidden, "the submitter cannot approve their own diagram"}
+	}
+	return nil
+}
+
+func (a *app) getReview(ctx context.Context, q reviewQueryer, diagramID string) (diagramReview, error) {
+	review := diagramReview{
+		DiagramID:         diagramID,
+		State:             reviewDraft,
+		Revision:          1,
+		Approvals:         []reviewApproval{},
+		RequiredApprovals: a.requiredApprovals,
+	}
+	const query = `
+SELECT state, revision, COALESCE(submitted_by, ''), COALESCE(submitted_at, ''), updated_at, COALESCE(message, '')
+FROM diagram_reviews
+WHERE diagram_id = ?`
+	err := q.QueryRowContext(ctx, query, diagramID).Scan(&review.State, &review.Revision, &review.SubmittedBy, &review.SubmittedAt, &review.UpdatedAt, &review.Message)
+	if errors.Is(err, sql.ErrNoRows) {
+		return review, nil
+	}
+	if err != nil {
+		return review, err
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT approver, approved_at FROM diagram_review_approvals WHERE diagram_id = ? ORDER BY approved_at`, diagramID)
+	if err != nil {
+		return review, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var approval reviewApproval
+		if err := rows.Scan(&approval.Approver, &approval.ApprovedAt); err != nil {
+			return review, err
+		}
+		review.Approvals = append(review.Approvals, approval)
+	}
+	return review, rows.Err()
+}
+
+// reviewLockedState returns the review state, in_review or approved, that
+// refuses writes to the diagram, or "" when it is a draft.
+func reviewLockedState(ctx context.Context, q rowQueryer, diagramID string) (string, error) {
+	var state string
+	const query = `SELECT state FROM diagram_reviews WHERE diagram_id = ? AND state IN (?, ?)`
+	err := q.QueryRowContext(ctx, query, diagramID, reviewInReview, reviewApproved).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return state, err
+}
+
+func reviewLockedCode(state string) string {
+	if state == reviewInReview {
+		return codeDiagramInReview
+	}
+	return codeDiagramApproved
+}
+
+func reviewLockedMessage(state string) string {
+	if state == reviewInReview {
+		return "diagram is in review; POST /api/diagrams/{id}/review with action reject to withdraw it before changing it"
+	}
+	return "diagram is approved; POST /api/diagrams/{id}/review with action revise to start a new revision before changing it"
+}
+
+func writeDiagramReviewLocked(w http.ResponseWriter, state string) {
+	writeErrorCode(w, http.StatusLocked, reviewLockedCode(state), reviewLockedMessage(state))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	s3Timeout       = 5 * time.Minute
+)
+
+// s3Client is a minimal S3 client (PUT, GET, DELETE and ListObjectsV2 with
+// Signature Version 4) that also works with MinIO and other S3-compatible
+// stores, so no SDK is needed.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// newS3Client returns nil when no bucket is configured.
+func newS3Client(cfg config) (*s3Client, error) {
+	s3cfg := cfg.Backup.S3
+	if s3cfg.Bucket == "" {
+		return nil, nil
+	}
+	if s3cfg.AccessKeyID == "" || s3cfg.SecretAccessKey == "" {
+		return nil, errors.New("BACKUP_S3_BUCKET requires BACKUP_S3_ACCESS_KEY_ID and BACKUP_S3_SECRET_ACCESS_KEY")
+	}
+	region := s3cfg.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+	endpoint := s3cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid BACKUP_S3_ENDPOINT %q: must be an http:// or https:// URL", endpoint)
+	}
+	prefix := strings.Trim(s3cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Client{
+		endpoint:  parsed,
+		region:    region,
+		bucket:    s3cfg.Bucket,
+		prefix:    prefix,
+		accessKey: s3cfg.AccessKeyID,
+		secretKey: s3cfg.SecretAccessKey,
+		pathStyle: s3cfg.PathStyle,
+		client:    &http.Client{Timeout: s3Timeout},
+	}, nil
+}
+
+// objectURL addresses key below the configured prefix, either path-style
+// (endpoint/bucket/key, as MinIO expects) or virtual-hosted
+// (bucket.endpoint/key, the AWS default).
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := c.bucketURL()
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.prefix + key
+	return u
+}
+
+func (c *s3Client) bucketURL() *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/"
+	if c.pathStyle {
+		u.Path += c.bucket
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	return &u
+}
+
+func (c *s3Client) putObject(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	res, err := c.do(ctx, http.MethodPut, c.objectURL(key), body, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkS3Response(res)
+}
+
+// getObject returns the object body; the caller closes it.
+func (c *s3Client) getObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, http.MethodGet, c.objectURL(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkS3Response(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (c *s3Client) deleteObject(ctx context.Context, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, c.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return checkS3Response(res)
+}
+
+// listObjects returns the objects whose key starts with prefix (relative to
+// the configured prefix), with keys relative to the configured prefix too.
+func (c *s3Client) listObjects(ctx context.Context, prefix string) ([]s3Object, error) {
+	var (
+		objects []s3Object
+		token   string
+	)
+	for {
+		u := c.bucketURL()
+		query := url.Values{"list-type": {"2"}, "prefix": {c.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+
+		res, err := c.do(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = checkS3Response(res)
+		if err == nil {
+			err = xml.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Contents {
+			objects = append(objects, s3Object{
+				Key:          strings.TrimPrefix(item.Key, c.prefix),
+				Size:         item.Size,
+				LastModified: item.LastModified,
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// s3NotFoundError is returned for 404 responses.
+type s3NotFoundError struct {
+	status string
+}
+
+func (e *s3NotFoundError) Error() string {
+	return "s3: " + e.status
+}
+
+func checkS3Response(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return &s3NotFoundError{status: res.Status}
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3: %s: %s (%s)", res.Status, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("s3: %s", res.Status)
+}
+
+func (c *s3Client) do(ctx context.Context, method string, u *url.URL, body io.ReadSeeker, header http.Header) (*http.Response, error) {
+	payloadHash, size, err := hashPayload(body)
+	if err != nil {
+		return nil, err
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = body
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	// Send the path and query exactly as they are signed; S3 rejects
+	// chunked uploads without a length.
+	req.URL.RawPath = s3EscapePath(req.URL.Path)
+	req.URL.RawQuery = canonicalQuery(req.URL.Query())
+	req.ContentLength = size
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	c.sign(req, payloadHash, time.Now().UTC())
+	return c.client.Do(req)
+}
+
+// hashPayload returns the hex SHA-256 SigV4 needs and the body size, and
+// rewinds body.
+func hashPayload(body io.ReadSeeker) (string, int64, error) {
+	hash := sha256.New()
+	var size int64
+	if body != nil {
+		var err error
+		if size, err = io.Copy(hash, body); err != nil {
+			return "", 0, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return "", 0, err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		lower := strings.ToLower(key)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath percent-encodes everything but unreserved characters and
+// slashes, as SigV4 requires for S3.
+func s3EscapePath(path string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		if ch == '/' || isUnreserved(ch) {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3EscapeQuery(key)+"="+s3EscapeQuery(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EscapeQuery(value string) string {
+	return strings.ReplaceAll(s3EscapePath(value), "/", "%2F")
+}
+
+func isUnreserved(ch byte) bool {
+	return (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+		ch == '-' || ch == '_' || ch == '.' || ch == '~'
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNamespace  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlPOSTBinding        = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearerConfirmation = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	samlMetadataPath = "/api/auth/saml/metadata"
+	samlLoginPath    = "/api/auth/saml/login"
+	samlACSPath      = "/api/auth/saml/acs"
+
+	samlRequestCookieName = "chartdb_saml_request"
+	samlRequestTTL        = 10 * time.Minute
+	samlClockSkew         = 2 * time.Minute
+)
+
+// samlProvider signs browsers in through a SAML 2.0 identity provider:
+// the server is a service provider that sends unsigned AuthnRequests with
+// the HTTP-Redirect binding and takes signed responses at its assertion
+// consumer service with the HTTP-POST binding.
+type samlProvider struct {
+	entityID string
+	acsURL   string
+	// identityAttribute names the attribute holding the identity; empty
+	// uses the NameID.
+	identityAttribute string
+
+	idpEntityID string
+	idpSSOURL   string
+	idpCerts    []*x509.Certificate
+}
+
+// newSAMLProvider reads the SAML settings. It returns nil when
+// SAML_IDP_SSO_URL is not set.
+func newSAMLProvider(cfg config) (*samlProvider, error) {
+	if cfg.SAML.IdPSSOURL == "" {
+		if cfg.SAML.IdPEntityID != "" || cfg.SAML.IdPCert != "" {
+			return nil, errors.New("SAML_IDP_ENTITY_ID and SAML_IDP_CERT require SAML_IDP_SSO_URL")
+		}
+		return nil, nil
+	}
+	publicURL := strings.TrimRight(cfg.PublicURL, "/")
+	if u, err := url.Parse(publicURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("SAML requires PUBLIC_URL to be an https URL: the identity provider posts responses to it")
+	}
+	if u, err := url.Parse(cfg.SAML.IdPSSOURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid SAML_IDP_SSO_URL %q: must be an absolute URL", cfg.SAML.IdPSSOURL)
+	}
+	if cfg.SAML.IdPEntityID == "" {
+		return nil, errors.New("SAML_IDP_SSO_URL requires SAML_IDP_ENTITY_ID")
+	}
+	if cfg.SAML.IdPCert == "" {
+		return nil, errors.New("SAML_IDP_SSO_URL requires SAML_IDP_CERT")
+	}
+	data, err := os.ReadFile(cfg.SAML.IdPCert)
+	if err != nil {
+		return nil, fmt.Errorf("read SAML_IDP_CERT: %w", err)
+	}
+	// Listing the next certificate as well lets the identity provider
+	// rotate its signing key without an outage.
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse SAML_IDP_CERT: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("SAML_IDP_CERT contains no PEM certificates")
+	}
+
+	provider := &samlProvider{
+		entityID:          cfg.SAML.EntityID,
+		acsURL:            publicURL + "/api/v1/auth/saml/acs",
+		identityAttribute: strings.TrimSpace(cfg.SAML.IdentityAttribute),
+		idpEntityID:       cfg.SAML.IdPEntityID,
+		idpSSOURL:         cfg.SAML.IdPSSOURL,
+		idpCerts:          certs,
+	}
+	if provider.entityID == "" {
+		provider.entityID = publicURL + "/api/v1/auth/saml/metadata"
+	}
+	return provider, nil
+}
+
+// handleSAML serves /api/auth/saml:
+//
+//	GET  /api/auth/saml/metadata  the service provider metadata to give the identity provider
+//	GET  /api/auth/saml/login     redirects to the identity provider; ?returnTo= is where to land afterwards
+//	POST /api/auth/saml/acs       takes the identity provider's response and starts a session
+func (a *app) handleSAML(w http.ResponseWriter, r *http.Request) {
+	if a.saml == nil {
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "SAML sign-in is not configured")
+		return
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	method := http.MethodGet
+	if path == samlACSPath {
+		method = http.MethodPost
+	}
+	if path != samlMetadataPath && path != samlLoginPath && path != samlACSPath {
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+		return
+	}
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	switch path {
+	case samlMetadataPath:
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write(a.saml.metadata())
+	case samlLoginPath:
+		a.samlLogin(w, r)
+	case samlACSPath:
+		a.samlACS(w, r)
+	}
+}
+
+func (p *samlProvider) metadata() []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<md:EntityDescriptor xmlns:md="%s" entityID="%s">`, samlMetadataNamespace, xmlEscape(p.entityID))
+	fmt.Fprintf(&b, `<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">`, samlProtocolNamespace)
+	fmt.Fprintf(&b, `<md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>`, samlPOSTBinding, xmlEscape(p.acsURL))
+	b.WriteString(`</md:SPSSODescriptor></md:EntityDescriptor>`)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// samlLogin records the request and redirects to the identity provider. A
+// cookie ties the request to this browser, so a response obtained by
+// someone else cannot be posted to it to sign it in to their account.
+func (a *app) samlLogin(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("returnTo")
+	if returnTo == "" {
+		returnTo = a.sessions.path
+	}
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, `/\`) {
+		writeErrorCode(w, http.StatusBadRequest, codeInvalidRequest, "returnTo must be a path on this server")
+		return
+	}
+
+	requestID := "_" + randomID(32)
+	binding := randomID(32)
+	now := time.Now().UTC()
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(r.Context(), `DELETE FROM saml_requests WHERE expires_at <= ?`, now.Format(sortableTimeFormat)); err != nil {
+			return err
+		}
+		const query = `INSERT INTO saml_requests (id, binding_hash, return_to, expires_at) VALUES (?, ?, ?, ?)`
+		_, err := tx.ExecContext(r.Context(), query, requestID, hashSessionID(binding), returnTo, now.Add(samlRequestTTL).Format(sortableTimeFormat))
+		return err
+	})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	target, err := a.saml.authnRequestURL(requestID, now)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	// The identity provider posts the response from its own site, so the
+	// cookie must be SameSite=None to come along.
+	http.SetCookie(w, &http.Cookie{
+		Name:     samlRequestCookieName,
+		Value:    binding,
+		Path:     a.sessions.path,
+		MaxAge:   int(samlRequestTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// authnRequestURL returns the identity provider URL carrying an
+// AuthnRequest in the HTTP-Redirect binding.
+func (p *samlProvider) authnRequestURL(requestID string, now time.Time) (string, error) {
+	var request bytes.Buffer
+	fmt.Fprintf(&request, `<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`,
+		samlProtocolNamespace, samlAssertionNamespace, requestID, now.Format(time.RFC3339), xmlEscape(p.idpSSOURL), xmlEscape(p.acsURL), samlPOSTBinding)
+	fmt.Fprintf(&request, `<saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`, xmlEscape(p.entityID))
+
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	writer.Write(request.Bytes())
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	target, err := url.Parse(p.idpSSOURL)
+	if err != nil {
+		return "", err
+	}
+	query := target.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	target.RawQuery = query.Encode()
+	return target.String(), nil
+}
+
+// samlACS checks the identity provider's response, signs the browser in
+// and sends it where samlLogin was asked to.
+func (a *app) samlACS(w http.ResponseWriter, r *http.Request) {
+	reject := func(reason string) {
+		slog.Warn("saml response rejected", "reason", reason)
+		writeErrorCode(w, http.StatusForbidden, codeForbidden, "SAML sign-in failed: "+reason)
+	}
+	cookie, err := r.Cookie(samlRequestCookieName)
+	if err != nil || cookie.Value == "" {
+		reject("no sign-in was started in this browser; start at " + a.sessions.path + "api/v1/auth/saml/login")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codeInvalidRequest, "invalid form body")
+		return
+	}
+	document, err := base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLResponse"))
+	if err != nil || len(document) == 0 {
+		writeErrorCode(w, http.StatusBadRequest, codeInvalidRequest, "SAMLResponse must be a base64 SAML response")
+		return
+	}
+	requestID, userID, err := a.saml.assertedIdentity(document, time.Now())
+	if err != nil {
+		reject(err.Error())
+		return
+	}
+	returnTo, ok, err := a.takeSAMLRequest(r.Context(), requestID, cookie.Value)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if !ok {
+		reject("the response does not answer a sign-in started in this browser, or it was already used")
+		return
+	}
+	if isServiceAccountIdentity(userID) {
+		reject("the identity provider asserted an identity reserved for service accounts")
+		return
+	}
+	deprovisioned, err := a.identityDeprovisioned(r.Context(), userID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if deprovisioned {
+		reject("the user is deactivated")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: samlRequestCookieName, Path: a.sessions.path, MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode})
+	if _, err := a.startSession(w, r, identity{ID: userID, Source: "saml"}); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+// takeSAMLRequest consumes the pending request a response answers, so
+// each response signs in once, and only the browser that started it.
+func (a *app) takeSAMLRequest(ctx context.Context, requestID, binding string) (string, bool, error) {
+	var returnTo, bindingHash string
+	found := false
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		const query = `SELECT binding_hash, return_to FROM saml_requests WHERE id = ? AND expires_at > ?`
+		err := tx.QueryRowContext(ctx, query, requestID, time.Now().UTC().Format(sortableTimeFormat)).Scan(&bindingHash, &returnTo)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(bindingHash), []byte(hashSessionID(binding))) != 1 {
+			return nil
+		}
+		found = true
+		_, err = tx.ExecContext(ctx, `DELETE FROM saml_requests WHERE id = ?`, requestID)
+		return err
+	})
+	return returnTo, found, err
+}
+
+// assertedIdentity verifies a SAML response and returns the id of the
+// request it answers and the identity it asserts. Either the response or
+// its assertion must be signed by the identity provider; encrypted
+// assertions and unsolicited responses are refused.
+func (p *samlProvider) assertedIdentity(document []byte, now time.Time) (string, string, error) {
+	response, err := parseXMLDocument(document)
+	if err != nil {
+		return "", "", errors.New("the response is not valid XML")
+	}
+	if !response.is(samlProtocolNamespace, "Response") {
+		return "", "", errors.New("the document is not a SAML response")
+	}
+	if destination := response.attr("Destination"); destination != "" && destination != p.acsURL {
+		return "", "", fmt.Errorf("the response is for %s, not %s", destination, p.acsURL)
+	}
+	if issuer := response.child(samlAssertionNamespace, "Issuer"); issuer != nil && strings.TrimSpace(issuer.text()) != p.idpEntityID {
+		return "", "", fmt.Errorf("the response was issued by %q, not SAML_IDP_ENTITY_ID", strings.TrimSpace(issuer.text()))
+	}
+	if status := samlStatus(response); status != samlStatusSuccess {
+		return "", "", fmt.Errorf("the identity provider refused the sign-in: %s", status)
+	}
+	requestID := response.attr("InResponseTo")
+	if requestID == "" {
+		return "", "", errors.New("unsolicited responses are not accepted; start at the login endpoint")
+	}
+
+	if len(response.children(samlAssertionNamespace, "EncryptedAssertion")) > 0 {
+		return "", "", errors.New("encrypted assertions are not supported; turn assertion encryption off for this service provider")
+	}
+	assertions := response.children(samlAssertionNamespace, "Assertion")
+	if len(assertions) != 1 {
+		return "", "", errors.New("the response must hold exactly one assertion")
+	}
+	assertion := assertions[0]
+	signed := response
+	if response.child(xmlDSigNamespace, "Signature") == nil {
+		if assertion.child(xmlDSigNamespace, "Signature") == nil {
+			return "", "", errors.New("neither the response nor its assertion is signed")
+		}
+		signed = assertion
+	}
+	if err := verifyXMLSignature(signed, p.idpCerts); err != nil {
+		return "", "", err
+	}
+
+	issuer := assertion.child(samlAssertionNamespace, "Issuer")
+	if issuer == nil || strings.TrimSpace(issuer.text()) != p.idpEntityID {
+		return "", "", errors.New("the assertion was not issued by SAML_IDP_ENTITY_ID")
+	}
+	if err := p.checkConditions(assertion, now); err != nil {
+		return "", "", err
+	}
+	subject := assertion.child(samlAssertionNamespace, "Subject")
+	if subject == nil {
+		return "", "", errors.New("the assertion has no subject")
+	}
+	if err := p.checkSubjectConfirmation(subject, requestID, now); err != nil {
+		return "", "", err
+	}
+
+	var userID string
+	if p.identityAttribute == "" {
+		if nameID := subject.child(samlAssertionNamespace, "NameID"); nameID != nil {
+			userID = strings.TrimSpace(nameID.text())
+		}
+		if userID == "" {
+			return "", "", errors.New("the assertion has no NameID")
+		}
+		return requestID, userID, nil
+	}
+	for _, statement := range assertion.children(samlAssertionNamespace, "AttributeStatement") {
+		for _, attribute := range statement.children(samlAssertionNamespace, "Attribute") {
+			if attribute.attr("Name") != p.identityAttribute && attribute.attr("FriendlyName") != p.identityAttribute {
+				continue
+			}
+			if value := attribute.child(samlAssertionNamespace, "AttributeValue"); value != nil {
+				userID = strings.TrimSpace(value.text())
+			}
+		}
+	}
+	if userID == "" {
+		return "", "", fmt.Errorf("the assertion has no %s attribute", p.identityAttribute)
+	}
+	return requestID, userID, nil
+}
+
+func samlStatus(response *xmlElement) string {
+	status := response.child(samlProtocolNamespace, "Status")
+	if status == nil {
+		return "no status"
+	}
+	code := status.child(samlProtocolNamespace, "StatusCode")
+	if code == nil {
+		return "no status code"
+	}
+	value := code.attr("Value")
+	if value != samlStatusSuccess {
+		if message := status.child(samlProtocolNamespace, "StatusMessage"); message != nil {
+			value += " (" + strings.TrimSpace(message.text()) + ")"
+		}
+	}
+	return value
+}
+
+// checkConditions checks the validity window of the assertion and that it
+// is meant for this service provider.
+func (p *samlProvider) checkConditions(assertion *xmlElement, now time.Time) error {
+	conditions := assertion.child(samlAssertionNamespace, "Conditions")
+	if conditions == nil {
+		return errors.New("the assertion has no conditions")
+	}
+	if err := checkSAMLTime(conditions.attr("NotBefore"), conditions.attr("NotOnOrAfter"), now); err != nil {
+		return fmt.Errorf("the assertion %w", err)
+	}
+	restrictions := conditions.children(samlAssertionNamespace, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return errors.New("the assertion has no audience restriction")
+	}
+	for _, restriction := range restrictions {
+		allowed := false
+		for _, audience := range restriction.children(samlAssertionNamespace, "Audience") {
+			if strings.TrimSpace(audience.text()) == p.entityID {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("the assertion is not meant for %s", p.entityID)
+		}
+	}
+	return nil
+}
+
+// checkSubjectConfirmation looks for a bearer confirmation of the subject
+// that sends it to this service, in answer to requestID.
+func (p *samlProvider) checkSubjectConfirmation(subject *xmlElement, requestID string, now time.Time) error {
+	problem := errors.New("the subject has no bearer confirmation")
+	for _, confirmation := range subject.children(samlAssertionNamespace, "SubjectConfirmation") {
+		if confirmation.attr("Method") != samlBearerConfirmation {
+			continue
+		}
+		data := confirmation.child(samlAssertionNamespace, "SubjectConfirmationData")
+		switch {
+		case data == nil:
+			problem = errors.New("the subject confirmation has no data")
+		case data.attr("Recipient") != p.acsURL:
+			problem = fmt.Errorf("the subject confirmation is for %s, not %s", data.attr("Recipient"), p.acsURL)
+		case data.attr("InResponseTo") != requestID:
+			problem = errors.New("the subject confirmation answers another request")
+		case data.attr("NotOnOrAfter") == "":
+			problem = errors.New("the subject confirmation does not expire")
+		default:
+			if err := checkSAMLTime(data.attr("NotBefore"), data.attr("NotOnOrAfter"), now); err != nil {
+				problem = fmt.Errorf("the subject confirmation %w", err)
+				continue
+			}
+			return nil
+		}
+	}
+	return problem
+}
+
+// checkSAMLTime checks now against an optional NotBefore and NotOnOrAfter,
+// allowing for clock skew between the servers.
+func checkSAMLTime(notBefore, notOnOrAfter string, now time.Time) error {
+	if notBefore != "" {
+		at, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			return fmt.Errorf("has an invalid NotBefore %q", notBefore)
+		}
+		if now.Add(samlClockSkew).Before(at) {
+			return errors.New("is not valid yet")
+		}
+	}
+	if notOnOrAfter != "" {
+		at, err := time.Parse(time.RFC3339, notOnOrAfter)
+		if err != nil {
+			return fmt.Errorf("has an invalid NotOnOrAfter %q", notOnOrAfter)
+		}
+		if !now.Add(-samlClockSkew).Before(at) {
+			return errors.New("has expired")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// A small XML tree and the parts of XML Signature that SAML identity
+// providers use: enveloped signatures over exclusive canonicalization
+// (https://www.w3.org/TR/xml-exc-c14n/), with RSA or ECDSA keys and SHA-2
+// digests.
+
+const (
+	xmlNamespace                = "http://www.w3.org/XML/1998/namespace"
+	xmlDSigNamespace            = "http://www.w3.org/2000/09/xmldsig#"
+	excC14NAlgorithm            = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+var xmlDigestMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+}
+
+var xmlSignatureMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":   crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512":   crypto.SHA512,
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512": crypto.SHA512,
+}
+
+// xmlElement is an element of a parsed document. Comments are dropped, as
+// canonicalization without comments leaves them out anyway.
+type xmlElement struct {
+	prefix, local string
+	// space is the namespace the prefix resolves to.
+	space  string
+	attrs  []xmlAttr
+	scope  map[string]string
+	parent *xmlElement
+	nodes  []xmlNode
+}
+
+type xmlAttr struct {
+	prefix, local, space, value string
+}
+
+// xmlNode is a child element, character data or a processing instruction.
+type xmlNode struct {
+	element  *xmlElement
+	text     string
+	procInst *xml.ProcInst
+}
+
+// parseXMLDocument parses data into a tree, refusing DTDs so no entity can
+// expand into the signed content.
+func parseXMLDocument(data []byte) (*xmlElement, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root, current *xmlElement
+	for {
+		token, err := decoder.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := xml.CopyToken(token).(type) {
+		case xml.StartElement:
+			if current == nil && root != nil {
+				return nil, errors.New("xml: more than one root element")
+			}
+			element, err := newXMLElement(t, current)
+			if err != nil {
+				return nil, err
+			}
+			if current == nil {
+				root = element
+			} else {
+				current.nodes = append(current.nodes, xmlNode{element: element})
+			}
+			current = element
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.local {
+				return nil, fmt.Errorf("xml: unexpected end element </%s>", t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current == nil {
+				if len(bytes.TrimSpace(t)) > 0 {
+					return nil, errors.New("xml: text outside the root element")
+				}
+				continue
+			}
+			if last := len(current.nodes) - 1; last >= 0 && current.nodes[last].element == nil && current.nodes[last].procInst == nil {
+				current.nodes[last].text += string(t)
+			} else {
+				current.nodes = append(current.nodes, xmlNode{text: string(t)})
+			}
+		case xml.ProcInst:
+			if current != nil {
+				current.nodes = append(current.nodes, xmlNode{procInst: &t})
+			}
+		case xml.Directive:
+			return nil, errors.New("xml: document type declarations are not allowed")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("xml: unexpected end of document")
+	}
+	return root, nil
+}
+
+func newXMLElement(start xml.StartElement, parent *xmlElement) (*xmlElement, error) {
+	element := &xmlElement{prefix: start.Name.Space, local: start.Name.Local, parent: parent}
+	if parent != nil {
+		element.scope = parent.scope
+	} else {
+		element.scope = map[string]string{"xml": xmlNamespace}
+	}
+	declared := false
+	for _, attr := range start.Attr {
+		prefix, isDecl := "", false
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			isDecl = true
+		case attr.Name.Space == "xmlns":
+			prefix, isDecl = attr.Name.Local, true
+		}
+		if !isDecl {
+			element.attrs = append(element.attrs, xmlAttr{prefix: attr.Name.Space, local: attr.Name.Local, value: attr.Value})
+			continue
+		}
+		if !declared {
+			// Copy on the first declaration so siblings keep theirs.
+			scope := make(map[string]string, len(element.scope)+1)
+			for p, space := range element.scope {
+				scope[p] = space
+			}
+			element.scope, declared = scope, true
+		}
+		element.scope[prefix] = attr.Value
+	}
+
+	var ok bool
+	if element.space, ok = element.scope[element.prefix]; !ok && element.prefix != "" {
+		return nil, fmt.Errorf("xml: undeclared namespace prefix %q", element.prefix)
+	}
+	for i, attr := range element.attrs {
+		if attr.prefix == "" {
+			continue
+		}
+		if element.attrs[i].space, ok = element.scope[attr.prefix]; !ok {
+			return nil, fmt.Errorf("xml: undeclared namespace prefix %q", attr.prefix)
+		}
+	}
+	return element, nil
+}
+
+func (e *xmlElement) is(space, local string) bool {
+	return e.space == space && e.local == local
+}
+
+// children returns the child elements named space:local.
+func (e *xmlElement) children(space, local string) []*xmlElement {
+	var found []*xmlElement
+	for _, node := range e.nodes {
+		if node.element != nil && node.element.is(space, local) {
+			found = append(found, node.element)
+		}
+	}
+	return found
+}
+
+// child returns the first child element named space:local, or nil.
+func (e *xmlElement) child(space, local string) *xmlElement {
+	if found := e.children(space, local); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// attr returns the value of an attribute without a namespace.
+func (e *xmlElement) attr(local string) string {
+	for _, attr := range e.attrs {
+		if attr.space == "" && attr.local == local {
+			return attr.value
+		}
+	}
+	return ""
+}
+
+// text returns the character data directly inside the element.
+func (e *xmlElement) text() string {
+	var b strings.Builder
+	for _, node := range e.nodes {
+		if node.element == nil && node.procInst == nil {
+			b.WriteString(node.text)
+		}
+	}
+	return b.String()
+}
+
+// canonicalXML writes the exclusive canonicalization of e without
+// comments, leaving out the element skip. inclusive lists the prefixes
+// ("#default" for the default namespace) of an InclusiveNamespaces
+// PrefixList, which are declared wherever they are in scope.
+func canonicalXML(e *xmlElement, inclusive []string, skip *xmlElement) []byte {
+	c := c14nWriter{skip: skip, inclusive: make(map[string]bool, len(inclusive))}
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		c.inclusive[prefix] = true
+	}
+	c.element(e, map[string]string{})
+	return c.buf.Bytes()
+}
+
+type c14nWriter struct {
+	buf       bytes.Buffer
+	skip      *xmlElement
+	inclusive map[string]bool
+}
+
+// element writes e. rendered holds the namespace declarations already in
+// effect from the output ancestors.
+func (c *c14nWriter) element(e *xmlElement, rendered map[string]string) {
+	// Exclusive canonicalization declares only the prefixes the element
+	// and its attributes use, and those of the PrefixList.
+	used := map[string]bool{e.prefix: true}
+	for _, attr := range e.attrs {
+		if attr.prefix != "" {
+			used[attr.prefix] = true
+		}
+	}
+	for prefix := range c.inclusive {
+		if _, ok := e.scope[prefix]; ok {
+			used[prefix] = true
+		}
+	}
+	delete(used, "xml")
+
+	var decls []string
+	for prefix := range used {
+		space := e.scope[prefix]
+		if previous, ok := rendered[prefix]; (ok || prefix == "") && previous == space {
+			continue
+		}
+		decls = append(decls, prefix)
+	}
+	sort.Strings(decls)
+	if len(decls) > 0 {
+		inherited := rendered
+		rendered = make(map[string]string, len(inherited)+len(decls))
+		for prefix, space := range inherited {
+			rendered[prefix] = space
+		}
+	}
+
+	c.buf.WriteByte('<')
+	c.name(e.prefix, e.local)
+	for _, prefix := range decls {
+		rendered[prefix] = e.scope[prefix]
+		c.buf.WriteString(" xmlns")
+		if prefix != "" {
+			c.buf.WriteByte(':')
+			c.buf.WriteString(prefix)
+		}
+		c.buf.WriteString(`="`)
+		c.attrValue(e.scope[prefix])
+		c.buf.WriteByte('"')
+	}
+	attrs := append([]xmlAttr(nil), e.attrs...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return attrs[i].local < attrs[j].local
+	})
+	for _, attr := range attrs {
+		c.buf.WriteByte(' ')
+		c.name(attr.prefix, attr.local)
+		c.buf.WriteString(`="`)
+		c.attrValue(attr.value)
+		c.buf.WriteByte('"')
+	}
+	c.buf.WriteByte('>')
+
+	for _, node := range e.nodes {
+		switch {
+		case node.element != nil:
+			if node.element != c.skip {
+				c.element(node.element, rendered)
+			}
+		case node.procInst != nil:
+			c.buf.WriteString("<?")
+			c.buf.WriteString(node.procInst.Target)
+			if len(node.procInst.Inst) > 0 {
+				c.buf.WriteByte(' ')
+				c.buf.Write(node.procInst.Inst)
+			}
+			c.buf.WriteString("?>")
+		default:
+			c.escape(node.text, false)
+		}
+	}
+
+	c.buf.WriteString("</")
+	c.name(e.prefix, e.local)
+	c.buf.WriteByte('>')
+}
+
+func (c *c14nWriter) name(prefix, local string) {
+	if prefix != "" {
+		c.buf.WriteString(prefix)
+		c.buf.WriteByte(':')
+	}
+	c.buf.WriteString(local)
+}
+
+func (c *c14nWriter) attrValue(value string) {
+	c.escape(value, true)
+}
+
+func (c *c14nWriter) escape(s string, attr bool) {
+	for _, r := range s {
+		switch {
+		case r == '&':
+			c.buf.WriteString("&amp;")
+		case r == '<':
+			c.buf.WriteString("&lt;")
+		case r == '>' && !attr:
+			c.buf.WriteString("&gt;")
+		case r == '"' && attr:
+			c.buf.WriteString("&quot;")
+		case r == '\t' && attr:
+			c.buf.WriteString("&#x9;")
+		case r == '\n' && attr:
+			c.buf.WriteString("&#xA;")
+		case r == '\r':
+			c.buf.WriteString("&#xD;")
+		default:
+			c.buf.WriteRune(r)
+		}
+	}
+}
+
+// verifyXMLSignature checks the enveloped signature that is a direct child
+// of e, whose reference must point at e itself, against certs. Callers
+// read only the verified element afterwards, so signed content moved
+// elsewhere in the document is never trusted.
+func verifyXMLSignature(e *xmlElement, certs []*x509.Certificate) error {
+	signatures := e.children(xmlDSigNamespace, "Signature")
+	if len(signatures) != 1 {
+		return fmt.Errorf("%s must carry exactly one signature", e.local)
+	}
+	signature := signatures[0]
+	signedInfo := signature.child(xmlDSigNamespace, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("signature has no SignedInfo")
+	}
+
+	method := signedInfo.child(xmlDSigNamespace, "CanonicalizationMethod")
+	if method == nil || method.attr("Algorithm") != excC14NAlgorithm {
+		return errors.New("signature must use exclusive canonicalization")
+	}
+	signatureMethod := signedInfo.child(xmlDSigNamespace, "SignatureMethod")
+	if signatureMethod == nil {
+		return errors.New("signature has no SignatureMethod")
+	}
+	signatureHash, ok := xmlSignatureMethods[signatureMethod.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported signature method %q: use RSA or ECDSA with SHA-256 or SHA-512", signatureMethod.attr("Algorithm"))
+	}
+
+	references := signedInfo.children(xmlDSigNamespace, "Reference")
+	if len(references) != 1 {
+		return errors.New("signature must have exactly one reference")
+	}
+	reference := references[0]
+	if id := e.attr("ID"); id == "" || reference.attr("URI") != "#"+id {
+		return fmt.Errorf("signature does not reference the %s it is in", e.local)
+	}
+	var inclusive []string
+	enveloped, canonical := false, false
+	if transforms := reference.child(xmlDSigNamespace, "Transforms"); transforms != nil {
+		for _, transform := range transforms.children(xmlDSigNamespace, "Transform") {
+			switch transform.attr("Algorithm") {
+			case envelopedSignatureAlgorithm:
+				enveloped = true
+			case excC14NAlgorithm:
+				canonical = true
+				inclusive = inclusivePrefixes(transform)
+			default:
+				return fmt.Errorf("unsupported signature transform %q", transform.attr("Algorithm"))
+			}
+		}
+	}
+	if !enveloped || !canonical {
+		return errors.New("signature must use the enveloped-signature and exclusive canonicalization transforms")
+	}
+	digestMethod := reference.child(xmlDSigNamespace, "DigestMethod")
+	digestValue := reference.child(xmlDSigNamespace, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return errors.New("signature reference has no digest")
+	}
+	digestHash, ok := xmlDigestMethods[digestMethod.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported digest method %q: use SHA-256 or SHA-512", digestMethod.attr("Algorithm"))
+	}
+	want, err := decodeXMLBase64(digestValue.text())
+	if err != nil {
+		return errors.New("signature digest is not base64")
+	}
+	digest := digestHash.New()
+	digest.Write(canonicalXML(e, inclusive, signature))
+	if !bytes.Equal(digest.Sum(nil), want) {
+		return fmt.Errorf("%s does not match its signature digest", e.local)
+	}
+
+	signatureValue := signature.child(xmlDSigNamespace, "SignatureValue")
+	if signatureValue == nil {
+		return errors.New("signature has no SignatureValue")
+	}
+	value, err := decodeXMLBase64(signatureValue.text())
+	if err != nil {
+		return errors.New("signature value is not base64")
+	}
+	signed := signatureHash.New()
+	signed.Write(canonicalXML(signedInfo, inclusivePrefixes(method), nil))
+	hashed := signed.Sum(nil)
+	for _, cert := range certs {
+		if verifySignatureValue(cert.PublicKey, signatureHash, hashed, value) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match the identity provider certificate")
+}
+
+// inclusivePrefixes reads the InclusiveNamespaces PrefixList of a
+// canonicalization method or transform.
+func inclusivePrefixes(e *xmlElement) []string {
+	if list := e.child(excC14NAlgorithm, "InclusiveNamespaces"); list != nil {
+		return strings.Fields(list.attr("PrefixList"))
+	}
+	return nil
+}
+
+func decodeXMLBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+func verifySignatureValue(key crypto.PublicKey, hash crypto.Hash, hashed, value []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, hashed, value) == nil
+	case *ecdsa.PublicKey:
+		// XML Signature stores ECDSA signatures as r and s side by side.
+		if len(value) == 0 || len(value)%2 != 0 {
+			return false
+		}
+		half := len(value) / 2
+		r, s := new(big.Int).SetBytes(value[:half]), new(big.Int).SetBytes(value[half:])
+		return ecdsa.Verify(key, hashed, r, s)
+	}
+	return false
+}
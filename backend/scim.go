@@ -0,0 +1,728 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scimUserSchema           = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema          = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimEnterpriseUserSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	scimListSchema           = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema          = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	scimBasePath    = "/api/scim/v2"
+	scimContentType = "application/scim+json"
+	// scimLocationPath prefixes resource locations, through the versioned
+	// API so clients following them don't hit the deprecated paths.
+	scimLocationPath = "/api/v1/scim/v2"
+
+	defaultSCIMPageSize = 100
+	maxSCIMPageSize     = 1000
+)
+
+// scimKind is a SCIM resource type: users, whose userName is the identity
+// they sign in as, or groups of them.
+type scimKind struct {
+	name     string
+	endpoint string
+	schema   string
+	table    string
+	// key is the attribute that must be unique, stored in the name column.
+	key string
+	// refs is the multi-valued attribute listing the other kind: the
+	// groups of a user, the members of a group.
+	refs string
+}
+
+var (
+	scimUsers  = scimKind{name: "User", endpoint: "Users", schema: scimUserSchema, table: "scim_users", key: "userName", refs: "groups"}
+	scimGroups = scimKind{name: "Group", endpoint: "Groups", schema: scimGroupSchema, table: "scim_groups", key: "displayName", refs: "members"}
+)
+
+// scimResource is a stored user or group. attrs are the attributes the
+// identity provider sent, without those the server keeps itself: id,
+// meta, schemas and, for users, groups. The members of a group are kept
+// in scim_group_members and held in attrs while a request edits them.
+type scimResource struct {
+	id        string
+	attrs     map[string]interface{}
+	createdAt string
+	updatedAt string
+}
+
+// scimRef is an element of the groups of a user or the members of a group.
+type scimRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref"`
+}
+
+// handleSCIM serves the SCIM 2.0 provisioning API (RFC 7644) identity
+// providers use to create, update and deactivate users and their group
+// memberships:
+//
+//	GET              /api/scim/v2/ServiceProviderConfig
+//	GET              /api/scim/v2/ResourceTypes
+//	GET|POST         /api/scim/v2/Users
+//	GET|PUT|PATCH|DELETE /api/scim/v2/Users/{id}
+//	GET|POST         /api/scim/v2/Groups
+//	GET|PUT|PATCH|DELETE /api/scim/v2/Groups/{id}
+//
+// It needs a caller, usually a service account token with the scim scope,
+// whatever ANONYMOUS_ACCESS allows. A user made inactive, or deleted, is
+// signed out, and while inactive cannot authenticate in any way.
+func (a *app) handleSCIM(w http.ResponseWriter, r *http.Request) {
+	if requestUserID(r) == "" {
+		writeSCIMError(w, http.StatusUnauthorized, "", "authentication required: use a token with the scim scope")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, scimBasePath), "/"), "/")
+	if !strings.HasPrefix(r.URL.Path, scimBasePath) || parts[0] == "" || len(parts) > 2 {
+		writeSCIMError(w, http.StatusNotFound, "", "route not found")
+		return
+	}
+
+	var kind scimKind
+	switch parts[0] {
+	case "ServiceProviderConfig", "ResourceTypes":
+		if r.Method != http.MethodGet || len(parts) > 1 {
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+			return
+		}
+		if parts[0] == "ServiceProviderConfig" {
+			writeSCIM(w, http.StatusOK, scimServiceProviderConfig())
+		} else {
+			writeSCIM(w, http.StatusOK, scimListResponse(scimResourceTypes(), 2, 1))
+		}
+		return
+	case scimUsers.endpoint:
+		kind = scimUsers
+	case scimGroups.endpoint:
+		kind = scimGroups
+	default:
+		writeSCIMError(w, http.StatusNotFound, "", "route not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			a.listSCIM(w, r, kind)
+		case http.MethodPost:
+			a.createSCIM(w, r, kind)
+		default:
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+		}
+		return
+	}
+
+	id := parts[1]
+	switch r.Method {
+	case http.MethodGet:
+		res, err := a.loadSCIMResource(r.Context(), a.db, kind, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeSCIMError(w, http.StatusNotFound, "", kind.name+" not found")
+			return
+		}
+		if err != nil {
+			writeSCIMServerError(w, err)
+			return
+		}
+		refs, err := a.scimRefs(r.Context(), kind)
+		if err != nil {
+			writeSCIMServerError(w, err)
+			return
+		}
+		writeSCIM(w, http.StatusOK, projectSCIM(r, kind, scimDocument(kind, res, refs[id])))
+	case http.MethodPut, http.MethodPatch:
+		a.updateSCIM(w, r, kind, id)
+	case http.MethodDelete:
+		a.deleteSCIM(w, r, kind, id)
+	default:
+		writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+	}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+// writeSCIMError writes a SCIM error (RFC 7644 section 3.12). scimType
+// narrows a 400 or 409 down, e.g. to invalidFilter or uniqueness.
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(w, status, body)
+}
+
+// writeSCIMServerError is writeServerError with a SCIM error body.
+func writeSCIMServerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDatabaseBusy) || isBusyError(err) {
+		writeServerError(w, err)
+		return
+	}
+	writeSCIMError(w, http.StatusInternalServerError, "", err.Error())
+}
+
+func scimListResponse(resources []map[string]interface{}, total, startIndex int) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	}
+}
+
+func scimServiceProviderConfig() map[string]interface{} {
+	unsupported := map[string]bool{"supported": false}
+	return map[string]interface{}{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": maxSCIMPageSize},
+		"changePassword": unsupported,
+		"sort":           unsupported,
+		"etag":           unsupported,
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "An API token with the scim scope, such as one of a service account.",
+			"primary":     true,
+		}},
+		"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": scimLocationPath + "/ServiceProviderConfig"},
+	}
+}
+
+func scimResourceTypes() []map[string]interface{} {
+	var types []map[string]interface{}
+	for _, kind := range []scimKind{scimUsers, scimGroups} {
+		resourceType := map[string]interface{}{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       kind.name,
+			"name":     kind.name,
+			"endpoint": "/" + kind.endpoint,
+			"schema":   kind.schema,
+			"meta":     map[string]string{"resourceType": "ResourceType", "location": scimLocationPath + "/ResourceTypes/" + kind.name},
+		}
+		if kind == scimUsers {
+			resourceType["schemaExtensions"] = []map[string]interface{}{{"schema": scimEnterpriseUserSchema, "required": false}}
+		}
+		types = append(types, resourceType)
+	}
+	return types
+}
+
+// scimDocument renders a resource with the attributes the server keeps.
+func scimDocument(kind scimKind, res scimResource, refs []scimRef) map[string]interface{} {
+	doc := make(map[string]interface{}, len(res.attrs)+4)
+	for key, value := range res.attrs {
+		doc[key] = value
+	}
+	schemas := []string{kind.schema}
+	if _, ok := doc[scimKey(doc, scimEnterpriseUserSchema)]; ok && kind == scimUsers {
+		schemas = append(schemas, scimEnterpriseUserSchema)
+	}
+	doc["schemas"] = schemas
+	doc["id"] = res.id
+	if refs == nil {
+		refs = []scimRef{}
+	}
+	delete(doc, scimKey(doc, kind.refs))
+	doc[kind.refs] = refs
+	doc["meta"] = map[string]string{
+		"resourceType": kind.name,
+		"created":      res.createdAt,
+		"lastModified": res.updatedAt,
+		"location":     scimLocationPath + "/" + kind.endpoint + "/" + res.id,
+	}
+	return doc
+}
+
+// projectSCIM applies the attributes and excludedAttributes parameters to
+// the top-level attributes of doc. id and schemas are always returned.
+func projectSCIM(r *http.Request, kind scimKind, doc map[string]interface{}) map[string]interface{} {
+	names := func(param string) []string {
+		var list []string
+		for _, name := range splitList(r.URL.Query().Get(param)) {
+			list = append(list, scimAttrPath(name, kind.schema)[0])
+		}
+		return list
+	}
+	if only := names("attributes"); len(only) > 0 {
+		projected := map[string]interface{}{"id": doc["id"], "schemas": doc["schemas"]}
+		for _, name := range only {
+			if value, ok := doc[scimKey(doc, name)]; ok {
+				projected[scimKey(doc, name)] = value
+			}
+		}
+		return projected
+	}
+	for _, name := range names("excludedAttributes") {
+		if key := scimKey(doc, name); key != "id" && key != "schemas" {
+			delete(doc, key)
+		}
+	}
+	return doc
+}
+
+func (a *app) listSCIM(w http.ResponseWriter, r *http.Request, kind scimKind) {
+	query := r.URL.Query()
+	var filter scimFilter
+	if expr := strings.TrimSpace(query.Get("filter")); expr != "" {
+		var err error
+		if filter, err = parseSCIMFilter(expr, kind.schema); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+	}
+	startIndex, count := 1, defaultSCIMPageSize
+	if value := query.Get("startIndex"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "startIndex must be a number")
+			return
+		}
+		startIndex = max(n, 1)
+	}
+	if value := query.Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "count must be a number")
+			return
+		}
+		count = min(max(n, 0), maxSCIMPageSize)
+	}
+
+	resources, err := a.listSCIMResources(r.Context(), kind)
+	if err != nil {
+		writeSCIMServerError(w, err)
+		return
+	}
+	refs, err := a.scimRefs(r.Context(), kind)
+	if err != nil {
+		writeSCIMServerError(w, err)
+		return
+	}
+	var matched []map[string]interface{}
+	for _, res := range resources {
+		doc := scimDocument(kind, res, refs[res.id])
+		if filter == nil || filter.matches(doc) {
+			matched = append(matched, doc)
+		}
+	}
+	page := []map[string]interface{}{}
+	for i := startIndex - 1; i < len(matched) && len(page) < count; i++ {
+		page = append(page, projectSCIM(r, kind, matched[i]))
+	}
+	writeSCIM(w, http.StatusOK, scimListResponse(page, len(matched), startIndex))
+}
+
+// decodeSCIMResource reads a User or Group from the request body.
+func decodeSCIMResource(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	var attrs map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil || attrs == nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "the body must be a JSON object")
+		return nil, false
+	}
+	for _, key := range []string{"id", "meta", "schemas"} {
+		delete(attrs, scimKey(attrs, key))
+	}
+	return attrs, true
+}
+
+func (a *app) createSCIM(w http.ResponseWriter, r *http.Request, kind scimKind) {
+	attrs, ok := decodeSCIMResource(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC().Format(sortableTimeFormat)
+	res := scimResource{id: randomID(24), attrs: attrs, createdAt: now, updatedAt: now}
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		return a.saveSCIMResource(r.Context(), tx, kind, res, true)
+	})
+	if a.writeSCIMSaveError(w, kind, err) {
+		return
+	}
+	a.writeSCIMResource(w, r, kind, res.id, http.StatusCreated)
+}
+
+// updateSCIM replaces a resource (PUT) or applies PatchOp operations to it
+// (PATCH).
+func (a *app) updateSCIM(w http.ResponseWriter, r *http.Request, kind scimKind, id string) {
+	var replacement map[string]interface{}
+	var ops []scimPatchOp
+	if r.Method == http.MethodPut {
+		var ok bool
+		if replacement, ok = decodeSCIMResource(w, r); !ok {
+			return
+		}
+	} else {
+		var patch struct {
+			Operations []scimPatchOp `json:"Operations"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "the body must be a PatchOp request")
+			return
+		}
+		if len(patch.Operations) == 0 {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "Operations must not be empty")
+			return
+		}
+		ops = patch.Operations
+	}
+
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		res, err := a.loadSCIMResource(r.Context(), tx, kind, id)
+		if err != nil {
+			return err
+		}
+		if replacement != nil {
+			res.attrs = replacement
+		} else {
+			if kind == scimGroups {
+				// Members are edited like any other attribute.
+				members, err := a.scimMemberIDs(r.Context(), tx, id)
+				if err != nil {
+					return err
+				}
+				list := make([]interface{}, len(members))
+				for i, member := range members {
+					list[i] = map[string]interface{}{"value": member}
+				}
+				res.attrs["members"] = list
+			}
+			for _, op := range ops {
+				if err := applySCIMPatch(res.attrs, op, kind.schema); err != nil {
+					return &scimInvalidError{scimType: "invalidValue", err: err}
+				}
+			}
+		}
+		res.updatedAt = time.Now().UTC().Format(sortableTimeFormat)
+		return a.saveSCIMResource(r.Context(), tx, kind, res, false)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		writeSCIMError(w, http.StatusNotFound, "", kind.name+" not found")
+		return
+	}
+	if a.writeSCIMSaveError(w, kind, err) {
+		return
+	}
+	a.writeSCIMResource(w, r, kind, id, http.StatusOK)
+}
+
+func (a *app) deleteSCIM(w http.ResponseWriter, r *http.Request, kind scimKind, id string) {
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		var name string
+		if err := tx.QueryRowContext(r.Context(), `SELECT name FROM `+kind.table+` WHERE id = ?`, id).Scan(&name); err != nil {
+			return err
+		}
+		column := "group_id"
+		if kind == scimUsers {
+			column = "user_id"
+			// Deprovisioning signs the user out and revokes their tokens.
+			if err := signOutIdentity(r.Context(), tx, name, true); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(r.Context(), `DELETE FROM scim_group_members WHERE `+column+` = ?`, id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(r.Context(), `DELETE FROM `+kind.table+` WHERE id = ?`, id)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		writeSCIMError(w, http.StatusNotFound, "", kind.name+" not found")
+		return
+	}
+	if err != nil {
+		writeSCIMServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeSCIMResource answers with the resource as stored, along with its
+// groups or members.
+func (a *app) writeSCIMResource(w http.ResponseWriter, r *http.Request, kind scimKind, id string, status int) {
+	res, err := a.loadSCIMResource(r.Context(), a.db, kind, id)
+	if err != nil {
+		writeSCIMServerError(w, err)
+		return
+	}
+	refs, err := a.scimRefs(r.Context(), kind)
+	if err != nil {
+		writeSCIMServerError(w, err)
+		return
+	}
+	doc := scimDocument(kind, res, refs[id])
+	if status == http.StatusCreated {
+		w.Header().Set("Location", scimLocationPath+"/"+kind.endpoint+"/"+id)
+	}
+	writeSCIM(w, status, doc)
+}
+
+// scimInvalidError is a resource the server refuses to store, answered
+// with 400 and its scimType.
+type scimInvalidError struct {
+	scimType string
+	err      error
+}
+
+func (e *scimInvalidError) Error() string { return e.err.Error() }
+
+func (a *app) writeSCIMSaveError(w http.ResponseWriter, kind scimKind, err error) bool {
+	var invalid *scimInvalidError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &invalid):
+		scimType := invalid.scimType
+		if errors.Is(invalid.err, errSCIMFilter) {
+			scimType = "invalidPath"
+		}
+		writeSCIMError(w, http.StatusBadRequest, scimType, invalid.Error())
+	case isUniqueConstraintError(err):
+		writeSCIMError(w, http.StatusConflict, "uniqueness", "a "+kind.name+" with this "+kind.key+" already exists")
+	default:
+		writeSCIMServerError(w, err)
+	}
+	return true
+}
+
+// saveSCIMResource validates res and stores it. For a user, becoming
+// inactive signs them out; for a group, its members are replaced by
+// attrs["members"].
+func (a *app) saveSCIMResource(ctx context.Context, tx *sql.Tx, kind scimKind, res scimResource, create bool) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &scimInvalidError{scimType: "invalidValue", err: fmt.Errorf(format, args...)}
+	}
+	nameKey := scimKey(res.attrs, kind.key)
+	name, _ := res.attrs[nameKey].(string)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return invalid("%s is required", kind.key)
+	}
+	res.attrs[nameKey] = name
+	externalID, _ := res.attrs[scimKey(res.attrs, "externalId")].(string)
+
+	var members []string
+	if kind == scimGroups {
+		key := scimKey(res.attrs, "members")
+		if list, ok := res.attrs[key].([]interface{}); ok {
+			seen := map[string]bool{}
+			for _, item := range list {
+				id, ok := scimElementValue(item)
+				if !ok {
+					return invalid("members must be objects with a value")
+				}
+				if !seen[id] {
+					seen[id] = true
+					members = append(members, id)
+				}
+			}
+		} else if res.attrs[key] != nil {
+			return invalid("members must be a list")
+		}
+		delete(res.attrs, key)
+	} else {
+		delete(res.attrs, scimKey(res.attrs, "groups"))
+	}
+
+	active := true
+	if kind == scimUsers {
+		// Some identity providers send booleans as strings.
+		key := scimKey(res.attrs, "active")
+		switch value := res.attrs[key].(type) {
+		case nil:
+		case bool:
+			active = value
+		case string:
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return invalid("active must be true or false")
+			}
+			active = parsed
+		default:
+			return invalid("active must be true or false")
+		}
+		res.attrs[key] = active
+	}
+
+	attrs, err := json.Marshal(res.attrs)
+	if err != nil {
+		return err
+	}
+	if create {
+		query := `INSERT INTO ` + kind.table + ` (id, name, external_id, attributes, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`
+		args := []interface{}{res.id, name, nullableString(externalID), string(attrs), res.createdAt, res.updatedAt}
+		if kind == scimUsers {
+			query = `INSERT INTO scim_users (id, name, external_id, attributes, created_at, updated_at, active) VALUES (?, ?, ?, ?, ?, ?, ?)`
+			args = append(args, active)
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	} else {
+		if kind == scimUsers {
+			var previous string
+			var wasActive bool
+			if err := tx.QueryRowContext(ctx, `SELECT name, active FROM scim_users WHERE id = ?`, res.id).Scan(&previous, &wasActive); err != nil {
+				return err
+			}
+			if wasActive && !active {
+				if err := signOutIdentity(ctx, tx, previous, false); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE scim_users SET active = ? WHERE id = ?`, active, res.id); err != nil {
+				return err
+			}
+		}
+		query := `UPDATE ` + kind.table + ` SET name = ?, external_id = ?, attributes = ?, updated_at = ? WHERE id = ?`
+		if _, err := tx.ExecContext(ctx, query, name, nullableString(externalID), string(attrs), res.updatedAt, res.id); err != nil {
+			return err
+		}
+	}
+
+	if kind != scimGroups {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM scim_group_members WHERE group_id = ?`, res.id); err != nil {
+		return err
+	}
+	for _, member := range members {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM scim_users WHERE id = ?)`, member).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return invalid("member %s is not a user", member)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO scim_group_members (group_id, user_id) VALUES (?, ?)`, res.id, member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signOutIdentity ends the sessions of a deprovisioned user and, when the
+// user is deleted, revokes their tokens.
+func signOutIdentity(ctx context.Context, tx *sql.Tx, id string, revokeTokens bool) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE identity = ?`, id); err != nil {
+		return err
+	}
+	if !revokeTokens {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM api_tokens WHERE owner = ?`, id)
+	return err
+}
+
+func scanSCIMResource(row interface{ Scan(...interface{}) error }) (scimResource, error) {
+	var res scimResource
+	var attrs string
+	if err := row.Scan(&res.id, &attrs, &res.createdAt, &res.updatedAt); err != nil {
+		return res, err
+	}
+	err := json.Unmarshal([]byte(attrs), &res.attrs)
+	if res.attrs == nil {
+		res.attrs = map[string]interface{}{}
+	}
+	return res, err
+}
+
+func (a *app) loadSCIMResource(ctx context.Context, q rowQueryer, kind scimKind, id string) (scimResource, error) {
+	return scanSCIMResource(q.QueryRowContext(ctx, `SELECT id, attributes, created_at, updated_at FROM `+kind.table+` WHERE id = ?`, id))
+}
+
+func (a *app) listSCIMResources(ctx context.Context, kind scimKind) ([]scimResource, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT id, attributes, created_at, updated_at FROM `+kind.table+` ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var resources []scimResource
+	for rows.Next() {
+		res, err := scanSCIMResource(rows)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, res)
+	}
+	return resources, rows.Err()
+}
+
+func (a *app) scimMemberIDs(ctx context.Context, tx *sql.Tx, groupID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT user_id FROM scim_group_members WHERE group_id = ? ORDER BY user_id`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// scimRefs returns, by resource id, the groups of every user or the
+// members of every group.
+func (a *app) scimRefs(ctx context.Context, kind scimKind) (map[string][]scimRef, error) {
+	const query = `
+SELECT m.group_id, g.name, m.user_id, u.name
+FROM scim_group_members m
+JOIN scim_groups g ON g.id = m.group_id
+JOIN scim_users u ON u.id = m.user_id`
+	rows, err := a.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	refs := map[string][]scimRef{}
+	for rows.Next() {
+		var groupID, groupName, userID, userName string
+		if err := rows.Scan(&groupID, &groupName, &userID, &userName); err != nil {
+			return nil, err
+		}
+		if kind == scimUsers {
+			refs[userID] = append(refs[userID], scimRef{Value: groupID, Display: groupName, Ref: scimLocationPath + "/Groups/" + groupID})
+		} else {
+			refs[groupID] = append(refs[groupID], scimRef{Value: userID, Display: userName, Ref: scimLocationPath + "/Users/" + userID})
+		}
+	}
+	for _, list := range refs {
+		sort.Slice(list, func(i, j int) bool { return list[i].Display < list[j].Display })
+	}
+	return refs, rows.Err()
+}
+
+// identityDeprovisioned reports whether SCIM has made the user with this
+// identity inactive.
+func (a *app) identityDeprovisioned(ctx context.Context, id string) (bool, error) {
+	var inactive bool
+	err := a.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM scim_users WHERE name = ? AND active = 0)`, id).Scan(&inactive)
+	return inactive, err
+}
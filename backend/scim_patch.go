@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SCIM filters (RFC 7644 section 3.4.2.2) and PATCH paths (section
+// 3.5.2) over resources held as decoded JSON.
+
+// scimFilter is a filter: groups of comparisons that must all hold, of
+// which any one group must match, since "or" binds looser than "and".
+// Parentheses and "not" are not supported.
+type scimFilter [][]scimComparison
+
+type scimComparison struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+var scimFilterOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true, "pr": true,
+}
+
+// errSCIMFilter marks a filter or path the server cannot parse, answered
+// with scimType invalidFilter or invalidPath.
+var errSCIMFilter = errors.New("scim: invalid filter")
+
+func parseSCIMFilter(s, schema string) (scimFilter, error) {
+	tokens, err := scimFilterTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	filter := scimFilter{nil}
+	for len(tokens) > 0 {
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("%w: %q is incomplete", errSCIMFilter, s)
+		}
+		comparison := scimComparison{path: scimAttrPath(tokens[0], schema), op: strings.ToLower(tokens[1])}
+		if !scimFilterOperators[comparison.op] {
+			return nil, fmt.Errorf("%w: unsupported operator %q", errSCIMFilter, tokens[1])
+		}
+		tokens = tokens[2:]
+		if comparison.op != "pr" {
+			if len(tokens) == 0 {
+				return nil, fmt.Errorf("%w: %s needs a value", errSCIMFilter, comparison.op)
+			}
+			if err := json.Unmarshal([]byte(tokens[0]), &comparison.value); err != nil {
+				return nil, fmt.Errorf("%w: invalid value %s", errSCIMFilter, tokens[0])
+			}
+			tokens = tokens[1:]
+		}
+		last := len(filter) - 1
+		filter[last] = append(filter[last], comparison)
+		if len(tokens) == 0 {
+			break
+		}
+		switch strings.ToLower(tokens[0]) {
+		case "and":
+		case "or":
+			filter = append(filter, nil)
+		default:
+			return nil, fmt.Errorf("%w: expected and or or, got %q", errSCIMFilter, tokens[0])
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("%w: %q ends with an operator", errSCIMFilter, s)
+		}
+	}
+	if len(filter[0]) == 0 {
+		return nil, fmt.Errorf("%w: empty filter", errSCIMFilter)
+	}
+	return filter, nil
+}
+
+// scimFilterTokens splits a filter at spaces outside quoted strings.
+func scimFilterTokens(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == ' ':
+			i++
+		case s[i] == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated string", errSCIMFilter)
+			}
+			tokens = append(tokens, s[i:end+1])
+			i = end + 1
+		case s[i] == '(' || s[i] == ')':
+			return nil, fmt.Errorf("%w: grouping with parentheses is not supported", errSCIMFilter)
+		default:
+			end := strings.IndexByte(s[i:], ' ')
+			if end < 0 {
+				end = len(s) - i
+			}
+			tokens = append(tokens, s[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// scimAttrPath splits an attribute path such as "name.givenName" or
+// "urn:...:enterprise:2.0:User:department". The resource's own schema URN
+// may prefix any attribute; extension attributes live under theirs.
+func scimAttrPath(name, schema string) []string {
+	if rest, ok := cutPrefixFold(name, schema+":"); ok {
+		name = rest
+	} else if rest, ok := cutPrefixFold(name, scimEnterpriseUserSchema+":"); ok {
+		return append([]string{scimEnterpriseUserSchema}, strings.Split(rest, ".")...)
+	} else if strings.EqualFold(name, scimEnterpriseUserSchema) {
+		return []string{scimEnterpriseUserSchema}
+	}
+	return strings.Split(name, ".")
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
+
+// scimKey returns the key of m that names attribute, which SCIM compares
+// case-insensitively, or attribute itself when m has none.
+func scimKey(m map[string]interface{}, attribute string) string {
+	if _, ok := m[attribute]; ok {
+		return attribute
+	}
+	for key := range m {
+		if strings.EqualFold(key, attribute) {
+			return key
+		}
+	}
+	return attribute
+}
+
+// scimValues returns the values at path in doc, flattening multi-valued
+// attributes on the way, so "emails.value" holds every address.
+func scimValues(doc interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		if list, ok := doc.([]interface{}); ok {
+			return list
+		}
+		return []interface{}{doc}
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		child, ok := v[scimKey(v, path[0])]
+		if !ok || child == nil {
+			return nil
+		}
+		return scimValues(child, path[1:])
+	case []interface{}:
+		var values []interface{}
+		for _, item := range v {
+			values = append(values, scimValues(item, path)...)
+		}
+		return values
+	}
+	return nil
+}
+
+func (f scimFilter) matches(doc map[string]interface{}) bool {
+	for _, group := range f {
+		all := true
+		for _, comparison := range group {
+			if !comparison.matches(doc) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func (c scimComparison) matches(doc map[string]interface{}) bool {
+	values := scimValues(doc, c.path)
+	if c.op == "ne" {
+		for _, value := range values {
+			if scimCompare(value, "eq", c.value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, value := range values {
+		if c.op == "pr" {
+			if s, ok := value.(string); !ok || s != "" {
+				return true
+			}
+			continue
+		}
+		if scimCompare(value, c.op, c.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimCompare applies op to a stored value and a filter value. Strings
+// compare case-insensitively; timestamps are stored so that they also
+// order as strings.
+func scimCompare(stored interface{}, op string, want interface{}) bool {
+	switch want := want.(type) {
+	case string:
+		s, ok := stored.(string)
+		if !ok {
+			return false
+		}
+		s, want = strings.ToLower(s), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return s == want
+		case "co":
+			return strings.Contains(s, want)
+		case "sw":
+			return strings.HasPrefix(s, want)
+		case "ew":
+			return strings.HasSuffix(s, want)
+		case "gt":
+			return s > want
+		case "ge":
+			return s >= want
+		case "lt":
+			return s < want
+		case "le":
+			return s <= want
+		}
+	case float64:
+		n, ok := stored.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return n == want
+		case "gt":
+			return n > want
+		case "ge":
+			return n >= want
+		case "lt":
+			return n < want
+		case "le":
+			return n <= want
+		}
+	case bool, nil:
+		return op == "eq" && stored == want
+	}
+	return false
+}
+
+// template returns the element a filter such as `type eq "work"`
+// describes, for adding to a multi-valued attribute through a path that
+// matches nothing yet.
+func (f scimFilter) template() map[string]interface{} {
+	element := map[string]interface{}{}
+	if len(f) == 1 {
+		for _, comparison := range f[0] {
+			if comparison.op == "eq" && len(comparison.path) == 1 {
+				element[comparison.path[0]] = comparison.value
+			}
+		}
+	}
+	return element
+}
+
+// scimPatchOp is an operation of a PatchOp request.
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// scimPatchPath is a parsed PATCH path: the attribute, a filter selecting
+// elements of a multi-valued attribute, and a sub-attribute of those
+// elements, as in `emails[type eq "work"].value`.
+type scimPatchPath struct {
+	keys   []string
+	filter scimFilter
+	sub    string
+}
+
+func parseSCIMPatchPath(path, schema string) (scimPatchPath, error) {
+	var parsed scimPatchPath
+	attribute := path
+	if open := strings.IndexByte(path, '['); open >= 0 {
+		end := strings.LastIndexByte(path, ']')
+		if end < open {
+			return parsed, fmt.Errorf("%w: unbalanced brackets in %q", errSCIMFilter, path)
+		}
+		filter, err := parseSCIMFilter(path[open+1:end], schema)
+		if err != nil {
+			return parsed, err
+		}
+		parsed.filter = filter
+		attribute = path[:open]
+		if rest := path[end+1:]; rest != "" {
+			sub, ok := strings.CutPrefix(rest, ".")
+			if !ok || sub == "" {
+				return parsed, fmt.Errorf("%w: unexpected %q after the filter", errSCIMFilter, rest)
+			}
+			parsed.sub = sub
+		}
+	}
+	parsed.keys = scimAttrPath(attribute, schema)
+	for _, key := range parsed.keys {
+		if key == "" {
+			return parsed, fmt.Errorf("%w: invalid path %q", errSCIMFilter, path)
+		}
+	}
+	return parsed, nil
+}
+
+// applySCIMPatch applies one PATCH operation to attrs.
+func applySCIMPatch(attrs map[string]interface{}, op scimPatchOp, schema string) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return fmt.Errorf("unsupported PATCH op %q: use add, replace or remove", op.Op)
+	}
+	if op.Path == "" {
+		if kind == "remove" {
+			return errors.New("remove needs a path")
+		}
+		object, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return errors.New("an operation without a path needs an object value")
+		}
+		for key, value := range object {
+			if err := applySCIMPatch(attrs, scimPatchOp{Op: kind, Path: key, Value: value}, schema); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	path, err := parseSCIMPatchPath(op.Path, schema)
+	if err != nil {
+		return err
+	}
+
+	parent := attrs
+	for _, key := range path.keys[:len(path.keys)-1] {
+		key = scimKey(parent, key)
+		child, ok := parent[key].(map[string]interface{})
+		if !ok {
+			if kind == "remove" {
+				return nil
+			}
+			child = map[string]interface{}{}
+			parent[key] = child
+		}
+		parent = child
+	}
+	key := scimKey(parent, path.keys[len(path.keys)-1])
+
+	if path.filter == nil {
+		switch kind {
+		case "remove":
+			// Some identity providers remove members by value rather than
+			// by filter.
+			list, isList := parent[key].([]interface{})
+			values, hasValues := op.Value.([]interface{})
+			if !isList || !hasValues {
+				delete(parent, key)
+				return nil
+			}
+			remove := map[string]bool{}
+			for _, value := range values {
+				if id, ok := scimElementValue(value); ok {
+					remove[id] = true
+				}
+			}
+			kept := []interface{}{}
+			for _, item := range list {
+				if id, ok := scimElementValue(item); ok && remove[id] {
+					continue
+				}
+				kept = append(kept, item)
+			}
+			parent[key] = kept
+		case "replace":
+			parent[key] = op.Value
+		case "add":
+			switch existing := parent[key].(type) {
+			case []interface{}:
+				if values, ok := op.Value.([]interface{}); ok {
+					parent[key] = append(existing, values...)
+				} else {
+					parent[key] = append(existing, op.Value)
+				}
+			case map[string]interface{}:
+				if object, ok := op.Value.(map[string]interface{}); ok {
+					mergeSCIMObject(existing, object)
+				} else {
+					parent[key] = op.Value
+				}
+			default:
+				parent[key] = op.Value
+			}
+		}
+		return nil
+	}
+
+	list, _ := parent[key].([]interface{})
+	kept := make([]interface{}, 0, len(list)+1)
+	matched := false
+	for _, item := range list {
+		element, ok := item.(map[string]interface{})
+		if !ok || !path.filter.matches(element) {
+			kept = append(kept, item)
+			continue
+		}
+		matched = true
+		switch {
+		case kind == "remove" && path.sub == "":
+			continue
+		case kind == "remove":
+			delete(element, scimKey(element, path.sub))
+		case path.sub != "":
+			element[scimKey(element, path.sub)] = op.Value
+		default:
+			object, ok := op.Value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s needs an object value", op.Path)
+			}
+			if kind == "replace" {
+				element = map[string]interface{}{}
+			}
+			mergeSCIMObject(element, object)
+		}
+		kept = append(kept, element)
+	}
+	if !matched && kind != "remove" {
+		element := path.filter.template()
+		if path.sub != "" {
+			element[path.sub] = op.Value
+		} else if object, ok := op.Value.(map[string]interface{}); ok {
+			mergeSCIMObject(element, object)
+		}
+		kept = append(kept, element)
+	}
+	parent[key] = kept
+	return nil
+}
+
+func mergeSCIMObject(dst, src map[string]interface{}) {
+	for key, value := range src {
+		dst[scimKey(dst, key)] = value
+	}
+}
+
+// scimElementValue returns the "value" of an element of a multi-valued
+// attribute, such as the id of a group member.
+func scimElementValue(item interface{}) (string, bool) {
+	element, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	value, ok := element[scimKey(element, "value")].(string)
+	return value, ok
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// serviceAccountPrefix starts the identity of every service account, so
+// the audit log tells bots from people. Client certificates cannot claim
+// it.
+const serviceAccountPrefix = "service:"
+
+const maxServiceAccountDescriptionLen = 500
+
+var serviceAccountNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// serviceAccount is a non-interactive identity for automation such as
+// exporter bots and CI jobs. It belongs to the server rather than to a
+// person: operators manage it through the admin API, and it authenticates
+// with its own tokens only.
+type serviceAccount struct {
+	Name        string `json:"name"`
+	Identity    string `json:"identity"`
+	Description string `json:"description,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+	Disabled    bool   `json:"disabled"`
+	DisabledAt  string `json:"disabledAt,omitempty"`
+}
+
+func isServiceAccountIdentity(id string) bool {
+	return strings.HasPrefix(id, serviceAccountPrefix)
+}
+
+// handleServiceAccounts serves /api/admin/service-accounts:
+//
+//	GET|POST              /api/admin/service-accounts
+//	GET|PATCH|DELETE      /api/admin/service-accounts/{name}
+//	GET|POST              /api/admin/service-accounts/{name}/tokens
+//	GET|DELETE            /api/admin/service-accounts/{name}/tokens/{id}
+//	POST                  /api/admin/service-accounts/{name}/tokens/{id}/rotate
+//
+// PATCH {"description", "disabled"} updates an account; a disabled
+// account's tokens stop working until it is enabled again. Deleting it
+// revokes its tokens.
+func (a *app) handleServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// /api/admin/service-accounts
+	if len(parts) == 3 {
+		switch r.Method {
+		case http.MethodGet:
+			accounts, err := a.listServiceAccounts(r.Context())
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, accounts)
+		case http.MethodPost:
+			a.createServiceAccount(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	name := parts[3]
+	account, err := a.getServiceAccount(r.Context(), name)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeErrorCode(w, http.StatusNotFound, codeNotFound, "service account not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	// /api/admin/service-accounts/{name}/tokens...
+	if len(parts) > 4 {
+		if parts[4] != "tokens" {
+			writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+			return
+		}
+		a.serveTokens(w, r, account.Identity, parts[5:])
+		return
+	}
+
+	// /api/admin/service-accounts/{name}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, account)
+	case http.MethodPatch:
+		var req struct {
+			Description *string `json:"description"`
+			Disabled    *bool   `json:"disabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		if req.Description != nil {
+			account.Description = strings.TrimSpace(*req.Description)
+			if len(account.Description) > maxServiceAccountDescriptionLen {
+				writePayloadError(w, invalidField("description", "must be at most 500 bytes"))
+				return
+			}
+		}
+		if req.Disabled != nil && *req.Disabled != account.Disabled {
+			account.Disabled = *req.Disabled
+			account.DisabledAt = ""
+			if account.Disabled {
+				account.DisabledAt = time.Now().UTC().Format(sortableTimeFormat)
+			}
+		}
+		const query = `UPDATE service_accounts SET description = ?, disabled_at = NULLIF(?, '') WHERE name = ?`
+		if _, err := a.db.ExecContext(r.Context(), query, account.Description, account.DisabledAt, name); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, account)
+	case http.MethodDelete:
+		err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(r.Context(), `DELETE FROM api_tokens WHERE owner = ?`, account.Identity); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(r.Context(), `DELETE FROM service_accounts WHERE name = ?`, name)
+			return err
+		})
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *app) createServiceAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	if !serviceAccountNamePattern.MatchString(req.Name) {
+		writePayloadError(w, invalidField("name", "must be 1 to 63 lowercase letters, digits and dashes, starting with a letter or digit"))
+		return
+	}
+	account := serviceAccount{
+		Name:        req.Name,
+		Identity:    serviceAccountPrefix + req.Name,
+		Description: strings.TrimSpace(req.Description),
+		CreatedBy:   requestUserID(r),
+		CreatedAt:   time.Now().UTC().Format(sortableTimeFormat),
+	}
+	if len(account.Description) > maxServiceAccountDescriptionLen {
+		writePayloadError(w, invalidField("description", "must be at most 500 bytes"))
+		return
+	}
+	const query = `INSERT INTO service_accounts (name, description, created_by, created_at) VALUES (?, ?, ?, ?)`
+	if _, err := a.db.ExecContext(r.Context(), query, account.Name, account.Description, account.CreatedBy, account.CreatedAt); err != nil {
+		if isUniqueConstraintError(err) {
+			writeErrorCode(w, http.StatusConflict, codeConflict, "service account already exists")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+account.Name)
+	writeJSON(w, http.StatusCreated, account)
+}
+
+const serviceAccountColumns = `name, COALESCE(description, ''), COALESCE(created_by, ''), created_at, COALESCE(disabled_at, '')`
+
+func scanServiceAccount(row interface{ Scan(...interface{}) error }) (serviceAccount, error) {
+	var account serviceAccount
+	err := row.Scan(&account.Name, &account.Description, &account.CreatedBy, &account.CreatedAt, &account.DisabledAt)
+	account.Identity = serviceAccountPrefix + account.Name
+	account.Disabled = account.DisabledAt != ""
+	return account, err
+}
+
+func (a *app) getServiceAccount(ctx context.Context, name string) (serviceAccount, error) {
+	return scanServiceAccount(a.db.QueryRowContext(ctx, `SELECT `+serviceAccountColumns+` FROM service_accounts WHERE name = ?`, name))
+}
+
+func (a *app) listServiceAccounts(ctx context.Context) ([]serviceAccount, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT `+serviceAccountColumns+` FROM service_accounts ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := []serviceAccount{}
+	for rows.Next() {
+		account, err := scanServiceAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
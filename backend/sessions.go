@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "chartdb_session"
+	csrfHeader        = "X-CSRF-Token"
+
+	defaultSessionTTL = 12 * time.Hour
+)
+
+// sessionSettings are how session cookies are issued.
+type sessionSettings struct {
+	ttl      time.Duration
+	sameSite http.SameSite
+	// path scopes the cookie to BASE_PATH.
+	path string
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid SESSION_COOKIE_SAMESITE %q: use lax, strict or none", value)
+}
+
+// session is a browser sign-in. It acts as the identity that logged in,
+// with the scopes of the token used, if any. Only the SHA-256 of its cookie
+// is stored; the CSRF token is sent back on every write.
+type session struct {
+	Identity  string   `json:"identity"`
+	Source    string   `json:"source"`
+	Scopes    []string `json:"scopes,omitempty"`
+	CSRFToken string   `json:"csrfToken"`
+	CreatedAt string   `json:"createdAt"`
+	ExpiresAt string   `json:"expiresAt"`
+}
+
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleAuth serves /api/auth:
+//
+//	POST /api/auth/login    signs in and sets the session cookie
+//	POST /api/auth/logout   ends the session and clears the cookie
+//	GET  /api/auth/session  returns the session and its CSRF token
+//
+// Login takes the caller's client certificate or API token, as an
+// Authorization header or {"token": "..."}, so a browser can trade a token
+// for a cookie once instead of holding on to it. /api/auth/saml/... signs
+// in through a SAML identity provider instead.
+func (a *app) handleAuth(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/api/auth/login":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		a.login(w, r)
+	case "/api/auth/logout":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			if _, err := a.db.ExecContext(r.Context(), `DELETE FROM sessions WHERE id_hash = ?`, hashSessionID(cookie.Value)); err != nil {
+				writeServerError(w, err)
+				return
+			}
+		}
+		a.setSessionCookie(w, r, "", -1)
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/auth/session":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		current, ok := requestSession(r.Context())
+		if !ok {
+			writeErrorCode(w, http.StatusUnauthorized, codeUnauthorized, "not signed in")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, current)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/api/auth/saml/") {
+			a.handleSAML(w, r)
+			return
+		}
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+	}
+}
+
+func (a *app) login(w http.ResponseWriter, r *http.Request) {
+	// A form on another site cannot send JSON without a CORS preflight, so
+	// it cannot sign the browser in to the attacker's account.
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.ContentLength != 0 && contentType != "application/json" {
+		writeErrorCode(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "login takes application/json")
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	id, _ := requestIdentity(r.Context())
+	if req.Token != "" {
+		var problem string
+		var err error
+		id, problem, err = a.authenticateToken(r.Context(), req.Token)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if problem != "" {
+			writeErrorCode(w, http.StatusUnauthorized, codeUnauthorized, problem)
+			return
+		}
+	}
+	if id.ID == "" {
+		writeErrorCode(w, http.StatusUnauthorized, codeUnauthorized, "sign in with a client certificate or an API token")
+		return
+	}
+	if isServiceAccountIdentity(id.ID) {
+		writeErrorCode(w, http.StatusForbidden, codeForbidden, "service accounts cannot sign in; send their token with each request")
+		return
+	}
+	if id.Source == "session" {
+		writeErrorCode(w, http.StatusConflict, codeConflict, "already signed in; POST /api/auth/logout first")
+		return
+	}
+
+	created, err := a.startSession(w, r, id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// startSession signs the browser in as id and sets the session cookie.
+func (a *app) startSession(w http.ResponseWriter, r *http.Request, id identity) (session, error) {
+	sessionID := randomID(43)
+	now := time.Now().UTC()
+	created := session{
+		Identity:  id.ID,
+		Source:    id.Source,
+		Scopes:    id.Scopes,
+		CSRFToken: randomID(32),
+		CreatedAt: now.Format(sortableTimeFormat),
+		ExpiresAt: now.Add(a.sessions.ttl).Format(sortableTimeFormat),
+	}
+	var scopes sql.NullString
+	if created.Scopes != nil {
+		scopes = sql.NullString{String: strings.Join(created.Scopes, ","), Valid: true}
+	}
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(r.Context(), `DELETE FROM sessions WHERE expires_at <= ?`, created.CreatedAt); err != nil {
+			return err
+		}
+		const query = `
+INSERT INTO sessions (id_hash, identity, source, scopes, csrf_token, created_at, expires_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+		_, err := tx.ExecContext(r.Context(), query, hashSessionID(sessionID), created.Identity, created.Source, scopes, created.CSRFToken, created.CreatedAt, created.ExpiresAt)
+		return err
+	})
+	if err != nil {
+		return session{}, err
+	}
+	slog.Info("session started", "identity", created.Identity, "source", created.Source)
+	a.setSessionCookie(w, r, sessionID, int(a.sessions.ttl.Seconds()))
+	return created, nil
+}
+
+// setSessionCookie sets the session cookie, or clears it when maxAge is
+// negative. It is Secure whenever the browser reached the server over
+// HTTPS, including through a trusted proxy.
+func (a *app) setSessionCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     a.sessions.path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https" || a.sessions.sameSite == http.SameSiteNoneMode,
+		SameSite: a.sessions.sameSite,
+	})
+}
+
+type sessionKey struct{}
+
+func requestSession(ctx context.Context) (session, bool) {
+	current, ok := ctx.Value(sessionKey{}).(session)
+	return current, ok
+}
+
+func (a *app) lookupSession(ctx context.Context, sessionID string) (session, bool, error) {
+	var current session
+	var scopes sql.NullString
+	const query = `
+SELECT identity, source, scopes, csrf_token, created_at, expires_at
+FROM sessions
+WHERE id_hash = ? AND expires_at > ?`
+	err := a.db.QueryRowContext(ctx, query, hashSessionID(sessionID), time.Now().UTC().Format(sortableTimeFormat)).
+		Scan(&current.Identity, &current.Source, &scopes, &current.CSRFToken, &current.CreatedAt, &current.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session{}, false, nil
+	}
+	if err != nil {
+		return session{}, false, err
+	}
+	if scopes.Valid {
+		current.Scopes = splitList(scopes.String)
+	}
+	return current, true, nil
+}
+
+// withSessions sets the request identity from the session cookie, for
+// requests that bring no certificate or token of their own. Writes made
+// with a session must repeat its CSRF token in X-CSRF-Token, which other
+// sites cannot read, so they cannot forge them with the browser's cookie.
+func (a *app) withSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The SAML identity provider posts to the assertion consumer
+		// service without the CSRF token; its signature stands in for it.
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || cookie.Value == "" || requestUserID(r) != "" || strings.TrimSuffix(r.URL.Path, "/") == samlACSPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		current, ok, err := a.lookupSession(r.Context(), cookie.Value)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if !ok {
+			// An expired or revoked session signs the browser out.
+			a.setSessionCookie(w, r, "", -1)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(current.CSRFToken)) != 1 {
+				writeErrorCode(w, http.StatusForbidden, codeCSRFInvalid, "missing or invalid "+csrfHeader+" header; GET /api/auth/session returns the token")
+				return
+			}
+		}
+
+		id := identity{ID: current.Identity, Source: "session", Scopes: current.Scopes}
+		if scope := requiredScope(r); !id.allows(scope) {
+			writeErrorCode(w, http.StatusForbidden, codeForbidden, "session lacks the "+scope+" scope")
+			return
+		}
+		ctx := withRequestIdentity(r.Context(), id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, sessionKey{}, current)))
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// uiRuntimeEnv is served as /config.js (window.env), replacing the file the
+// nginx image generates from the same environment variables.
+type uiRuntimeEnv struct {
+	OpenAIAPIKey      string `json:"OPENAI_API_KEY"`
+	OpenAIAPIEndpoint string `json:"OPENAI_API_ENDPOINT"`
+	LLMModelName      string `json:"LLM_MODEL_NAME"`
+	APIBaseURL        string `json:"API_BASE_URL"`
+	HideChartDBCloud  string `json:"HIDE_CHARTDB_CLOUD"`
+	DisableAnalytics  string `json:"DISABLE_ANALYTICS"`
+}
+
+// uiHandler serves the built ChartDB frontend. Paths without a matching
+// file and without an extension fall back to index.html so client-side
+// routes work on reload.
+type uiHandler struct {
+	files     fs.FS
+	index     []byte
+	configJS  []byte
+	fileServe http.Handler
+}
+
+// newUIHandler returns nil when no frontend is available: UI_DIR is unset
+// and the binary was built without the embedui tag. Links in index.html and
+// the default API base URL are placed under basePath.
+func newUIHandler(cfg config, basePath string) (*uiHandler, error) {
+	var files fs.FS
+	switch {
+	case cfg.UI.Dir != "":
+		info, err := os.Stat(cfg.UI.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.New("UI_DIR is not a directory")
+		}
+		files = os.DirFS(cfg.UI.Dir)
+	default:
+		files = embeddedUI()
+	}
+	if files == nil {
+		return nil, nil
+	}
+	index, err := fs.ReadFile(files, "index.html")
+	if err != nil {
+		return nil, errors.New("frontend has no index.html")
+	}
+
+	apiBaseURL := cfg.UI.APIBaseURL
+	if apiBaseURL == "" {
+		apiBaseURL = basePath + "/api/v1"
+	}
+
+	env, err := json.Marshal(uiRuntimeEnv{
+		OpenAIAPIKey:      cfg.UI.OpenAIAPIKey,
+		OpenAIAPIEndpoint: cfg.UI.OpenAIAPIEndpoint,
+		LLMModelName:      cfg.UI.LLMModelName,
+		APIBaseURL:        apiBaseURL,
+		HideChartDBCloud:  cfg.UI.HideChartDBCloud,
+		DisableAnalytics:  cfg.UI.DisableAnalytics,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &uiHandler{
+		files:     files,
+		index:     prefixRootLinks(index, basePath),
+		configJS:  []byte("window.env = " + string(env) + ";\n"),
+		fileServe: http.FileServerFS(files),
+	}, nil
+}
+
+func (h *uiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if r.URL.Path == "/config.js" {
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write(h.configJS)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" || name == "index.html" {
+		h.serveIndex(w, r)
+		return
+	}
+	info, err := fs.Stat(h.files, name)
+	if err != nil || info.IsDir() {
+		if path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		h.serveIndex(w, r)
+		return
+	}
+
+	// Vite fingerprints everything under assets/, so it can be cached forever.
+	if strings.HasPrefix(name, "assets/") {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	h.fileServe.ServeHTTP(w, r)
+}
+
+func (h *uiHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(h.index))
+}
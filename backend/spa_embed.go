@@ -0,0 +1,22 @@
+//go:build embedui
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The frontend build (npm run build) is copied to backend/ui before
+// building with -tags embedui.
+//
+//go:embed all:ui
+var uiFiles embed.FS
+
+func embeddedUI() fs.FS {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		return nil
+	}
+	return files
+}
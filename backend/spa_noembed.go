@@ -0,0 +1,9 @@
+//go:build !embedui
+
+package main
+
+import "io/fs"
+
+func embeddedUI() fs.FS {
+	return nil
+}
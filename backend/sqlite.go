@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSQLiteMaxOpenConns    = 4
+	defaultSQLiteSynchronous     = "full"
+	defaultWALCheckpointInterval = 5 * time.Minute
+	sqliteConnMaxIdleTime        = 10 * time.Minute
+)
+
+// sqliteOptions are the connection settings from the sqlite config section.
+type sqliteOptions struct {
+	busyTimeout        time.Duration
+	cacheSize          int
+	synchronous        string
+	maxOpenConns       int
+	checkpointInterval time.Duration
+	// replicating hands checkpoints to the WAL replicator.
+	replicating bool
+}
+
+func parseSQLiteOptions(cfg config) (sqliteOptions, error) {
+	opts := sqliteOptions{
+		cacheSize:    cfg.SQLite.CacheSize,
+		synchronous:  strings.ToLower(strings.TrimSpace(cfg.SQLite.Synchronous)),
+		maxOpenConns: cfg.SQLite.MaxOpenConns,
+	}
+	var err error
+	if opts.busyTimeout, err = time.ParseDuration(cfg.SQLite.BusyTimeout); err != nil || opts.busyTimeout < 0 {
+		return opts, fmt.Errorf("invalid SQLITE_BUSY_TIMEOUT %q", cfg.SQLite.BusyTimeout)
+	}
+	switch opts.synchronous {
+	case "off", "normal", "full", "extra":
+	default:
+		return opts, fmt.Errorf("invalid SQLITE_SYNCHRONOUS %q: use off, normal, full or extra", cfg.SQLite.Synchronous)
+	}
+	if opts.maxOpenConns < 1 {
+		return opts, fmt.Errorf("invalid SQLITE_MAX_OPEN_CONNS %d: must be at least 1", opts.maxOpenConns)
+	}
+	if opts.checkpointInterval, err = parseRetentionAge(cfg.SQLite.CheckpointInterval); err != nil {
+		return opts, fmt.Errorf("invalid SQLITE_WAL_CHECKPOINT_INTERVAL: %w", err)
+	}
+	return opts, nil
+}
+
+// sqliteDSN applies the pragmas to every pooled connection. Background jobs
+// write alongside request handlers, so wait for the lock instead of failing
+// immediately with SQLITE_BUSY. Transactions take the write lock up front: a
+// deferred transaction that reads first and then writes can fail with
+// SQLITE_BUSY without waiting at all. Read-only ones stay deferred (readTx).
+func sqliteDSN(path string, opts sqliteOptions) string {
+	pragmas := []string{
+		"journal_mode(WAL)",
+		"foreign_keys(ON)",
+		fmt.Sprintf("busy_timeout(%d)", opts.busyTimeout.Milliseconds()),
+		"synchronous(" + opts.synchronous + ")",
+	}
+	if opts.replicating {
+		pragmas = append(pragmas, "wal_autocheckpoint(0)")
+	}
+	if opts.cacheSize != 0 {
+		// Positive values are pages, negative values KiB, as in SQLite.
+		pragmas = append(pragmas, fmt.Sprintf("cache_size(%d)", opts.cacheSize))
+	}
+
+	var dsn strings.Builder
+	dsn.WriteString("file:" + path + "?_txlock=immediate")
+	for _, pragma := range pragmas {
+		dsn.WriteString("&_pragma=" + pragma)
+	}
+	return dsn.String()
+}
+
+// configurePool limits the pool: SQLite allows one writer at a time, so
+// more connections only add lock contention, and keeping them idle avoids
+// re-running the pragmas for every burst of requests.
+func configurePool(db *sql.DB, opts sqliteOptions) {
+	db.SetMaxOpenConns(opts.maxOpenConns)
+	db.SetMaxIdleConns(opts.maxOpenConns)
+	db.SetConnMaxIdleTime(sqliteConnMaxIdleTime)
+}
+
+// checkpointWAL copies the WAL into the database and truncates it. SQLite's
+// automatic checkpoints never shrink the file, and they cannot complete
+// while readers keep the WAL busy, so it grows on write-heavy instances.
+func (a *app) checkpointWAL(ctx context.Context) error {
+	if a.replicator != nil {
+		return a.replicator.checkpoint(ctx)
+	}
+	var busy, walPages, checkpointed int
+	if err := a.db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &walPages, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		slog.Debug("wal checkpoint incomplete, readers still active", "wal_pages", walPages, "checkpointed", checkpointed)
+	}
+	return nil
+}
+
+func (a *app) runWALCheckpoint(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := a.checkpointWAL(ctx); err != nil {
+			slog.Error("wal checkpoint failed", "error", err)
+		}
+	}
+}
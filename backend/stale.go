@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+)
+
+// saveOptions are the top-level fields of a saved payload that are not
+// part of the diagram.
+type saveOptions struct {
+	// message is stored with the version.
+	message string
+	// baseUpdatedAt is the updatedAt of the copy the edit started from; a
+	// save is rejected when the stored diagram has moved on since.
+	baseUpdatedAt string
+}
+
+// staleWriteError rejects a save made on top of an outdated copy.
+type staleWriteError struct {
+	current   diagramMeta
+	submitted diagramMeta
+}
+
+func (e *staleWriteError) Error() string {
+	return "diagram was changed since " + e.submitted.UpdatedAt
+}
+
+// saveDiagramWithVersion is replaceDiagramWithVersion for a client save that
+// may carry a baseUpdatedAt.
+func (a *app) saveDiagramWithVersion(ctx context.Context, payload []byte, meta diagramMeta, opts saveOptions) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		return a.saveDiagram(ctx, tx, payload, meta, opts)
+	})
+}
+
+// saveDiagram replaces the diagram unless opts.baseUpdatedAt no longer
+// matches the stored one, which returns a *staleWriteError. The check runs
+// in the transaction of the write, so two clients saving on the same base
+// cannot both succeed. sql.ErrNoRows means there is no such diagram.
+func (a *app) saveDiagram(ctx context.Context, tx *sql.Tx, payload []byte, meta diagramMeta, opts saveOptions) error {
+	if opts.baseUpdatedAt != "" {
+		const query = `
+SELECT id, name, database_type, database_edition, created_at, updated_at, archived, folder_id
+FROM diagrams
+WHERE id = ?`
+		var current diagramMeta
+		err := tx.QueryRowContext(ctx, query, meta.ID).Scan(
+			&current.ID,
+			&current.Name,
+			&current.DatabaseType,
+			&current.DatabaseEdition,
+			&current.CreatedAt,
+			&current.UpdatedAt,
+			&current.Archived,
+			&current.FolderID,
+		)
+		if err != nil {
+			return err
+		}
+		if !sameTimestamp(current.UpdatedAt, opts.baseUpdatedAt) {
+			submitted := meta
+			submitted.UpdatedAt = opts.baseUpdatedAt
+			return &staleWriteError{current: current, submitted: submitted}
+		}
+	}
+	return a.replaceDiagram(ctx, tx, meta.ID, payload, meta, "save", opts.message)
+}
+
+// sameTimestamp compares RFC 3339 timestamps by instant, so a client that
+// reformats updatedAt is not mistaken for a stale one.
+func sameTimestamp(a, b string) bool {
+	if a == b {
+		return true
+	}
+	at, bt := parseStoredTime(a), parseStoredTime(b)
+	return !at.IsZero() && at.Equal(bt)
+}
+
+// writeStaleWrite answers 409 DIAGRAM_STALE with the metadata of the stored
+// diagram as "current" and of the rejected save, with the updatedAt it was
+// based on, as "submitted", so the client can offer to reload or merge.
+func writeStaleWrite(w http.ResponseWriter, stale *staleWriteError) {
+	writeAPIErrorWith(w, http.StatusConflict, codeDiagramStale, "diagram was changed since baseUpdatedAt; reload it before saving", nil, map[string]interface{}{
+		"current":   stale.current,
+		"submitted": stale.submitted,
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// diagramStats summarizes a diagram for dashboards. Tables include views,
+// which are also counted separately. PayloadBytes is the size of the JSON
+// payload; StoredBytes what it takes in the database after compression and
+// encryption.
+type diagramStats struct {
+	DiagramID         string `json:"diagramId"`
+	TableCount        int    `json:"tableCount"`
+	ViewCount         int    `json:"viewCount"`
+	ColumnCount       int    `json:"columnCount"`
+	RelationshipCount int    `json:"relationshipCount"`
+	IndexCount        int    `json:"indexCount"`
+	PayloadBytes      int64  `json:"payloadBytes"`
+	StoredBytes       int64  `json:"storedBytes"`
+	VersionCount      int    `json:"versionCount"`
+}
+
+// handleDiagramStats serves GET /api/diagrams/{id}/stats.
+func (a *app) handleDiagramStats(w http.ResponseWriter, r *http.Request, diagramID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	stats, err := a.diagramStats(r.Context(), diagramID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *app) diagramStats(ctx context.Context, diagramID string) (diagramStats, error) {
+	stats := diagramStats{DiagramID: diagramID}
+	const query = `
+SELECT b.payload, b.size, (SELECT COUNT(*) FROM diagram_versions v WHERE v.diagram_id = d.id)
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.id = ?`
+	var raw []byte
+	if err := a.db.QueryRowContext(ctx, query, diagramID).Scan(&raw, &stats.PayloadBytes, &stats.VersionCount); err != nil {
+		return diagramStats{}, err
+	}
+	stats.StoredBytes = int64(len(raw))
+
+	payload, err := a.decodePayload(raw)
+	if err != nil {
+		return diagramStats{}, err
+	}
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		return diagramStats{}, err
+	}
+	stats.TableCount = len(doc.Tables)
+	stats.RelationshipCount = len(doc.Relationships)
+	for _, table := range doc.Tables {
+		if table.IsView {
+			stats.ViewCount++
+		}
+		stats.ColumnCount += len(table.Fields)
+		stats.IndexCount += len(table.Indexes)
+	}
+	return stats, nil
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	syncModeUpdate = "update"
+	syncModeDrift  = "drift"
+
+	minSyncInterval   = time.Minute
+	syncSchedulerTick = 30 * time.Second
+)
+
+// syncTableKeys and syncFieldKeys are the payload keys owned by the live
+// database during a sync; everything else (positions, colors, notes) is
+// left exactly as the user arranged it.
+var (
+	syncTableKeys = []string{"name", "schema", "fields", "indexes", "isView", "comments"}
+	syncFieldKeys = []string{
+		"name", "type", "primaryKey", "unique", "nullable", "increment", "isArray",
+		"characterMaximumLength", "precision", "scale", "default", "comments",
+	}
+)
+
+type syncConfig struct {
+	DiagramID  string            `json:"diagramId"`
+	Connection introspectRequest `json:"connection"`
+	Interval   string            `json:"interval"`
+	Mode       string            `json:"mode"`
+	Enabled    *bool             `json:"enabled,omitempty"`
+	LastRunAt  *string           `json:"lastRunAt,omitempty"`
+	NextRunAt  *string           `json:"nextRunAt,omitempty"`
+	LastStatus *string           `json:"lastStatus,omitempty"`
+	LastError  *string           `json:"lastError,omitempty"`
+	Drift      json.RawMessage   `json:"drift,omitempty"`
+}
+
+type schemaDrift struct {
+	AddedTables   []string       `json:"addedTables"`
+	RemovedTables []string       `json:"removedTables"`
+	ChangedTables []tableDrift   `json:"changedTables"`
+	CheckedAt     string         `json:"checkedAt"`
+	Summary       map[string]int `json:"summary"`
+}
+
+type tableDrift struct {
+	Table          string   `json:"table"`
+	AddedColumns   []string `json:"addedColumns,omitempty"`
+	RemovedColumns []string `json:"removedColumns,omitempty"`
+	ChangedColumns []string `json:"changedColumns,omitempty"`
+}
+
+// syncSkippedError is why an update sync left its diagram alone: writes to
+// it are refused, as by a freeze or its review. The run is recorded as
+// skipped.
+type syncSkippedError struct {
+	reason string
+}
+
+func (e *syncSkippedError) Error() string { return "sync skipped: " + e.reason }
+
+func (d schemaDrift) empty() bool {
+	return len(d.AddedTables) == 0 && len(d.RemovedTables) == 0 && len(d.ChangedTables) == 0
+}
+
+func (a *app) handleDiagramSync(w http.ResponseWriter, r *http.Request, diagramID string) {
+	if !a.introspectionEnabled {
+		writeErrorCode(w, http.StatusForbidden, codeIntrospectionDisabled, "database introspection is disabled (set INTROSPECTION_ENABLED=true)")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		config, err := a.getSyncConfig(r.Context(), diagramID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeSyncNotConfigured, "sync not configured")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, config.redacted())
+	case http.MethodPut:
+		var config syncConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		if _, err := a.getDiagramPayload(r.Context(), diagramID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+
+		config.DiagramID = diagramID
+		if config.Mode == "" {
+			config.Mode = syncModeDrift
+		}
+		if config.Mode != syncModeUpdate && config.Mode != syncModeDrift {
+			writeError(w, http.StatusBadRequest, "mode must be update or drift")
+			return
+		}
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval < minSyncInterval {
+			writeError(w, http.StatusBadRequest, "interval must be a duration of at least 1m (e.g. \"6h\")")
+			return
+		}
+		if config.Enabled == nil {
+			enabled := true
+			config.Enabled = &enabled
+		}
+		if config.Connection.Password == "" || config.Connection.Password == redactedPassword {
+			// Allow re-saving a config fetched via GET, whose password is redacted.
+			if existing, err := a.getSyncConfig(r.Context(), diagramID); err == nil {
+				config.Connection.Password = existing.Connection.Password
+			}
+		}
+
+		if err := a.saveSyncConfig(r.Context(), config, interval); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		saved, err := a.getSyncConfig(r.Context(), diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, saved.redacted())
+	case http.MethodPost:
+		// Runs the configured sync immediately, regardless of schedule.
+		config, err := a.getSyncConfig(r.Context(), diagramID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeSyncNotConfigured, "sync not configured")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		a.runSync(r.Context(), config)
+		updated, err := a.getSyncConfig(r.Context(), diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, updated.redacted())
+	case http.MethodDelete:
+		if _, err := a.db.ExecContext(r.Context(), `DELETE FROM diagram_sync WHERE diagram_id = ?`, diagramID); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// redactedPassword stands in for the password of a sync connection in
+// responses. PUT keeps the stored password when it is sent back.
+const redactedPassword = "********"
+
+func (c syncConfig) redacted() syncConfig {
+	if c.Connection.Password != "" {
+		c.Connection.Password = redactedPassword
+	}
+	return c
+}
+
+func (a *app) getSyncConfig(ctx context.Context, diagramID string) (syncConfig, error) {
+	const query = `
+SELECT diagram_id, connection, interval, mode, enabled, last_run_at, next_run_at, last_status, last_error, drift
+FROM diagram_sync
+WHERE diagram_id = ?`
+	var (
+		config     syncConfig
+		connection []byte
+		enabled    bool
+		drift      []byte
+	)
+	err := a.db.QueryRowContext(ctx, query, diagramID).Scan(
+		&config.DiagramID,
+		&connection,
+		&config.Interval,
+		&config.Mode,
+		&enabled,
+		&config.LastRunAt,
+		&config.NextRunAt,
+		&config.LastStatus,
+		&config.LastError,
+		&drift,
+	)
+	if err != nil {
+		return syncConfig{}, err
+	}
+	config.Enabled = &enabled
+	connection, err = a.payloadKeys.openValue(connection)
+	if err != nil {
+		return syncConfig{}, err
+	}
+	if err := json.Unmarshal(connection, &config.Connection); err != nil {
+		return syncConfig{}, err
+	}
+	if drift != nil {
+		drift, err = a.payloadKeys.openValue(drift)
+		if err != nil {
+			return syncConfig{}, err
+		}
+		config.Drift = json.RawMessage(drift)
+	}
+	return config, nil
+}
+
+// saveSyncConfig stores the connection sealed when payloads are encrypted,
+// since it holds the database password. The drift is sealed by runSync.
+func (a *app) saveSyncConfig(ctx context.Context, config syncConfig, interval time.Duration) error {
+	encoded, err := json.Marshal(config.Connection)
+	if err != nil {
+		return err
+	}
+	connection, err := a.payloadKeys.sealValue(encoded, true)
+	if err != nil {
+		return err
+	}
+	const query = `
+INSERT INTO diagram_sync (diagram_id, connection, interval, mode, enabled, next_run_at)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(diagram_id) DO UPDATE SET
+	connection=excluded.connection,
+	interval=excluded.interval,
+	mode=excluded.mode,
+	enabled=excluded.enabled,
+	next_run_at=excluded.next_run_at`
+	nextRun := time.Now().UTC().Add(interval).Format(time.RFC3339Nano)
+	_, err = a.db.ExecContext(ctx, query, config.DiagramID, connection, interval.String(), config.Mode, *config.Enabled, nextRun)
+	return err
+}
+
+// runSyncScheduler periodically runs every enabled sync whose next run time
+// has passed. Runs are serialized, so a slow database delays later jobs
+// rather than piling up connections.
+func (a *app) runSyncScheduler(ctx context.Context) {
+	ticker := time.NewTicker(syncSchedulerTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Due syncs run once read-only mode is switched off.
+		if a.readOnly.enabled() {
+			continue
+		}
+
+		ids, err := a.dueSyncIDs(ctx)
+		if err != nil {
+			slog.Error("sync scheduler failed", "error", err)
+			continue
+		}
+		for _, id := range ids {
+			config, err := a.getSyncConfig(ctx, id)
+			if err != nil {
+				slog.Error("sync scheduler: load config failed", "diagram_id", id, "error", err)
+				continue
+			}
+			a.runSync(ctx, config)
+		}
+	}
+}
+
+func (a *app) dueSyncIDs(ctx context.Context) ([]string, error) {
+	const query = `
+SELECT diagram_id
+FROM diagram_sync
+WHERE enabled = 1
+	AND (next_run_at IS NULL OR next_run_at <= ?)
+	AND diagram_id NOT IN (SELECT id FROM diagrams WHERE deleted_at IS NOT NULL)
+ORDER BY next_run_at ASC`
+	rows, err := a.db.QueryContext(ctx, query, time.Now().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// runSync re-introspects the configured database and, depending on the
+// mode, either rewrites the linked diagram (recording a "sync" version) or
+// only records the drift. The outcome is stored on the sync row.
+func (a *app) runSync(ctx context.Context, config syncConfig) {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	status, drift, runErr := a.syncDiagram(ctx, config)
+	var skipped *syncSkippedError
+	switch {
+	case errors.As(runErr, &skipped):
+		status = "skipped"
+		slog.InfoContext(ctx, "sync skipped", "diagram_id", config.DiagramID, "reason", skipped.reason)
+	case runErr != nil:
+		status = "error"
+		slog.WarnContext(ctx, "sync failed", "diagram_id", config.DiagramID, "error", runErr)
+	}
+
+	var (
+		lastError *string
+		driftRaw  interface{}
+	)
+	if runErr != nil {
+		message := runErr.Error()
+		lastError = &message
+	}
+	if drift != nil {
+		encoded, err := json.Marshal(drift)
+		if err == nil {
+			driftRaw, err = a.payloadKeys.sealValue(encoded, true)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "sync: encode drift failed", "diagram_id", config.DiagramID, "error", err)
+			driftRaw = nil
+		}
+	}
+
+	interval, err := time.ParseDuration(config.Interval)
+	if err != nil || interval < minSyncInterval {
+		interval = minSyncInterval
+	}
+	now := time.Now().UTC()
+	const query = `
+UPDATE diagram_sync
+SET last_run_at=?, next_run_at=?, last_status=?, last_error=?, drift=COALESCE(?, drift)
+WHERE diagram_id=?`
+	if _, err := a.db.ExecContext(ctx, query,
+		now.Format(time.RFC3339Nano),
+		now.Add(interval).Format(time.RFC3339Nano),
+		status,
+		lastError,
+		driftRaw,
+		config.DiagramID,
+	); err != nil {
+		slog.ErrorContext(ctx, "sync: record result failed", "diagram_id", config.DiagramID, "error", err)
+	}
+}
+
+func (a *app) syncDiagram(ctx context.Context, config syncConfig) (string, *schemaDrift, error) {
+	payload, err := a.getDiagramPayload(ctx, config.DiagramID)
+	if err != nil {
+		return "", nil, err
+	}
+	snapshot, err := introspectDatabase(ctx, config.Connection)
+	if err != nil {
+		return "", nil, err
+	}
+
+	doc, err := parseDiagramDoc(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	drift := computeSchemaDrift(doc, snapshot)
+
+	if config.Mode == syncModeDrift {
+		if drift.empty() {
+			return "in_sync", &drift, nil
+		}
+		return "drift", &drift, nil
+	}
+
+	merged, changed, err := mergeSnapshotIntoPayload(payload, snapshot)
+	if err != nil {
+		return "", nil, err
+	}
+	if !changed {
+		return "in_sync", &drift, nil
+	}
+	normalized, meta, err := normalizeDiagramPayload(merged)
+	if err != nil {
+		return "", nil, err
+	}
+	// A sync runs as nobody, so any lock held under LOCKS_ENFORCE keeps it
+	// out, like a freeze, a review in progress or an approved revision.
+	err = a.inTx(ctx, func(tx *sql.Tx) error {
+		_, reason, err := a.diagramWriteRefusal(ctx, tx, config.DiagramID, "")
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return &syncSkippedError{reason}
+		}
+		return a.replaceDiagram(ctx, tx, config.DiagramID, normalized, meta, "sync", syncVersionMessage(drift))
+	})
+	if err != nil {
+		return "", &drift, err
+	}
+	return "updated", &drift, nil
+}
+
+func syncVersionMessage(drift schemaDrift) string {
+	return fmt.Sprintf("Schema sync: %d added, %d removed, %d changed tables",
+		len(drift.AddedTables), len(drift.RemovedTables), len(drift.ChangedTables))
+}
+
+// mergeSnapshotIntoPayload replaces the tables and relationships of an
+// existing payload with the introspected schema while keeping the ids,
+// positions and styling of tables, fields, indexes and relationships that
+// still exist, so a sync produces a minimal diff instead of a new layout.
+func mergeSnapshotIntoPayload(payload []byte, snapshot schemaSnapshot) ([]byte, bool, error) {
+	current := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &current); err != nil {
+		return nil, false, err
+	}
+	fresh := buildDiagramFromSnapshot(snapshot, "", "")
+
+	priorTables := map[string]map[string]interface{}{}
+	maxY := 0.0
+	for _, item := range asSlice(current["tables"]) {
+		table, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		schema, _ := asString(table["schema"])
+		name, _ := asString(table["name"])
+		priorTables[schema+"."+name] = table
+		if y, ok := table["y"].(float64); ok && y > maxY {
+			maxY = y
+		}
+	}
+
+	idMap := map[string]string{}
+	tables := make([]interface{}, 0)
+	for _, item := range fresh["tables"].([]interface{}) {
+		table := item.(map[string]interface{})
+		schema, _ := asString(table["schema"])
+		name, _ := asString(table["name"])
+		prior, ok := priorTables[schema+"."+name]
+		if !ok {
+			if len(priorTables) > 0 {
+				table["y"] = toFloat(table["y"]) + maxY + 500
+			}
+			tables = append(tables, table)
+			continue
+		}
+		tables = append(tables, mergeSyncedTable(prior, table, idMap))
+	}
+
+	priorRelationships := map[string]map[string]interface{}{}
+	for _, item := range asSlice(current["relationships"]) {
+		rel, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		source, _ := asString(rel["sourceFieldId"])
+		target, _ := asString(rel["targetFieldId"])
+		priorRelationships[source+"->"+target] = rel
+	}
+	relationships := make([]interface{}, 0)
+	for _, item := range fresh["relationships"].([]interface{}) {
+		rel := item.(map[string]interface{})
+		for _, key := range []string{"sourceTableId", "targetTableId", "sourceFieldId", "targetFieldId"} {
+			if id, ok := idMap[rel[key].(string)]; ok {
+				rel[key] = id
+			}
+		}
+		if prior, ok := priorRelationships[rel["sourceFieldId"].(string)+"->"+rel["targetFieldId"].(string)]; ok {
+			rel["id"] = prior["id"]
+			rel["createdAt"] = prior["createdAt"]
+		}
+		relationships = append(relationships, rel)
+	}
+
+	before, err := json.Marshal([]interface{}{current["tables"], current["relationships"]})
+	if err != nil {
+		return nil, false, err
+	}
+	after, err := json.Marshal([]interface{}{tables, relationships})
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.Equal(before, after) {
+		return payload, false, nil
+	}
+
+	current["tables"] = tables
+	current["relationships"] = relationships
+	current["updatedAt"] = time.Now().UTC().Format(time.RFC3339Nano)
+	merged, err := json.Marshal(current)
+	return merged, true, err
+}
+
+func mergeSyncedTable(prior, fresh map[string]interface{}, idMap map[string]string) map[string]interface{} {
+	merged := copyMap(prior)
+	for _, key := range syncTableKeys {
+		delete(merged, key)
+	}
+	for _, key := range syncTableKeys {
+		if value, ok := fresh[key]; ok {
+			merged[key] = value
+		}
+	}
+	idMap[fresh["id"].(string)] = prior["id"].(string)
+
+	priorFields := map[string]map[string]interface{}{}
+	for _, item := range asSlice(prior["fields"]) {
+		if field, ok := item.(map[string]interface{}); ok {
+			name, _ := asString(field["name"])
+			priorFields[name] = field
+		}
+	}
+	fields := make([]interface{}, 0)
+	for _, item := range asSlice(fresh["fields"]) {
+		field := item.(map[string]interface{})
+		priorField, ok := priorFields[field["name"].(string)]
+		if !ok {
+			fields = append(fields, field)
+			continue
+		}
+		mergedField := copyMap(priorField)
+		for _, key := range syncFieldKeys {
+			delete(mergedField, key)
+		}
+		for _, key := range syncFieldKeys {
+			if value, ok := field[key]; ok {
+				mergedField[key] = value
+			}
+		}
+		idMap[field["id"].(string)] = priorField["id"].(string)
+		fields = append(fields, mergedField)
+	}
+	merged["fields"] = fields
+
+	priorIndexes := map[string]map[string]interface{}{}
+	for _, item := range asSlice(prior["indexes"]) {
+		if index, ok := item.(map[string]interface{}); ok {
+			name, _ := asString(index["name"])
+			priorIndexes[name] = index
+		}
+	}
+	indexes := make([]interface{}, 0)
+	for _, item := range asSlice(fresh["indexes"]) {
+		index := item.(map[string]interface{})
+		ids := index["fieldIds"].([]string)
+		mapped := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if priorID, ok := idMap[id]; ok {
+				id = priorID
+			}
+			mapped = append(mapped, id)
+		}
+		index["fieldIds"] = mapped
+		if priorIndex, ok := priorIndexes[index["name"].(string)]; ok {
+			index["id"] = priorIndex["id"]
+			index["createdAt"] = priorIndex["createdAt"]
+		}
+		indexes = append(indexes, index)
+	}
+	merged["indexes"] = indexes
+	return merged
+}
+
+// computeSchemaDrift compares the diagram with the live schema by table and
+// column name.
+func computeSchemaDrift(doc diagramDoc, snapshot schemaSnapshot) schemaDrift {
+	drift := schemaDrift{
+		AddedTables:   make([]string, 0),
+		RemovedTables: make([]string, 0),
+		ChangedTables: make([]tableDrift, 0),
+		CheckedAt:     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	qualified := func(schema, name string) string {
+		if schema == "" {
+			return name
+		}
+		return schema + "." + name
+	}
+
+	live := map[string]map[string]schemaColumn{}
+	for _, table := range snapshot.Tables {
+		live[qualified(table.Schema, table.Name)] = map[string]schemaColumn{}
+	}
+	for _, column := range snapshot.Columns {
+		if columns, ok := live[qualified(column.Schema, column.Table)]; ok {
+			columns[column.Name] = column
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, table := range doc.Tables {
+		name := qualified(table.Schema, table.Name)
+		seen[name] = true
+		columns, ok := live[name]
+		if !ok {
+			drift.RemovedTables = append(drift.RemovedTables, name)
+			continue
+		}
+
+		change := tableDrift{Table: name}
+		known := map[string]bool{}
+		for _, field := range table.Fields {
+			known[field.Name] = true
+			column, ok := columns[field.Name]
+			switch {
+			case !ok:
+				change.RemovedColumns = append(change.RemovedColumns, field.Name)
+			case !strings.EqualFold(column.DataType, field.Type.Name) || column.Nullable != field.Nullable || column.PrimaryKey != field.PrimaryKey:
+				change.ChangedColumns = append(change.ChangedColumns, field.Name)
+			}
+		}
+		for columnName := range columns {
+			if !known[columnName] {
+				change.AddedColumns = append(change.AddedColumns, columnName)
+			}
+		}
+		sort.Strings(change.AddedColumns)
+		if len(change.AddedColumns) > 0 || len(change.RemovedColumns) > 0 || len(change.ChangedColumns) > 0 {
+			drift.ChangedTables = append(drift.ChangedTables, change)
+		}
+	}
+	for name := range live {
+		if !seen[name] {
+			drift.AddedTables = append(drift.AddedTables, name)
+		}
+	}
+	sort.Strings(drift.AddedTables)
+
+	drift.Summary = map[string]int{
+		"addedTables":   len(drift.AddedTables),
+		"removedTables": len(drift.RemovedTables),
+		"changedTables": len(drift.ChangedTables),
+	}
+	return drift
+}
+
+func asSlice(v interface{}) []interface{} {
+	value, _ := v.([]interface{})
+	return value
+}
+
+func copyMap(source map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(source))
+	for k, v := range source {
+		result[k] = v
+	}
+	return result
+}
+
+func toFloat(v interface{}) float64 {
+	switch value := v.(type) {
+	case float64:
+		return value
+	case int:
+		return float64(value)
+	case int64:
+		return float64(value)
+	default:
+		return 0
+	}
+}
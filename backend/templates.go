@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// diagramTemplate is a reusable starting schema. Diagram holds a diagram
+// payload without id, name or timestamps; those are assigned when the
+// template is instantiated.
+type diagramTemplate struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Description  string          `json:"description,omitempty"`
+	DatabaseType string          `json:"databaseType"`
+	Diagram      json.RawMessage `json:"diagram,omitempty"`
+	CreatedAt    string          `json:"createdAt"`
+	UpdatedAt    string          `json:"updatedAt"`
+}
+
+type templateRequest struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Diagram     map[string]interface{} `json:"diagram"`
+}
+
+func (a *app) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// /api/templates
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			templates, err := a.listTemplates(r.Context())
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, templates)
+		case http.MethodPost:
+			template, err := decodeTemplateRequest(r.Body)
+			if err != nil {
+				writePayloadError(w, err)
+				return
+			}
+			template.ID = newDiagramID()
+			if err := a.insertTemplate(r.Context(), template); err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, template)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	templateID, err := url.PathUnescape(parts[2])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid template id")
+		return
+	}
+
+	// /api/templates/{id}
+	if len(parts) == 3 {
+		switch r.Method {
+		case http.MethodGet:
+			template, err := a.getTemplate(r.Context(), templateID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeErrorCode(w, http.StatusNotFound, codeTemplateNotFound, "template not found")
+					return
+				}
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, template)
+		case http.MethodPut:
+			template, err := decodeTemplateRequest(r.Body)
+			if err != nil {
+				writePayloadError(w, err)
+				return
+			}
+			template.ID = templateID
+			if err := a.updateTemplate(r.Context(), template); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeErrorCode(w, http.StatusNotFound, codeTemplateNotFound, "template not found")
+					return
+				}
+				writeServerError(w, err)
+				return
+			}
+			updated, err := a.getTemplate(r.Context(), templateID)
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, updated)
+		case http.MethodDelete:
+			if _, err := a.db.ExecContext(r.Context(), `DELETE FROM templates WHERE id = ?`, templateID); err != nil {
+				writeServerError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	// /api/templates/{id}/instantiate
+	if len(parts) == 4 && parts[3] == "instantiate" {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		var options struct {
+			Name string `json:"name"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&options); err != nil && !errors.Is(err, io.EOF) {
+				writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+				return
+			}
+		}
+
+		payload, err := a.instantiateTemplate(r.Context(), templateID, strings.TrimSpace(options.Name))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeTemplateNotFound, "template not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		writeCreatedDiagram(w, payload)
+		return
+	}
+
+	writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+}
+
+func decodeTemplateRequest(body io.Reader) (diagramTemplate, error) {
+	var req templateRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return diagramTemplate{}, errors.New("invalid json payload")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return diagramTemplate{}, invalidField("template.name", "is required")
+	}
+	if req.Diagram == nil {
+		return diagramTemplate{}, invalidField("template.diagram", "is required")
+	}
+	databaseType, ok := asString(req.Diagram["databaseType"])
+	if !ok || strings.TrimSpace(databaseType) == "" {
+		return diagramTemplate{}, invalidField("template.diagram.databaseType", "is required")
+	}
+
+	for _, key := range []string{"id", "name", "createdAt", "updatedAt"} {
+		delete(req.Diagram, key)
+	}
+	diagram, err := json.Marshal(req.Diagram)
+	if err != nil {
+		return diagramTemplate{}, errors.New("invalid json payload")
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return diagramTemplate{
+		Name:         name,
+		Description:  strings.TrimSpace(req.Description),
+		DatabaseType: databaseType,
+		Diagram:      diagram,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}, nil
+}
+
+func (a *app) listTemplates(ctx context.Context) ([]diagramTemplate, error) {
+	const query = `
+SELECT id, name, COALESCE(description, ''), database_type, created_at, updated_at
+FROM templates
+ORDER BY name ASC`
+	rows, err := a.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]diagramTemplate, 0)
+	for rows.Next() {
+		var item diagramTemplate
+		if err := rows.Scan(&item.ID, &item.Name, &item.Description, &item.DatabaseType, &item.CreatedAt, &item.UpdatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+func (a *app) getTemplate(ctx context.Context, templateID string) (diagramTemplate, error) {
+	const query = `
+SELECT id, name, COALESCE(description, ''), database_type, payload, created_at, updated_at
+FROM templates
+WHERE id = ?`
+	var (
+		item diagramTemplate
+		raw  []byte
+	)
+	err := a.db.QueryRowContext(ctx, query, templateID).Scan(&item.ID, &item.Name, &item.Description, &item.DatabaseType, &raw, &item.CreatedAt, &item.UpdatedAt)
+	if err != nil {
+		return diagramTemplate{}, err
+	}
+	if raw, err = a.payloadKeys.openValue(raw); err != nil {
+		return diagramTemplate{}, err
+	}
+	item.Diagram = json.RawMessage(raw)
+	return item, nil
+}
+
+func (a *app) insertTemplate(ctx context.Context, template diagramTemplate) error {
+	const query = `
+INSERT INTO templates (id, name, description, database_type, payload, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+	payload, err := a.payloadKeys.sealValue(template.Diagram, true)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.ExecContext(
+		ctx,
+		query,
+		template.ID,
+		template.Name,
+		nullableString(template.Description),
+		template.DatabaseType,
+		payload,
+		template.CreatedAt,
+		template.UpdatedAt,
+	)
+	return err
+}
+
+func (a *app) updateTemplate(ctx context.Context, template diagramTemplate) error {
+	const query = `
+UPDATE templates
+SET name = ?, description = ?, database_type = ?, payload = ?, updated_at = ?
+WHERE id = ?`
+	payload, err := a.payloadKeys.sealValue(template.Diagram, true)
+	if err != nil {
+		return err
+	}
+	res, err := a.db.ExecContext(
+		ctx,
+		query,
+		template.Name,
+		nullableString(template.Description),
+		template.DatabaseType,
+		payload,
+		template.UpdatedAt,
+		template.ID,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// instantiateTemplate creates a new diagram from a template. The name
+// defaults to the template's name.
+func (a *app) instantiateTemplate(ctx context.Context, templateID, name string) ([]byte, error) {
+	template, err := a.getTemplate(ctx, templateID)
+	if err != nil {
+		return nil, err
+	}
+
+	diagram := map[string]interface{}{}
+	if err := json.Unmarshal(template.Diagram, &diagram); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = template.Name
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	diagram["name"] = name
+	diagram["createdAt"] = now
+	diagram["updatedAt"] = now
+
+	var payload []byte
+	if err := a.inTx(ctx, func(tx *sql.Tx) error {
+		id, err := a.unusedDiagramID(ctx, tx)
+		if err != nil {
+			return err
+		}
+		diagram["id"] = id
+		raw, err := json.Marshal(diagram)
+		if err != nil {
+			return err
+		}
+		var meta diagramMeta
+		payload, meta, err = normalizeDiagramPayload(raw)
+		if err != nil {
+			return err
+		}
+
+		if err := a.insertDiagram(ctx, tx, payload, meta); err != nil {
+			return err
+		}
+		if err := a.insertVersion(ctx, tx, meta.ID, meta.Name, payload, "template", "Created from template "+template.Name); err != nil {
+			return err
+		}
+		return a.recordEvent(ctx, tx, eventDiagramCreated, meta.ID)
+	}); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
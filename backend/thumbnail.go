@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxThumbnailBytes = 2 << 20
+
+	thumbnailPNG = "image/png"
+	thumbnailSVG = "image/svg+xml"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// handleDiagramThumbnail serves /api/diagrams/{id}/thumbnail: a preview the
+// client renders and uploads with PUT as a PNG or SVG body, for list views
+// and share links. GET answers with ETag and Last-Modified so previews are
+// revalidated instead of downloaded again.
+func (a *app) handleDiagramThumbnail(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		var contentType, hash, updatedAt string
+		var data []byte
+		const query = `SELECT content_type, hash, updated_at, data FROM diagram_thumbnails WHERE diagram_id = ?`
+		err := a.db.QueryRowContext(r.Context(), query, diagramID).Scan(&contentType, &hash, &updatedAt, &data)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "diagram has no thumbnail")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if setValidators(w, r, `"`+hash+`"`, parseStoredTime(updatedAt), true) {
+			return
+		}
+		if data, err = a.payloadKeys.openValue(data); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		header := w.Header()
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+		header.Set("X-Content-Type-Options", "nosniff")
+		// An SVG opened directly must not run scripts on this origin.
+		header.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if contentType != thumbnailPNG && contentType != thumbnailSVG {
+			writeErrorCode(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "thumbnail must be sent as image/png or image/svg+xml")
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxThumbnailBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeErrorCode(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("thumbnail must be at most %d bytes", maxThumbnailBytes))
+			return
+		}
+		if err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "could not read thumbnail")
+			return
+		}
+		if problem := checkThumbnail(contentType, data); problem != "" {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, problem)
+			return
+		}
+
+		hash := blobHash(data)
+		updatedAt := time.Now().UTC().Format(sortableTimeFormat)
+		stored, err := a.payloadKeys.sealValue(data, false)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		err = a.inTx(r.Context(), func(tx *sql.Tx) error {
+			var exists bool
+			if err := tx.QueryRowContext(r.Context(), `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, diagramID).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return sql.ErrNoRows
+			}
+			const query = `
+INSERT INTO diagram_thumbnails (diagram_id, content_type, hash, updated_at, data)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT(diagram_id) DO UPDATE SET
+	content_type = excluded.content_type,
+	hash = excluded.hash,
+	updated_at = excluded.updated_at,
+	data = excluded.data`
+			_, err := tx.ExecContext(r.Context(), query, diagramID, contentType, hash, updatedAt, stored)
+			return err
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.Header().Set("ETag", `"`+hash+`"`)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if _, err := a.db.ExecContext(r.Context(), `DELETE FROM diagram_thumbnails WHERE diagram_id = ?`, diagramID); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// checkThumbnail makes sure the body is what its Content-Type says.
+func checkThumbnail(contentType string, data []byte) string {
+	switch contentType {
+	case thumbnailPNG:
+		if !bytes.HasPrefix(data, pngSignature) {
+			return "thumbnail is not a PNG image"
+		}
+	case thumbnailSVG:
+		head := data[:min(len(data), 1024)]
+		if !bytes.Contains(head, []byte("<svg")) {
+			return "thumbnail is not an SVG image"
+		}
+	}
+	return ""
+}
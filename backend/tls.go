@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultAutocertCacheDir = "autocert"
+
+// newTLSConfig returns nil when TLS is not configured and the server should
+// serve plain HTTP. With autocert, the returned handler answers ACME HTTP-01
+// challenges (and redirects everything else to HTTPS); it is served on
+// TLS_AUTOCERT_HTTP_ADDR when that is set, otherwise certificates are
+// obtained via TLS-ALPN-01 on the HTTPS port.
+func newTLSConfig(cfg config) (*tls.Config, http.Handler, error) {
+	hasFiles := cfg.TLS.Cert != "" || cfg.TLS.Key != ""
+	hasAutocert := len(cfg.TLS.Autocert.Domains) > 0
+	switch {
+	case hasFiles && hasAutocert:
+		return nil, nil, errors.New("TLS_CERT/TLS_KEY and TLS_AUTOCERT_DOMAINS are mutually exclusive")
+	case hasFiles:
+		if cfg.TLS.Cert == "" || cfg.TLS.Key == "" {
+			return nil, nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+		}
+		reloader, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.getCertificate,
+		}, nil, nil
+	case hasAutocert:
+		cacheDir := cfg.TLS.Autocert.CacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(cfg.DataDir, defaultAutocertCacheDir)
+		}
+		if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+			return nil, nil, fmt.Errorf("create autocert cache dir: %w", err)
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(cfg.TLS.Autocert.Domains...),
+			Email:      cfg.TLS.Autocert.Email,
+		}
+		tlsConfig := manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, manager.HTTPHandler(nil), nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// certReloader serves a certificate from files and picks up replaced files
+// (e.g. renewed by certbot) without a restart.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	reloader := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *certReloader) load() error {
+	info, err := os.Stat(c.certPath)
+	if err != nil {
+		return fmt.Errorf("read TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("load TLS key pair: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = info.ModTime()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Checking the file at most every few seconds keeps handshakes cheap.
+	if time.Since(c.checked) > 5*time.Second {
+		c.checked = time.Now()
+		if info, err := os.Stat(c.certPath); err == nil && !info.ModTime().Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				// Keep serving the previous certificate until the new pair is
+				// complete and valid.
+				slog.Warn("TLS certificate reload failed", "error", err)
+			} else {
+				slog.Info("TLS certificate reloaded", "cert", c.certPath)
+			}
+		}
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	scopeDiagramsRead  = "diagrams:read"
+	scopeDiagramsWrite = "diagrams:write"
+	scopeAdmin         = "admin"
+	scopeSCIM          = "scim"
+)
+
+var knownTokenScopes = []string{scopeDiagramsRead, scopeDiagramsWrite, scopeAdmin, scopeSCIM}
+
+// apiTokenConfig is an entry of apiTokens in the config file. The token
+// itself is never stored, only "sha256:<hex>" of it.
+type apiTokenConfig struct {
+	Name      string   `yaml:"name"`
+	Identity  string   `yaml:"identity"`
+	Hash      string   `yaml:"hash"`
+	Scopes    []string `yaml:"scopes"`
+	ExpiresAt string   `yaml:"expiresAt"`
+}
+
+// apiToken is a bearer token the server accepts. A zero expiresAt never
+// expires.
+type apiToken struct {
+	name      string
+	identity  string
+	scopes    []string
+	expiresAt time.Time
+}
+
+func (t apiToken) expired(now time.Time) bool {
+	return !t.expiresAt.IsZero() && !now.Before(t.expiresAt)
+}
+
+// parseAPITokens indexes the configured tokens by the SHA-256 of the token.
+func parseAPITokens(entries []apiTokenConfig) (map[[sha256.Size]byte]apiToken, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	tokens := make(map[[sha256.Size]byte]apiToken, len(entries))
+	for i, entry := range entries {
+		label := fmt.Sprintf("apiTokens[%d]", i)
+		if entry.Name != "" {
+			label += " (" + entry.Name + ")"
+		}
+		token := apiToken{name: entry.Name, identity: strings.TrimSpace(entry.Identity)}
+		if token.name == "" {
+			token.name = token.identity
+		}
+		if token.identity == "" {
+			return nil, fmt.Errorf("%s: identity is required", label)
+		}
+		if isServiceAccountIdentity(token.identity) {
+			return nil, fmt.Errorf("%s: identities starting with %q are reserved for service accounts", label, serviceAccountPrefix)
+		}
+
+		digest, ok := strings.CutPrefix(entry.Hash, "sha256:")
+		raw, err := hex.DecodeString(digest)
+		if !ok || err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("%s: hash must be sha256:<64 hex digits>", label)
+		}
+		key := [sha256.Size]byte(raw)
+		if _, dup := tokens[key]; dup {
+			return nil, fmt.Errorf("%s: hash is already used by another token", label)
+		}
+
+		if len(entry.Scopes) == 0 {
+			return nil, fmt.Errorf("%s: scopes must list at least one of %s", label, strings.Join(knownTokenScopes, ", "))
+		}
+		for _, scope := range entry.Scopes {
+			if !slices.Contains(knownTokenScopes, scope) {
+				return nil, fmt.Errorf("%s: unknown scope %q: use %s", label, scope, strings.Join(knownTokenScopes, ", "))
+			}
+		}
+		token.scopes = entry.Scopes
+
+		if entry.ExpiresAt != "" {
+			token.expiresAt, err = time.Parse(time.RFC3339, entry.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("%s: expiresAt must be an RFC 3339 time: %w", label, err)
+			}
+		}
+		tokens[key] = token
+	}
+	return tokens, nil
+}
+
+// allows reports whether the identity may use a route that needs scope.
+// Only tokens carry scopes; other identities may use every route. Writing
+// diagrams includes reading them.
+func (id identity) allows(scope string) bool {
+	if scope == "" || id.Scopes == nil {
+		return true
+	}
+	if scope == scopeDiagramsRead && slices.Contains(id.Scopes, scopeDiagramsWrite) {
+		return true
+	}
+	return slices.Contains(id.Scopes, scope)
+}
+
+// requiredScope is the scope a token needs for the request: admin for the
+// admin API, scim for SCIM provisioning, diagrams:write for writes and
+// diagrams:read for the rest of the API. Health, version, features, the API docs, signing in and
+// /api/tokens, which keeps tokens within the scopes of the one used, need
+// none.
+func requiredScope(r *http.Request) string {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path != "/api" && !strings.HasPrefix(path, "/api/") || anonymousPublicPaths[path] {
+		return ""
+	}
+	if path == "/api/tokens" || strings.HasPrefix(path, "/api/tokens/") || strings.HasPrefix(path, "/api/auth/") {
+		return ""
+	}
+	if strings.HasPrefix(path, "/api/admin") {
+		return scopeAdmin
+	}
+	if strings.HasPrefix(path, "/api/scim/") {
+		return scopeSCIM
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeDiagramsRead
+	case http.MethodPost:
+		if path == "/api/diagrams/validate" || path == "/api/graphql" {
+			return scopeDiagramsRead
+		}
+	}
+	return scopeDiagramsWrite
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authenticateToken looks up a bearer token among apiTokens and the tokens
+// made through /api/tokens, returning the message to refuse it with when it
+// is unknown or expired.
+func (a *app) authenticateToken(ctx context.Context, secret string) (identity, string, error) {
+	token, ok := a.apiTokens[sha256.Sum256([]byte(secret))]
+	if !ok {
+		var err error
+		token, ok, err = a.lookupUserToken(ctx, secret)
+		if err != nil {
+			return identity{}, "", err
+		}
+	}
+	if !ok {
+		return identity{}, "invalid token", nil
+	}
+	if token.expired(time.Now()) {
+		return identity{}, "token expired", nil
+	}
+	source := "token"
+	if isServiceAccountIdentity(token.identity) {
+		source = "service-account"
+	} else if deprovisioned, err := a.identityDeprovisioned(ctx, token.identity); err != nil {
+		return identity{}, "", err
+	} else if deprovisioned {
+		return identity{}, "user is deactivated", nil
+	}
+	return identity{ID: token.identity, Source: source, Scopes: token.scopes}, "", nil
+}
+
+// withAPITokens sets the request identity from an "Authorization: Bearer"
+// token and refuses routes outside its scopes. A token takes the place of
+// a client certificate sent with it.
+func (a *app) withAPITokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, problem, err := a.authenticateToken(r.Context(), token)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if problem != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="`+problem+`"`)
+			writeErrorCode(w, http.StatusUnauthorized, codeUnauthorized, problem)
+			return
+		}
+		if scope := requiredScope(r); !id.allows(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			writeErrorCode(w, http.StatusForbidden, codeForbidden, "token lacks the "+scope+" scope")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withRequestIdentity(r.Context(), id)))
+	})
+}
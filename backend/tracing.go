@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTraceServiceName = "chartdb-backend"
+	traceBatchSize          = 512
+	traceFlushInterval      = 5 * time.Second
+	traceQueueSize          = 4096
+
+	// OTLP span kinds and status codes.
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusError = 2
+)
+
+// tracer records spans and exports them in batches to an OTLP/HTTP
+// collector using the JSON encoding, so Jaeger, Tempo or any OpenTelemetry
+// collector can receive them without pulling in the OTel SDK.
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	queue       chan *span
+}
+
+type span struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	finish     time.Time
+	attributes map[string]interface{}
+	errMessage string
+	failed     bool
+	endOnce    sync.Once
+}
+
+type spanContextKey struct{}
+
+// newTracer returns nil when no OTLP endpoint is configured, which disables
+// tracing. The settings map to the standard OTEL_EXPORTER_OTLP_* variables.
+func newTracer(cfg config) (*tracer, error) {
+	endpoint := cfg.Tracing.TracesEndpoint
+	if endpoint == "" {
+		base := cfg.Tracing.Endpoint
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("endpoint %q must start with http:// or https://", endpoint)
+	}
+
+	headers := map[string]string{}
+	for _, pair := range strings.Split(cfg.Tracing.Headers, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q: expected key=value", pair)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return &tracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: cfg.Tracing.ServiceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *span, traceQueueSize),
+	}, nil
+}
+
+// startSpan starts a span as a child of the span in ctx, or a new trace if
+// there is none. On a nil tracer it returns ctx and a nil span, whose
+// methods are no-ops.
+func (t *tracer) startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// startRemoteSpan starts a server span continuing the trace from a W3C
+// traceparent header, if one is present and valid.
+func (t *tracer) startRemoteSpan(ctx context.Context, traceparent, name string) (context.Context, *span) {
+	ctx, s := t.startSpan(ctx, name, spanKindServer)
+	if s == nil {
+		return ctx, nil
+	}
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx, s
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	parentID, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil {
+		return ctx, s
+	}
+	copy(s.traceID[:], traceID)
+	copy(s.parentID[:], parentID)
+	return ctx, s
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.failed = true
+	s.errMessage = err.Error()
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.endOnce.Do(func() {
+		s.finish = time.Now()
+		select {
+		case s.tracer.queue <- s:
+		default:
+			// Dropping spans is preferable to blocking requests when the
+			// collector is slow or unreachable.
+		}
+	})
+}
+
+// run exports queued spans until ctx is cancelled.
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			slog.Warn("trace export failed", "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		attributes := make([]map[string]interface{}, 0, len(s.attributes))
+		for key, value := range s.attributes {
+			attributes = append(attributes, otlpAttribute(key, value))
+		}
+		item := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.finish.UnixNano(), 10),
+			"attributes":        attributes,
+		}
+		if s.parentID != [8]byte{} {
+			item["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			item["status"] = map[string]interface{}{"code": spanStatusError, "message": s.errMessage}
+		}
+		encoded = append(encoded, item)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpAttribute("service.name", t.serviceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": defaultTraceServiceName},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with %s", res.Status)
+	}
+	return nil
+}
+
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var encoded map[string]interface{}
+	switch v := value.(type) {
+	case int:
+		encoded = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		encoded = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		encoded = map[string]interface{}{"boolValue": v}
+	default:
+		encoded = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return map[string]interface{}{"key": key, "value": encoded}
+}
+
+func (a *app) withTracing(next http.Handler) http.Handler {
+	if a.tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeLabel(r.URL.Path)
+		ctx, s := a.tracer.startRemoteSpan(r.Context(), r.Header.Get("traceparent"), r.Method+" "+route)
+		defer s.end()
+		s.setAttribute("http.request.method", r.Method)
+		s.setAttribute("http.route", route)
+		s.setAttribute("url.path", r.URL.Path)
+		s.setAttribute("url.scheme", requestScheme(r))
+		s.setAttribute("client.address", clientIP(r))
+		if requestID := requestIDFromContext(ctx); requestID != "" {
+			s.setAttribute("http.request.id", requestID)
+		}
+
+		recorder := recordResponse(w)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.statusCode()
+		s.setAttribute("http.response.status_code", status)
+		if status >= http.StatusInternalServerError {
+			message := recorder.errorMsg
+			if message == "" {
+				message = http.StatusText(status)
+			}
+			s.setError(errors.New(message))
+		}
+	})
+}
+
+// tracedConnector opens SQLite connections whose statements and
+// transactions are recorded as client spans under the request's span.
+type tracedConnector struct {
+	dsn    string
+	driver driver.Driver
+	tracer *tracer
+}
+
+func (c *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn, tracer: c.tracer}, nil
+}
+
+func (c *tracedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type tracedConn struct {
+	driver.Conn
+	tracer *tracer
+}
+
+func (c *tracedConn) startQuerySpan(ctx context.Context, query string) (context.Context, *span) {
+	operation := strings.ToUpper(strings.Fields(query + " QUERY")[0])
+	ctx, s := c.tracer.startSpan(ctx, "sqlite "+operation, spanKindClient)
+	s.setAttribute("db.system", "sqlite")
+	s.setAttribute("db.operation.name", operation)
+	s.setAttribute("db.query.text", strings.TrimSpace(query))
+	return ctx, s
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, s := c.startQuerySpan(ctx, query)
+	defer s.end()
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		s.setError(err)
+	}
+	return result, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, s := c.startQuerySpan(ctx, query)
+	defer s.end()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		s.setError(err)
+	}
+	return rows, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	_, s := c.tracer.startSpan(ctx, "sqlite transaction", spanKindClient)
+	s.setAttribute("db.system", "sqlite")
+
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		s.setError(err)
+		s.end()
+		return nil, err
+	}
+	return &tracedTx{Tx: tx, span: s}, nil
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+type tracedTx struct {
+	driver.Tx
+	span *span
+}
+
+func (t *tracedTx) Commit() error {
+	err := t.Tx.Commit()
+	t.span.setAttribute("db.transaction.outcome", "commit")
+	t.span.setError(err)
+	t.span.end()
+	return err
+}
+
+func (t *tracedTx) Rollback() error {
+	err := t.Tx.Rollback()
+	t.span.setAttribute("db.transaction.outcome", "rollback")
+	t.span.end()
+	return err
+}
+
+type tracedStmt struct {
+	driver.Stmt
+	conn  *tracedConn
+	query string
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, sp := s.conn.startQuerySpan(ctx, s.query)
+	defer sp.end()
+	var (
+		result driver.Result
+		err    error
+	)
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		values, convErr := namedValuesToValues(args)
+		if convErr != nil {
+			return nil, convErr
+		}
+		result, err = s.Stmt.Exec(values)
+	}
+	sp.setError(err)
+	return result, err
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, sp := s.conn.startQuerySpan(ctx, s.query)
+	defer sp.end()
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		values, convErr := namedValuesToValues(args)
+		if convErr != nil {
+			return nil, convErr
+		}
+		rows, err = s.Stmt.Query(values)
+	}
+	sp.setError(err)
+	return rows, err
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("named parameter %q is not supported", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTrashRetention = "30d"
+	trashPurgeInterval    = time.Hour
+)
+
+type trashedDiagram struct {
+	diagramMeta
+	DeletedAt string `json:"deletedAt"`
+}
+
+// handleTrash serves GET /api/trash and POST /api/trash/{id}/restore.
+func (a *app) handleTrash(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// /api/trash
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		items, err := a.listTrash(r.Context())
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	// /api/trash/{id}/restore
+	if len(parts) == 4 && parts[3] == "restore" {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		diagramID, err := url.PathUnescape(parts[2])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid diagram id")
+			return
+		}
+		if err := a.restoreFromTrash(r.Context(), diagramID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found in trash")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		payload, err := a.getDiagramPayload(r.Context(), diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeRawJSON(w, http.StatusOK, payload)
+		return
+	}
+
+	writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+}
+
+func (a *app) listTrash(ctx context.Context) ([]trashedDiagram, error) {
+	const query = `
+SELECT d.id, d.name, d.database_type, d.database_edition, d.created_at, d.updated_at, d.archived, d.folder_id, d.deleted_at, b.size
+FROM diagrams d
+JOIN blobs b ON b.hash = d.blob_hash
+WHERE d.deleted_at IS NOT NULL
+ORDER BY d.deleted_at DESC`
+	rows, err := a.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]trashedDiagram, 0)
+	for rows.Next() {
+		var item trashedDiagram
+		if err := rows.Scan(
+			&item.ID,
+			&item.Name,
+			&item.DatabaseType,
+			&item.DatabaseEdition,
+			&item.CreatedAt,
+			&item.UpdatedAt,
+			&item.Archived,
+			&item.FolderID,
+			&item.DeletedAt,
+			&item.PayloadBytes,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
+
+// isInTrash reports whether the diagram exists but has been deleted.
+// Missing diagrams report false so callers return their usual not-found.
+func (a *app) isInTrash(ctx context.Context, diagramID string) (bool, error) {
+	var inTrash bool
+	err := a.db.QueryRowContext(ctx, `SELECT deleted_at IS NOT NULL FROM diagrams WHERE id = ?`, diagramID).Scan(&inTrash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return inTrash, err
+}
+
+// deleteDiagram moves a diagram to the trash. Its versions, filter and sync
+// configuration are kept until the diagram is purged.
+func (a *app) deleteDiagram(ctx context.Context, diagramID string) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := a.trashDiagram(ctx, tx, diagramID)
+		return err
+	})
+}
+
+// trashDiagram sets deleted_at on a live diagram and reports whether there
+// was one.
+func (a *app) trashDiagram(ctx context.Context, tx *sql.Tx, diagramID string) (bool, error) {
+	const query = `UPDATE diagrams SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`
+	res, err := tx.ExecContext(ctx, query, time.Now().UTC().Format(time.RFC3339Nano), diagramID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+	return true, a.recordEvent(ctx, tx, eventDiagramDeleted, diagramID)
+}
+
+func (a *app) restoreFromTrash(ctx context.Context, diagramID string) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE diagrams SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`, diagramID)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return a.recordEvent(ctx, tx, eventDiagramRestored, diagramID)
+	})
+}
+
+// purgeDiagram permanently removes a diagram and everything attached to it.
+func (a *app) purgeDiagram(ctx context.Context, diagramID string) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		return a.purgeDiagramTx(ctx, tx, diagramID)
+	})
+}
+
+func (a *app) purgeDiagramTx(ctx context.Context, tx *sql.Tx, diagramID string) error {
+	if err := a.recordEvent(ctx, tx, eventDiagramPurged, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_filters WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_versions WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_sync WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_stars WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_watches WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if err := deleteCRDT(ctx, tx, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_locks WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_thumbnails WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_attachments WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_comments WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_reviews WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_review_approvals WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM diagram_freezes WHERE diagram_id = ?`, diagramID); err != nil {
+		return err
+	}
+	a.presence.forget(diagramID)
+	_, err := tx.ExecContext(ctx, `DELETE FROM diagrams WHERE id = ?`, diagramID)
+	return err
+}
+
+// purgeTrash permanently removes diagrams that have been in the trash for
+// longer than the retention period.
+func (a *app) purgeTrash(ctx context.Context) (int, error) {
+	cutoff := time.Now().UTC().Add(-a.trashRetention).Format(time.RFC3339Nano)
+	rows, err := a.db.QueryContext(ctx, `SELECT id FROM diagrams WHERE deleted_at IS NOT NULL AND deleted_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		if err := a.purgeDiagram(ctx, id); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+func (a *app) runTrashPurge(ctx context.Context) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if !a.readOnly.enabled() {
+			purged, err := a.purgeTrash(ctx)
+			if err != nil {
+				slog.Error("trash purge failed", "error", err)
+			} else if purged > 0 {
+				slog.Info("trash purge removed diagrams", "count", purged)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// preferCreateIfMissing is the Prefer token that makes PUT
+// /api/diagrams/{id} create the diagram instead of answering 404.
+const preferCreateIfMissing = "create-if-missing"
+
+// wantsUpsert reports whether a PUT asked for upsert semantics, with
+// ?upsert=true or Prefer: create-if-missing.
+func wantsUpsert(r *http.Request) bool {
+	if queryFlag(r, "upsert") {
+		return true
+	}
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(token), preferCreateIfMissing) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upsertDiagramWithVersion saves the payload over the diagram with its id,
+// creating the diagram when there is none, and reports whether it was
+// created. Both happen in one transaction, so concurrent upserts of a new id
+// cannot both create it.
+func (a *app) upsertDiagramWithVersion(ctx context.Context, payload []byte, meta diagramMeta, opts saveOptions) (bool, error) {
+	var created bool
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		created = false
+		err := a.saveDiagram(ctx, tx, payload, meta, opts)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		created = true
+		return a.createDiagram(ctx, tx, payload, meta, "create")
+	})
+	return created, err
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	configSourceUser    = "user"
+	configSourceDefault = "default"
+)
+
+// The frontend config is stored in two layers: server-wide defaults in the
+// settings row, and per-user overrides keyed by the client identity. A
+// user sees the defaults with their overrides on top, so one user's
+// defaultDiagramId no longer changes everyone's. Anonymous requests have
+// no layer of their own and read and write the defaults, as a single-user
+// server always has.
+
+// handleConfig serves /api/config for the caller.
+func (a *app) handleConfig(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+	if key, ok := configKeyPath(r.URL.Path, "/api/config"); ok {
+		a.handleConfigKey(w, r, userID, key)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		config, err := a.getConfig(r.Context(), userID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, config)
+	case http.MethodPut:
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		config, err := a.updateConfig(r.Context(), userID, payload)
+		if err != nil {
+			writeConfigError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, config)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminConfig serves /api/admin/config, the defaults every user
+// starts from.
+func (a *app) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if key, ok := configKeyPath(r.URL.Path, "/api/admin/config"); ok {
+		a.handleConfigKey(w, r, "", key)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		config, err := getDefaultConfig(r.Context(), a.db)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, config)
+	case http.MethodPut:
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		config, err := a.updateConfig(r.Context(), "", payload)
+		if err != nil {
+			writeConfigError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, config)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// configKeyPath returns the key of /api/config/{key} under base.
+func configKeyPath(path, base string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(path, "/"), base+"/")
+	return rest, ok && rest != "" && !strings.Contains(rest, "/")
+}
+
+// handleConfigKey serves /api/config/{key}: GET returns the value userID
+// sees and where it comes from, and DELETE unsets the key in userID's
+// layer (or the defaults when userID is empty), so the value falls back to
+// the default.
+func (a *app) handleConfigKey(w http.ResponseWriter, r *http.Request, userID, key string) {
+	if _, known := configKeys[key]; !known {
+		writeErrorCode(w, http.StatusNotFound, codeNotFound, "config key "+key+" is not known")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, source, err := a.getConfigValue(r.Context(), userID, key)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if source == "" {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "config key "+key+" is not set")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": key, "value": value, "source": source})
+	case http.MethodDelete:
+		if err := a.deleteConfigKey(r.Context(), userID, key); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// getConfigValue returns one key as userID sees it and its source: "user"
+// for the user's own value, "default" for the server-wide one, or "" when
+// the key is not set.
+func (a *app) getConfigValue(ctx context.Context, userID, key string) (interface{}, string, error) {
+	if userID != "" {
+		overrides, err := getUserConfig(ctx, a.db, userID)
+		if err != nil {
+			return nil, "", err
+		}
+		if value, ok := overrides[key]; ok {
+			return value, configSourceUser, nil
+		}
+	}
+	defaults, err := getDefaultConfig(ctx, a.db)
+	if err != nil {
+		return nil, "", err
+	}
+	if value, ok := defaults[key]; ok {
+		return value, configSourceDefault, nil
+	}
+	return nil, "", nil
+}
+
+// deleteConfigKey unsets key in userID's overrides, or in the defaults when
+// userID is empty.
+func (a *app) deleteConfigKey(ctx context.Context, userID, key string) error {
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		if userID == "" {
+			current, err := getDefaultConfig(ctx, tx)
+			if err != nil {
+				return err
+			}
+			delete(current, key)
+			return setDefaultConfig(ctx, tx, current)
+		}
+
+		current, err := getUserConfig(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if _, ok := current[key]; !ok {
+			return nil
+		}
+		delete(current, key)
+		return setUserConfig(ctx, tx, userID, current)
+	})
+}
+
+// getConfig returns the config userID sees: the defaults with the user's
+// overrides applied.
+func (a *app) getConfig(ctx context.Context, userID string) (map[string]interface{}, error) {
+	config, err := getDefaultConfig(ctx, a.db)
+	if err != nil || userID == "" {
+		return config, err
+	}
+	overrides, err := getUserConfig(ctx, a.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range overrides {
+		config[k] = v
+	}
+	return config, nil
+}
+
+// updateConfig merges patch into userID's overrides, or into the defaults
+// when userID is empty, and returns the config the user now sees. Every key
+// must be in configKeys with a valid value.
+func (a *app) updateConfig(ctx context.Context, userID string, patch map[string]interface{}) (map[string]interface{}, error) {
+	if problems := validateConfigPatch(patch); len(problems) > 0 {
+		return nil, &configInvalidError{problems: problems}
+	}
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		if userID == "" {
+			current, err := getDefaultConfig(ctx, tx)
+			if err != nil {
+				return err
+			}
+			for k, v := range patch {
+				current[k] = v
+			}
+			return setDefaultConfig(ctx, tx, current)
+		}
+
+		current, err := getUserConfig(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		for k, v := range patch {
+			current[k] = v
+		}
+		return setUserConfig(ctx, tx, userID, current)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.getConfig(ctx, userID)
+}
+
+func getDefaultConfig(ctx context.Context, q rowQueryer) (map[string]interface{}, error) {
+	const query = `SELECT value FROM settings WHERE key = 'config'`
+	var raw string
+	err := q.QueryRowContext(ctx, query).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return map[string]interface{}{
+			"defaultDiagramId": "",
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, err
+	}
+	dropInvalidConfig(config)
+	if _, ok := config["defaultDiagramId"]; !ok {
+		config["defaultDiagramId"] = ""
+	}
+	return config, nil
+}
+
+func setDefaultConfig(ctx context.Context, tx *sql.Tx, config map[string]interface{}) error {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	const query = `
+INSERT INTO settings (key, value)
+VALUES ('config', ?)
+ON CONFLICT(key) DO UPDATE SET value=excluded.value`
+	_, err = tx.ExecContext(ctx, query, string(raw))
+	return err
+}
+
+// getUserConfig returns only the keys userID has set.
+func getUserConfig(ctx context.Context, q rowQueryer, userID string) (map[string]interface{}, error) {
+	var raw string
+	err := q.QueryRowContext(ctx, `SELECT value FROM user_config WHERE user_id = ?`, userID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, err
+	}
+	dropInvalidConfig(config)
+	return config, nil
+}
+
+func setUserConfig(ctx context.Context, tx *sql.Tx, userID string, config map[string]interface{}) error {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	const query = `
+INSERT INTO user_config (user_id, value, updated_at)
+VALUES (?, ?, ?)
+ON CONFLICT(user_id) DO UPDATE SET value=excluded.value, updated_at=excluded.updated_at`
+	_, err = tx.ExecContext(ctx, query, userID, string(raw), time.Now().UTC().Format(sortableTimeFormat))
+	return err
+}
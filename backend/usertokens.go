@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// userTokenMarker starts every token made through /api/tokens, so
+	// secret scanners can recognise a leaked one.
+	userTokenMarker     = "cdb_"
+	userTokenPrefixLen  = len(userTokenMarker) + 8
+	maxTokensPerOwner   = 50
+	maxTokenNameLen     = 100
+	tokenLastUsedPeriod = time.Minute
+)
+
+// errTokenScope refuses a token that would have a scope the token used to
+// make or rotate it lacks.
+var errTokenScope = errors.New("a token cannot manage tokens with a scope it lacks")
+
+// userToken is a token a user made for themselves. Only its prefix and
+// SHA-256 are stored; Token is set in the one response that creates or
+// rotates it.
+type userToken struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  string   `json:"expiresAt,omitempty"`
+	CreatedAt  string   `json:"createdAt"`
+	RotatedAt  string   `json:"rotatedAt,omitempty"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+	Token      string   `json:"token,omitempty"`
+}
+
+func newUserTokenSecret() (token, prefix, hash string) {
+	token = userTokenMarker + randomID(40)
+	sum := sha256.Sum256([]byte(token))
+	return token, token[:userTokenPrefixLen], hex.EncodeToString(sum[:])
+}
+
+// handleTokens serves /api/tokens, where callers manage their own tokens:
+// GET lists them, POST {"name", "scopes", "expiresAt"} creates one,
+// POST /api/tokens/{id}/rotate replaces its secret and DELETE
+// /api/tokens/{id} revokes it. A token can only make tokens within its own
+// scopes.
+func (a *app) handleTokens(w http.ResponseWriter, r *http.Request) {
+	owner := requestUserID(r)
+	if owner == "" {
+		writeErrorCode(w, http.StatusUnauthorized, codeUnauthorized, "authentication required to manage tokens")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	a.serveTokens(w, r, owner, parts[2:])
+}
+
+// serveTokens serves the tokens of owner; rest is the path after the
+// tokens collection: empty, {id} or {id}/rotate.
+func (a *app) serveTokens(w http.ResponseWriter, r *http.Request, owner string, rest []string) {
+	if len(rest) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			tokens, err := a.listUserTokens(r.Context(), owner)
+			if err != nil {
+				writeServerError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, tokens)
+		case http.MethodPost:
+			a.createUserToken(w, r, owner)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	if len(rest) > 2 || len(rest) == 2 && rest[1] != "rotate" {
+		writeErrorCode(w, http.StatusNotFound, codeRouteNotFound, "route not found")
+		return
+	}
+	rawID, err := url.PathUnescape(rest[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token id")
+		return
+	}
+	tokenID, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid token id")
+		return
+	}
+
+	// tokens/{id}/rotate
+	if len(rest) == 2 {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		caller, _ := requestIdentity(r.Context())
+		token, err := a.rotateUserToken(r.Context(), owner, tokenID, caller)
+		switch {
+		case errors.Is(err, errTokenScope):
+			writeErrorCode(w, http.StatusForbidden, codeForbidden, err.Error())
+		case errors.Is(err, sql.ErrNoRows):
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "token not found")
+		case err != nil:
+			writeServerError(w, err)
+		default:
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusOK, token)
+		}
+		return
+	}
+
+	// tokens/{id}
+	switch r.Method {
+	case http.MethodGet:
+		token, err := a.getUserToken(r.Context(), a.db, owner, tokenID)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "token not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, token)
+	case http.MethodDelete:
+		res, err := a.db.ExecContext(r.Context(), `DELETE FROM api_tokens WHERE id = ? AND owner = ?`, tokenID, owner)
+		if err == nil {
+			err = requireRowAffected(res)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeErrorCode(w, http.StatusNotFound, codeNotFound, "token not found")
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *app) createUserToken(w http.ResponseWriter, r *http.Request, owner string) {
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresAt string   `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	switch {
+	case name == "":
+		writePayloadError(w, invalidField("name", "is required"))
+		return
+	case len(name) > maxTokenNameLen:
+		writePayloadError(w, invalidField("name", fmt.Sprintf("must be at most %d bytes", maxTokenNameLen)))
+		return
+	case len(req.Scopes) == 0:
+		writePayloadError(w, invalidField("scopes", "must list at least one of "+strings.Join(knownTokenScopes, ", ")))
+		return
+	}
+	caller, _ := requestIdentity(r.Context())
+	for _, scope := range req.Scopes {
+		if !slices.Contains(knownTokenScopes, scope) {
+			writePayloadError(w, invalidField("scopes", fmt.Sprintf("unknown scope %q: use %s", scope, strings.Join(knownTokenScopes, ", "))))
+			return
+		}
+		if !caller.allows(scope) {
+			writeErrorCode(w, http.StatusForbidden, codeForbidden, fmt.Errorf("%w: %s", errTokenScope, scope).Error())
+			return
+		}
+	}
+	now := time.Now().UTC()
+	if req.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			writePayloadError(w, invalidField("expiresAt", "must be an RFC 3339 time"))
+			return
+		}
+		if !expiresAt.After(now) {
+			writePayloadError(w, invalidField("expiresAt", "must be in the future"))
+			return
+		}
+		req.ExpiresAt = expiresAt.UTC().Format(sortableTimeFormat)
+	}
+
+	secret, prefix, hash := newUserTokenSecret()
+	token := userToken{
+		Name:      name,
+		Prefix:    prefix,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: now.Format(sortableTimeFormat),
+		Token:     secret,
+	}
+	var full bool
+	err := a.inTx(r.Context(), func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM api_tokens WHERE owner = ?`, owner).Scan(&count); err != nil {
+			return err
+		}
+		if count >= maxTokensPerOwner {
+			full = true
+			return nil
+		}
+		const query = `
+INSERT INTO api_tokens (owner, name, prefix, hash, scopes, expires_at, created_at)
+VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)`
+		res, err := tx.ExecContext(r.Context(), query, owner, token.Name, token.Prefix, hash, strings.Join(token.Scopes, ","), token.ExpiresAt, token.CreatedAt)
+		if err != nil {
+			return err
+		}
+		token.ID, err = res.LastInsertId()
+		return err
+	})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if full {
+		writeErrorCode(w, http.StatusConflict, codeConflict, fmt.Sprintf("you can have at most %d tokens", maxTokensPerOwner))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(r.URL.Path, "/"), token.ID))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// rotateUserToken gives the token a new secret; the old one stops working
+// at once. Name, scopes and expiry stay, so a token can only rotate tokens
+// within its own scopes.
+func (a *app) rotateUserToken(ctx context.Context, owner string, tokenID int64, caller identity) (userToken, error) {
+	secret, prefix, hash := newUserTokenSecret()
+	now := time.Now().UTC().Format(sortableTimeFormat)
+	var token userToken
+	err := a.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := a.getUserToken(ctx, tx, owner, tokenID)
+		if err != nil {
+			return err
+		}
+		for _, scope := range current.Scopes {
+			if !caller.allows(scope) {
+				return fmt.Errorf("%w: %s", errTokenScope, scope)
+			}
+		}
+		const query = `
+UPDATE api_tokens SET prefix = ?, hash = ?, rotated_at = ?, last_used_at = NULL
+WHERE id = ? AND owner = ?`
+		res, err := tx.ExecContext(ctx, query, prefix, hash, now, tokenID, owner)
+		if err != nil {
+			return err
+		}
+		if err := requireRowAffected(res); err != nil {
+			return err
+		}
+		token, err = a.getUserToken(ctx, tx, owner, tokenID)
+		return err
+	})
+	token.Token = secret
+	return token, err
+}
+
+const userTokenColumns = `id, name, prefix, scopes, COALESCE(expires_at, ''), created_at, COALESCE(rotated_at, ''), COALESCE(last_used_at, '')`
+
+func scanUserToken(row interface{ Scan(...interface{}) error }) (userToken, error) {
+	var token userToken
+	var scopes string
+	err := row.Scan(&token.ID, &token.Name, &token.Prefix, &scopes, &token.ExpiresAt, &token.CreatedAt, &token.RotatedAt, &token.LastUsedAt)
+	token.Scopes = splitList(scopes)
+	return token, err
+}
+
+func (a *app) getUserToken(ctx context.Context, q rowQueryer, owner string, tokenID int64) (userToken, error) {
+	return scanUserToken(q.QueryRowContext(ctx, `SELECT `+userTokenColumns+` FROM api_tokens WHERE id = ? AND owner = ?`, tokenID, owner))
+}
+
+func (a *app) listUserTokens(ctx context.Context, owner string) ([]userToken, error) {
+	rows, err := a.db.QueryContext(ctx, `SELECT `+userTokenColumns+` FROM api_tokens WHERE owner = ? ORDER BY id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []userToken{}
+	for rows.Next() {
+		token, err := scanUserToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// lookupUserToken authenticates a token made through /api/tokens and
+// records when it was last used, at most once per tokenLastUsedPeriod.
+func (a *app) lookupUserToken(ctx context.Context, secret string) (apiToken, bool, error) {
+	if !strings.HasPrefix(secret, userTokenMarker) {
+		return apiToken{}, false, nil
+	}
+	sum := sha256.Sum256([]byte(secret))
+	var (
+		id                          int64
+		token                       apiToken
+		scopes, expiresAt, lastUsed string
+	)
+	// Tokens of disabled service accounts do not authenticate.
+	const query = `
+SELECT t.id, t.owner, t.name, t.scopes, COALESCE(t.expires_at, ''), COALESCE(t.last_used_at, '')
+FROM api_tokens t
+WHERE t.hash = ? AND NOT EXISTS(
+	SELECT 1 FROM service_accounts s WHERE ? || s.name = t.owner AND s.disabled_at IS NOT NULL
+)`
+	err := a.db.QueryRowContext(ctx, query, hex.EncodeToString(sum[:]), serviceAccountPrefix).Scan(&id, &token.identity, &token.name, &scopes, &expiresAt, &lastUsed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiToken{}, false, nil
+	}
+	if err != nil {
+		return apiToken{}, false, err
+	}
+	token.scopes = splitList(scopes)
+	if expiresAt != "" {
+		token.expiresAt = parseStoredTime(expiresAt)
+	}
+
+	now := time.Now().UTC()
+	if !token.expired(now) && !a.readOnly.enabled() && now.Sub(parseStoredTime(lastUsed)) >= tokenLastUsedPeriod {
+		if _, err := a.db.ExecContext(ctx, `UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now.Format(sortableTimeFormat), id); err != nil {
+			slog.Warn("record token use failed", "token", token.name, "error", err)
+		}
+	}
+	return token, true, nil
+}
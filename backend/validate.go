@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// validationWarning is a problem that would not stop a diagram from being
+// saved but is likely to confuse the frontend. Path points into the
+// payload, e.g. "tables[2].fields[0].id".
+type validationWarning struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// handleValidateDiagram serves POST /api/diagrams/validate: the body goes
+// through the same normalization as POST /api/diagrams and is checked
+// against the diagram schema, but nothing is stored. Invalid payloads get
+// the error the create would have returned.
+func (a *app) handleValidateDiagram(w http.ResponseWriter, r *http.Request) {
+	newID := func() (string, error) { return a.unusedDiagramID(r.Context(), a.db) }
+	payload, meta, _, err := decodeAndNormalizeDiagramPayload(r.Body, newID)
+	if err == nil {
+		err = a.checkDiagramSize(payload)
+	}
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+	doc, err := decodeDiagramSchema(payload)
+	if err != nil {
+		writePayloadError(w, err)
+		return
+	}
+
+	warnings := diagramWarnings(doc)
+	var exists bool
+	if err := a.db.QueryRowContext(r.Context(), `SELECT EXISTS(SELECT 1 FROM diagrams WHERE id = ?)`, meta.ID).Scan(&exists); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if exists {
+		warnings = append([]validationWarning{{Path: "id", Message: "a diagram with this id already exists, so creating it would fail"}}, warnings...)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Diagram  json.RawMessage     `json:"diagram"`
+		Warnings []validationWarning `json:"warnings"`
+	}{Diagram: payload, Warnings: warnings})
+}
+
+// decodeDiagramSchema decodes a normalized payload into the typed model,
+// reporting values of the wrong JSON type as field errors.
+func decodeDiagramSchema(payload []byte) (diagramDoc, error) {
+	var doc diagramDoc
+	err := json.Unmarshal(payload, &doc)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return diagramDoc{}, invalidField("diagram."+indexedPath(typeErr.Field), "must be "+jsonKind(typeErr.Type))
+	}
+	if err != nil {
+		return diagramDoc{}, errors.New("invalid json payload")
+	}
+	return doc, nil
+}
+
+// indexedPath writes the array indexes in a decoder path such as
+// "tables.0.name" the way warnings do: "tables[0].name".
+func indexedPath(path string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Float32, reflect.Float64, reflect.Int, reflect.Int64:
+		return "a number"
+	case reflect.Slice:
+		return "an array"
+	case reflect.Pointer:
+		return jsonKind(t.Elem()) + " or null"
+	}
+	return "an object"
+}
+
+// diagramWarnings reports tables, fields, indexes and relationships that
+// lack an id or a name, or share an id with a sibling.
+func diagramWarnings(doc diagramDoc) []validationWarning {
+	warnings := make([]validationWarning, 0)
+	warn := func(path, format string, args ...interface{}) {
+		warnings = append(warnings, validationWarning{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	checkID := func(seen map[string]bool, path, kind, id string) {
+		switch {
+		case id == "":
+			warn(path+".id", "%s has no id", kind)
+		case seen[id]:
+			warn(path+".id", "duplicate %s id %q", kind, id)
+		}
+		seen[id] = true
+	}
+
+	tableIDs := map[string]bool{}
+	for i, table := range doc.Tables {
+		tablePath := fmt.Sprintf("tables[%d]", i)
+		checkID(tableIDs, tablePath, "table", table.ID)
+		if table.Name == "" {
+			warn(tablePath+".name", "table has no name")
+		}
+		fieldIDs := map[string]bool{}
+		for j, field := range table.Fields {
+			fieldPath := fmt.Sprintf("%s.fields[%d]", tablePath, j)
+			checkID(fieldIDs, fieldPath, "field", field.ID)
+			if field.Name == "" {
+				warn(fieldPath+".name", "field has no name")
+			}
+		}
+		indexIDs := map[string]bool{}
+		for j, index := range table.Indexes {
+			checkID(indexIDs, fmt.Sprintf("%s.indexes[%d]", tablePath, j), "index", index.ID)
+		}
+	}
+	relationshipIDs := map[string]bool{}
+	for i, relationship := range doc.Relationships {
+		checkID(relationshipIDs, fmt.Sprintf("relationships[%d]", i), "relationship", relationship.ID)
+	}
+	return warnings
+}
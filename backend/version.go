@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.19.0 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Builds from a git checkout without them fall back to the VCS stamp the
+// Go toolchain embeds.
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildDate = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+	// SchemaVersion is the migration level this build brings the
+	// database to; DatabaseSchemaVersion what the database is at.
+	SchemaVersion         int `json:"schemaVersion"`
+	DatabaseSchemaVersion int `json:"databaseSchemaVersion"`
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:       version,
+		GitCommit:     gitCommit,
+		BuildDate:     buildDate,
+		GoVersion:     runtime.Version(),
+		SchemaVersion: len(schemaMigrations),
+	}
+	if stamp, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range stamp.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.GitCommit == "" {
+					info.GitCommit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = gitCommit == "" && setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// handleVersion serves GET /api/version.
+func (a *app) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	info := currentBuildInfo()
+	if err := a.db.QueryRowContext(r.Context(), `PRAGMA user_version`).Scan(&info.DatabaseSchemaVersion); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
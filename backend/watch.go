@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"time"
+)
+
+// diagramWatch subscribes an email address to a diagram's events, either one
+// email per change or a periodic digest.
+type diagramWatch struct {
+	Email     string `json:"email"`
+	Digest    bool   `json:"digest"`
+	UserID    string `json:"userId,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// handleDiagramWatch serves /api/diagrams/{id}/watch: GET lists the
+// watchers, PUT {"email", "digest"} adds or updates one and DELETE
+// ?email= removes it.
+func (a *app) handleDiagramWatch(w http.ResponseWriter, r *http.Request, diagramID string) {
+	switch r.Method {
+	case http.MethodGet:
+		watches, err := a.listDiagramWatches(r.Context(), diagramID)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, watches)
+	case http.MethodPut:
+		var watch diagramWatch
+		if err := json.NewDecoder(r.Body).Decode(&watch); err != nil {
+			writeErrorCode(w, http.StatusBadRequest, codePayloadInvalid, "invalid json payload")
+			return
+		}
+		address, err := mail.ParseAddress(watch.Email)
+		if err != nil {
+			writePayloadError(w, invalidField("email", "must be an email address"))
+			return
+		}
+		watch.Email = address.Address
+		watch.UserID = requestUserID(r)
+		// Sortable, because digests compare it with event times.
+		watch.CreatedAt = time.Now().UTC().Format(sortableTimeFormat)
+		if err := a.putDiagramWatch(r.Context(), diagramID, watch); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeErrorCode(w, http.StatusNotFound, codeDiagramNotFound, "diagram not found")
+				return
+			}
+			writeServerError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, watch)
+	case http.MethodDelete:
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			writeError(w, http.StatusBadRequest, "email is required")
+			return
+		}
+		if err := a.deleteDiagramWatch(r.Context(), diagramID, email); err != nil {
+			writeServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *app) listDiagramWatches(ctx context.Context, diagramID string) ([]diagramWatch, error) {
+	rows, err := a.db.QueryContext(ctx, `
+SELECT email, digest, user_id, created_at
+FROM diagram_watches
+WHERE diagram_id = ?
+ORDER BY email`, diagramID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watches := make([]diagramWatch, 0)
+	for rows.Next() {
+		var watch diagramWatch
+		if err := rows.Scan(&watch.Email, &watch.Digest, &watch.UserID, &watch.CreatedAt); err != nil {
+			return nil, err
+		}
+		watches = append(watches, watch)
+	}
+	return watches, rows.Err()
+}
+
+// putDiagramWatch keeps the original created_at when the watch exists.
+func (a *app) putDiagramWatch(ctx context.Context, diagramID string, watch diagramWatch) error {
+	const query = `
+INSERT INTO diagram_watches (diagram_id, email, digest, user_id, created_at)
+SELECT id, ?, ?, ?, ? FROM diagrams WHERE id = ?
+ON CONFLICT(diagram_id, email) DO UPDATE SET digest = excluded.digest, user_id = excluded.user_id`
+	return a.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, query, watch.Email, watch.Digest, watch.UserID, watch.CreatedAt, diagramID)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+func (a *app) deleteDiagramWatch(ctx context.Context, diagramID, email string) error {
+	_, err := a.db.ExecContext(ctx, `DELETE FROM diagram_watches WHERE diagram_id = ? AND email = ?`, diagramID, email)
+	return err
+}
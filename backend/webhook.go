@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	deliveryTimeout        = 10 * time.Second
+	deliveryMaxAttempts    = 6
+	deliveryBaseBackoff    = time.Second
+	deliveryMaxBackoff     = 5 * time.Minute
+	webhookSignatureHeader = "X-ChartDB-Signature"
+)
+
+type webhookTarget struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+func (t webhookTarget) wants(eventType string) bool {
+	return len(t.Events) == 0 || slices.Contains(t.Events, eventType)
+}
+
+// webhookDispatcher POSTs diagram events from the event log to the
+// configured targets. Each target has its own cursor in event_cursors, so
+// deliveries resume where they stopped after a restart, and a slow or
+// failing target never delays a request or another target.
+type webhookDispatcher struct {
+	targets []webhookTarget
+	client  *http.Client
+}
+
+// newWebhookDispatcher returns nil when no targets are configured.
+func newWebhookDispatcher(cfg config) (*webhookDispatcher, error) {
+	targets := append([]webhookTarget(nil), cfg.Webhooks...)
+	if cfg.Webhook.URL != "" {
+		targets = append(targets, webhookTarget{URL: cfg.Webhook.URL, Secret: cfg.Webhook.Secret, Events: cfg.Webhook.Events})
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	for i, target := range targets {
+		parsed, err := url.Parse(target.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("webhook %d: invalid url %q", i+1, target.URL)
+		}
+		// The url names the target's cursor.
+		if seen[target.URL] {
+			return nil, fmt.Errorf("webhook %d: url %q is listed twice", i+1, target.URL)
+		}
+		seen[target.URL] = true
+		for _, eventType := range target.Events {
+			if !slices.Contains(diagramEventTypes, eventType) {
+				return nil, fmt.Errorf("webhook %d: unknown event %q (use %s)", i+1, eventType, strings.Join(diagramEventTypes, ", "))
+			}
+		}
+	}
+	return &webhookDispatcher{
+		targets: targets,
+		client:  &http.Client{Timeout: deliveryTimeout},
+	}, nil
+}
+
+func (a *app) runWebhooks(ctx context.Context) {
+	for _, target := range a.webhooks.targets {
+		go a.followEvents(ctx, "webhook:"+target.URL, func(ctx context.Context, event diagramEvent) bool {
+			if !target.wants(event.Type) {
+				return true
+			}
+			return a.webhooks.deliver(ctx, target, event)
+		})
+	}
+}
+
+// webhookDelivery is the JSON body of a webhook request. The id is the
+// event's sequence number, so it stays the same across retries and
+// restarts and receivers can drop duplicates.
+type webhookDelivery struct {
+	ID    string       `json:"id"`
+	Event diagramEvent `json:"event"`
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, target webhookTarget, event diagramEvent) bool {
+	body, err := json.Marshal(webhookDelivery{ID: strconv.FormatInt(event.Seq, 10), Event: event})
+	if err != nil {
+		slog.Error("encode webhook failed", "error", err)
+		return true
+	}
+	headers := map[string]string{"X-ChartDB-Event": event.Type}
+	if target.Secret != "" {
+		headers[webhookSignatureHeader] = webhookSignature(target.Secret, body)
+	}
+	return postWithRetry(ctx, d.client, target.URL, headers, body, "type", event.Type, "seq", event.Seq, "diagram_id", event.DiagramID)
+}
+
+// postWithRetry POSTs a JSON body until the target answers 2xx or rejects
+// it with a 4xx other than 408 and 429; see retryDelivery.
+func postWithRetry(ctx context.Context, client *http.Client, target string, headers map[string]string, body []byte, attrs ...any) bool {
+	send := func() (bool, error) { return postJSON(ctx, client, target, headers, body) }
+	return retryDelivery(ctx, send, append([]any{"url", target}, attrs...)...)
+}
+
+// retryDelivery calls send, which reports whether its error is worth
+// retrying, with exponential backoff until it succeeds, fails for good, or
+// the attempts run out. Failures are logged with attrs. It returns false
+// only when ctx is done.
+func retryDelivery(ctx context.Context, send func() (bool, error), attrs ...any) bool {
+	backoff := deliveryBaseBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := send()
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		logAttrs := append([]any{"attempt", attempt, "error", err}, attrs...)
+		if !retry || attempt == deliveryMaxAttempts {
+			slog.Error("delivery failed", logAttrs...)
+			return true
+		}
+		slog.Warn("delivery failed, retrying", logAttrs...)
+
+		// Jitter keeps many failing targets from retrying in step.
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, deliveryMaxBackoff)
+	}
+}
+
+func postJSON(ctx context.Context, client *http.Client, target string, headers map[string]string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chartdb-backend")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("target answered %s", res.Status)
+	default:
+		return false, fmt.Errorf("target answered %s", res.Status)
+	}
+}
+
+// webhookSignature is "sha256=" and the hex HMAC-SHA256 of the body, as
+// GitHub signs its webhooks, so existing verification code can be reused.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
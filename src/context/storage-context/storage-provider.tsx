@@ -146,10 +146,14 @@ export const StorageProvider: React.FC<React.PropsWithChildren> = ({
 
                 try {
                     const payload = (await response.json()) as {
-                        error?: string;
+                        error?: string | { code?: string; message?: string };
                     };
-                    if (payload.error) {
-                        errorMessage = payload.error;
+                    const message =
+                        typeof payload.error === 'string'
+                            ? payload.error
+                            : payload.error?.message;
+                    if (message) {
+                        errorMessage = message;
                     }
                 } catch {
                     // Ignore parse failures and keep default message.
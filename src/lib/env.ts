@@ -5,7 +5,7 @@ export const LLM_MODEL_NAME: string = import.meta.env.VITE_LLM_MODEL_NAME;
 export const API_BASE_URL: string =
     window?.env?.API_BASE_URL ??
     import.meta.env.VITE_API_BASE_URL ??
-    '/api';
+    '/api/v1';
 export const IS_CHARTDB_IO: boolean =
     import.meta.env.VITE_IS_CHARTDB_IO === 'true';
 export const APP_URL: string = import.meta.env.VITE_APP_URL;
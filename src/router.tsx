@@ -141,4 +141,6 @@ const routes: RouteObject[] = [
     },
 ];
 
-export const router = createBrowserRouter(routes);
+export const router = createBrowserRouter(routes, {
+    basename: import.meta.env.BASE_URL,
+});